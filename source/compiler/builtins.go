@@ -19,6 +19,7 @@ var BUILTINS = map[string]functionAndReturnType{
 	"add_sets":                  {(*Compiler).btAddSets, AltType(values.SET)},
 	"add_string_to_rune":        {(*Compiler).btAddStringToRune, AltType(values.STRING)},
 	"add_strings":               {(*Compiler).btAddStrings, AltType(values.STRING)},
+	"batch":                     {(*Compiler).btBatch, AltType(values.ERROR, values.LIST)},
 	"cast":                      {(*Compiler).btCast, AltType()},
 	"cast_to_float":             {(*Compiler).btCastToFloat, AltType(values.FLOAT)},
 	"cast_to_int":               {(*Compiler).btCastToInt, AltType(values.INT)},
@@ -86,6 +87,7 @@ var BUILTINS = map[string]functionAndReturnType{
 	"negate_float":              {(*Compiler).btNegateFloat, AltType(values.FLOAT)},
 	"negate_integer":            {(*Compiler).btNegateInteger, AltType(values.INT)},
 	"post_to_output":            {(*Compiler).btPostToOutput, AltType(values.SUCCESSFUL_VALUE)},
+	"post_mail":                 {(*Compiler).btPostMail, AltType(values.SUCCESSFUL_VALUE, values.ERROR)},
 	"post_sql":                  {(*Compiler).btPostToSQL, AltType(values.SUCCESSFUL_VALUE, values.ERROR)},
 	"post_to_terminal":          {(*Compiler).btPostToTerminal, AltType(values.SUCCESSFUL_VALUE)},
 	"rune":                      {(*Compiler).btRune, AltType(values.RUNE)},
@@ -136,6 +138,33 @@ func (cp *Compiler) btAddStringToRune(tok *token.Token, dest uint32, args []uint
 	cp.Emit(vm.Adsr, dest, args[0], args[2])
 }
 
+// Calls to `batch` on the name of a function are compiled as mappings, so that calls to external
+// functions can be batched, and so we only get here when it's called on some other function value.
+func (cp *Compiler) btBatch(tok *token.Token, dest uint32, args []uint32) {
+	cp.Put(vm.Asgm, values.C_ZERO)
+	counter := cp.That()
+	cp.Put(vm.Asgm, values.C_EMPTY_TUPLE)
+	accumulator := cp.That()
+	cp.Put(vm.LenL, args[1])
+	length := cp.That()
+	element := cp.Reserve(values.UNDEFINED_TYPE, DUMMY, tok)
+	loopStart := cp.CodeTop()
+	cp.Put(vm.Gthi, length, counter)
+	listFinished := cp.vmIf(vm.Qtru, cp.That())
+	cp.Emit(vm.IdxL, element, args[1], counter, DUMMY)
+	cp.Put(vm.Dofn, args[0], element)
+	result := cp.That()
+	cp.Emit(vm.Qtyp, result, uint32(values.ERROR), cp.CodeTop()+3)
+	cp.Emit(vm.Asgm, dest, result)
+	resultIsError := cp.vmGoTo()
+	cp.Emit(vm.CcT1, accumulator, accumulator, result)
+	cp.Emit(vm.Addi, counter, counter, values.C_ONE)
+	cp.Emit(vm.Jmp, loopStart)
+	cp.VmComeFrom(listFinished)
+	cp.Emit(vm.List, dest, accumulator)
+	cp.VmComeFrom(resultIsError)
+}
+
 func (cp *Compiler) btCast(tok *token.Token, dest uint32, args []uint32) {
 	cp.Emit(vm.Casx, dest, args[1], args[0], cp.ReserveToken(tok))
 }
@@ -411,6 +440,10 @@ func (cp *Compiler) btPostToOutput(tok *token.Token, dest uint32, args []uint32)
 	cp.Emit(vm.Asgm, dest, values.C_OK)
 }
 
+func (cp *Compiler) btPostMail(tok *token.Token, dest uint32, args []uint32) {
+	cp.Emit(vm.Mail, dest, args[0], args[1], cp.ReserveToken(tok))
+}
+
 func (cp *Compiler) btPostToSQL(tok *token.Token, dest uint32, args []uint32) {
 	cp.Emit(vm.Psql, dest, args[1], args[2], cp.ReserveToken(tok))
 }
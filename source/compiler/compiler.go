@@ -12,6 +12,7 @@ import (
 
 	"github.com/tim-hardcastle/pipefish/source/dtypes"
 	"github.com/tim-hardcastle/pipefish/source/err"
+	"github.com/tim-hardcastle/pipefish/source/lexer"
 	"github.com/tim-hardcastle/pipefish/source/parser"
 	"github.com/tim-hardcastle/pipefish/source/settings"
 	"github.com/tim-hardcastle/pipefish/source/text"
@@ -44,10 +45,12 @@ type Compiler struct {
 	FunctionForest           map[string]*FunctionTree           // Used for type dispatch
 	DocString                string                             // Doctring for the module.
 	API                      string                             // If the compiler is the root of the service, this will contain the serialized API of the service.
+	ExternalApis             map[string]string                  // The serialized APIs of the external services the module declares, by name.
 	ApiDescription           [][]ApiItem                        // Data used to generate a description of the API.
 	AbstractTypesByName      TypeSys                            // Abstract types indexed by name.
 	Pool                     InclusionPool                      // Records what includes what. It's used by the compiler, but only at initialization time, and therefore is nil-ed out after initialization as a way to say we can ignore it from then on.
 	PrivateNullImports       dtypes.Set[string]                 // Exists to keep the *public* functions of *private* null imports out of the hands of the REPL.
+	wireCodec                *vm.WireCodec                      // Made the first time it's wanted, since its maps take a while to make.
 
 	// Temporary state.
 	ThunkList          []ThunkData                   // Records what thunks we made so we know what to unthunk at the top of the function.
@@ -71,6 +74,7 @@ func NewCompiler(p *parser.Parser, ccb *CommonCompilerBindle) *Compiler {
 		Fns:                      []*CpFunc{},
 		Modules:                  make(map[string]*Compiler),
 		CallHandlerNumbersByName: make(map[string]uint32),
+		ExternalApis:             make(map[string]string),
 		TypeToCloneGroup:         make(map[values.ValueType]AlternateType),
 		TypeNameToTypeScheme:     INITIAL_TYPE_SCHEMES,
 		Common:                   ccb,
@@ -211,7 +215,15 @@ const ( // We use this to keep track of what we're doing so we don't e.g. call a
 // It parses the line to an AST, initializes the context, calls `CompileNode` with the AST and the context
 // as arguments, runs the resulting code, rolls back the VM, and returns the value it got.
 func (cp *Compiler) Do(line string) values.Value {
+	return cp.DoWithValues(line, nil)
+}
+
+// Evaluates the line with the given values bound to names, as though they were global variables.
+// This lets the service evaluate an external call made in the binary wire format without turning
+// the values back into code.
+func (cp *Compiler) DoWithValues(line string, vals map[string]values.Value) values.Value {
 	state := cp.GetState()
+	env := cp.EnvironmentWithValues(vals)
 	cT := cp.CodeTop()
 	node := cp.P.ParseLine("REPL input", line)
 	if settings.SHOW_PARSER {
@@ -220,7 +232,7 @@ func (cp *Compiler) Do(line string) values.Value {
 	if cp.P.ErrorsExist() {
 		return val(values.ERROR, &err.Error{})
 	}
-	ctxt := Context{Env: cp.GlobalVars, Access: REPL, LowMem: DUMMY, TrackingFlavor: LF_NONE}
+	ctxt := Context{Env: env, Access: REPL, LowMem: DUMMY, TrackingFlavor: LF_NONE}
 	cp.CompileNode(node, ctxt)
 	if cp.P.ErrorsExist() {
 		return val(values.ERROR, &err.Error{})
@@ -233,6 +245,101 @@ func (cp *Compiler) Do(line string) values.Value {
 	return result
 }
 
+// Returns the environment in which to compile a line from the REPL, with the given values bound
+// to names as though they were global variables, so that the compiler doesn't try to fold them
+// into constants. The values are reserved in memory, and so the caller should take the state of
+// the vm first, and roll it back afterwards.
+func (cp *Compiler) EnvironmentWithValues(vals map[string]values.Value) *Environment {
+	if len(vals) == 0 {
+		return cp.GlobalVars
+	}
+	env := NewEnvironment()
+	env.Ext = cp.GlobalVars
+	tok := &token.Token{Source: "REPL input"}
+	for name, v := range vals {
+		cp.Reserve(v.T, v.V, tok)
+		env.Data[name] = Variable{MLoc: cp.That(), Access: GLOBAL_VARIABLE_PUBLIC, Types: AltType(v.T), Token: tok}
+	}
+	return env
+}
+
+// Returns something to translate values to and from the binary wire format, naming types as the
+// compiler does.
+func (cp *Compiler) WireCodec() *vm.WireCodec {
+	if cp.wireCodec == nil {
+		cp.wireCodec = &vm.WireCodec{Vm: cp.Vm, CpNumber: cp.Number}
+	}
+	return cp.wireCodec
+}
+
+// Decodes an external call made in the binary wire format, and returns a line which makes the
+// call, with the values of the arguments bound to names in it, to be passed to `DoWithValues`.
+func (cp *Compiler) DecodeWireCall(data []byte) (string, map[string]values.Value, error) {
+	call, e := cp.WireCodec().DecodeCall(data)
+	if e != nil {
+		return "", nil, e
+	}
+	if e := checkWireCall(call); e != nil {
+		return "", nil, e
+	}
+	vals := map[string]values.Value{}
+	line := call.Line(func(v values.Value) string {
+		name := wireArgumentName(len(vals))
+		vals[name] = v
+		return name
+	})
+	return line, vals, nil
+}
+
+// Since the line we make from a call is compiled, its namespace, name, and bling must each be
+// one word, as a lexer would read it, so that they can't add anything else to the line.
+func checkWireCall(call *vm.ExternalCall) error {
+	if call.Namespace != "" {
+		namespace, ok := strings.CutSuffix(call.Namespace, ".")
+		for _, word := range strings.Split(namespace, ".") {
+			if !ok || !isOneWord(word) {
+				return errors.New("`" + call.Namespace + "` isn't a namespace")
+			}
+		}
+	}
+	if !isOneWord(call.Name) {
+		return errors.New("`" + call.Name + "` isn't the name of a function")
+	}
+	for _, arg := range call.Args {
+		if arg.T == values.BLING && !isOneWord(arg.V.(string)) {
+			return errors.New("`" + arg.V.(string) + "` isn't bling")
+		}
+	}
+	return nil
+}
+
+func isOneWord(s string) bool {
+	runes := []rune(s)
+	if len(runes) == 0 || !lexer.IsLegalStart(runes[0]) {
+		return false
+	}
+	for i := 0; i+1 < len(runes); i++ {
+		if lexer.IsBoundary(runes[i], runes[i+1]) {
+			return false
+		}
+	}
+	return true
+}
+
+// The name the nth argument of a call is bound to. It's spelled in letters, since an identifier
+// followed by a number would be read as a number with a prefix.
+func wireArgumentName(n int) string {
+	name := ""
+	for {
+		name = string(rune('a'+n%26)) + name
+		n = n / 26
+		if n == 0 {
+			return "_wire_" + name
+		}
+		n--
+	}
+}
+
 // The heart of the compiler. It starts by taking a snapshot of the vm. It then does a big switch on the node type
 // and compiles accordingly. It then performs some sanity checks and, if the compiled expression is constant,
 // evaluates it and uses the snapshot to roll back the vm.
@@ -1025,6 +1132,12 @@ NodeTypeSwitch:
 			cp.addToForData(cp.vmBreakWithValue(cp.That()))
 			break
 		}
+		if node.Operator == "batch" && len(node.Args) == 2 && cp.isBuiltin(node.GetToken(), "batch", ctxt) {
+			if _, ok := node.Args[0].(*parser.Identifier); ok { // Then `batch(f, L)` means `L >> f`, which batches the calls if `f` is external.
+				result = cp.CompileNode(&parser.PipingExpression{Token: node.Token, Left: node.Args[1], Operator: ">>", Right: node.Args[0]}, ctxt)
+				break
+			}
+		}
 		resolvingCompiler := cp.getResolvingCompiler(node.GetToken(), ac)
 		if cp.P.ErrorsExist() {
 			break
@@ -2542,6 +2655,12 @@ func (cp *Compiler) compileMappingOrFilter(lhsTypes AlternateType, lhsConst bool
 		}
 	}
 	rhs = desugar(rhs)
+	if xcall, ok := cp.xcallOnThat(rhs, ctxt); ok && !isFilter {
+		cp.Cm("Mapping is of an external function, and so we make the calls as a batch.", tok)
+		cp.emitBatchedXcall(xcall, sourceList, tok)
+		cp.VmComeFrom(lhsIsNotListlike)
+		return cpResult{Types: AltType(values.ERROR, values.LIST), Foldable: false}
+	}
 	thatLoc = cp.Reserve(values.UNDEFINED_TYPE, DUMMY, rhs.GetToken())
 	envWithThat = &Environment{Data: map[string]Variable{"that": {MLoc: cp.That(), Access: VERY_LOCAL_VARIABLE, Types: cp.GetAlternateTypeFromTypeAst(parser.ANY_NULLABLE_TYPE_AST), Token: &token.Token{Literal: "that"}}}, Ext: env}
 	cp.Put(vm.Asgm, values.C_ZERO)
@@ -2602,6 +2721,105 @@ func (cp *Compiler) compileMappingOrFilter(lhsTypes AlternateType, lhsConst bool
 	return concResult(values.LIST, lhsConst && result.Foldable)
 }
 
+// If the node calls a function of an external service on `that` and nothing else, e.g. if it's
+// the desugared `crud.show` in `L >> crud.show`, this returns what we need to make the calls.
+func (cp *Compiler) xcallOnThat(node parser.Node, ctxt Context) (*XBindle, bool) {
+	prefix, ok := node.(*parser.PrefixExpression)
+	if !ok || len(prefix.Args) != 1 {
+		return nil, false
+	}
+	if arg, ok := prefix.Args[0].(*parser.Identifier); !ok || arg.Value != "that" {
+		return nil, false
+	}
+	return cp.externalFunction(&prefix.Token, prefix.Operator, ctxt)
+}
+
+// Returns what we need to call the named function as an external function of one parameter, if
+// every version of it is a function, rather than a command, of the same external service, and
+// one of them has one parameter. (Which of them gets called is then up to the service.)
+func (cp *Compiler) externalFunction(tok *token.Token, name string, ctxt Context) (*XBindle, bool) {
+	resolvingCompiler := cp.getResolvingCompiler(tok, ctxt.Access)
+	if resolvingCompiler == nil {
+		return nil, false
+	}
+	if _, ok := ctxt.Env.GetVar(name); ok && resolvingCompiler == cp { // Then it's a variable which shadows the function.
+		return nil, false
+	}
+	tree, ok := resolvingCompiler.FunctionForest[name]
+	if !ok {
+		return nil, false
+	}
+	var xcall *XBindle
+	unary := false
+	var walk func(node *FnTreeNode, depth int) bool
+	walk = func(node *FnTreeNode, depth int) bool {
+		for _, branch := range node.Branch {
+			info := branch.Node.CallInfo
+			if info == nil {
+				if !walk(branch.Node, depth+1) {
+					return false
+				}
+				continue
+			}
+			if info.Number >= uint32(len(info.Compiler.Fns)) {
+				return false
+			}
+			F := info.Compiler.Fns[info.Number]
+			if F.Xcall == nil || F.Command || F.Xcall.Position != vm.PREFIX || xcall != nil && *xcall != *F.Xcall {
+				return false
+			}
+			xcall = F.Xcall
+			unary = unary || depth == 1
+		}
+		return true
+	}
+	if !walk(tree.Tree, 0) || !unary {
+		return nil, false
+	}
+	return xcall, true
+}
+
+// Says whether the name, in the namespace of the token, refers only to the builtin of that name,
+// and not to a variable or to a function someone has declared.
+func (cp *Compiler) isBuiltin(tok *token.Token, name string, ctxt Context) bool {
+	resolvingCompiler := cp.getResolvingCompiler(tok, ctxt.Access)
+	if resolvingCompiler == nil {
+		return false
+	}
+	if _, ok := ctxt.Env.GetVar(name); ok && resolvingCompiler == cp {
+		return false
+	}
+	tree, ok := resolvingCompiler.FunctionForest[name]
+	if !ok {
+		return false
+	}
+	var walk func(node *FnTreeNode) bool
+	walk = func(node *FnTreeNode) bool {
+		for _, branch := range node.Branch {
+			info := branch.Node.CallInfo
+			if info == nil {
+				if !walk(branch.Node) {
+					return false
+				}
+				continue
+			}
+			if info.Number >= uint32(len(info.Compiler.Fns)) || info.Compiler.Fns[info.Number].Builtin != name {
+				return false
+			}
+		}
+		return true
+	}
+	return walk(tree.Tree)
+}
+
+// Calls the external function on each element of the list, leaving the list of the results on
+// top of memory, or the first error.
+func (cp *Compiler) emitBatchedXcall(xcall *XBindle, listLoc uint32, tok *token.Token) {
+	namespaceLoc := cp.Reserve(values.STRING, "", tok)
+	nameLoc := cp.Reserve(values.STRING, xcall.FunctionName, tok)
+	cp.Put(vm.Extb, xcall.ExternalServiceOrdinal, xcall.Position, namespaceLoc, nameLoc, listLoc)
+}
+
 // This supports the piping functions by desugaring things of the form `foo`
 // into `foo(that)`
 func desugar(node parser.Node) parser.Node {
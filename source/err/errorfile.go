@@ -833,6 +833,18 @@ var errorCreatorMap = map[string]ErrorCreator{
 		},
 	},
 
+	"ext/circuit": {
+		Message: func(tok *token.Token, args ...any) string {
+			return "calls to external service " + emph(args[0]) + " are suspended after " + strconv.Itoa(args[1].(int)) + " failures in a row"
+		},
+		Explanation: func(tok *token.Token, args ...any) string {
+			return "When calls to an external service on another hub keep failing, Pipefish stops making " +
+				"them for a while, so as not to wait on a service which is down, or add to its load while it " +
+				"recovers. How many failures this takes, and how long it waits before trying the service " +
+				"again, can be set with the `breakAfter` and `breakFor` options of the `$_externals` service variable."
+		},
+	},
+
 	"ext/deserialize": {
 		Message: func(tok *token.Token, args ...any) string {
 			return "unable to deserialize message from external service"
@@ -845,6 +857,60 @@ var errorCreatorMap = map[string]ErrorCreator{
 		},
 	},
 
+	"ext/protocol": {
+		Message: func(tok *token.Token, args ...any) string {
+			return "external service " + emph(args[0]) + " didn't reply as a Pipefish hub should: " + args[1].(string)
+		},
+		Explanation: func(tok *token.Token, args ...any) string {
+			return "Pipefish reached the hub serving the external service, but its reply wasn't one " +
+				"Pipefish could understand. This may be because the URL of the service points at " +
+				"something other than a Pipefish hub, or because the hub is overloaded or has had an " +
+				"internal error."
+		},
+	},
+
+	"ext/timeout": {
+		Message: func(tok *token.Token, args ...any) string {
+			return "external service " + emph(args[0]) + " timed out: " + args[1].(string)
+		},
+		Explanation: func(tok *token.Token, args ...any) string {
+			return "The hub serving the external service didn't reply in time. If the function being " +
+				"called is just slow, you can give it longer with the `timeout` option of the `$_externals` " +
+				"service variable."
+		},
+	},
+
+	"ext/unauthorized": {
+		Message: func(tok *token.Token, args ...any) string {
+			return "external service " + emph(args[0]) + " refused the call: " + args[1].(string)
+		},
+		Explanation: func(tok *token.Token, args ...any) string {
+			return "The hub serving the external service didn't accept the username and password " +
+				"this service gave it."
+		},
+	},
+
+	"ext/unreachable": {
+		Message: func(tok *token.Token, args ...any) string {
+			return "can't reach external service " + emph(args[0]) + ": " + args[1].(string)
+		},
+		Explanation: func(tok *token.Token, args ...any) string {
+			return "Pipefish couldn't connect to the hub serving the external service. Either the hub " +
+				"isn't running, or it can't be reached from here, or the URL of the service is wrong."
+		},
+	},
+
+	"ext/wire": {
+		Message: func(tok *token.Token, args ...any) string {
+			return "unable to decode the reply of external service " + emph(args[0]) + ": " + args[1].(string)
+		},
+		Explanation: func(tok *token.Token, args ...any) string {
+			return "The external service replied in the binary wire format, but its reply couldn't be " +
+				"decoded. This may be because the service has changed since its API was imported, in " +
+				"which case recompiling this service should fix it."
+		},
+	},
+
 	"golang/build": {
 		Message: func(tok *token.Token, args ...any) string {
 			return "failed to compile Go\n\nError was " + emph(args[0].(string))
@@ -917,6 +983,51 @@ var errorCreatorMap = map[string]ErrorCreator{
 		},
 	},
 
+	"golang/native/conflict": {
+		Message: func(tok *token.Token, args ...any) string {
+			return "the Go type " + emph(args[0]) + " can't stand for both " + emph(args[1]) + " and " + emph(args[2])
+		},
+		Explanation: func(tok *token.Token, args ...any) string {
+			return "The VM turns the values returned by native functions back into Pipefish values by their Go " +
+				"types, and so the Go functions registered for the native functions of a service can't use the " +
+				"same Go type for two different Pipefish types. Give each Pipefish type its own Go type."
+		},
+	},
+
+	"golang/native/missing": {
+		Message: func(tok *token.Token, args ...any) string {
+			return "no Go function has been registered for native function " + emph(args[0])
+		},
+		Explanation: func(tok *token.Token, args ...any) string {
+			return "A function with the body `native` is supplied by the Go program embedding the " +
+				"service, which should register a Go function with the same name by calling `RegisterFunction` " +
+				"on the service before initializing it."
+		},
+	},
+
+	"golang/native/param": {
+		Message: func(tok *token.Token, args ...any) string {
+			return "the parameters of native function " + emph(args[0]) + " don't match the Go type " + emph(args[1])
+		},
+		Explanation: func(tok *token.Token, args ...any) string {
+			return "The Go function registered for a native function should take as many parameters as the " +
+				"Pipefish function, and each should be of the Go type corresponding to the Pipefish type: e.g. " +
+				"`int` for `int`, `float64` for `float`, a struct with the same fields for a struct, or an integer " +
+				"type for an enum. A parameter of type `any` in Go will accept any Pipefish value."
+		},
+	},
+
+	"golang/native/return": {
+		Message: func(tok *token.Token, args ...any) string {
+			return "the return types of native function " + emph(args[0]) + " don't match the Go type " + emph(args[1])
+		},
+		Explanation: func(tok *token.Token, args ...any) string {
+			return "The Go function registered for a native function should return either nothing or a single " +
+				"value, optionally followed by an `error`, and the value should be of the Go type corresponding to " +
+				"the return type of the Pipefish function."
+		},
+	},
+
 	"init/abstract/ident": {
 		Message: func(tok *token.Token, args ...any) string {
 			return "expected identifier, not " + emph(tok)
@@ -1121,6 +1232,44 @@ var errorCreatorMap = map[string]ErrorCreator{
 		},
 	},
 
+	"init/external/breaking": {
+		Message: func(tok *token.Token, args ...any) string {
+			changes := args[2].([]string)
+			result := "the API of external service " + emph(args[0]) + " has changed since it was recorded in " +
+				emph(args[1]) + ": the " + changes[0]
+			switch len(changes) {
+			case 1:
+			case 2:
+				result = result + ", and there is 1 other breaking change"
+			default:
+				result = result + ", and there are " + strconv.Itoa(len(changes)-1) + " other breaking changes"
+			}
+			return result
+		},
+		Explanation: func(tok *token.Token, args ...any) string {
+			result := "Since this script was built against the API of the external service recorded in its lockfile, " +
+				"the service has changed as follows:\n\n"
+			for _, change := range args[2].([]string) {
+				result = result + "- " + change + "\n"
+			}
+			return result + "\nIf the service was changed on purpose, change this script to match, and then use " +
+				"`pipefish api lock <script>` to record the new API in the lockfile."
+		},
+	},
+
+	"init/external/config": {
+		Message: func(tok *token.Token, args ...any) string {
+			return "invalid configuration of external services: " + args[0].(string)
+		},
+		Explanation: func(tok *token.Token, args ...any) string {
+			return "The `$_externals` service variable should be a map from the names of external services " +
+				"to maps from the names of options to their values, e.g. " +
+				"`map(\"billing\"::map(\"timeout\"::2.5, \"retries\"::0))`. The options are `timeout`, " +
+				"`backoff`, and `breakFor`, which are numbers of seconds, and `retries` and `breakAfter`, " +
+				"which are non-negative integers."
+		},
+	},
+
 	"init/external/conflict": {
 		Message: func(tok *token.Token, args ...any) string {
 			return "source conflict for external service " + emph(tok.Literal)
@@ -1140,6 +1289,17 @@ var errorCreatorMap = map[string]ErrorCreator{
 		},
 	},
 
+	"init/external/lockfile": {
+		Message: func(tok *token.Token, args ...any) string {
+			return "can't use lockfile " + emph(args[0]) + ": " + args[1].(string)
+		},
+		Explanation: func(tok *token.Token, args ...any) string {
+			return "Pipefish records the APIs of the external services a script uses in the script's lockfile, " +
+				"and failed to read it. If the lockfile has been damaged, you can make it again with " +
+				"`pipefish api lock <script>`."
+		},
+	},
+
 	"init/external/path": {
 		Message: func(tok *token.Token, args ...any) string {
 			return "malformed path to external service"
@@ -1283,6 +1443,18 @@ var errorCreatorMap = map[string]ErrorCreator{
 		},
 	},
 
+	"init/operations": {
+		Message: func(tok *token.Token, args ...any) string {
+			return "can't read the operations of the VM: " + args[0].(string)
+		},
+		Explanation: func(tok *token.Token, args ...any) string {
+			return "The file system the service was initialized from contains `source/vm/operations.md`, " +
+				"which describes the operations of the VM, but Pipefish couldn't read it. You can copy it " +
+				"from `source/vm` in the Pipefish home directory, or leave it out, in which case the VM's " +
+				"code can't be described when debugging."
+		},
+	},
+
 	"init/overload": {
 		Message: func(tok *token.Token, args ...any) string {
 			return "too much overloading: function " + emph(args[0]) + " defined" + DescribePos(args[1].(*token.Token)) + " conflicts with another version of the same function defined at"
@@ -2636,6 +2808,35 @@ var errorCreatorMap = map[string]ErrorCreator{
 		},
 	},
 
+	"vm/mail/none": {
+		Message: func(tok *token.Token, args ...any) string {
+			return "no mailer has been configured for this service"
+		},
+		Explanation: func(tok *token.Token, args ...any) string {
+			return "A service can only send mail without saying which mail server to use if it's running " +
+				"on a hub which has a mailer. This is set up by giving a `mailer` in the `HUB_CONFIG` of the " +
+				"`hub.pf` file of the hub."
+		},
+	},
+
+	"vm/mail/recipient": {
+		Message: func(tok *token.Token, args ...any) string {
+			return "non-string value in list of recipients"
+		},
+		Explanation: func(tok *token.Token, args ...any) string {
+			return "The recipients of an email should be given as a list of email addresses."
+		},
+	},
+
+	"vm/mail/send": {
+		Message: func(tok *token.Token, args ...any) string {
+			return "failed to send mail with error " + emph(args[0])
+		},
+		Explanation: func(tok *token.Token, args ...any) string {
+			return "The hub's mailer tried to send the mail but couldn't, for the reason given by the error."
+		},
+	},
+
 	"vm/map/key": {
 		Message: func(tok *token.Token, args ...any) string {
 			return fmt.Sprintf("can't use value of type %v as the key in a key-value pair", emph(args[0]))
@@ -2655,6 +2856,15 @@ var errorCreatorMap = map[string]ErrorCreator{
 		},
 	},
 
+	"vm/native": {
+		Message: func(tok *token.Token, args ...any) string {
+			return "native function " + emph(args[0]) + " returned error " + emph(args[1])
+		},
+		Explanation: func(tok *token.Token, args ...any) string {
+			return "A Go function registered with the service to implement a native function has returned an error."
+		},
+	},
+
 	"vm/mod/zero": {
 		Message: func(tok *token.Token, args ...any) string {
 			return "taking the modulus of a number by zero"
@@ -0,0 +1,107 @@
+package hub
+
+import (
+	"strings"
+
+	"src.elv.sh/pkg/persistent/vector"
+
+	"github.com/tim-hardcastle/pipefish/source/lexer"
+	"github.com/tim-hardcastle/pipefish/source/token"
+	"github.com/tim-hardcastle/pipefish/source/values"
+)
+
+// On an administered hub, the public functions and commands of a service can be restricted
+// to particular groups, so that having access to the service doesn't mean being able to
+// call everything in it. This can be done from the hub with e.g. `hub let "finance" call
+// "billing.refund"`, or in the script of the service by setting the service variable
+// `$_access` to a map from the names of functions to the groups which may call them:
+//
+//	var
+//
+//	$_access = map("refund"::["finance"])
+//
+// A user may call a restricted function if they're in any of the groups allowed by either
+// means. Administrators may call anything.
+//
+// Only administrators may mention service variables such as `$_access` in a line, since
+// otherwise anyone could remove the restrictions by reassigning it, or read `$_env`.
+
+// Splits e.g. "billing.refund" into the service and the function.
+func splitFunctionName(s string) (string, string, bool) {
+	i := strings.LastIndex(s, ".")
+	if i <= 0 || i == len(s)-1 {
+		return "", "", false
+	}
+	return s[:i], s[i+1:], true
+}
+
+// Returns the name of a restricted function or service variable mentioned in the line which
+// the user may not use, or the empty string if there isn't one. We look at the line before
+// it's compiled, so a name counts as being mentioned whether the line calls it or, e.g.,
+// passes it as a value to some other function.
+func (h *Hub) forbiddenFunction(username, service, line string) (string, error) {
+	if isAdmin, _ := IsUserAdmin(h.Db, username); isAdmin {
+		return "", nil
+	}
+	rl := lexer.NewRelexer("REPL input", line)
+	for tok := rl.NextToken(); tok.Type != token.EOF; tok = rl.NextToken() {
+		if tok.Type == token.IDENT && strings.HasPrefix(tok.Literal, "$_") {
+			return tok.Literal, nil
+		}
+	}
+	restrictions, err := GetFunctionsOfService(h.Db, service)
+	if err != nil {
+		return "", err
+	}
+	sv, _ := h.getService(service)
+	if access, err := sv.GetVariable("$_access"); err == nil && access.T == values.MAP {
+		access.V.(values.Map).Range(func(k, v values.Value) {
+			if k.T == values.STRING {
+				restrictions[k.V.(string)] = append(restrictions[k.V.(string)], groupNames(v)...)
+			}
+		})
+	}
+	if len(restrictions) == 0 {
+		return "", nil
+	}
+	rl = lexer.NewRelexer("REPL input", line)
+	for tok := rl.NextToken(); tok.Type != token.EOF; tok = rl.NextToken() {
+		groups, ok := restrictions[tok.Literal]
+		if tok.Type != token.IDENT || !ok {
+			continue
+		}
+		allowed := false
+		for _, group := range groups {
+			if inGroup, _ := IsUserInGroup(h.Db, username, group); inGroup {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return tok.Literal, nil
+		}
+	}
+	return "", nil
+}
+
+// The groups given for a function in `$_access` may be a single string, or a list or set
+// of them.
+func groupNames(v values.Value) []string {
+	result := []string{}
+	add := func(el values.Value) {
+		if el.T == values.STRING {
+			result = append(result, el.V.(string))
+		}
+	}
+	switch v.T {
+	case values.STRING:
+		add(v)
+	case values.LIST:
+		for it := v.V.(vector.Vector).Iterator(); it.HasElem(); it.Next() {
+			add(it.Elem().(values.Value))
+		}
+	case values.SET:
+		v.V.(values.Set).Range(add)
+	}
+	return result
+}
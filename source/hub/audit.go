@@ -0,0 +1,147 @@
+package hub
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tim-hardcastle/pipefish/source/settings"
+)
+
+// On an administered hub, we keep a record in the database of everything done through the
+// hub: hub commands, use of the shell, and calls to services by remote users.
+//
+// Since the arguments of a call or a shell command may be passwords, tokens, and the like, we
+// only log the name of the function called, or of the program run, and not the whole line.
+
+// The index of the first argument of each of these verbs which is a password, email, etc, and
+// so shouldn't go in the log. Such arguments always come last, and everything from there on is
+// redacted, since the arguments are separated by ", " and a password may contain ", " too.
+var secretArgs = map[string]int{
+	"change-password": 0,
+	"config-admin":    3,
+	"env-key":         0,
+	"forgot-password": 1,
+	"log-on":          1,
+	"register":        3,
+	"reset-password":  0,
+}
+
+const REDACTED = "▪▪▪▪▪▪▪▪"
+
+// The format of the timestamps is chosen so that putting them in alphabetical order puts them
+// in chronological order.
+const AUDIT_TIME_FORMAT = "2006-01-02T15:04:05.000000Z"
+
+// Adds an entry to the audit log if the hub is administered. The outcome is "OK" unless
+// the hub has written an error since `h.lastError` was last cleared.
+func (h *Hub) audit(verb string, args []string) {
+	outcome := "OK"
+	if h.lastError != "" {
+		outcome = h.lastError
+	}
+	h.addAuditEntry(h.username, h.session.addr, verb, args, outcome)
+}
+
+// Audits a call to the service by the name of the function it calls, if we can find one.
+func (h *Hub) auditCall(service, line string) {
+	args := []string{service}
+	if fn := h.labelsOf(line, service).function; fn != "" {
+		args = append(args, fn)
+	}
+	h.audit("call", args)
+}
+
+// Audits a line given to the shell by the name of the program it runs.
+func (h *Hub) auditShell(line string) {
+	words := strings.Fields(line)
+	switch len(words) {
+	case 0:
+		h.audit("$", nil)
+	case 1:
+		h.audit("$", words)
+	default:
+		h.audit("$", []string{words[0], REDACTED})
+	}
+}
+
+func (h *Hub) addAuditEntry(username, addr, verb string, args []string, outcome string) {
+	if !h.administered() || h.Db == nil {
+		return
+	}
+	redacted := make([]string, len(args))
+	copy(redacted, args)
+	if first, ok := secretArgs[verb]; ok {
+		for i := first; i < len(redacted); i++ {
+			redacted[i] = REDACTED
+		}
+	}
+	// If we can't write to the log, there's no-one we can usefully complain to, and it would be
+	// perverse to stop people using the hub because of it.
+	AddAuditEntry(h.Db, AuditEntry{
+		Time:     time.Now().UTC().Format(AUDIT_TIME_FORMAT),
+		Username: username,
+		Address:  addr,
+		Verb:     verb,
+		Args:     redacted,
+		Outcome:  outcome,
+	})
+}
+
+// Shows the entries in the audit log which pass the filters, or, if `file` isn't empty,
+// exports them to the file as JSON lines.
+func (h *Hub) showAudit(username, verb, since, file string) {
+	entries, err := GetAuditEntries(h.Db, username, verb, since)
+	if err != nil {
+		h.WriteError(err.Error())
+		return
+	}
+	if file != "" {
+		var buf strings.Builder
+		encoder := json.NewEncoder(&buf)
+		for _, entry := range entries {
+			encoder.Encode(entry)
+		}
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(settings.PipefishHomeDirectory, file)
+		}
+		err = os.WriteFile(file, []byte(buf.String()), 0600)
+		if err != nil {
+			h.WriteError(err.Error())
+			return
+		}
+		h.WritePretty("Exported " + strconv.Itoa(len(entries)) + " entries to <C>\"" + filepath.Base(file) + "\"</>.")
+		return
+	}
+	if len(entries) == 0 {
+		h.WritePretty("There are no matching entries in the audit log.")
+		return
+	}
+	var buf strings.Builder
+	for _, entry := range entries {
+		user := entry.Username
+		if user == "" {
+			user = "(not signed on)"
+		}
+		buf.WriteString(BULLET + strings.Replace(entry.Time[:19], "T", " ", 1) + " " + Cyan(user) + " at " + entry.Address + ": ")
+		buf.WriteString(entry.Verb)
+		for i, arg := range entry.Args {
+			if i == 0 {
+				buf.WriteString(" ")
+			} else {
+				buf.WriteString(", ")
+			}
+			buf.WriteString(strconv.Quote(arg))
+		}
+		if entry.Outcome == "OK" {
+			buf.WriteString(" " + GREEN_OK)
+		} else {
+			buf.WriteString(" " + Red("failed") + ": " + entry.Outcome)
+		}
+		buf.WriteString("\n")
+	}
+	h.WriteString(buf.String())
+}
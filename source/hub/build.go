@@ -0,0 +1,62 @@
+package hub
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/tim-hardcastle/pipefish/source/initializer"
+	"github.com/tim-hardcastle/pipefish/source/text"
+	"github.com/tim-hardcastle/pipefish/source/values"
+)
+
+// `pipefish build --with-go <script> ... [-o <file>]` builds a `pipefish` binary into which all
+// the Go used by the scripts and the modules they import has been compiled, so that running them
+// with the binary doesn't need a Go toolchain or make plugins. The binary is written to the file
+// if it's given, and otherwise is named after the first script without its extension. See
+// `initializer/gobuild.go`.
+
+func Build() {
+	flags := flag.NewFlagSet("build", flag.ExitOnError)
+	withGo := flags.Bool("with-go", false, "compile the Go used by the scripts into the binary")
+	out := flags.String("o", "", "the file to write the binary to")
+	flags.Parse(os.Args[2:])
+	scripts := []string{}
+	for flags.NArg() > 0 { // So that the options can come after the scripts.
+		scripts = append(scripts, flags.Arg(0))
+		flags.Parse(flags.Args()[1:])
+	}
+	if !*withGo {
+		println("`build` needs the option `--with-go`.")
+		os.Exit(6)
+	}
+	if len(scripts) == 0 {
+		println("`build` needs at least one script.")
+		os.Exit(6)
+	}
+	binary := *out
+	if binary == "" {
+		binary = strings.TrimSuffix(filepath.Base(scripts[0]), filepath.Ext(scripts[0]))
+	}
+	sources := map[string]string{}
+	for _, filename := range scripts {
+		cp, err := initializer.GoSourcesFromFilepath(filename, sources)
+		if err != nil {
+			fmt.Println("\nPipefish can't read the script " + text.CYAN + "\"" + filename + "\"" + text.RESET + ": " + err.Error() + ".\n")
+			os.Exit(7)
+		}
+		if cp.P.Common.IsBroken {
+			fmt.Println("\nThere were errors initializing the script " + text.CYAN + "\"" + filename + "\"" + text.RESET + ".\n")
+			fmt.Println(cp.GetMarkdowner("", 92, values.Map{})(cp.P.ReturnErrors()))
+			fmt.Println()
+			os.Exit(3)
+		}
+	}
+	if err := initializer.BuildWithGo(sources, binary); err != nil {
+		fmt.Println("\nPipefish can't build the binary " + text.CYAN + "\"" + binary + "\"" + text.RESET + ": " + err.Error() + ".\n")
+		os.Exit(7)
+	}
+	os.Exit(0)
+}
@@ -0,0 +1,308 @@
+package hub
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"src.elv.sh/pkg/persistent/vector"
+
+	"github.com/tim-hardcastle/pipefish/source/pf"
+	"github.com/tim-hardcastle/pipefish/source/text"
+	"github.com/tim-hardcastle/pipefish/source/values"
+)
+
+// A hub is configured by giving `HUB_CONFIG` in the `hub.pf` file of the hub folder, as a map
+// from the names of the fields of `Config` below, starting with a lower-case letter, to their
+// values, e.g:
+//
+//	import
+//
+//	NULL::"database/sql"
+//
+//	const
+//
+//	HUB_CONFIG = map("services"::map("shop"::"services/shop.pf",
+//	              ..                 "stock"::"services/stock.pf"),
+//	              .. "http"::8080,
+//	              .. "database"::SqlDb(SQLITE),
+//	              .. "mailer"::"smtp://mail.example.com?from=hub@example.com",
+//	              .. "limits"::map("ipRate"::2, "ipBurst"::10),
+//	              .. "metrics"::true,
+//	              .. "theme"::SOLARIZED_DARK)
+//
+// The services are started when the hub opens, as well as any started with `hub run`; the
+// paths of their scripts are relative to the hub folder. If `http` or `https` is given, the hub
+// listens to HTTP on that port or to HTTPS for those domains as soon as it opens. See
+// `backend.go`, `mailer.go`, `limits.go`, and `metrics.go` for the other fields.
+//
+// The config is checked when the hub opens, and `hub reload config` reads it again, applying
+// whatever has changed. If it's invalid, the hub says why. In the case of `hub reload config`,
+// the hub goes on with the config it had; when the hub opens, it starts the services and sets
+// the theme and width, but doesn't open its database or mailer or listen to HTTP until the
+// config has been fixed and reloaded, and `pipefish serve` won't start at all.
+//
+// Hubs older than `HUB_CONFIG` are configured by the constants `HUB_DB`, `HUB_MAILER`,
+// `HUB_LIMITS`, and `HUB_METRICS`, which are used if `HUB_CONFIG` isn't given.
+
+type Config struct {
+	Services map[string]string // The paths of the scripts of the services, by name.
+	Http     int               // The port to listen to HTTP on, or 0.
+	Https    []string          // The domains to listen to HTTPS for, if any.
+	Database any               // A `*sql.DB` or a URL, or nil for the default.
+	Mailer   any               // A `Mailer` struct as a `[]pf.Value`, or a URL, or nil for none.
+	Limits   Limits
+	Metrics  bool
+	Theme    *pf.Value // Nil if it's not given, in which case the hub keeps the theme it had.
+	Width    int       // 0 if it's not given, in which case the hub keeps the width it had.
+}
+
+// Reads the config from the hub service, returning all the errors in it, if there are any.
+func readConfig(hubService *pf.Service, hubFolder string) (Config, []string) {
+	config := Config{Services: map[string]string{}, Limits: DEFAULT_LIMITS}
+	errs := []string{}
+	v, err := hubService.GetVariable("HUB_CONFIG")
+	if err != nil || v.T == values.NULL {
+		return readOldConfig(hubService)
+	}
+	m, ok := v.V.(values.Map)
+	if !ok {
+		return config, []string{"`HUB_CONFIG` should be a map"}
+	}
+	bad := func(key, should string) {
+		errs = append(errs, "`"+key+"` in `HUB_CONFIG` should be "+should)
+	}
+	m.Range(func(k, v values.Value) {
+		key, _ := k.V.(string)
+		switch key {
+		case "services":
+			services, ok := v.V.(values.Map)
+			if !ok {
+				bad(key, "a map from the names of services to the paths of their scripts")
+				return
+			}
+			services.Range(func(name, path values.Value) {
+				n, nameOk := name.V.(string)
+				p, pathOk := path.V.(string)
+				if !nameOk || !pathOk || n == "" || n == "hub" {
+					bad(key, "a map from the names of services to the paths of their scripts, which can't be named `\"\"` or `\"hub\"`")
+					return
+				}
+				if !text.Head(p, "!") && !text.Head(p, "http") { // Then it's a local file.
+					if !filepath.IsAbs(p) {
+						p = filepath.Join(hubFolder, p)
+					}
+					if _, err := os.Stat(p); err != nil {
+						errs = append(errs, "the script of the service `"+n+"` in `HUB_CONFIG` can't be opened: "+err.Error())
+						return
+					}
+				}
+				config.Services[n] = p
+			})
+		case "http":
+			port, ok := v.V.(int)
+			if v.T != values.INT || !ok || port < 1 || port > 65535 {
+				bad(key, "a port number from 1 to 65535")
+				return
+			}
+			config.Http = port
+		case "https":
+			domains, ok := v.V.(vector.Vector)
+			if v.T != values.LIST || !ok {
+				bad(key, "a list of domain names")
+				return
+			}
+			for i := 0; i < domains.Len(); i++ {
+				el, _ := domains.Index(i)
+				domain, ok := el.(values.Value).V.(string)
+				if !ok || domain == "" {
+					bad(key, "a list of domain names")
+					return
+				}
+				config.Https = append(config.Https, domain)
+			}
+		case "database":
+			switch db := v.V.(type) {
+			case *sql.DB, string, nil:
+				config.Database = db
+			default:
+				bad(key, "a `SqlDb` or a URL")
+			}
+		case "mailer":
+			switch mailer := v.V.(type) {
+			case []pf.Value, string, nil:
+				config.Mailer = mailer
+			default:
+				bad(key, "a `Mailer` or a URL")
+			}
+		case "limits":
+			config.Limits, err = limitsFromMap(v.V, "`limits` in `HUB_CONFIG`")
+			if err != nil {
+				errs = append(errs, err.Error())
+			}
+		case "metrics":
+			metrics, ok := v.V.(bool)
+			if v.T != values.BOOL || !ok {
+				bad(key, "a boolean")
+				return
+			}
+			config.Metrics = metrics
+		case "theme":
+			themeType, _ := hubService.TypeNameToType("Theme")
+			if v.T != themeType {
+				bad(key, "a `Theme`")
+				return
+			}
+			config.Theme = &v
+		case "width":
+			width, ok := v.V.(int)
+			if v.T != values.INT || !ok || width < 1 {
+				bad(key, "a positive integer")
+				return
+			}
+			config.Width = width
+		default:
+			errs = append(errs, "`HUB_CONFIG` has no field "+strconv.Quote(key))
+		}
+	})
+	if config.Http != 0 && len(config.Https) > 0 {
+		errs = append(errs, "`HUB_CONFIG` can't give both `http` and `https`")
+	}
+	slices.Sort(errs) // Since the map isn't ordered.
+	return config, errs
+}
+
+func readOldConfig(hubService *pf.Service) (Config, []string) {
+	config := Config{Services: map[string]string{}}
+	get := func(name string) any {
+		v, _ := hubService.GetVariable(name)
+		return v.V
+	}
+	config.Database = get("HUB_DB")
+	config.Mailer = get("HUB_MAILER")
+	config.Metrics, _ = get("HUB_METRICS").(bool)
+	var err error
+	config.Limits, err = limitsFromMap(get("HUB_LIMITS"), "`HUB_LIMITS`")
+	if err != nil {
+		return config, []string{err.Error()}
+	}
+	return config, nil
+}
+
+func (h *Hub) writeConfigErrors(errs []string) {
+	h.WriteError("the config of the hub is invalid:")
+	for _, e := range errs {
+		h.WriteString(BULLET + strings.TrimSpace(h.GetPretty(e+".")) + "\n")
+	}
+	h.WriteString("\n")
+}
+
+// Starts listening as the config says, if it says to.
+func (h *Hub) listenAsConfigured() error {
+	switch {
+	case h.config.Http != 0:
+		return h.StartHttp([]string{strconv.Itoa(h.config.Http)}, false)
+	case len(h.config.Https) > 0:
+		return h.StartHttp(h.config.Https, true)
+	}
+	return nil
+}
+
+// Compiles the hub service again, reads the config from it, and if it's valid, puts it into
+// effect. The state of the hub, e.g. who's signed on and what services are running, carries
+// over, as do the services which the config doesn't mention.
+func (h *Hub) reloadConfig() {
+	h.saveHubFile() // So that the new hub service starts with the state of the old one.
+	newHub := pf.NewService()
+	newHub.SetLocalExternalServices(h.servicesSnapshot())
+	newHub.InitializeFromFilepathWithStore(h.hubFilepath, h.store)
+	if newHub.IsBroken() {
+		h.GetAndReportErrors(newHub)
+		h.WriteError("the config hasn't been reloaded, since the hub's code has errors.")
+		return
+	}
+	config, errs := readConfig(newHub, filepath.Dir(h.hubFilepath))
+	if len(errs) > 0 {
+		h.writeConfigErrors(errs)
+		h.WriteError("the config hasn't been reloaded.")
+		return
+	}
+	oldHub, _ := h.getService("hub")
+	if handler, err := oldHub.GetOutHandler(); err == nil {
+		newHub.SetOutHandler(handler)
+	}
+	h.replaceService("hub", newHub, nil)
+	h.setSV("scopedEnv", pf.MAP, h.scopedStore)
+	ty, _ := newHub.TypeNameToType("Hub")
+	newHub.SetVariable("HUB", ty, h.makeWriter())
+	old := h.config
+	h.config = config
+	h.badConfig = false
+	h.applyDisplayConfig()
+	h.countInstructions()
+
+	if h.hasDatabase() || h.administered() {
+		oldDb := h.Db
+		err := h.openDatabase()
+		if err == nil && oldDb == nil && h.administered() { // Then the hub was opened without its database.
+			err = Migrate(h.Db)
+		}
+		if err != nil {
+			h.WriteError("can't open the database of the hub: " + err.Error())
+			h.Db = oldDb
+		} else if oldDb != nil && oldDb != h.Db {
+			oldDb.Close()
+		}
+	}
+	h.Mailer = nil
+	if h.hasMailer() {
+		if err := h.openMailer(); err != nil {
+			h.WriteError("can't open the mailer of the hub: " + err.Error())
+		}
+	}
+	for _, sv := range h.servicesSnapshot() {
+		sv.SetMailHandler(h.Mailer)
+	}
+	h.limiter.setLimits(config.Limits)
+
+	names, cycles := startupOrder(dependencyGraph(sortedKeys(config.Services), config.Services))
+	h.writeCycles(cycles)
+	for _, name := range names {
+		path := config.Services[name]
+		if sv, ok := h.getService(name); ok {
+			if current, _ := sv.GetFilepath(); current == path {
+				continue
+			}
+		}
+		h.WritePretty("Starting script <C>\"" + filepath.Base(path) + "\"</> as service <C>\"" + name + "\"</>.")
+		h.createService(name, path, true)
+	}
+	for name := range old.Services {
+		if _, ok := config.Services[name]; !ok {
+			h.deleteService(name)
+			if name == h.CurrentServiceName() {
+				h.makeEmptyServiceCurrent()
+			}
+		}
+	}
+
+	if old.Http != config.Http || !slices.Equal(old.Https, config.Https) {
+		h.reportDrain(h.StopHttp(DRAIN_TIMEOUT), DRAIN_TIMEOUT)
+		if err := h.listenAsConfigured(); err != nil {
+			h.WriteError(err.Error())
+		}
+	}
+}
+
+// Puts the parts of the config which say how the hub should look into effect.
+func (h *Hub) applyDisplayConfig() {
+	if h.config.Theme != nil {
+		h.setSV("theme", h.config.Theme.T, h.config.Theme.V)
+	}
+	if h.config.Width != 0 {
+		h.setSV("width", pf.INT, h.config.Width)
+	}
+}
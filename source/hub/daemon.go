@@ -0,0 +1,256 @@
+package hub
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/term"
+
+	"github.com/tim-hardcastle/pipefish/source/settings"
+)
+
+// `pipefish serve` runs a hub as a daemon, without a terminal: it listens to HTTP, on the port
+// or for the domains given by the config of the hub if it gives them (see `config.go`), and it
+// accepts hub commands, and anything else you could type into the REPL, through a control
+// socket, a Unix domain socket which by default is the file `hub.sock` in the hub folder.
+// `pipefish ctl` sends a line to the control socket and writes out the reply, e.g:
+//
+//	pipefish serve --port 8080 hubs/production
+//	pipefish ctl --socket hubs/production/hub.sock hub services
+//
+// Anyone who can open the control socket can do anything the person at the terminal of the
+// hub could, and so it's only readable and writable by the user who owns it.
+//
+// Since the daemon can't ask for the env key, it takes it from the `PIPEFISH_ENV_KEY`
+// environment variable, or from the file given by `--env-key-file`. If neither is given, the
+// hub starts without opening the env store if it's encrypted.
+//
+// The control socket speaks the protocol of the websocket (see `websocket.go`) as a stream of
+// JSON objects, except that it only takes one line per connection; and that before it sends a
+// message of type "ready", it sends one of type "error" if the hub wrote an error, so that
+// `pipefish ctl` can exit with a status of 1.
+//
+// The daemon stops when it's sent SIGINT or SIGTERM, or when it's told `hub quit`.
+
+const CONTROL_SOCKET = "hub.sock"
+
+func Serve() {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	port := flags.String("port", "50005", "the port to listen to HTTP on, if the config of the hub doesn't say")
+	keyFile := flags.String("env-key-file", "", "a file containing the env key")
+	socket := flags.String("socket", "", "the path of the control socket")
+	flags.Parse(os.Args[2:])
+	hubFolder := flags.Arg(0)
+	if hubFolder == "" {
+		hubFolder = currentHubFolder()
+	}
+	if *socket == "" {
+		*socket = filepath.Join(hubFolder, CONTROL_SOCKET)
+	}
+	envKey := os.Getenv("PIPEFISH_ENV_KEY")
+	if *keyFile != "" {
+		b, err := os.ReadFile(*keyFile)
+		if err != nil {
+			fmt.Println("Pipefish can't read the env key: " + err.Error())
+			os.Exit(7)
+		}
+		envKey = strings.TrimSpace(string(b))
+	}
+	h := NewHeadless(hubFolder, os.Stdout, envKey)
+	if h.badConfig {
+		fmt.Println("Pipefish can't serve the hub, since its config is invalid.")
+		os.Exit(7)
+	}
+	if !h.listening() { // Then the config doesn't say what to listen to.
+		if err := h.StartHttp([]string{*port}, false); err != nil {
+			fmt.Println("Pipefish can't listen to HTTP: " + err.Error())
+			os.Exit(7)
+		}
+	}
+	if err := h.ServeControl(*socket); err != nil {
+		fmt.Println("Pipefish can't open the control socket: " + err.Error())
+		os.Exit(7)
+	}
+	fmt.Println("Pipefish is listening to the control socket " + Cyan("\""+*socket+"\"") + ".")
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+	h.doLock.Lock()
+	h.Quit()
+}
+
+// Sends a line to the control socket of a hub running as a daemon, and writes out the reply,
+// asking for keyboard input if the hub wants it.
+func Ctl() {
+	flags := flag.NewFlagSet("ctl", flag.ExitOnError)
+	socket := flags.String("socket", "", "the path of the control socket")
+	flags.Parse(os.Args[2:])
+	if *socket == "" {
+		*socket = filepath.Join(currentHubFolder(), CONTROL_SOCKET)
+	}
+	if flags.NArg() == 0 {
+		fmt.Println("Pipefish has nothing to send to the hub.")
+		os.Exit(6)
+	}
+	conn, err := net.Dial("unix", *socket)
+	if err != nil {
+		fmt.Println("Pipefish can't connect to the hub: " + err.Error())
+		os.Exit(7)
+	}
+	defer conn.Close()
+	enc, dec := json.NewEncoder(conn), json.NewDecoder(conn)
+	enc.Encode(wsMessage{Type: "line", Body: strings.Join(flags.Args(), " ")})
+	status := 0
+	for {
+		var msg wsMessage
+		if err := dec.Decode(&msg); err != nil {
+			os.Exit(status) // The hub has hung up, e.g. because it's been told to quit.
+		}
+		switch msg.Type {
+		case "output":
+			os.Stdout.WriteString(msg.Body)
+		case "prompt":
+			os.Stdout.WriteString(msg.Body)
+			enc.Encode(wsMessage{Type: "input", Body: readInput(msg.Masked)})
+		case "error":
+			status = 1
+		case "ready":
+			os.Exit(status)
+		}
+	}
+}
+
+var stdin = bufio.NewReader(os.Stdin)
+
+func readInput(masked bool) string {
+	if masked && term.IsTerminal(int(os.Stdin.Fd())) {
+		b, _ := term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Println()
+		return string(b)
+	}
+	line, _ := stdin.ReadString('\n')
+	return strings.TrimRight(line, "\r\n")
+}
+
+// The hub folder the TUI would open.
+func currentHubFolder() string {
+	b, _ := os.ReadFile(filepath.Join(settings.PipefishHomeDirectory, "user/hub.dat"))
+	hubFolder := strings.TrimSpace(string(b))
+	if filepath.IsLocal(hubFolder) {
+		hubFolder = filepath.Join(settings.PipefishHomeDirectory, hubFolder)
+	}
+	return hubFolder
+}
+
+// Listens for connections to the control socket.
+//
+// The socket is made in a new folder which only we can get into, and moved to where it belongs
+// once only we can use it, since otherwise there'd be a moment between making it and changing
+// its permissions in which anyone could connect to it.
+func (h *Hub) ServeControl(path string) error {
+	os.Remove(path) // In case it's been left behind by a hub which didn't stop cleanly.
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".hub-sock-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	listener, err := net.Listen("unix", filepath.Join(dir, CONTROL_SOCKET))
+	if err != nil {
+		return err
+	}
+	// Otherwise closing the listener would try to remove the socket from the folder it started in.
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	if err := os.Chmod(filepath.Join(dir, CONTROL_SOCKET), 0600); err != nil {
+		listener.Close()
+		return err
+	}
+	if err := os.Rename(filepath.Join(dir, CONTROL_SOCKET), path); err != nil {
+		listener.Close()
+		return err
+	}
+	h.control = &controlListener{listener, path}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return // The listener has been closed.
+			}
+			go h.handleControl(conn)
+		}
+	}()
+	return nil
+}
+
+// Removes the socket when it's closed.
+type controlListener struct {
+	net.Listener
+	path string
+}
+
+func (cl *controlListener) Close() error {
+	err := cl.Listener.Close()
+	os.Remove(cl.path)
+	return err
+}
+
+// A connection to the control socket acts on behalf of the terminal's session, since whoever
+// can use it could use the terminal.
+type ctlConnection struct {
+	conn net.Conn
+	enc  *json.Encoder
+	dec  *json.Decoder
+}
+
+func (h *Hub) handleControl(conn net.Conn) {
+	defer conn.Close()
+	cc := &ctlConnection{conn: conn, enc: json.NewEncoder(conn), dec: json.NewDecoder(conn)}
+	var msg wsMessage
+	if err := cc.dec.Decode(&msg); err != nil || msg.Type != "line" {
+		return
+	}
+	h.doLock.Lock()
+	h.lastError = ""
+	h.doRedirected(msg.Body, h.terminal, false, cc, cc)
+	failed := h.lastError != ""
+	h.doLock.Unlock()
+	if failed {
+		cc.enc.Encode(wsMessage{Type: "error"})
+	}
+	cc.enc.Encode(wsMessage{Type: "ready", Body: h.terminal.service})
+}
+
+// The output is sent as it's written rather than when the line is done, since the hub may
+// quit before then.
+func (cc *ctlConnection) Write(b []byte) (int, error) {
+	if err := cc.enc.Encode(wsMessage{Type: "output", Body: string(b)}); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// As with the websocket, a client which doesn't answer a prompt in time is hung up on, since
+// the hub holds its lock while it waits.
+func (cc *ctlConnection) GetFromKeyboard(prompt string, masked bool) string {
+	cc.enc.Encode(wsMessage{Type: "prompt", Body: prompt, Masked: masked})
+	cc.conn.SetReadDeadline(time.Now().Add(PROMPT_TIMEOUT))
+	defer cc.conn.SetReadDeadline(time.Time{})
+	for {
+		var msg wsMessage
+		if err := cc.dec.Decode(&msg); err != nil {
+			cc.conn.Close()
+			return ""
+		}
+		if msg.Type == "input" {
+			return msg.Body
+		}
+	}
+}
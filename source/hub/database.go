@@ -9,6 +9,7 @@ package hub
 import (
 	"crypto/rand"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"math/big"
 	"sort"
@@ -29,43 +30,7 @@ import (
 // List of SQL drivers for when I want to import more: https://zchee.github.io/golang-wiki/SQLDrivers/
 
 func AddAdmin(db *sql.DB, username, firstName, lastName, email, password string) error {
-
-	query :=
-		`CREATE TABLE IF NOT EXISTS PipefishUsers (
-    username varchar(32),
-    firstName varchar(32),
-    lastName varchar(32),
-    password varchar(60),
-    email varchar(60),
-PRIMARY KEY (username));
-
-CREATE TABLE IF NOT EXISTS PipefishGroups (
-    groupName varchar(32),
-PRIMARY KEY (groupName));
-
-CREATE TABLE IF NOT EXISTS PipefishGroupMemberships (
-    username varchar(32) REFERENCES PipefishUsers ON DELETE CASCADE,
-    groupName varchar(32) REFERENCES PipefishGroups ON DELETE CASCADE,
-    owner BOOLEAN DEFAULT FALSE,
-PRIMARY KEY (username, groupName));
-
-CREATE TABLE IF NOT EXISTS PipefishGroupServices (
-    groupName varchar(32) REFERENCES PipefishGroups ON DELETE CASCADE,
-	serviceName varchar(32),
-PRIMARY KEY (groupName, serviceName));
-
-INSERT INTO PipefishGroups (groupName)
-VALUES('Admin')
-ON CONFLICT DO NOTHING;
-
-INSERT INTO PipefishGroups (groupName)
-VALUES('Users')
-ON CONFLICT DO NOTHING;
-
-INSERT INTO PipefishGroups (groupName)
-VALUES('Guests')
-ON CONFLICT DO NOTHING;`
-	_, err := db.Exec(query)
+	err := Migrate(db)
 	if err != nil {
 		return err
 	}
@@ -121,6 +86,21 @@ func UnLetGroupUseService(db *sql.DB, groupName, serviceName string) error {
 	return err
 }
 
+func LetGroupCallFunction(db *sql.DB, groupName, serviceName, functionName string) error {
+	query :=
+		`INSERT INTO PipefishGroupFunctions(groupName, serviceName, functionName)
+	VALUES ($1, $2, $3)`
+	_, err := db.Exec(query, groupName, serviceName, functionName)
+	return err
+}
+
+func UnLetGroupCallFunction(db *sql.DB, groupName, serviceName, functionName string) error {
+	query :=
+		`DELETE FROM PipefishGroupFunctions WHERE groupName = $1 AND serviceName = $2 AND functionName = $3`
+	_, err := db.Exec(query, groupName, serviceName, functionName)
+	return err
+}
+
 func SetOwnership(db *sql.DB, username, groupName string, owner bool) error {
 	query := `UPDATE PipefishGroupMemberships
 SET owner = $3
@@ -518,15 +498,137 @@ WHERE groupName = $1`
 	return err
 }
 
+// Note that this leaves the audit log alone: it would be a poor sort of audit log that
+// you could get rid of by nuking the admin.
 func DropTables(db *sql.DB) {
 	query :=
-		`DROP TABLE PipefishGroupServices;
+		`DROP TABLE PipefishSchema;
+DROP TABLE PipefishResetTokens;
+DROP TABLE PipefishGroupFunctions;
+DROP TABLE PipefishGroupServices;
 DROP TABLE PipefishGroupMemberships;
 DROP TABLE PipefishGroups;
 DROP TABLE PipefishUsers`
 	db.Exec(query)
 }
 
+// Returns a map from the names of the restricted functions of the service to the groups
+// which are allowed to call them.
+func GetFunctionsOfService(db *sql.DB, serviceName string) (map[string][]string, error) {
+	rows, err := db.Query("SELECT functionName, groupName FROM PipefishGroupFunctions WHERE serviceName = $1", serviceName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := map[string][]string{}
+	for rows.Next() {
+		var functionName, groupName string
+		if err := rows.Scan(&functionName, &groupName); err != nil {
+			return nil, err
+		}
+		result[functionName] = append(result[functionName], groupName)
+	}
+	return result, nil
+}
+
+type AuditEntry struct {
+	Time     string   `json:"time"`
+	Username string   `json:"username"`
+	Address  string   `json:"address"`
+	Verb     string   `json:"verb"`
+	Args     []string `json:"args"`
+	Outcome  string   `json:"outcome"`
+}
+
+func AddAuditEntry(db *sql.DB, entry AuditEntry) error {
+	args, _ := json.Marshal(entry.Args)
+	query :=
+		`INSERT INTO PipefishAudit(time, username, address, verb, args, outcome)
+	VALUES ($1, $2, $3, $4, $5, $6)`
+	_, err := db.Exec(query, entry.Time, entry.Username, entry.Address, entry.Verb, string(args), entry.Outcome)
+	return err
+}
+
+// Gets the entries in the audit log in chronological order. Empty strings for the username
+// or the verb mean that we don't filter on them. Since the timestamps are in ISO 8601 format,
+// `since` can be any prefix of a timestamp, e.g. "2025-03" for everything since the start
+// of March 2025.
+func GetAuditEntries(db *sql.DB, username, verb, since string) ([]AuditEntry, error) {
+	rows, err := db.Query(`SELECT time, username, address, verb, args, outcome FROM PipefishAudit
+WHERE ($1 = '' OR username = $1) AND ($2 = '' OR verb = $2) AND time >= $3
+ORDER BY time`, username, verb, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []AuditEntry{}
+	for rows.Next() {
+		var entry AuditEntry
+		var args string
+		if err := rows.Scan(&entry.Time, &entry.Username, &entry.Address, &entry.Verb, &args, &entry.Outcome); err != nil {
+			return nil, err
+		}
+		json.Unmarshal([]byte(args), &entry.Args)
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// Timestamps in the following are in AUDIT_TIME_FORMAT, so that they can be compared as strings.
+
+func AddResetToken(db *sql.DB, username, tokenHash, created string) error {
+	query :=
+		`INSERT INTO PipefishResetTokens(tokenHash, username, created)
+	VALUES ($1, $2, $3)`
+	_, err := db.Exec(query, tokenHash, username, created)
+	return err
+}
+
+// Returns how many reset tokens have been issued to the user since the given time.
+func CountResetTokens(db *sql.DB, username, since string) (int, error) {
+	var count int
+	err := db.QueryRow(`SELECT COUNT(*) FROM PipefishResetTokens WHERE username = $1 AND created >= $2`,
+		username, since).Scan(&count)
+	return count, err
+}
+
+// If there's an unused reset token with the given hash issued since the given time, this
+// changes the password of its user, marks all the tokens of the user as used, and returns the
+// username. The token is checked and claimed by the one statement, so that two requests can't
+// both use it; and if the password can't be changed, the token isn't used up.
+func ResetPassword(db *sql.DB, tokenHash, since, newPassword string) (string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+	var username string
+	err = tx.QueryRow(`UPDATE PipefishResetTokens SET used = TRUE WHERE tokenHash = $1 AND NOT used AND created >= $2 RETURNING username`,
+		tokenHash, since).Scan(&username)
+	if err == sql.ErrNoRows {
+		return "", errors.New("invalid or expired reset token")
+	}
+	if err != nil {
+		return "", err
+	}
+	_, err = tx.Exec(`UPDATE PipefishUsers SET password = $1 WHERE username = $2`, encrypt(newPassword), username)
+	if err != nil {
+		return "", err
+	}
+	_, err = tx.Exec(`UPDATE PipefishResetTokens SET used = TRUE WHERE username = $1`, username)
+	if err != nil {
+		return "", err
+	}
+	return username, tx.Commit()
+}
+
+func DeleteResetTokensBefore(db *sql.DB, before string) error {
+	_, err := db.Exec(`DELETE FROM PipefishResetTokens WHERE created < $1`, before)
+	return err
+}
+
 func encrypt(s string) string {
 	result, _ := bcrypt.GenerateFromPassword([]byte(s), bcrypt.DefaultCost)
 	return string(result)
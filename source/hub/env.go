@@ -0,0 +1,249 @@
+package hub
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/lmorg/readline/v4"
+	"golang.org/x/crypto/pbkdf2"
+
+	"github.com/tim-hardcastle/pipefish/source/pf"
+	"github.com/tim-hardcastle/pipefish/source/text"
+	"github.com/tim-hardcastle/pipefish/source/values"
+)
+
+// The env store holds secrets, API keys, etc, which the services on the hub can read through
+// their `$_env` service variable. A secret may be set for the whole hub with `hub env (p pair)`,
+// in which case every service can see it; or for one service with `hub env (svc string, p pair)`,
+// in which case only that service can, and it overrides any secret with the same key set for
+// the whole hub.
+//
+// The store is kept in the `hub.env` file of the hub folder. The first line of this is a header
+// giving the version of the format and whether the rest is encrypted; the rest consists of two
+// Pipefish map literals, one giving the secrets for the whole hub, and the other being a map
+// from the names of services to maps of their own secrets.
+//
+// If the hub has an env key, the rest is encrypted with AES-GCM, using a key derived from the
+// env key with PBKDF2; and is stored as base64 of the salt, the nonce, and the ciphertext. The
+// header is included as additional data, so the whole file is authenticated.
+//
+// Stores in the old format, which starts with "PLAINTEXT" if it's unencrypted and is otherwise
+// encrypted with AES-CBC and has no header, are converted to the new format when the hub opens
+// them.
+
+const (
+	ENV_HEADER        = "PIPEFISH ENV 2"
+	ENV_PLAINTEXT     = ENV_HEADER + " PLAINTEXT"
+	ENV_ENCRYPTED     = ENV_HEADER + " AES-GCM"
+	ENV_SALT_LENGTH   = 32
+	ENV_KEY_LENGTH    = 32
+	ENV_PBKDF2_ROUNDS = 65536
+)
+
+var errWrongEnvKey = errors.New("incorrect environment key")
+
+// The env a service sees.
+func (h *Hub) envOf(service string) values.Map {
+	env := h.store
+	if scoped, ok := h.scopedStore.Get(values.Value{values.STRING, service}); ok && scoped.T == values.MAP {
+		scoped.V.(values.Map).Range(func(k, v values.Value) {
+			env = env.Set(k, v)
+		})
+	}
+	return env
+}
+
+func (h *Hub) storePath() string {
+	return h.hubFilepath[0:len(h.hubFilepath)-len(".hub")] + ".env"
+}
+
+func (h *Hub) SaveAndPropagateHubStore() {
+	for name, srv := range h.Services {
+		if name == "hub" {
+			srv.SetEnv(h.store)
+			continue
+		}
+		srv.SetEnv(h.envOf(name))
+	}
+	writeStoreFile(h.storePath(), h.encodeStore())
+}
+
+// Writes the store to the file so that only the owner can read it. Since `os.WriteFile` only
+// sets the permissions of a file it creates, we also tighten those of one that's already there.
+func writeStoreFile(path, data string) {
+	os.WriteFile(path, []byte(data), 0600)
+	os.Chmod(path, 0600)
+}
+
+func (h *Hub) encodeStore() string {
+	hubService := h.Services["hub"]
+	payload := hubService.ToLiteral(values.Value{values.MAP, h.store}) + "\n" +
+		hubService.ToLiteral(values.Value{values.MAP, h.scopedStore}) + "\n"
+	if h.storekey == "" {
+		return ENV_PLAINTEXT + "\n" + payload
+	}
+	salt := make([]byte, ENV_SALT_LENGTH)
+	rand.Read(salt)
+	gcm := makeGcm(h.storekey, salt)
+	nonce := make([]byte, gcm.NonceSize())
+	rand.Read(nonce)
+	sealed := gcm.Seal(nil, nonce, []byte(payload), []byte(ENV_ENCRYPTED))
+	data := append(append(salt, nonce...), sealed...)
+	return ENV_ENCRYPTED + "\n" + base64.StdEncoding.EncodeToString(data) + "\n"
+}
+
+// Loads the store from the file, asking for the env key if it's encrypted, unless the hub is
+// headless, in which case it uses the one it was given.
+func (h *Hub) loadStore(path string) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return
+		}
+		panic("Can't open hub `$_env` data.")
+	}
+	s := string(b)
+	if strings.TrimSpace(s) == "" {
+		return
+	}
+	storekey := ""
+	encrypted := !text.Head(s, ENV_PLAINTEXT) && !text.Head(s, "PLAINTEXT")
+	for {
+		switch {
+		case encrypted && h.headless: // Then there's no-one to ask.
+			storekey = h.envKey
+			if storekey == "" {
+				h.WriteError("no env key was given, so the hub is starting without opening env data.")
+				return
+			}
+		case encrypted:
+			rline := readline.NewInstance()
+			rline.SetPrompt("Enter the env key for the hub: ")
+			rline.PasswordMask = '▪'
+			storekey = "Default key for testing."
+			if !testing.Testing() {
+				storekey, _ = rline.Readline()
+			}
+			if storekey == "" {
+				println("Starting hub without opening env data.")
+				return
+			}
+		}
+		err = h.decodeStore(s, storekey)
+		if err == nil {
+			break
+		}
+		if err != errWrongEnvKey {
+			h.WriteError("can't read `$_env` data: " + err.Error())
+			return
+		}
+		if h.headless {
+			h.WriteError("the env key is invalid, so the hub is starting without opening env data.")
+			return
+		}
+		h.WritePretty("Invalid `env` key. Enter a valid one or press return to continue without loading the store.")
+	}
+	h.storekey = storekey
+	h.Services["hub"].SetEnv(h.store)
+	h.setSV("scopedEnv", pf.MAP, h.scopedStore)
+	if !text.Head(s, ENV_HEADER) { // Then we convert it to the current format.
+		writeStoreFile(path, h.encodeStore())
+	}
+}
+
+func (h *Hub) decodeStore(s, storekey string) error {
+	header, body, _ := strings.Cut(s, "\n")
+	switch header {
+	case ENV_PLAINTEXT:
+		return h.parseStore(body)
+	case ENV_ENCRYPTED:
+		data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(body))
+		if err != nil {
+			return err
+		}
+		if len(data) < ENV_SALT_LENGTH {
+			return errors.New("data is truncated")
+		}
+		gcm := makeGcm(storekey, data[:ENV_SALT_LENGTH])
+		if len(data) < ENV_SALT_LENGTH+gcm.NonceSize() {
+			return errors.New("data is truncated")
+		}
+		nonce := data[ENV_SALT_LENGTH : ENV_SALT_LENGTH+gcm.NonceSize()]
+		payload, err := gcm.Open(nil, nonce, data[ENV_SALT_LENGTH+gcm.NonceSize():], []byte(ENV_ENCRYPTED))
+		if err != nil {
+			return errWrongEnvKey // Or someone's tampered with it, but we can't tell the difference.
+		}
+		return h.parseStore(string(payload))
+	}
+	if text.Head(header, ENV_HEADER) {
+		return errors.New("unknown format `" + header + "`")
+	}
+	if header != "PLAINTEXT" { // Then it's in the old encrypted format.
+		if len(s) < ENV_SALT_LENGTH+aes.BlockSize {
+			return errors.New("data is truncated")
+		}
+		salt := s[0:ENV_SALT_LENGTH]
+		ciphertext := s[ENV_SALT_LENGTH:]
+		block, _ := aes.NewCipher(deriveEnvKey(storekey, []byte(salt)))
+		iv := ciphertext[:aes.BlockSize]
+		ciphertext = ciphertext[aes.BlockSize:]
+		if len(ciphertext)%aes.BlockSize != 0 {
+			return errors.New("data is truncated")
+		}
+		decrypt := make([]byte, len(ciphertext))
+		cipher.NewCBCDecrypter(block, []byte(iv)).CryptBlocks(decrypt, []byte(ciphertext))
+		if !text.Head(string(decrypt), "PLAINTEXT") {
+			return errWrongEnvKey
+		}
+		s = string(decrypt)
+	}
+	// The old format has a line for each pair in the store, and no scoping.
+	for _, bit := range strings.Split(strings.TrimSpace(s), "\n")[1:] {
+		pair, _ := h.Services["hub"].Do(bit)
+		if pair.T != values.PAIR {
+			return errors.New("can't parse `" + bit + "`")
+		}
+		h.store = h.store.Set(pair.V.([]values.Value)[0], pair.V.([]values.Value)[1])
+	}
+	return nil
+}
+
+func (h *Hub) parseStore(payload string) error {
+	lines := strings.Split(strings.TrimSpace(payload), "\n")
+	if len(lines) != 2 {
+		return errors.New("malformed data")
+	}
+	maps := make([]values.Map, 2)
+	for i, line := range lines {
+		v, _ := h.Services["hub"].Do(line)
+		if v.T != values.MAP {
+			return errors.New("can't parse `" + line + "`")
+		}
+		maps[i] = v.V.(values.Map)
+	}
+	h.store, h.scopedStore = maps[0], maps[1]
+	return nil
+}
+
+func deriveEnvKey(storekey string, salt []byte) []byte {
+	return pbkdf2.Key([]byte(storekey), salt, ENV_PBKDF2_ROUNDS, ENV_KEY_LENGTH, sha256.New) // sha256 has nothing to do with it but the API is stupid.
+}
+
+func makeGcm(storekey string, salt []byte) cipher.AEAD {
+	block, err := aes.NewCipher(deriveEnvKey(storekey, salt))
+	if err != nil {
+		panic(err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+	return gcm
+}
@@ -0,0 +1,102 @@
+package hub
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+
+	"github.com/tim-hardcastle/pipefish/source/initializer"
+	"github.com/tim-hardcastle/pipefish/source/text"
+)
+
+// `pipefish gen proto <script> [-o <file>]` writes the API of the script as a `.proto` file,
+// for clients which call the service by gRPC, to the file if it's given and to the standard
+// output otherwise. The name of the service is the name of the script without its extension,
+// as it would be if it were run on a hub by `hub run`. See `initializer/proto.go`.
+//
+// `pipefish gen go <script> [-o <directory>]` writes a Go package which is a client of the
+// service, named after the directory, to `client.go` in the directory if it's given, making the
+// directory if it doesn't exist, and to the standard output otherwise. See `initializer/goclient.go`.
+//
+// `pipefish gen python <script> [-o <file>]` and `pipefish gen ts <script> [-o <file>]` write a
+// Python module or a TypeScript module which is a client of the service on a hub, to the file if
+// it's given and to the standard output otherwise. See `initializer/pyclient.go` and
+// `initializer/tsclient.go`.
+
+func Gen() {
+	if len(os.Args) < 3 {
+		println("`gen` needs to be followed by `proto`, `go`, `python`, or `ts`.")
+		os.Exit(6)
+	}
+	flags := flag.NewFlagSet("gen "+os.Args[2], flag.ExitOnError)
+	out := flags.String("o", "", "the file or directory to write to")
+	flags.Parse(os.Args[3:])
+	if flags.NArg() == 0 {
+		println("`gen " + os.Args[2] + "` needs a script.")
+		os.Exit(6)
+	}
+	filename := flags.Arg(0)
+	flags.Parse(flags.Args()[1:]) // So that the options can come after the script.
+	if flags.NArg() != 0 {
+		println("Wrong number of arguments for `gen " + os.Args[2] + "`.")
+		os.Exit(6)
+	}
+	name := strings.TrimSuffix(filepath.Base(filename), filepath.Ext(filename))
+	switch os.Args[2] {
+	case "proto":
+		writeGenerated(initializer.ProtoFromApi(name, readApi(filename)).String(), *out)
+	case "go":
+		pkg, file := goPackageName(name), ""
+		if *out != "" {
+			if err := os.MkdirAll(*out, 0755); err != nil {
+				fmt.Println("\nPipefish can't make the directory " + text.CYAN + "\"" + *out + "\"" + text.RESET + ": " + err.Error() + ".\n")
+				os.Exit(7)
+			}
+			pkg, file = goPackageName(filepath.Base(*out)), filepath.Join(*out, "client.go")
+		}
+		code, err := initializer.GoClientFromApi(pkg, name, readApi(filename))
+		if err != nil {
+			fmt.Println("\nPipefish can't generate valid Go from the API of " + text.CYAN + "\"" + filename + "\"" + text.RESET + ": " + err.Error() + ".\n")
+			os.Exit(6)
+		}
+		writeGenerated(code, file)
+	case "python":
+		writeGenerated(initializer.PythonClientFromApi(name, readApi(filename)), *out)
+	case "ts":
+		writeGenerated(initializer.TypeScriptClientFromApi(name, readApi(filename)), *out)
+	default:
+		println("`gen` needs to be followed by `proto`, `go`, `python`, or `ts`.")
+		os.Exit(6)
+	}
+	os.Exit(0)
+}
+
+// Writes generated code to the file, or to the standard output if there's no file.
+func writeGenerated(code, filename string) {
+	if filename == "" {
+		os.Stdout.WriteString(code)
+		return
+	}
+	if err := os.WriteFile(filename, []byte(code), 0644); err != nil {
+		fmt.Println("\nPipefish can't write the file " + text.CYAN + "\"" + filename + "\"" + text.RESET + ": " + err.Error() + ".\n")
+		os.Exit(7)
+	}
+}
+
+// Makes a name into the name of a Go package, which is in lower case and has only letters and
+// digits, and doesn't start with a digit.
+func goPackageName(name string) string {
+	var buf strings.Builder
+	for _, r := range strings.ToLower(name) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) && buf.Len() > 0 {
+			buf.WriteRune(r)
+		}
+	}
+	if buf.Len() == 0 {
+		return "client"
+	}
+	return buf.String()
+}
@@ -0,0 +1,231 @@
+package hub
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/tim-hardcastle/pipefish/source/dtypes"
+	"github.com/tim-hardcastle/pipefish/source/initializer"
+	"github.com/tim-hardcastle/pipefish/source/lexer"
+	"github.com/tim-hardcastle/pipefish/source/settings"
+	"github.com/tim-hardcastle/pipefish/source/text"
+	"github.com/tim-hardcastle/pipefish/source/token"
+)
+
+// A service depends on another service of the same hub if it declares it as `external`, either
+// by its name, or by the path of its script. When the hub opens, it starts the services it's
+// running in an order such that each one starts after the services it depends on, so that it
+// finds them already running.
+//
+// This can't be done if services depend on one another in a cycle, in which case the hub says
+// so and doesn't start them.
+//
+// `hub graph` shows which services depend on which, and `hub graph to (f string)` exports the
+// graph to a file in the DOT language of Graphviz.
+
+// Returns the names and paths of the services the script declares as `external`, as
+// `TweakNameAndPath` would make them. It only looks at the `external` section of the script,
+// without compiling it, and so there may be other errors in it which it doesn't notice.
+func externalsOf(scriptFilepath string) ([][2]string, error) {
+	if text.Head(scriptFilepath, "!") {
+		scriptFilepath = filepath.Join(settings.PipefishHomeDirectory, scriptFilepath[1:])
+	}
+	b, err := os.ReadFile(scriptFilepath)
+	if err != nil {
+		return nil, err
+	}
+	result := [][2]string{}
+	line := []token.Token{}
+	inExternals := false
+	rl := lexer.NewRelexer(scriptFilepath, string(b))
+	for done := false; !done; {
+		tok := rl.NextToken()
+		done = tok.Type == token.EOF // Which may end the last declaration, in place of a newline.
+		if _, ok := token.HEADWORDS[tok.Type]; ok {
+			inExternals = tok.Type == token.EXTERNAL
+			line = line[:0]
+			continue
+		}
+		if !inExternals || tok.Type == token.PRIVATE {
+			continue
+		}
+		if !(tok.Type == token.NEWLINE || done) {
+			line = append(line, tok)
+			continue
+		}
+		var name, path string
+		switch {
+		case len(line) == 1 && line[0].Type == token.IDENT:
+			name = line[0].Literal
+		case len(line) == 1 && line[0].Type == token.STRING:
+			path = line[0].Literal
+		case len(line) == 3 && line[0].Type == token.IDENT && line[1].Literal == "::" && line[2].Type == token.STRING:
+			name, path = line[0].Literal, line[2].Literal
+		}
+		line = line[:0]
+		if name != "" || path != "" { // Otherwise the compiler will complain about it in due course.
+			name, path = initializer.TweakNameAndPath(name, path, scriptFilepath)
+			result = append(result, [2]string{name, path})
+		}
+	}
+	return result, nil
+}
+
+// Makes a digraph with an arrow from each of the services to each of the services it depends
+// on, given the paths of their scripts by name. The nodes are in the order of the names.
+func dependencyGraph(names []string, paths map[string]string) *dtypes.Digraph {
+	graph := dtypes.NewDigraph()
+	byPath := map[string]string{}
+	for _, name := range names {
+		dtypes.Add(graph, name)
+		path := paths[name]
+		if text.Head(path, "!") {
+			path = filepath.Join(settings.PipefishHomeDirectory, path[1:])
+		}
+		byPath[filepath.Clean(path)] = name
+	}
+	for _, name := range names {
+		externals, err := externalsOf(paths[name])
+		if err != nil { // Then the hub will say so when it tries to start the service.
+			continue
+		}
+		for _, ex := range externals {
+			exName, exPath := ex[0], ex[1]
+			if text.Head(exPath, "http:") || text.Head(exPath, "https:") {
+				continue
+			}
+			if _, ok := paths[exName]; ok {
+				dtypes.AddArrow(graph, name, exName)
+				continue
+			}
+			if dependency, ok := byPath[filepath.Clean(exPath)]; ok && exPath != "" {
+				dtypes.AddArrow(graph, name, dependency)
+			}
+		}
+	}
+	return graph
+}
+
+// Returns the services in the order they should be started in, and the cycles which prevent
+// the rest from being started.
+func startupOrder(graph *dtypes.Digraph) ([]string, [][]string) {
+	order := []string{}
+	cycles := [][]string{}
+	for _, component := range dtypes.Tarjan(graph) { // Which puts the dependencies first.
+		name := component[0]
+		dependencies, _ := graph.Get(name)
+		if len(component) == 1 && !dependencies.Contains(name) {
+			order = append(order, name)
+			continue
+		}
+		cycles = append(cycles, findCycle(graph, component))
+	}
+	return order, cycles
+}
+
+// Finds a cycle in a strongly connected component of the graph, starting with the member of
+// the component which comes first alphabetically, and ending where it started.
+func findCycle(graph *dtypes.Digraph, component []string) []string {
+	cycle := []string{slices.Min(component)}
+	for {
+		dependencies, _ := graph.Get(cycle[len(cycle)-1])
+		var next string
+		for _, name := range component { // Since it's strongly connected, there is one.
+			if dependencies.Contains(name) {
+				next = name
+				break
+			}
+		}
+		if i := slices.Index(cycle, next); i >= 0 {
+			return append(cycle[i:], next)
+		}
+		cycle = append(cycle, next)
+	}
+}
+
+func (h *Hub) writeCycles(cycles [][]string) {
+	for _, cycle := range cycles {
+		h.WriteError("the services " + describeCycle(cycle) + " depend on one another in a " +
+			"cycle through their `external` declarations, and so can't be started.")
+	}
+}
+
+func describeCycle(cycle []string) string {
+	quoted := make([]string, len(cycle))
+	for i, name := range cycle {
+		quoted[i] = "<C>\"" + name + "\"</>"
+	}
+	return strings.Join(quoted, " → ")
+}
+
+// The names and paths of the services the hub is running, other than the hub itself.
+func (h *Hub) runningServices() ([]string, map[string]string) {
+	services := h.servicesSnapshot()
+	delete(services, "")
+	delete(services, "hub")
+	paths := map[string]string{}
+	for name, sv := range services {
+		paths[name], _ = sv.GetFilepath()
+	}
+	return sortedKeys(paths), paths
+}
+
+// Shows the graph of the services the hub is running, or, if `file` isn't empty, exports it
+// to the file as DOT.
+func (h *Hub) showGraph(file string) {
+	names, paths := h.runningServices()
+	graph := dependencyGraph(names, paths)
+	if file != "" {
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(settings.PipefishHomeDirectory, file)
+		}
+		if err := os.WriteFile(file, []byte(toDot(graph)), 0644); err != nil {
+			h.WriteError(err.Error())
+			return
+		}
+		h.WritePretty("Exported the graph of " + strconv.Itoa(len(names)) + " services to <C>\"" + filepath.Base(file) + "\"</>.")
+		return
+	}
+	if len(names) == 0 {
+		h.WriteString("No services are running on this hub.\n\n")
+		return
+	}
+	for pair := graph.Oldest(); pair != nil; pair = pair.Next() {
+		dependencies := []string{}
+		for _, name := range names {
+			if pair.Value.Contains(name) {
+				dependencies = append(dependencies, "<C>\""+name+"\"</>")
+			}
+		}
+		line := "Service <C>\"" + pair.Key + "\"</> depends on no other service."
+		if len(dependencies) > 0 {
+			line = "Service <C>\"" + pair.Key + "\"</> depends on " + strings.Join(dependencies, ", ") + "."
+		}
+		h.WriteString(BULLET + strings.TrimSpace(h.GetPretty(line)) + "\n")
+	}
+	h.WriteString("\n")
+	_, cycles := startupOrder(graph)
+	h.writeCycles(cycles)
+}
+
+// Writes the graph in the DOT language, with the arrows pointing from each service to the
+// services it depends on.
+func toDot(graph *dtypes.Digraph) string {
+	var buf strings.Builder
+	buf.WriteString("digraph hub {\n")
+	for pair := graph.Oldest(); pair != nil; pair = pair.Next() {
+		buf.WriteString("\t" + strconv.Quote(pair.Key) + ";\n")
+	}
+	for pair := graph.Oldest(); pair != nil; pair = pair.Next() {
+		for dependency := graph.Oldest(); dependency != nil; dependency = dependency.Next() {
+			if pair.Value.Contains(dependency.Key) {
+				buf.WriteString("\t" + strconv.Quote(pair.Key) + " -> " + strconv.Quote(dependency.Key) + ";\n")
+			}
+		}
+	}
+	buf.WriteString("}\n")
+	return buf.String()
+}
@@ -0,0 +1,444 @@
+package hub
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/tim-hardcastle/pipefish/source/initializer"
+	"github.com/tim-hardcastle/pipefish/source/pf"
+	"github.com/tim-hardcastle/pipefish/source/values"
+	"github.com/tim-hardcastle/pipefish/source/vm"
+)
+
+// Besides JSON, the hub serves the services on it by gRPC, on the same port, to clients made
+// from the `.proto` file which `pipefish gen proto` makes from a service's API. (See
+// `initializer/proto.go` for how the API is described.) An RPC is sent to the path
+// `/pipefish.<service>/<rpc>`, and the username and password of the user, if the hub is
+// administered, are sent as the metadata `username` and `password`.
+//
+// The hub turns the request into a call to the function in the binary wire format, and makes
+// it just as it would a call sent as JSON (see `wire.go`), in a session of its own which the hub
+// doesn't keep, and then turns the result into the response. If the result is an error, or the
+// hub outputs something instead, e.g. because the user has no access to the function, that
+// becomes the status of the RPC. So does the hub's refusal of a request which is over the limits
+// described in `limits.go`, as RESOURCE_EXHAUSTED.
+//
+// Since gRPC needs HTTP/2, the hub speaks it over plain HTTP as well as HTTPS. Compressed
+// messages aren't supported.
+
+// The gRPC status codes the hub uses.
+const (
+	GRPC_OK                 = 0
+	GRPC_UNKNOWN            = 2
+	GRPC_INVALID_ARGUMENT   = 3
+	GRPC_RESOURCE_EXHAUSTED = 8
+	GRPC_UNIMPLEMENTED      = 12
+	GRPC_INTERNAL           = 13
+	GRPC_UNAUTHENTICATED    = 16
+)
+
+func isGrpc(r *http.Request) bool {
+	return r.ProtoMajor == 2 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc")
+}
+
+// The protocols the hub's HTTP server speaks.
+func httpProtocols() *http.Protocols {
+	var protocols http.Protocols
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(true)
+	protocols.SetUnencryptedHTTP2(true)
+	return &protocols
+}
+
+func (h *Hub) handleGrpc(w http.ResponseWriter, r *http.Request) {
+	service, method, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"+initializer.PROTO_PACKAGE+"."), "/")
+	if !ok || !strings.HasPrefix(r.URL.Path, "/"+initializer.PROTO_PACKAGE+".") {
+		grpcStatus(w, GRPC_UNIMPLEMENTED, "the hub serves no gRPC method "+r.URL.Path)
+		return
+	}
+	message, e := readGrpcMessage(r.Body, h.limiter.getLimits().MaxBody)
+	if e != nil {
+		var tooBig *http.MaxBytesError
+		if errors.As(e, &tooBig) {
+			h.limiter.refuseSize()
+			grpcStatus(w, GRPC_RESOURCE_EXHAUSTED, "request body is larger than "+strconv.FormatInt(tooBig.Limit, 10)+" bytes")
+			return
+		}
+		grpcStatus(w, GRPC_INVALID_ARGUMENT, e.Error())
+		return
+	}
+	h.doLock.Lock()
+	defer h.doLock.Unlock()
+	username, password := r.Header.Get("username"), r.Header.Get("password")
+	if !h.admitRequest(w, r, service, 1) {
+		return
+	}
+	if h.administered() {
+		if e := ValidateUser(h.Db, username, password); e != nil {
+			grpcStatus(w, GRPC_UNAUTHENTICATED, e.Error())
+			return
+		}
+		if username != "" && !h.admitUser(w, r, username, 1) {
+			return
+		}
+	}
+	sv, ok := h.getService(service)
+	if !ok || sv.IsBroken() {
+		grpcStatus(w, GRPC_UNIMPLEMENTED, "the hub has no working service \""+service+"\"")
+		return
+	}
+	api := h.protoApi(service, sv)
+	rpc, ok := api.Rpc(method)
+	if !ok {
+		grpcStatus(w, GRPC_UNIMPLEMENTED, "the service \""+service+"\" has no RPC "+method)
+		return
+	}
+	codec := grpcCodec{sv: sv, api: api}
+	call, e := codec.call(rpc, message)
+	if e != nil {
+		grpcStatus(w, GRPC_INVALID_ARGUMENT, e.Error())
+		return
+	}
+	data, e := sv.EncodeWireCall(call)
+	if e != nil {
+		grpcStatus(w, GRPC_INVALID_ARGUMENT, e.Error())
+		return
+	}
+	session := &Session{service: service, username: username, password: password, addr: r.RemoteAddr, ers: []*pf.Error{}, lastUsed: time.Now()}
+	var buf strings.Builder
+	oldOut := h.Out
+	h.Out = &buf
+	defer func() { h.Out = oldOut }()
+	sv.SetOutHandler(sv.MakeLiteralOutHandler(&buf))
+	hubService := h.Services["hub"]
+	oldHubHandler, _ := hubService.GetOutHandler()
+	hubService.SetOutHandler(hubService.MakeLiteralOutHandler(&buf))
+	defer hubService.SetOutHandler(oldHubHandler)
+	defer func() {
+		if r := recover(); r != nil {
+			grpcStatus(w, GRPC_INTERNAL, "the hub failed to evaluate the request: "+fmt.Sprint(r))
+		}
+	}()
+	result := h.doWireCall(data, session)
+	if result == nil {
+		grpcStatus(w, GRPC_UNKNOWN, plainText(buf.String()))
+		return
+	}
+	val, e := sv.DecodeWireValue(result)
+	if e != nil {
+		grpcStatus(w, GRPC_INTERNAL, e.Error())
+		return
+	}
+	if val.T == values.ERROR {
+		grpcStatus(w, GRPC_UNKNOWN, plainText(val.V.(*pf.Error).Message))
+		return
+	}
+	response, e := codec.encodeMessage(&rpc.Response, []values.Value{val})
+	if e != nil {
+		grpcStatus(w, GRPC_INTERNAL, e.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	w.WriteHeader(http.StatusOK)
+	w.Write(binary.BigEndian.AppendUint32([]byte{0}, uint32(len(response))))
+	w.Write(response)
+	w.Header().Set("Grpc-Status", strconv.Itoa(GRPC_OK))
+	w.Header().Set("Grpc-Message", "")
+}
+
+// The description of the API of a service as protocol buffers, which we keep until the service
+// is compiled again.
+type grpcApi struct {
+	sv  *pf.Service
+	api *initializer.ProtoApi
+}
+
+// Returns the description of the API of the service. The caller should hold the `doLock`.
+func (h *Hub) protoApi(name string, sv *pf.Service) *initializer.ProtoApi {
+	if cached, ok := h.grpcApis[name]; ok && cached.sv == sv {
+		return cached.api
+	}
+	api := initializer.ProtoFromApi(name, sv.SerializeApi())
+	h.grpcApis[name] = grpcApi{sv, api}
+	return api
+}
+
+// Reads the one length-prefixed message of a unary RPC, which may be no longer than the maximum
+// size of a request, if there is one.
+func readGrpcMessage(body io.Reader, maxBody int64) ([]byte, error) {
+	header := make([]byte, 5)
+	if _, e := io.ReadFull(body, header); e != nil {
+		return nil, fmt.Errorf("the request has no message: %w", e)
+	}
+	if header[0] != 0 {
+		return nil, errors.New("the hub doesn't accept compressed messages")
+	}
+	// We go by the length the client claims only so far as to refuse it if it's too long, since
+	// the client may not send as much as it claims.
+	length := int64(binary.BigEndian.Uint32(header[1:]))
+	if maxBody > 0 && length > maxBody {
+		return nil, &http.MaxBytesError{Limit: maxBody}
+	}
+	message, e := io.ReadAll(io.LimitReader(body, length))
+	if e != nil {
+		return nil, fmt.Errorf("the message is truncated: %w", e)
+	}
+	if int64(len(message)) < length {
+		return nil, errors.New("the message is truncated")
+	}
+	return message, nil
+}
+
+// Responds with no message, just a status, which goes in the headers since there's nothing
+// for it to come after.
+func grpcStatus(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Grpc-Status", strconv.Itoa(code))
+	w.Header().Set("Grpc-Message", grpcPercentEncode(message))
+	w.WriteHeader(http.StatusOK)
+}
+
+// The status message is percent-encoded, except for printable ASCII.
+func grpcPercentEncode(s string) string {
+	var buf strings.Builder
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c >= 0x20 && c <= 0x7e && c != '%' {
+			buf.WriteByte(c)
+		} else {
+			fmt.Fprintf(&buf, "%%%02X", c)
+		}
+	}
+	return buf.String()
+}
+
+var ansiCodes = regexp.MustCompile("\x1b\\[[0-9;]*m")
+
+// Turns what the hub output into a one-line message.
+func plainText(s string) string {
+	return strings.Join(strings.Fields(ansiCodes.ReplaceAllString(s, "")), " ")
+}
+
+// Translates between messages and Pipefish values, for the API of a service.
+type grpcCodec struct {
+	sv  *pf.Service
+	api *initializer.ProtoApi
+}
+
+// Makes the call an RPC describes from its request.
+func (gc *grpcCodec) call(rpc *initializer.ProtoRpc, data []byte) (*vm.ExternalCall, error) {
+	args, e := gc.decodeMessage(&rpc.Request, data)
+	if e != nil {
+		return nil, e
+	}
+	xc := &vm.ExternalCall{Operator: rpc.Position, Name: rpc.Function}
+	for _, bling := range rpc.Sig {
+		if bling == "" {
+			xc.Args = append(xc.Args, args[0])
+			args = args[1:]
+			continue
+		}
+		xc.Args = append(xc.Args, values.Value{values.BLING, bling})
+	}
+	return xc, nil
+}
+
+// The types of the protocol buffers wire format.
+const (
+	PROTO_VARINT  = 0
+	PROTO_FIXED64 = 1
+	PROTO_BYTES   = 2
+	PROTO_FIXED32 = 5
+)
+
+// Decodes a message into the values of its fields, in order.
+func (gc *grpcCodec) decodeMessage(m *initializer.ProtoMessage, data []byte) ([]values.Value, error) {
+	raw := make([]any, len(m.Fields)) // The last value given for each field, if any.
+	for len(data) > 0 {
+		tag, n := binary.Uvarint(data)
+		if n <= 0 {
+			return nil, errors.New("malformed message " + m.Name)
+		}
+		data = data[n:]
+		number, wireType := tag>>3, tag&7
+		var v any
+		switch wireType {
+		case PROTO_VARINT:
+			u, n := binary.Uvarint(data)
+			if n <= 0 {
+				return nil, errors.New("malformed message " + m.Name)
+			}
+			v, data = u, data[n:]
+		case PROTO_FIXED64:
+			if len(data) < 8 {
+				return nil, errors.New("malformed message " + m.Name)
+			}
+			v, data = binary.LittleEndian.Uint64(data), data[8:]
+		case PROTO_BYTES:
+			length, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < length {
+				return nil, errors.New("malformed message " + m.Name)
+			}
+			v, data = data[n:n+int(length)], data[n+int(length):]
+		case PROTO_FIXED32:
+			if len(data) < 4 {
+				return nil, errors.New("malformed message " + m.Name)
+			}
+			data = data[4:]
+			continue
+		default:
+			return nil, errors.New("malformed message " + m.Name)
+		}
+		if number >= 1 && number <= uint64(len(raw)) { // Otherwise it's a field we don't know about, which we ignore.
+			raw[number-1] = v
+		}
+	}
+	result := make([]values.Value, len(m.Fields))
+	for i, field := range m.Fields {
+		if raw[i] == nil && field.Optional {
+			result[i] = values.Value{values.NULL, nil}
+			continue
+		}
+		v, e := gc.decodeField(field, raw[i])
+		if e != nil {
+			return nil, errors.New("field " + field.Name + " of " + m.Name + ": " + e.Error())
+		}
+		result[i] = v
+	}
+	return result, nil
+}
+
+// Decodes a field from its raw value, or from nil if it was absent, in which case it has the
+// default value.
+func (gc *grpcCodec) decodeField(field initializer.ProtoField, raw any) (values.Value, error) {
+	t, e := gc.sv.TypeNameToType(field.Type)
+	if e != nil {
+		return values.Value{}, errors.New("no type " + field.Type)
+	}
+	wrongType := errors.New("wrong wire type for " + field.Proto)
+	if message, ok := gc.api.Message(field.Type); ok {
+		data, ok := raw.([]byte)
+		if !ok && raw != nil {
+			return values.Value{}, wrongType
+		}
+		fields, e := gc.decodeMessage(message, data)
+		if e != nil {
+			return values.Value{}, e
+		}
+		return values.Value{t, fields}, nil
+	}
+	if enum, ok := gc.api.Enum(field.Type); ok {
+		u, ok := raw.(uint64)
+		if !ok && raw != nil {
+			return values.Value{}, wrongType
+		}
+		if u >= uint64(len(enum.Elements)) {
+			return values.Value{}, errors.New("no element " + strconv.FormatUint(u, 10) + " of " + enum.Name)
+		}
+		return values.Value{t, int(u)}, nil
+	}
+	switch field.Proto {
+	case "int64", "int32", "bool":
+		u, ok := raw.(uint64)
+		if !ok && raw != nil {
+			return values.Value{}, wrongType
+		}
+		switch field.Proto {
+		case "int64":
+			return values.Value{t, int(int64(u))}, nil
+		case "int32":
+			return values.Value{t, rune(int32(u))}, nil
+		default:
+			return values.Value{t, u != 0}, nil
+		}
+	case "double":
+		u, ok := raw.(uint64)
+		if !ok && raw != nil {
+			return values.Value{}, wrongType
+		}
+		return values.Value{t, math.Float64frombits(u)}, nil
+	case "string":
+		b, ok := raw.([]byte)
+		if !ok && raw != nil {
+			return values.Value{}, wrongType
+		}
+		if !utf8.Valid(b) {
+			return values.Value{}, errors.New("string isn't valid UTF-8")
+		}
+		return values.Value{t, string(b)}, nil
+	}
+	return values.Value{}, errors.New("no way to decode " + field.Proto)
+}
+
+// Encodes the values of the fields of a message.
+func (gc *grpcCodec) encodeMessage(m *initializer.ProtoMessage, vals []values.Value) ([]byte, error) {
+	buf := []byte{}
+	for i, field := range m.Fields {
+		v := vals[i]
+		if v.T == values.NULL && field.Optional {
+			continue
+		}
+		number := uint64(i + 1)
+		if field.Type == "" {
+			buf = appendProtoBytes(buf, number, []byte(gc.sv.ToLiteral(v)))
+			continue
+		}
+		if t, _ := gc.sv.TypeNameToType(field.Type); v.T != t {
+			return nil, errors.New("the value of " + field.Name + " isn't of type " + field.Type)
+		}
+		if message, ok := gc.api.Message(field.Type); ok {
+			fields := v.V.([]values.Value)
+			if len(fields) != len(message.Fields) {
+				return nil, errors.New("the value of " + field.Name + " has the wrong number of fields")
+			}
+			data, e := gc.encodeMessage(message, fields)
+			if e != nil {
+				return nil, e
+			}
+			buf = appendProtoBytes(buf, number, data)
+			continue
+		}
+		if _, ok := gc.api.Enum(field.Type); ok {
+			buf = appendProtoVarint(buf, number, uint64(v.V.(int)))
+			continue
+		}
+		switch field.Proto {
+		case "int64":
+			buf = appendProtoVarint(buf, number, uint64(int64(v.V.(int))))
+		case "int32":
+			buf = appendProtoVarint(buf, number, uint64(int64(v.V.(rune))))
+		case "bool":
+			b := uint64(0)
+			if v.V.(bool) {
+				b = 1
+			}
+			buf = appendProtoVarint(buf, number, b)
+		case "double":
+			buf = binary.AppendUvarint(buf, number<<3|PROTO_FIXED64)
+			buf = binary.LittleEndian.AppendUint64(buf, math.Float64bits(v.V.(float64)))
+		case "string":
+			buf = appendProtoBytes(buf, number, []byte(v.V.(string)))
+		}
+	}
+	return buf, nil
+}
+
+func appendProtoVarint(buf []byte, number, u uint64) []byte {
+	buf = binary.AppendUvarint(buf, number<<3|PROTO_VARINT)
+	return binary.AppendUvarint(buf, u)
+}
+
+func appendProtoBytes(buf []byte, number uint64, data []byte) []byte {
+	buf = binary.AppendUvarint(buf, number<<3|PROTO_BYTES)
+	buf = binary.AppendUvarint(buf, uint64(len(data)))
+	return append(buf, data...)
+}
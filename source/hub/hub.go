@@ -2,27 +2,28 @@ package hub
 
 import (
 	"bytes"
-	"crypto/aes"
-	"crypto/cipher"
-	"crypto/sha256"
+	"context"
+	"crypto/tls"
 	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"maps"
+	"net"
 	"net/http"
-	"net/smtp"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/caddyserver/certmagic"
-	"github.com/lmorg/readline/v4"
-	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/net/websocket"
 
 	"github.com/tim-hardcastle/pipefish/source/dtypes"
 	"github.com/tim-hardcastle/pipefish/source/err"
@@ -31,65 +32,147 @@ import (
 	"github.com/tim-hardcastle/pipefish/source/settings"
 	"github.com/tim-hardcastle/pipefish/source/text"
 	"github.com/tim-hardcastle/pipefish/source/values"
+	"github.com/tim-hardcastle/pipefish/source/vm"
 )
 
 type Hub struct {
 	hubFilepath            string
 	Services               map[string]*pf.Service // The services the hub knows about.
-	ers                    []*pf.Error            // The errors produced by the latest compilation/execution of one of the hub's services.
 	Out                    io.Writer
 	Sources                map[string][]string
 	Db                     *sql.DB
-	mailData               mailer
+	Mailer                 Mailer // What the hub and its services send mail through, if anything. See `mailer.go`.
+	config                 Config // See `config.go`.
+	badConfig              bool   // Whether the config was invalid when the hub was opened, in which case it's mostly ignored.
+	limiter                *limiter
+	metrics                *metrics
 	listeningToHttpOrHttps bool
-	// The username and password of the person logged into the terminal.
-	TerminalUsername string
-	TerminalPassword string
+	server                 *http.Server
+	redirect               *http.Server // Redirects HTTP to HTTPS, if the hub is listening to HTTPS.
+	serverLock             sync.Mutex
+	// Held while the map of services is changed, so that requests in progress can get the
+	// service they want from it.
+	servicesLock sync.RWMutex
+	// The latest versions of services which failed to compile in live mode while the last
+	// versions which did compile go on running.
+	failedBuilds map[string]*pf.Service
+	sockets      map[*wsConnection]bool // The open websocket connections, so we can close them when we stop listening.
+	grpcApis     map[string]grpcApi     // The APIs of the services as protocol buffers. See `grpc.go`.
+	// The session of the person using the terminal, the session the hub is acting for at
+	// the moment, and the sessions of remote users, keyed by their IDs.
+	terminal    *Session
+	session     *Session
+	sessions    map[string]*Session
+	sessionLock sync.Mutex
+	pruner      *time.Timer // Forgets old sessions. See `session.go`.
 	// The usernames and password of whoever called `hub.Do``.
 	username, password string
+	// The last error written by the hub, so that we can put it in the audit log.
+	lastError string
 	// Whether this is an external call.
-	store    values.Map
-	storekey string
+	store       values.Map
+	scopedStore values.Map // Secrets which only particular services can see, keyed by the names of the services.
+	storekey    string
+	// The websocket connection on whose behalf the hub is acting, if any.
+	socket *wsConnection
+	// Held while a line is being evaluated, since connections through websockets change the state of the hub.
+	doLock sync.Mutex
+	// Whether the hub is running without a terminal, in which case it never asks for keyboard
+	// input and gets its env key from `envKey`. See `daemon.go`.
+	headless bool
+	envKey   string
+	control  net.Listener // The control socket, if the hub is running as a daemon.
+	// Watches the files the services are compiled from in live mode. See `watcher.go`.
+	watcher     *watcher
+	watcherLock sync.Mutex
+	// Whether the hub is being used through the REPL, in which case what it says in the
+	// background is shown as a hint below the line being edited, and otherwise waits until
+	// the next prompt.
+	atRepl  bool
+	hint    func(string)
+	waiting strings.Builder
 }
 
 var TheHub *Hub
 
-type mailer = struct {
-	addr   string
-	auth   smtp.Auth
-	sender string
+func (h *Hub) sendMail(to, subject, body string) error {
+	if h.Mailer == nil {
+		return errors.New("mailer has not been configured")
+	}
+	return h.Mailer.Send([]string{to}, makeMessage(h.Mailer.From(), to, subject, body))
 }
 
 func New(path string, out io.Writer) *Hub {
-	h := Hub{
-		Services: make(map[string]*pf.Service),
-		Out:      out,
-	}
+	h := newHub(out)
+	h.OpenHubFolder(path)
+	return h
+}
+
+// Makes a hub which runs without a terminal, and which uses the given key, if any, to open
+// the env store.
+func NewHeadless(path string, out io.Writer, envKey string) *Hub {
+	h := newHub(out)
+	h.headless = true
+	h.envKey = envKey
 	h.OpenHubFolder(path)
+	return h
+}
+
+func newHub(out io.Writer) *Hub {
+	h := Hub{
+		Services:     make(map[string]*pf.Service),
+		failedBuilds: make(map[string]*pf.Service),
+		grpcApis:     make(map[string]grpcApi),
+		Out:          out,
+		terminal:     &Session{addr: "terminal", ers: []*pf.Error{}},
+		metrics:      newMetrics(),
+	}
+	h.session = h.terminal
 	return &h
 }
 
+// The current service of whoever the hub is acting for.
 func (h *Hub) CurrentServiceName() string {
-	cs := h.getSV("currentService")
-	if cs.T == pf.NULL {
-		return ""
-	} else {
-		return cs.V.(string)
-	}
+	return h.session.service
 }
 
 func (h *Hub) hasDatabase() bool {
-	return h.getSV("HUB_DB").V != nil
+	return h.config.Database != nil
+}
+
+// Opens the database given by the config of the hub, or the default SQLite database in the
+// hub folder if there isn't one. See `backend.go`.
+func (h *Hub) openDatabase() error {
+	var err error
+	switch db := h.config.Database.(type) {
+	case *sql.DB:
+		h.Db = db
+	case string:
+		h.Db, err = OpenDatabase(db, filepath.Dir(h.hubFilepath))
+	case nil:
+		h.Db, err = OpenDatabase(DEFAULT_DB, filepath.Dir(h.hubFilepath))
+	default:
+		err = errors.New("the database should be either a `SqlDb` or a URL")
+	}
+	return err
 }
 
 func (h *Hub) hasMailer() bool {
-	return h.getSV("HUB_MAILER").V != nil
+	return h.config.Mailer != nil
 }
 
-func (h *Hub) getMailer() (string, string, string, string, string, string) {
-	mailerStruct := h.getSV("HUB_MAILER").V.([]pf.Value)
-	authStruct := mailerStruct[1].V.([]pf.Value)
-	return mailerStruct[0].V.(string), authStruct[0].V.(string), authStruct[1].V.(string), authStruct[2].V.(string), authStruct[3].V.(string), mailerStruct[2].V.(string)
+// Opens the mailer given by the config of the hub. See `mailer.go`.
+func (h *Hub) openMailer() error {
+	var err error
+	switch m := h.config.Mailer.(type) {
+	case []pf.Value:
+		h.Mailer, err = mailerFromStruct(m)
+	case string:
+		h.Mailer, err = OpenMailer(m, filepath.Dir(h.hubFilepath))
+	default:
+		err = errors.New("the mailer should be either a `Mailer` or a URL")
+	}
+	return err
 }
 
 func (h *Hub) isLive() bool {
@@ -101,11 +184,11 @@ func (h *Hub) setLive(b bool) {
 }
 
 func (h *Hub) setServiceName(name string) {
-	h.setSV("currentService", pf.STRING, name)
+	h.session.service = name
 }
 
 func (h *Hub) makeEmptyServiceCurrent() {
-	h.setSV("currentService", pf.NULL, nil)
+	h.session.service = ""
 }
 
 func (h *Hub) getSV(sv string) pf.Value {
@@ -138,6 +221,8 @@ func (h *Hub) getFonts() values.Map {
 // as an instruction to the os if it begins with '$', and as an expression to be passed to
 // the current service if none of the above hold.
 func (h *Hub) Do(line, username, password, service string, external bool) {
+	h.username = username
+	h.password = password
 
 	// We may be talking to the hub itself.
 	hubWords := strings.Fields(line)
@@ -146,15 +231,21 @@ func (h *Hub) Do(line, username, password, service string, external bool) {
 			h.WriteError("you need to say what you want the hub to do.")
 			return
 		}
-		h.username = username
-		h.password = password
 		h.setSV("$_external", pf.BOOL, external)
+		h.setSV("$_websocket", pf.BOOL, h.socket != nil && h.socket.mayPrompt())
+		isAdmin := !h.administered()
+		if !isAdmin {
+			isAdmin, _ = IsUserAdmin(h.Db, username)
+		}
+		h.setSV("$_admin", pf.BOOL, isAdmin)
 		h.DoHubCommand(strings.Join(hubWords[1:], " "))
 		return
 	}
 
 	// We may be talking to the os
 	if len(hubWords) > 0 && hubWords[0] == "$" {
+		h.lastError = ""
+		defer h.auditShell(line[1:])
 		if h.administered() {
 			isAdmin, err := IsUserAdmin(h.Db, username)
 			if err != nil {
@@ -185,22 +276,14 @@ func (h *Hub) Do(line, username, password, service string, external bool) {
 		return
 	}
 	h.Sources["REPL input"] = []string{line}
-	_, ok := h.Services[service]
-	if !ok {
-		h.WriteError("the hub can't find the service <C>\"" + service + "\"</>.")
-		return
+	if external {
+		h.lastError = ""
+		defer h.auditCall(service, line)
 	}
-	if h.administered() {
-		if !userHasService(h.Db, username, service) {
-			if isAdmin, _ := IsUserAdmin(h.Db, username); !isAdmin {
-				h.WriteError("you have no access to a service named <C>\"" + service + "\"</> on this hub.")
-				return
-			}
-		}
+	serviceToUse, ok := h.serviceFor(username, service)
+	if !ok || !h.mayCall(line, username, service) {
+		return
 	}
-	h.ers = []*err.Error{}
-	h.update(service)
-	serviceToUse, _ := h.Services[service]
 	// Empty/comment-only lines do nothing, but we wait until now to decide that because we *do* want them to
 	// trigger recompilation of code.
 	if match, _ := regexp.MatchString(`^\s*(|\/\/.*)$`, line); match {
@@ -209,7 +292,7 @@ func (h *Hub) Do(line, username, password, service string, external bool) {
 	}
 	// The service may be broken, in which case we'll let the empty service handle the input.
 	if serviceToUse.IsBroken() {
-		serviceToUse = h.Services[""]
+		serviceToUse, _ = h.getService("")
 	}
 
 	// We call the service and get the value.
@@ -217,7 +300,7 @@ func (h *Hub) Do(line, username, password, service string, external bool) {
 
 	errorsExist, _ := serviceToUse.ErrorsExist()
 	if errorsExist { // Any lex-parse-compile errors should end up in the parser of the compiler of the service, returned in p.
-		if h.Services[service].IsBroken() {
+		if sv, _ := h.getService(service); sv.IsBroken() {
 			println("\n")
 		}
 		h.GetAndReportErrors(serviceToUse)
@@ -226,20 +309,67 @@ func (h *Hub) Do(line, username, password, service string, external bool) {
 	h.outputVal(val, serviceToUse, external)
 }
 
+// Finds the service for the user, checking that they have access to it, and recompiling it
+// first in live mode. If it can't, it says why.
+func (h *Hub) serviceFor(username, service string) (*pf.Service, bool) {
+	_, ok := h.getService(service)
+	if !ok {
+		h.WriteError("the hub can't find the service <C>\"" + service + "\"</>.")
+		return nil, false
+	}
+	if h.administered() {
+		if !userHasService(h.Db, username, service) {
+			if isAdmin, _ := IsUserAdmin(h.Db, username); !isAdmin {
+				h.WriteError("you have no access to a service named <C>\"" + service + "\"</> on this hub.")
+				return nil, false
+			}
+		}
+	}
+	h.session.ers = []*err.Error{}
+	h.update(service)
+	serviceToUse, _ := h.getService(service)
+	return serviceToUse, true
+}
+
+// Checks that the user has access to the functions of the service which the line calls, and
+// says so if they don't.
+func (h *Hub) mayCall(line, username, service string) bool {
+	if !h.administered() {
+		return true
+	}
+	function, e := h.forbiddenFunction(username, service, line)
+	if e != nil {
+		h.WriteError(e.Error())
+		return false
+	}
+	if strings.HasPrefix(function, "$_") {
+		h.WriteError("only an administrator may use the service variable <C>" + function + "</>.")
+		return false
+	}
+	if function != "" {
+		h.WriteError("you have no access to the function <C>" + function + "</> of the service <C>\"" + service + "\"</>.")
+		return false
+	}
+	return true
+}
+
 func (h *Hub) outputVal(val values.Value, serviceToUse *pf.Service, external bool) {
 	if val.T == pf.UNSATISFIED_CONDITIONAL {
 		h.WriteError("call returned unsatisfied conditional.")
 		return
 	}
-	if val.T == pf.ERROR && !external {
+	if val.T == pf.ERROR {
+		h.recordError(val.V.(*pf.Error))
+	}
+	if val.T == pf.ERROR && (!external || h.socket != nil) {
 		e := val.V.(*pf.Error)
 		if e.Message == "" {
 			e = err.CreateErr(e.ErrorId, e.Token, e.Args...)
 		}
 		h.WriteString("\n")
-		h.WritePretty("[" + strconv.Itoa(len(h.ers)) + "] " + text.ERROR + e.Message + err.DescribePos(e.Token) + ".")
+		h.WritePretty("[" + strconv.Itoa(len(h.session.ers)) + "] " + text.ERROR + e.Message + err.DescribePos(e.Token) + ".")
 		h.WriteString("\n\n")
-		h.ers = append(h.ers, e)
+		h.session.ers = append(h.session.ers, e)
 		if len(val.V.(*pf.Error).Values) > 0 {
 			h.WritePretty("Values are available with `hub values`.")
 			h.WriteString("\n\n")
@@ -249,12 +379,24 @@ func (h *Hub) outputVal(val values.Value, serviceToUse *pf.Service, external boo
 	}
 }
 
+// Records an error returned by a service, for the metrics and the audit log.
+func (h *Hub) recordError(e *pf.Error) {
+	h.metrics.countError(e.ErrorId)
+	h.lastError = e.Message
+	if h.lastError == "" {
+		h.lastError = err.CreateErr(e.ErrorId, e.Token, e.Args...).Message
+	}
+}
+
 func (h *Hub) update(serviceName string) {
 	if !h.isLive() {
 		return
 	}
-	path, _ := h.Services[serviceName].GetFilepath()
-	h.createService(serviceName, path, false)
+	sv, _ := h.getService(serviceName)
+	path, _ := sv.GetFilepath()
+	if h.createService(serviceName, path, false) {
+		h.metrics.countReload(serviceName)
+	}
 }
 
 func (h *Hub) DoHubCommand(line string) {
@@ -272,28 +414,29 @@ type hubWriter struct {
 }
 
 // Things that only make sense if we have RBAM set up.
-var rbamVerbs = dtypes.SetOf("add", "change-password", "create-group", "forgot-password", "groups",
-	"groups-of-service", "groups-of-user", "let-own", "let-use", "log-off", "log-on",
-	"nuke-account", "nuke-admin", "register", "services of group", "services-of-user", "unadd", "uncreate",
-	"unlet-own", "unlet-use", "unregister", "users-of-service", "users-of-group")
+var rbamVerbs = dtypes.SetOf("add", "audit", "change-password", "create-group", "forgot-password", "groups",
+	"groups-of-service", "groups-of-user", "let-call", "let-own", "let-use", "log-off", "log-on",
+	"nuke-account", "nuke-admin", "register", "reset-password", "services of group", "services-of-user", "unadd", "uncreate",
+	"unlet-call", "unlet-own", "unlet-use", "unregister", "users-of-service", "users-of-group")
 
 // Things you can use if you're logged in to a service with RBAM, but not as admin.
 var greenList = dtypes.SetOf("change-password", "forgot-password", "hub", "log-on", "log-off", "groups",
-	"nuke-account", "register", "services", "switch")
+	"nuke-account", "register", "reset-password", "services", "switch")
 
 func (hw hubWriter) Write(b []byte) (int, error) {
 	bits := strings.Split(string(b), ", ")
 	verb := bits[0]
 	args := bits[1:]
 	h := hw.hub
+	h.lastError = ""
+	defer h.audit(verb, args)
 	// There are commands to the hub that should only have permission if you're an administrator, of course.
-	// But there are also commands like `switch` which only apply to the person using the TUI, and which won't
-	// work if `external` is set.
+	// But there are also commands like `switch` which only apply to the session of the person using them.
 	username := h.username
 	var isAdmin bool
 	var err error
 	if h.administered() {
-		if username == "" && !(verb == "log-on" || verb == "register" || verb == "forgot-password") {
+		if username == "" && !(verb == "log-on" || verb == "register" || verb == "forgot-password" || verb == "reset-password") {
 			h.WriteError("this is an administered hub and you aren't logged on. Please use either " +
 				"`hub register` to register as a guest; `hub forgot password(username, email string)` " +
 				"to replace your password; or `hub sign on` to sign on if you're trying to use the hub on " +
@@ -325,6 +468,8 @@ func (hw hubWriter) Write(b []byte) (int, error) {
 		if err != nil {
 			h.WriteError(err.Error())
 		}
+	case "audit":
+		h.showAudit(args[0], args[1], args[2], args[3])
 	case "api", "wiki":
 		path := args[0]
 		var root string
@@ -361,12 +506,11 @@ func (hw hubWriter) Write(b []byte) (int, error) {
 		if err != nil {
 			h.WriteError(err.Error())
 		} else {
-			if h.getSV("$_external").V.(bool) {
+			h.session.password = args[0]
+			if h.getSV("$_external").V.(bool) && h.socket == nil {
 				h.WritePretty("You have changed your password. Any connections that relied on the old password are " +
 					"now broken, presumably including this one. Please recompile any client services that depended on the old password " +
 					"to make them operative again.")
-			} else {
-				h.TerminalPassword = args[0]
 			}
 		}
 	case "config-admin":
@@ -374,11 +518,13 @@ func (hw hubWriter) Write(b []byte) (int, error) {
 			h.WriteError("this hub is already administered.")
 			break
 		}
-		if !h.hasDatabase() {
-			h.WriteError("database has not been configured: edit the `hub.pf` file of this hub to specify a ")
-			break
+		if h.Db == nil {
+			if err := h.openDatabase(); err != nil {
+				h.WriteError("can't open the database of the hub: " + err.Error())
+				break
+			}
 		}
-		if !h.hasMailer() && !testing.Testing() {
+		if h.Mailer == nil {
 			h.WriteError("mailer has not been configured: edit the `hub.pf` file of this hub to specify a mailer.")
 			break
 		}
@@ -390,10 +536,11 @@ func (hw hubWriter) Write(b []byte) (int, error) {
 			h.WriteError(err.Error())
 			break
 		}
-		h.TerminalUsername = args[0]
-		h.TerminalPassword = args[4]
-		h.WritePretty("You are logged on as <C>" + h.TerminalUsername + "</>.\n")
+		h.session.username = args[0]
+		h.session.password = args[4]
+		h.WritePretty("You are logged on as <C>" + h.session.username + "</>.\n")
 		h.setSV("isAdministered", pf.BOOL, true)
+		h.saveHubFile()
 	case "create-group":
 		err := CreateGroup(h.Db, args[0])
 		if err != nil {
@@ -410,9 +557,11 @@ func (hw hubWriter) Write(b []byte) (int, error) {
 			os.WriteFile(filepath.Join(settings.PipefishHomeDirectory, args[3]), []byte(dump), 0666)
 		}
 	case "env":
-		// $_env has been updated by hub.pf. This is called by both `env` and `delete env`.
+		// $_env or scopedEnv has been updated by hub.pf. This is called by both `env` and `delete env`.
 		env, _ := h.Services["hub"].GetVariable("$_env")
 		h.store = env.V.(values.Map)
+		scoped, _ := h.Services["hub"].GetVariable("scopedEnv")
+		h.scopedStore = scoped.V.(values.Map)
 		h.SaveAndPropagateHubStore()
 	case "env-key":
 		cur := args[0]
@@ -427,28 +576,14 @@ func (hw hubWriter) Write(b []byte) (int, error) {
 		r, _ := h.Services[h.CurrentServiceName()].GetErrorReport()
 		h.WritePretty(r)
 	case "forgot-password":
-		err := ValidateEmail(h.Db, args[0], args[1])
-		if err != nil {
-			h.WriteError(err.Error())
-		} else {
-			newPassword := MakePassword()
-			ChangePassword(h.Db, args[0], newPassword)
-			msg := `Subject: Replacement password for ` + args[0] + "\n" +
-				`From: Pipefish mailer (do not reply)
-
-Your replacement password for your account ` + args[0] + ` is ` + newPassword + ".\n\nYou should change this as soon as possible to a new password of your choosing."
-			var err error
-			if !testing.Testing() {
-				err = smtp.SendMail(h.mailData.addr, h.mailData.auth, h.mailData.sender, []string{args[1]}, []byte(msg))
-			}
-			if err != nil {
-				h.WriteError(err.Error())
-			} else {
-				h.WritePretty("An email with a replacement password has been sent to <C>" + args[1] + "</>.")
-			}
+		if err := h.forgotPassword(args[0], args[1]); err != nil {
+			h.lastError = err.Error() // For the audit log only. See `reset.go`.
 		}
+		h.WritePretty("If that is the email address of <C>" + args[0] + "</>, a reset token has been sent to it.")
 	case "fork-hub":
 		h.copyAndOpenHubFile(filepath.Dir(h.hubFilepath), args[0])
+	case "graph":
+		h.showGraph(args[0])
 	case "groups":
 		result, err := GetGroupsOfUser(h.Db, username, true)
 		if err != nil {
@@ -483,23 +618,52 @@ Your replacement password for your account ` + args[0] + ` is ` + newPassword +
 			h.WriteError("the hub doesn't know what you want to halt.")
 			break
 		}
-		delete(h.Services, name)
+		h.deleteService(name)
 		if name == h.CurrentServiceName() {
 			h.makeEmptyServiceCurrent()
 		}
 	case "help":
 		h.WriteError("the `hub help` command is temporarily deprecated.")
 	case "http":
+		if err := h.StartHttp([]string{args[0]}, false); err != nil {
+			h.WriteError(err.Error())
+			break
+		}
+		h.WriteString(GREEN_OK)
+	case "http-stop":
+		timeout := DRAIN_TIMEOUT
+		if args[0] != "" {
+			seconds, _ := strconv.Atoi(args[0])
+			timeout = time.Duration(seconds) * time.Second
+		}
+		if !h.listening() {
+			h.WriteError("the hub isn't listening to HTTP.")
+			break
+		}
+		h.reportDrain(h.StopHttp(timeout), timeout)
 		h.WriteString(GREEN_OK)
-		go h.StartHttp([]string{args[0]}, false)
 	case "https":
 		if len(args) == 0 {
 			h.WriteError("list of domain names cannot be empty.")
+			break
+		}
+		if err := h.StartHttp(args, true); err != nil {
+			h.WriteError(err.Error())
+			break
 		}
 		h.WriteString(GREEN_OK)
-		go h.StartHttp(args, true)
 	case "hub":
 		h.WritePretty("Hub is <C>\"" + filepath.Base(filepath.Dir(h.hubFilepath)) + "\"</>.")
+	case "let-call":
+		service, function, ok := splitFunctionName(args[1])
+		if !ok {
+			h.WriteError("the function should be given in the form <C>service.function</>.")
+			break
+		}
+		err = LetGroupCallFunction(h.Db, args[0], service, function)
+		if err != nil {
+			h.WriteError(err.Error())
+		}
 	case "let-own":
 		var inGroup bool
 		inGroup, err = IsUserInGroup(h.Db, args[0], args[1])
@@ -524,8 +688,12 @@ Your replacement password for your account ` + args[0] + ` is ` + newPassword +
 		}
 	case "live-on":
 		h.setLive(true)
+		if err := h.startWatching(); err != nil {
+			h.WriteError("can't watch the files of the services: " + err.Error())
+		}
 	case "live-off":
 		h.setLive(false)
+		h.stopWatching()
 	case "log-on":
 		err := ValidateUser(h.Db, args[0], args[1])
 		if err != nil {
@@ -533,13 +701,13 @@ Your replacement password for your account ` + args[0] + ` is ` + newPassword +
 			h.WriteString("Please try again.\n\n")
 			break
 		}
-		h.TerminalUsername = args[0]
-		h.TerminalPassword = args[1]
+		h.session.username = args[0]
+		h.session.password = args[1]
 		h.makeEmptyServiceCurrent()
-		h.WritePretty("You are logged on as <C>" + h.TerminalUsername + "</>.\n")
+		h.WritePretty("You are logged on as <C>" + h.session.username + "</>.\n")
 	case "log-off":
-		h.TerminalUsername = ""
-		h.TerminalPassword = ""
+		h.session.username = ""
+		h.session.password = ""
 		h.makeEmptyServiceCurrent()
 		h.WritePretty("<G>OK</>")
 		h.WriteString("\n\n" + strings.Repeat("┈", hw.hub.getSV("width").V.(int)) + "\n\n")
@@ -555,25 +723,24 @@ Your replacement password for your account ` + args[0] + ` is ` + newPassword +
 		if err != nil {
 			h.WriteError(err.Error())
 		}
-		if username == h.TerminalUsername {
-			h.TerminalUsername = ""
-			h.TerminalPassword = ""
-			h.setServiceName("")
-		}
+		h.signOff(func(s *Session) bool { return s.username == username })
 	case "nuke-admin":
 		DropTables(h.Db)
 		h.setSV("isAdministered", pf.BOOL, false)
-		h.TerminalUsername = ""
-		h.TerminalPassword = ""
-		h.setServiceName("")
+		h.saveHubFile()
+		h.signOff(func(s *Session) bool { return true })
 	case "nuke-env":
 		h.storekey = ""
 		h.store = values.Map{}
+		h.scopedStore = values.Map{}
+		h.setSV("scopedEnv", pf.MAP, h.scopedStore)
 		h.SaveAndPropagateHubStore()
 	case "open-hub":
 		h.OpenHubFolder(args[0])
 	case "quit":
 		h.Quit()
+	case "reload-config":
+		h.reloadConfig()
 	case "register":
 		if invalid(args) {
 			break
@@ -588,9 +755,9 @@ Your replacement password for your account ` + args[0] + ` is ` + newPassword +
 			h.WriteError(err.Error())
 			break
 		}
-		h.TerminalUsername = args[0]
-		h.TerminalPassword = args[4]
-		h.WritePretty("You are logged on as <C>" + h.TerminalUsername + "</>.\n")
+		h.session.username = args[0]
+		h.session.password = args[4]
+		h.WritePretty("You are logged on as <C>" + h.session.username + "</>.\n")
 	case "reset":
 		serviceToReset, ok := h.Services[h.CurrentServiceName()]
 		if !ok {
@@ -603,6 +770,13 @@ Your replacement password for your account ` + args[0] + ` is ` + newPassword +
 		h.WritePretty("Restarting script <C>\"" + filepath +
 			"\"</> as service <C>\"" + h.CurrentServiceName() + "\"</>.\n")
 		h.createService(h.CurrentServiceName(), filepath, true)
+	case "reset-password":
+		username, err := h.resetPassword(args[0], args[1])
+		if err != nil {
+			h.WriteError(err.Error())
+			break
+		}
+		h.WritePretty("The password of <C>" + username + "</> has been changed.")
 	case "run":
 		fname := args[0]
 		sname := args[1]
@@ -653,6 +827,8 @@ Your replacement password for your account ` + args[0] + ` is ` + newPassword +
 		} else {
 			h.WritePretty(result)
 		}
+	case "stats":
+		h.showStats()
 	case "switch":
 		sname := args[0]
 		if h.administered() && !isAdmin && !userHasService(h.Db, username, sname) {
@@ -674,15 +850,15 @@ Your replacement password for your account ` + args[0] + ` is ` + newPassword +
 			h.WriteError("although you have permissions to use a service called <C>" + sname + "</> on this hub, it's not currently running any service of that name.")
 		}
 	case "trace":
-		if len(h.ers) == 0 {
+		if len(h.session.ers) == 0 {
 			h.WriteError("there are no recent errors.")
 			break
 		}
-		if len(h.ers[0].Trace) == 0 {
+		if len(h.session.ers[0].Trace) == 0 {
 			h.WriteError("not a runtime error.")
 			break
 		}
-		h.WritePretty(pf.GetTraceReport(h.ers[0]))
+		h.WritePretty(pf.GetTraceReport(h.session.ers[0]))
 	case "log":
 		tracking, _ := h.Services[h.CurrentServiceName()].GetTrackingReport()
 		h.WritePretty(tracking)
@@ -696,6 +872,16 @@ Your replacement password for your account ` + args[0] + ` is ` + newPassword +
 		if err != nil {
 			h.WriteError(err.Error())
 		}
+	case "unlet-call":
+		service, function, ok := splitFunctionName(args[1])
+		if !ok {
+			h.WriteError("the function should be given in the form <C>service.function</>.")
+			break
+		}
+		err = UnLetGroupCallFunction(h.Db, args[0], service, function)
+		if err != nil {
+			h.WriteError(err.Error())
+		}
 	case "unlet-use":
 		err = UnLetGroupUseService(h.Db, args[0], args[1])
 		if err != nil {
@@ -736,14 +922,14 @@ Your replacement password for your account ` + args[0] + ` is ` + newPassword +
 			h.WritePretty(result)
 		}
 	case "values":
-		if len(h.ers) == 0 {
+		if len(h.session.ers) == 0 {
 			h.WriteError("there are no recent errors.")
 			break
 		}
 		// Usually a runtime error will be the only error, and so necessarily the last one. But also, a runtime error
 		// can arise when we're livecoding and we get compilation errors but also a runtime error from whatever we put
 		// into the REPL.
-		lastError := h.ers[len(h.ers)-1]
+		lastError := h.session.ers[len(h.session.ers)-1]
 		if lastError.Values == nil {
 			h.WriteError("no values were passed.")
 			break
@@ -772,17 +958,17 @@ Your replacement password for your account ` + args[0] + ` is ` + newPassword +
 			h.WriteError("the `where` keyword can't take a negative number as a parameter.")
 			break
 		}
-		if num >= len(h.ers) {
+		if num >= len(h.session.ers) {
 			h.WriteError("there aren't that many errors.")
 			break
 		}
 		println()
-		if h.ers[num].Token.Line <= 0 {
+		if h.session.ers[num].Token.Line <= 0 {
 			h.WriteError("line number is not available.")
 		}
-		line := h.Sources[h.ers[num].Token.Source][h.ers[num].Token.Line-1] + "\n"
-		startUnderline := h.ers[num].Token.ChStart
-		lenUnderline := h.ers[num].Token.ChEnd - startUnderline
+		line := h.Sources[h.session.ers[num].Token.Source][h.session.ers[num].Token.Line-1] + "\n"
+		startUnderline := h.session.ers[num].Token.ChStart
+		lenUnderline := h.session.ers[num].Token.ChEnd - startUnderline
 		if lenUnderline == 0 {
 			lenUnderline = 1
 		}
@@ -795,16 +981,16 @@ Your replacement password for your account ` + args[0] + ` is ` + newPassword +
 	case "why":
 		h.WriteString("\n")
 		num, _ := strconv.Atoi(args[0])
-		if num >= len(h.ers) {
+		if num >= len(h.session.ers) {
 			h.WriteError("there aren't that many errors.")
 			break
 		}
-		exp, _ := pf.ExplainError(h.ers, num)
-		h.WritePretty("<R>Error</>: " + h.ers[num].Message + ".")
+		exp, _ := pf.ExplainError(h.session.ers, num)
+		h.WritePretty("<R>Error</>: " + h.session.ers[num].Message + ".")
 		h.WriteString("\n\n")
 		h.WritePretty(exp)
 		h.WriteString("\n\n")
-		refLine := h.GetPretty("Error has reference `\"" + h.ers[num].ErrorId + "\"`.")
+		refLine := h.GetPretty("Error has reference `\"" + h.session.ers[num].ErrorId + "\"`.")
 		padding := strings.Repeat(" ", h.getSV("width").V.(int)-len(text.StripColors(refLine))-2)
 		h.WriteString(padding)
 		h.WritePretty(refLine)
@@ -830,12 +1016,31 @@ func (h *Hub) makeWriter() io.Writer {
 	}
 }
 
+// The caller should hold the `doLock`, which is released while we wait for the requests in
+// progress to finish, since they may be waiting for it.
 func (h *Hub) Quit() {
+	drained := h.StopHttp(DRAIN_TIMEOUT)
+	if h.control != nil {
+		h.control.Close()
+	}
+	h.stopWatching()
 	h.saveHubFile()
 	h.WriteString(GREEN_OK + "\n" + text.Logo() + "Thank you for using Pipefish. Have a nice day!\n\n")
-	if !testing.Testing() {
-		os.Exit(0)
+	if testing.Testing() {
+		return
 	}
+	// If we're being told to quit by a remote user, we can't wait for their own request to finish
+	// before we go, and so we wait in the background and let it.
+	if external, _ := h.getSV("$_external").V.(bool); external {
+		go func() {
+			<-drained
+			os.Exit(0)
+		}()
+		return
+	}
+	h.doLock.Unlock()
+	<-drained
+	os.Exit(0)
 }
 
 func (h *Hub) WritePretty(s string) {
@@ -855,6 +1060,7 @@ func (h *Hub) GetPretty(s string) string {
 }
 
 func (h *Hub) WriteError(s string) {
+	h.lastError = s
 	h.WriteString("\n")
 	h.WritePretty(HUB_ERROR + s)
 	h.WriteString("\n\n")
@@ -872,7 +1078,7 @@ func (h *Hub) tryMain() { // Guardedly tries to run the `main` command.
 		case pf.ERROR:
 			h.WritePretty("\n[0] " + valToString(h.Services[h.CurrentServiceName()], val))
 			h.WriteString("\n")
-			h.ers = []*pf.Error{val.V.(*pf.Error)}
+			h.session.ers = []*pf.Error{val.V.(*pf.Error)}
 		case pf.UNDEFINED_TYPE: // Which is what we get back if there is no `main` command.
 		default:
 			h.WriteString(valToString(h.Services[h.CurrentServiceName()], val))
@@ -881,13 +1087,19 @@ func (h *Hub) tryMain() { // Guardedly tries to run the `main` command.
 }
 
 func (h *Hub) serviceNeedsUpdate(name string) bool {
-	serviceToUpdate, present := h.Services[name]
+	serviceToUpdate, present := h.getService(name)
 	if !present {
 		return true
 	}
 	if name == "" {
 		return false
 	}
+	// If it's failed to compile since, what matters is whether it's been changed since then.
+	h.servicesLock.RLock()
+	if failed, ok := h.failedBuilds[name]; ok {
+		serviceToUpdate = failed
+	}
+	h.servicesLock.RUnlock()
 	needsUpdate, err := serviceToUpdate.NeedsUpdate()
 	if err != nil {
 		h.WriteError(err.Error())
@@ -901,12 +1113,53 @@ func (h *Hub) createService(name, scriptFilepath string, forceUpdate bool) bool
 	if !needsRebuild {
 		return false
 	}
-	newService := pf.NewService()
-	newService.SetLocalExternalServices(h.Services)
+	ok := h.buildService(name, scriptFilepath, !forceUpdate)
+	h.watchServices()
+	return ok
+}
+
+// Compiles the service, and if it compiles, replaces the old version of it. If it doesn't, and
+// `keepOld` is true, the old version goes on running if it compiled.
+func (h *Hub) buildService(name, scriptFilepath string, keepOld bool) bool {
+	b := h.prepareBuild(name, scriptFilepath)
+	b.compile()
+	return h.installBuild(b, keepOld)
+}
+
+// A service being compiled, and what it's being compiled with. This lets the watcher compile a
+// service without holding the `doLock`, which it only needs to install it: see `watcher.go`.
+type build struct {
+	name, path string
+	service    *pf.Service
+	externals  map[string]*pf.Service
+	env        values.Map
+	err        error // We get an error only if it completely fails to open the file, otherwise there'll be errors in the Common Parser Bindle as usual.
+}
+
+// Gets what's needed to compile the service from the hub. The caller should hold the `doLock`.
+func (h *Hub) prepareBuild(name, scriptFilepath string) *build {
 	if text.Head(scriptFilepath, "!") {
 		scriptFilepath = filepath.Join(settings.PipefishHomeDirectory, scriptFilepath[1:])
 	}
-	e := newService.InitializeFromFilepathWithStore(scriptFilepath, h.store) // We get an error only if it completely fails to open the file, otherwise there'll be errors in the Common Parser Bindle as usual.
+	// The new service is compiled while requests go on being served by the old one, if there
+	// is one, and so it gets a copy of the map of services to add any services it starts to.
+	b := &build{name: name, path: scriptFilepath, service: pf.NewService(), externals: h.servicesSnapshot(), env: h.envOf(name)}
+	if name == "hub" {
+		b.env = h.store
+	}
+	return b
+}
+
+// This doesn't touch the hub, and so needs no lock.
+func (b *build) compile() {
+	b.service.SetLocalExternalServices(b.externals)
+	b.err = b.service.InitializeFromFilepathWithStore(b.path, b.env)
+}
+
+// Replaces the old version of the service with the new one if it compiled, and reports on it
+// if it didn't. The caller should hold the `doLock`.
+func (h *Hub) installBuild(b *build, keepOld bool) bool {
+	name, scriptFilepath, newService, e := b.name, b.path, b.service, b.err
 	h.Sources, _ = newService.GetSources()
 	if newService.IsBroken() {
 		if name == "hub" {
@@ -928,8 +1181,16 @@ func (h *Hub) createService(name, scriptFilepath string, forceUpdate bool) bool
 			h.Sources = map[string][]string{}
 			h.makeEmptyServiceCurrent()
 		} else {
-			h.Services[name] = newService
 			h.GetAndReportErrors(newService)
+			// If we were recompiling a working service, it goes on working.
+			if old, ok := h.getService(name); ok && !old.IsBroken() && keepOld {
+				h.servicesLock.Lock()
+				h.failedBuilds[name] = newService
+				h.servicesLock.Unlock()
+				h.WritePretty("The service <C>\"" + name + "\"</> will go on running the last version which compiled.")
+				return false
+			}
+			h.replaceService(name, newService, b.externals)
 		}
 		if name == "hub" {
 			os.Exit(2)
@@ -939,10 +1200,47 @@ func (h *Hub) createService(name, scriptFilepath string, forceUpdate bool) bool
 	if testing.Testing() {
 		newService.SetOutHandler(newService.MakeLiteralOutHandler(h.Out))
 	}
-	h.Services[name] = newService
+	newService.SetMailHandler(h.Mailer)
+	h.replaceService(name, newService, b.externals)
 	return true
 }
 
+// Requests get their service from the map once, and so any request which has started on the
+// old version of a service will finish on it, while new requests go to the new one.
+func (h *Hub) replaceService(name string, sv *pf.Service, externals map[string]*pf.Service) {
+	h.servicesLock.Lock()
+	defer h.servicesLock.Unlock()
+	for k, v := range externals {
+		if _, ok := h.Services[k]; !ok {
+			v.SetCountInstructions(h.metricsEnabled())
+			h.Services[k] = v
+		}
+	}
+	sv.SetCountInstructions(h.metricsEnabled())
+	h.Services[name] = sv
+	delete(h.failedBuilds, name)
+}
+
+func (h *Hub) getService(name string) (*pf.Service, bool) {
+	h.servicesLock.RLock()
+	defer h.servicesLock.RUnlock()
+	sv, ok := h.Services[name]
+	return sv, ok
+}
+
+func (h *Hub) deleteService(name string) {
+	h.servicesLock.Lock()
+	defer h.servicesLock.Unlock()
+	delete(h.Services, name)
+	delete(h.failedBuilds, name)
+}
+
+func (h *Hub) servicesSnapshot() map[string]*pf.Service {
+	h.servicesLock.RLock()
+	defer h.servicesLock.RUnlock()
+	return maps.Clone(h.Services)
+}
+
 func StartServiceFromCli() {
 	if len(os.Args) != 3 {
 		println("Wrong number of argumetns for `run`.")
@@ -998,7 +1296,13 @@ func GetWiki() {
 }
 
 func (h *Hub) GetAndReportErrors(sv *pf.Service) {
-	h.ers = sv.GetErrors()
+	h.session.ers = sv.GetErrors()
+	for _, e := range h.session.ers {
+		h.metrics.countError(e.ErrorId)
+	}
+	if len(h.session.ers) > 0 {
+		h.lastError = h.session.ers[0].Message
+	}
 	r, _ := sv.GetErrorReport()
 	h.WritePretty(r)
 }
@@ -1032,18 +1336,13 @@ func (h *Hub) saveHubFile() string {
 	}
 	buf.WriteString(")\n\n")
 	buf.WriteString("currentService string? = ")
-	csV := h.getSV("currentService")
-	if csV.T == values.NULL {
+	cs := h.terminal.service // It's the terminal's current service that we want to see next time we open the hub.
+	if len(cs) == 0 || cs[0] == '#' {
 		buf.WriteString("NULL")
 	} else {
-		cs := csV.V.(string)
-		if len(cs) == 0 || cs[0] == '#' {
-			buf.WriteString("NULL")
-		} else {
-			buf.WriteString("`")
-			buf.WriteString(cs)
-			buf.WriteString("`")
-		}
+		buf.WriteString("`")
+		buf.WriteString(cs)
+		buf.WriteString("`")
 	}
 	buf.WriteString("\n\n")
 	buf.WriteString("isLive = ")
@@ -1067,7 +1366,7 @@ func (h *Hub) saveHubFile() string {
 	}
 	defer f.Close()
 	f.WriteString(buf.String())
-	if !testing.Testing() {
+	if !testing.Testing() && !h.headless { // A daemon doesn't change which hub the TUI opens.
 		os.WriteFile(filepath.Join(settings.PipefishHomeDirectory, "user/hub.dat"), []byte(filepath.Dir(h.hubFilepath)), 0755)
 	}
 	return GREEN_OK
@@ -1088,6 +1387,9 @@ func (h *Hub) copyAndOpenHubFile(fromDirectory, toDirectory string) {
 	}
 	entries, _ := os.ReadDir(fromDirectory)
 	for _, entry := range entries {
+		if !entry.Type().IsRegular() { // E.g. the control socket of a daemon.
+			continue
+		}
 		fromFile := filepath.Join(fromDirectory, entry.Name())
 		toFile := filepath.Join(toDirectory, entry.Name())
 		err = CopyFile(fromFile, toFile)
@@ -1123,86 +1425,78 @@ func (h *Hub) OpenHubFolder(hubFolder string) {
 	}
 	hubFilepath := filepath.Join(hubFolder, "hub.hub")
 	h.Services = map[string]*pf.Service{}
-	h.ers = []*pf.Error{}
+	h.session.ers = []*pf.Error{}
+	h.sessions = map[string]*Session{}
 	h.Sources = map[string][]string{}
+	h.reportDrain(h.StopHttp(DRAIN_TIMEOUT), DRAIN_TIMEOUT)
+	h.stopWatching()
 	h.Db = nil
-	h.mailData = mailer{}
-	h.listeningToHttpOrHttps = false
+	h.Mailer = nil
 	h.store = values.Map{}
+	h.scopedStore = values.Map{}
 	h.storekey = ""
 	h.createService("", "", true)
 	h.createService("hub", hubFilepath, true)
-	storePath := hubFilepath[0:len(hubFilepath)-len(filepath.Ext(hubFilepath))] + ".env"
-	_, err := os.Stat(storePath)
-	if err == nil {
-		file, err := os.Open(storePath)
-		if err != nil {
-			panic("Can't open hub `$_env` data.")
-		}
-		b, err := io.ReadAll(file)
-		if err != nil {
-			panic("Can't open hub `$_env` data.")
-		}
-		s := string(b)
-		for ; s != "" && !text.Head(s, "PLAINTEXT"); h.WritePretty("Invalid `env` key. Enter a valid one or press return to continue without loading the store.") {
-			salt := s[0:32]
-			ciphertext := s[32:]
-			rline := readline.NewInstance()
-			rline.SetPrompt("Enter the env key for the hub: ")
-			rline.PasswordMask = '▪'
-			storekey := "Default key for testing."
-			if !testing.Testing() {
-				storekey, _ = rline.Readline()
-			}
-			if storekey == "" {
-				println("Starting hub without opening env data.")
-				s = "PLAINTEXT"
-				break
-			}
-			key := pbkdf2.Key([]byte(storekey), []byte(salt), 65536, 32, sha256.New) // sha256 has nothing to do with it but the API is stupid.
-			block, err := aes.NewCipher(key)
-			if err != nil {
-				panic(err)
-			}
-			iv := ciphertext[:aes.BlockSize]
-			ciphertext = ciphertext[aes.BlockSize:]
-			mode := cipher.NewCBCDecrypter(block, []byte(iv))
-			decrypt := make([]byte, len(ciphertext))
-			mode.CryptBlocks(decrypt, []byte(ciphertext))
-			if string(decrypt[0:9]) == "PLAINTEXT" {
-				s = string(decrypt)
-				h.storekey = storekey
-				break
-			}
-		}
-		bits := strings.Split(strings.TrimSpace(s), "\n")[1:]
-		for _, bit := range bits {
-			pair, _ := h.Services["hub"].Do(bit)
-			h.store = h.store.Set(pair.V.([]pf.Value)[0], pair.V.([]pf.Value)[1])
-		}
+	if cs := h.getSV("currentService"); cs.T == pf.STRING {
+		h.terminal.service = cs.V.(string)
 	}
+	h.loadStore(hubFilepath[0:len(hubFilepath)-len(filepath.Ext(hubFilepath))] + ".env")
 	hubService := h.Services["hub"]
 	h.hubFilepath = h.MakeFilepath(hubFilepath)
 	v, _ := hubService.GetVariable("allServices")
 	services := v.V.(pf.Map).AsSlice()
-
-	if h.hasDatabase() {
-		h.Db = h.getSV("HUB_DB").V.(*sql.DB)
-
+	config, errs := readConfig(hubService, hubFolder)
+	h.badConfig = len(errs) > 0
+	if h.badConfig {
+		// Rather than guess at what the config meant, e.g. by opening the default database when
+		// the one it gives is invalid, we leave out everything but the services and the display.
+		h.writeConfigErrors(errs)
+		h.WriteError("the hub won't open its database or mailer, or listen to HTTP, until its config is fixed and reloaded with <C>hub reload config</>.")
+		config = Config{Services: config.Services, Limits: DEFAULT_LIMITS, Theme: config.Theme, Width: config.Width}
+	}
+	h.config = config
+	h.applyDisplayConfig()
+	h.countInstructions()
+
+	if !h.badConfig && (h.hasDatabase() || h.administered()) {
+		err := h.openDatabase()
+		if err == nil && h.administered() {
+			err = Migrate(h.Db)
+		}
+		if err != nil {
+			h.WriteError("can't open the database of the hub: " + err.Error())
+		}
 	}
 
 	if h.hasMailer() {
-		addr, identity, username, password, host, sender := h.getMailer()
-		h.mailData = mailer{addr, smtp.PlainAuth(identity, username, password, host), sender}
+		err := h.openMailer()
+		if err != nil {
+			h.WriteError("can't open the mailer of the hub: " + err.Error())
+		}
+		hubService.SetMailHandler(h.Mailer)
 	}
 
-	errors := false
+	h.limiter = newLimiter(config.Limits)
+
+	// The services the config gives come first, and then the others which were running when
+	// the hub was last closed, except that each is started after the services it depends on.
+	serviceFilepaths := map[string]string{}
+	serviceNames := sortedKeys(config.Services)
+	for name, path := range config.Services {
+		serviceFilepaths[name] = path
+	}
 	for _, pair := range services {
 		serviceName := pair.Key.V.(string)
-		serviceFilepath := pair.Val.V.(string)
-		if serviceName == "" || serviceName == "hub" {
-			continue
+		if _, ok := serviceFilepaths[serviceName]; !ok && serviceName != "" && serviceName != "hub" {
+			serviceFilepaths[serviceName] = pair.Val.V.(string)
+			serviceNames = append(serviceNames, serviceName)
 		}
+	}
+	serviceNames, cycles := startupOrder(dependencyGraph(serviceNames, serviceFilepaths))
+	h.writeCycles(cycles)
+	errors := false
+	for _, serviceName := range serviceNames {
+		serviceFilepath := serviceFilepaths[serviceName]
 		h.createService(serviceName, serviceFilepath, true)
 		errorsExist, _ := h.Services[serviceName].ErrorsExist()
 		if errorsExist {
@@ -1215,21 +1509,19 @@ func (h *Hub) OpenHubFolder(hubFolder string) {
 	hubService = h.Services["hub"] // TODO
 	ty, _ := hubService.TypeNameToType("Hub")
 	hubService.SetVariable("HUB", ty, h.makeWriter())
+	if err := h.listenAsConfigured(); err != nil {
+		h.WriteError(err.Error())
+	}
+	if h.isLive() {
+		if err := h.startWatching(); err != nil {
+			h.WriteError("can't watch the files of the services: " + err.Error())
+		}
+	}
 	if !testing.Testing() {
 		h.list()
 	}
 }
 
-func (h *Hub) SaveAndPropagateHubStore() {
-	for _, srv := range h.Services {
-		srv.SetEnv(h.store)
-	}
-	storePath := h.hubFilepath[0:len(h.hubFilepath)-len(filepath.Ext(h.hubFilepath))] + ".env"
-	storeDump := h.Services["hub"].WriteSecret(h.store, h.storekey)
-	file, _ := os.Create(storePath)
-	file.WriteString(storeDump)
-}
-
 func (h *Hub) list() {
 	if len(h.Services) == 2 { // TODO.
 		h.WriteString("No services are running on this hub.\n\n")
@@ -1259,60 +1551,283 @@ func valToString(srv *pf.Service, val pf.Value) string {
 	return srv.ToLiteral(val)
 }
 
-func (h *Hub) StartHttp(args []string, isHttps bool) {
-	// TODO --- everything that depends on this should depend on something else.
-	h.listeningToHttpOrHttps = true
+// How long `hub http stop` waits for the requests in progress to finish before cutting them off.
+var DRAIN_TIMEOUT = 30 * time.Second
+
+// Starts serving the hub over HTTP on the given port, or over HTTPS for the given domains.
+// We bind the port before returning, so that if it's taken we can say so, and so that the
+// hub can be called as soon as it says it's listening.
+func (h *Hub) StartHttp(args []string, isHttps bool) error {
+	if h.listening() {
+		return errors.New("the hub is already listening to HTTP")
+	}
+	var listener net.Listener
+	var redirect *http.Server
 	var err error
-	http.HandleFunc("/", h.handleJsonRequest)
 	if isHttps {
-		handler := http.NewServeMux()
-		err = certmagic.HTTPS(args, handler)
+		listener, redirect, err = listenHttps(args)
 	} else {
-		err = http.ListenAndServe(":"+args[0], nil)
+		listener, err = net.Listen("tcp", ":"+args[0])
 	}
-	if errors.Is(err, http.ErrServerClosed) {
-		h.WriteError("server closed.")
-	} else { // err is always non-nil.
-		h.WriteError("error starting server: " + err.Error())
-		return
+	if err != nil {
+		return errors.New("error starting server: " + err.Error())
+	}
+	server := &http.Server{Handler: h.HttpHandler(), Protocols: httpProtocols()}
+	server.RegisterOnShutdown(h.closeSockets)
+	h.serverLock.Lock()
+	h.server = server
+	h.redirect = redirect
+	// TODO --- everything that depends on this should depend on something else.
+	h.listeningToHttpOrHttps = true
+	h.serverLock.Unlock()
+	go func() {
+		err := server.Serve(listener)
+		if !errors.Is(err, http.ErrServerClosed) {
+			h.WriteError("error serving HTTP: " + err.Error())
+		}
+	}()
+	return nil
+}
+
+// Gets certificates for the domains and listens to HTTPS on port 443, as `certmagic.HTTPS` does,
+// but leaves the serving to us so that we can stop gracefully. Like `certmagic.HTTPS`, it also
+// serves port 80, answering the ACME HTTP challenge, by which certificates are renewed, and
+// redirecting everything else to HTTPS.
+func listenHttps(domains []string) (net.Listener, *http.Server, error) {
+	certmagic.DefaultACME.Agreed = true
+	cfg := certmagic.NewDefault()
+	if err := cfg.ManageSync(context.Background(), domains); err != nil {
+		return nil, nil, err
+	}
+	httpListener, err := net.Listen("tcp", ":"+strconv.Itoa(certmagic.HTTPPort))
+	if err != nil {
+		return nil, nil, err
 	}
+	tlsConfig := cfg.TLSConfig()
+	tlsConfig.NextProtos = append([]string{"h2", "http/1.1"}, tlsConfig.NextProtos...)
+	listener, err := tls.Listen("tcp", ":"+strconv.Itoa(certmagic.HTTPSPort), tlsConfig)
+	if err != nil {
+		httpListener.Close()
+		return nil, nil, err
+	}
+	var handler http.Handler = http.HandlerFunc(redirectToHttps)
+	if acme, ok := cfg.Issuers[0].(*certmagic.ACMEIssuer); ok {
+		handler = acme.HTTPChallengeHandler(handler)
+	}
+	redirect := &http.Server{Handler: handler, ReadHeaderTimeout: 5 * time.Second, IdleTimeout: 5 * time.Second}
+	go redirect.Serve(httpListener)
+	return listener, redirect, nil
+}
+
+func redirectToHttps(w http.ResponseWriter, r *http.Request) {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	w.Header().Set("Connection", "close")
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+}
+
+// Stops listening, and returns a channel which is sent nil once the requests in progress have
+// finished, or an error if they haven't by the timeout, in which case their connections are
+// closed. If the hub wasn't listening, the channel is sent nil at once.
+//
+// The requests may be waiting for the `doLock`, so whoever holds it mustn't wait on the channel
+// without releasing it.
+func (h *Hub) StopHttp(timeout time.Duration) <-chan error {
+	drained := make(chan error, 1)
+	h.serverLock.Lock()
+	server, redirect := h.server, h.redirect
+	h.server, h.redirect = nil, nil
+	h.listeningToHttpOrHttps = false
+	h.serverLock.Unlock()
+	if server == nil {
+		drained <- nil
+		return drained
+	}
+	if redirect != nil {
+		redirect.Close()
+	}
+	// The server calls this once it's stopped listening, so that we can return knowing that the
+	// port is free.
+	stoppedListening := make(chan struct{})
+	server.RegisterOnShutdown(func() { close(stoppedListening) })
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		err := server.Shutdown(ctx)
+		if err != nil {
+			server.Close()
+		}
+		drained <- err
+	}()
+	<-stoppedListening
+	return drained
+}
+
+// Says, once the requests in progress when the hub stopped listening have finished, if they had
+// to be cut off.
+func (h *Hub) reportDrain(drained <-chan error, timeout time.Duration) {
+	go func() {
+		if err := <-drained; err != nil {
+			h.doLock.Lock()
+			defer h.doLock.Unlock()
+			h.WriteError("requests were still in progress after " + timeout.String() + " and have been cut off.")
+		}
+	}()
+}
+
+func (h *Hub) listening() bool {
+	h.serverLock.Lock()
+	defer h.serverLock.Unlock()
+	return h.server != nil
+}
+
+// This returns the handler which serves the hub over HTTP or HTTPS: JSON requests go to
+// the root, gRPC requests to the paths of their methods (see `grpc.go`), and interactive
+// sessions are served by websocket at `/ws`.
+func (h *Hub) HttpHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if isGrpc(r) {
+			h.handleGrpc(w, r)
+			return
+		}
+		h.handleJsonRequest(w, r)
+	})
+	mux.HandleFunc("/forgot-password", h.handleForgotPassword)
+	mux.HandleFunc("/reset-password", h.handleResetPassword)
+	mux.HandleFunc("/metrics", h.handleMetrics)
+	mux.Handle("/ws", websocket.Server{Handler: h.handleWebsocket, Handshake: checkOrigin})
+	return h.limitRequests(mux)
 }
 
 // The hub expects an HTTP request to consist of JSON containing the line to be executed,
 // the service to execute it, and the username and password of the user.
+//
+// The request may also contain the ID of a session, as returned in a previous response, in
+// which case the line is executed in that session, so that e.g. `hub switch` and `hub sign on`
+// carry over from one request to the next. If the session is supplied, the service and
+// credentials may be left empty, and those of the session will be used. If the service is
+// supplied, it becomes the current service of the session.
+//
+// The request may also contain a call to a function of the service in the binary wire format
+// used by external services, in which case the result is returned in the same format, or a
+// batch of up to `vm.MAX_BATCH` such calls, in which case the results are returned in order.
+// See `wire.go`.
 type jsonRequest = struct {
 	Body     string
 	Service  string
 	Username string
 	Password string
+	Session  string
+	Wire     string
+	Call     []byte
+	Batch    [][]byte
 }
 
 type jsonResponse = struct {
-	Body string
+	Body    string
+	Session string
+	Wire    string              `json:",omitempty"`
+	Value   []byte              `json:",omitempty"`
+	Batch   []vm.ExternalResult `json:",omitempty"`
 }
 
 func (h *Hub) handleJsonRequest(w http.ResponseWriter, r *http.Request) {
 	var request jsonRequest
 	err := json.NewDecoder(r.Body).Decode(&request)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		h.badRequest(w, err)
+		return
+	}
+	if len(request.Batch) > vm.MAX_BATCH {
+		http.Error(w, "a batch can't have more than "+strconv.Itoa(vm.MAX_BATCH)+" calls", http.StatusBadRequest)
+		return
+	}
+	// Evaluating the request changes the state of the hub, and so requests take turns with one
+	// another and with everything else. (This means that a service shouldn't call a service on
+	// the same hub by its URL, since the request would wait for the call to finish.)
+	h.doLock.Lock()
+	defer h.doLock.Unlock()
+	var session *Session
+	if request.Session != "" {
+		var ok bool
+		session, ok = h.getSession(request.Session)
+		if !ok {
+			http.Error(w, vm.EXPIRED_SESSION, http.StatusBadRequest)
+			return
+		}
+		if request.Username == "" {
+			request.Username, request.Password = session.username, session.password
+		}
+	}
+	service := request.Service
+	if service == "" && session != nil {
+		service = session.service
+	}
+	calls := max(len(request.Batch), 1) // Each call in a batch counts against the limits.
+	if !h.admitRequest(w, r, service, calls) {
 		return
 	}
 	if h.administered() && !((!h.listeningToHttpOrHttps) && (request.Body == "hub register" || request.Body == "hub sign on")) {
 		err = ValidateUser(h.Db, request.Username, request.Password)
 		if err != nil {
-			h.WriteError(err.Error())
+			http.Error(w, err.Error(), http.StatusUnauthorized)
 			return
 		}
+		if request.Username != "" && !h.admitUser(w, r, request.Username, calls) {
+			return
+		}
+	}
+	if session == nil { // We only make a session for a request which has got this far.
+		session = h.newSession()
+	}
+	session.addr = r.RemoteAddr
+	session.username, session.password = request.Username, request.Password
+	if request.Service != "" {
+		session.service = request.Service
 	}
 	var buf bytes.Buffer
 	oldOut := h.Out
 	h.Out = &buf
-	sv := h.Services[request.Service]
-	sv.SetOutHandler(sv.MakeLiteralOutHandler(&buf))
-	h.Do(request.Body, request.Username, request.Password, request.Service, true)
-	h.Out = oldOut
-	response := jsonResponse{Body: buf.String()}
+	defer func() { h.Out = oldOut }()
+	if sv, ok := h.getService(session.service); ok {
+		sv.SetOutHandler(sv.MakeLiteralOutHandler(&buf))
+	}
+	hubService := h.Services["hub"]
+	oldHubHandler, _ := hubService.GetOutHandler()
+	hubService.SetOutHandler(hubService.MakeLiteralOutHandler(&buf))
+	defer hubService.SetOutHandler(oldHubHandler)
+	// A request which makes the hub panic shouldn't leave it writing to the buffer, or take down
+	// the server, and so the panic is turned into a response.
+	defer func() {
+		if r := recover(); r != nil {
+			http.Error(w, "the hub failed to evaluate the request: "+fmt.Sprint(r), http.StatusInternalServerError)
+		}
+	}()
+	response := jsonResponse{Session: session.Id}
+	switch {
+	case request.Wire == vm.WIRE_VERSION && request.Call != nil:
+		response.Wire = vm.WIRE_VERSION
+		response.Value = h.doWireCall(request.Call, session)
+	case request.Wire == vm.WIRE_VERSION && request.Batch != nil:
+		response.Wire = vm.WIRE_VERSION
+		response.Batch = make([]vm.ExternalResult, len(request.Batch))
+		for i, call := range request.Batch {
+			buf.Reset()
+			response.Batch[i].Value = h.doWireCall(call, session)
+			if response.Batch[i].Value == nil {
+				response.Batch[i].Body = buf.String()
+			}
+		}
+		buf.Reset()
+	default:
+		h.doInSession(request.Body, session, true)
+	}
+	if response.Value == nil {
+		response.Body = buf.String()
+	}
 	json.NewEncoder(w).Encode(response)
 }
 
@@ -1343,6 +1858,22 @@ const HELP = "\nUsage: pipefish [-v | --version] [-h | --help]\n" +
 	"Commands are:\n\n" +
 	"  tui           Starts the Pipfish TUI (text user interface).\n" +
 	"  run <file>    Runs a Pipefish script if it has a `main` command.\n" +
+	"  serve <hub>   Runs a hub as a daemon, listening to HTTP and to a control socket.\n" +
+	"  ctl <line>    Sends a line to the control socket of a hub run with `serve`.\n" +
+	"  api diff <old> <new>\n" +
+	"                Says whether the changes from one API to another are breaking.\n" +
+	"  api lock <file>\n" +
+	"                Records the APIs of the external services of a script in its lockfile.\n" +
+	"  gen proto <file> [-o <file>]\n" +
+	"                Writes the API of a script as a .proto file, for clients using gRPC.\n" +
+	"  gen go <file> [-o <directory>]\n" +
+	"                Writes a Go package which is a client of a script's service.\n" +
+	"  gen python <file> [-o <file>]\n" +
+	"                Writes a Python module which is a client of a script's service.\n" +
+	"  gen ts <file> [-o <file>]\n" +
+	"                Writes a TypeScript module which is a client of a script's service.\n" +
+	"  build --with-go <file> ... [-o <file>]\n" +
+	"                Builds a pipefish binary with the Go used by the scripts compiled into it.\n" +
 	"  wiki <file>   Returns a description of the file's API in GitHub wiki format.\n\n"
 
 
@@ -1,15 +1,43 @@
 package hub_test
 
 import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
 	"runtime"
+	"slices"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/net/websocket"
+
+	"github.com/tim-hardcastle/pipefish/source/hub"
+	"github.com/tim-hardcastle/pipefish/source/hub/test-files/clients/server"
+	"github.com/tim-hardcastle/pipefish/source/initializer"
+	"github.com/tim-hardcastle/pipefish/source/pf"
 	"github.com/tim-hardcastle/pipefish/source/test_helper"
 	"github.com/tim-hardcastle/pipefish/source/text"
+	"github.com/tim-hardcastle/pipefish/source/values"
+	"github.com/tim-hardcastle/pipefish/source/vm"
 )
 
 func TestApi(t *testing.T) {
@@ -23,6 +51,142 @@ func TestApi(t *testing.T) {
 	test_helper.RunHubTest(t, "default", test)
 }
 
+func TestAudit(t *testing.T) {
+	// no t.Parallel()
+	wd, _ := os.Getwd()
+	var out bytes.Buffer
+	h := hub.New(filepath.Join(wd, "test-files/rbam"), &out)
+	timestamp := regexp.MustCompile(`\d{4}-\d\d-\d\d \d\d:\d\d:\d\d`)
+	do := func(username, password, service, line string, external bool) string {
+		out.Reset()
+		h.Do(line, username, password, service, external)
+		return timestamp.ReplaceAllString(strings.TrimSpace(out.String()), "TIME")
+	}
+	do("", "", "", `hub config admin "mmadmin", "Norma", "Mortenson", "marilyn@hollywood.org", "password123"`, false)
+	do("mmadmin", "password123", "", `hub run "../hub/test-files/foo.pf"`, false)
+	do("mmadmin", "password123", "foo", `hub let "Users" use "foo"`, false)
+	do("mmadmin", "password123", "foo", `foo 2`, true)
+	do("mmadmin", "password123", "foo", `$ echo "Hello world!"`, false)
+	do("mmadmin", "password123", "foo", `hub change password "password456"`, false)
+	do("", "", "", `hub sign on "mmadmin", "wrong, guess"`, false)
+	test := []test_helper.TestItem{
+		{`hub audit of verb "let-use"`, "▪ TIME \x1b[36mmmadmin\x1b[0m at terminal: let-use \"Users\", \"foo\" \x1b[32mOK\x1b[0m"},
+		{`hub audit of verb "call"`, "▪ TIME \x1b[36mmmadmin\x1b[0m at terminal: call \"foo\", \"foo\" \x1b[32mOK\x1b[0m"},
+		{`hub audit of verb "$"`, "▪ TIME \x1b[36mmmadmin\x1b[0m at terminal: $ \"echo\", \"▪▪▪▪▪▪▪▪\" \x1b[32mOK\x1b[0m"},
+		{`hub audit of verb "change-password"`, "▪ TIME \x1b[36mmmadmin\x1b[0m at terminal: change-password \"▪▪▪▪▪▪▪▪\" \x1b[32mOK\x1b[0m"},
+		{`hub audit of verb "log-on"`, "▪ TIME \x1b[36m(not signed on)\x1b[0m at terminal: log-on \"mmadmin\", \"▪▪▪▪▪▪▪▪\", \"▪▪▪▪▪▪▪▪\" \x1b[31mfailed\x1b[0m: " +
+			"the hub doesn't recognize that combination of username and password"},
+		{`hub audit of verb "nonexistent"`, "There are no matching entries in the audit log."},
+		{`hub audit since "3000"`, "There are no matching entries in the audit log."},
+	}
+	for _, item := range test {
+		if got := do("mmadmin", "password456", "foo", item.Input, false); got != item.Want {
+			t.Fatal("\nOn input '" + item.Input + "'\n    Exp : " + strconv.Quote(item.Want) + "\n    Got : " + strconv.Quote(got))
+		}
+	}
+	file := filepath.Join(t.TempDir(), "audit.jsonl")
+	do("mmadmin", "password456", "foo", `hub audit ("", "config-admin", "") to "`+file+`"`, false)
+	data, _ := os.ReadFile(file)
+	var entry hub.AuditEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry.Verb != "config-admin" || entry.Args[0] != "mmadmin" || entry.Args[3] != hub.REDACTED || entry.Args[4] != hub.REDACTED {
+		t.Fatal("unexpected exported entry " + string(data))
+	}
+	do("mmadmin", "password456", "foo", `hub nuke admin`, false)
+}
+
+func TestPasswordReset(t *testing.T) {
+	// no t.Parallel()
+	wd, _ := os.Getwd()
+	var out bytes.Buffer
+	h := hub.New(filepath.Join(wd, "test-files/rbam"), &out)
+	do := func(username, password, line string) string {
+		out.Reset()
+		h.Do(line, username, password, "", false)
+		return strings.TrimSpace(out.String())
+	}
+	do("", "", `hub config admin "mmadmin", "Norma", "Mortenson", "marilyn@hollywood.org", "password123"`)
+	defer do("mmadmin", "password123", `hub nuke admin`)
+	do("", "", `hub register "jdean", "James", "Dean", "rebel@hollywood.org", "password456"`)
+	outbox := func() []hub.Mail { return h.Mailer.(*hub.MemoryMailer).Sent() }
+	tokenInMail := regexp.MustCompile(`reset password "([0-9a-f]+)"`)
+	// We say the same thing whether or not the email is right, but only send mail if it is.
+	sent := "If that is the email address of \x1b[36mjdean\x1b[39m, a reset token has been sent to it."
+	if got := do("", "", `hub forgot password "jdean", "wrong@hollywood.org"`); got != sent || len(outbox()) != 0 {
+		t.Fatal("unexpected output " + strconv.Quote(got))
+	}
+	if got := do("", "", `hub forgot password "jdean", "rebel@hollywood.org"`); got != sent || len(outbox()) != 1 {
+		t.Fatal("unexpected output " + strconv.Quote(got))
+	}
+	token := tokenInMail.FindStringSubmatch(outbox()[0].Msg)[1]
+	test := []test_helper.TestItem{
+		{`hub reset password "` + token + `", "password789"`, "The password of \x1b[36mjdean\x1b[39m has been changed."},
+		{`hub reset password "` + token + `", "password000"`, "\x1b[31mHub error\x1b[39m: invalid or expired reset token"},
+		{`hub sign on "jdean", "password789"`, "You are logged on as \x1b[36mjdean\x1b[39m."},
+	}
+	for _, item := range test {
+		if got := do("", "", item.Input); got != item.Want {
+			t.Fatal("\nOn input '" + item.Input + "'\n    Exp : " + strconv.Quote(item.Want) + "\n    Got : " + strconv.Quote(got))
+		}
+	}
+	// The tokens are rate-limited.
+	for range hub.MAX_RESET_REQUESTS {
+		do("", "", `hub forgot password "jdean", "rebel@hollywood.org"`)
+	}
+	if len(outbox()) != hub.MAX_RESET_REQUESTS {
+		t.Fatal("sent " + strconv.Itoa(len(outbox())) + " reset tokens")
+	}
+	// And can be used over HTTP, but only once, even by requests made at the same time.
+	server := httptest.NewServer(h.HttpHandler())
+	defer server.Close()
+	token = tokenInMail.FindStringSubmatch(outbox()[1].Msg)[1]
+	statuses := make(chan int, 4)
+	for range 4 {
+		go func() {
+			resp, err := http.Post(server.URL+"/reset-password", "application/json",
+				strings.NewReader(`{"Token": "`+token+`", "Password": "password000"}`))
+			if err != nil {
+				statuses <- 0
+				return
+			}
+			resp.Body.Close()
+			statuses <- resp.StatusCode
+		}()
+	}
+	succeeded := 0
+	for range 4 {
+		if <-statuses == http.StatusOK {
+			succeeded++
+		}
+	}
+	if succeeded != 1 {
+		t.Fatal("the token was used " + strconv.Itoa(succeeded) + " times")
+	}
+	// If the mail can't be sent, the caller is told the same thing as usual, since otherwise
+	// they'd know the account exists, but the failure is audited.
+	do("", "", `hub register "nwood", "Natalie", "Wood", "natalie@hollywood.org", "password321"`)
+	h.Mailer = failingMailer{}
+	sent = "If that is the email address of \x1b[36mnwood\x1b[39m, a reset token has been sent to it."
+	if got := do("", "", `hub forgot password "nwood", "natalie@hollywood.org"`); got != sent {
+		t.Fatal("unexpected output " + strconv.Quote(got))
+	}
+	if got := do("mmadmin", "password123", `hub audit of verb "forgot-password"`); !strings.Contains(got, "the carrier pigeon has flown") {
+		t.Fatal("unexpected audit " + strconv.Quote(got))
+	}
+}
+
+type failingMailer struct{}
+
+func (failingMailer) Send(to []string, msg []byte) error {
+	return errors.New("the carrier pigeon has flown")
+}
+
+func (failingMailer) From() string {
+	return "hub@example.com"
+}
+
 func TestBrokenService(t *testing.T) { // We want to make sure that if the service is broken, queries get handed off to the empty service.
 	// no t.Parallel()
 	test := []test_helper.TestItem{
@@ -54,12 +218,999 @@ func TestCli(t *testing.T) {
 	}
 }
 
+func TestBuildWithGo(t *testing.T) {
+	// no t.Parallel()
+	if runtime.GOOS == "windows" {
+		return
+	}
+	wd, _ := os.Getwd()
+	script := filepath.Join(wd, "test-files/build.pf")
+	tmpExe := filepath.Join(t.TempDir(), "pipefish")
+	sources := map[string]string{}
+	cp, err := initializer.GoSourcesFromFilepath(script, sources)
+	if err != nil || cp.P.Common.IsBroken {
+		t.Fatalf("can't get the Go from build.pf")
+	}
+	if err := initializer.BuildWithGo(sources, tmpExe); err != nil {
+		t.Fatalf("build failed: %v", err)
+	}
+	// Without a Go toolchain, the binary can only run the script with the Go compiled into it.
+	cmd := exec.Command(tmpExe, "run", script)
+	cmd.Env = append(os.Environ(), "PATH=")
+	result, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("run failed: %v\n%s", err, result)
+	}
+	if string(result) != "Hello, world!\n" {
+		t.Fatal("Expected \"Hello, world!\\n\"`; got " + strconv.Quote(string(result)))
+	}
+}
+
+func TestMailer(t *testing.T) {
+	// no t.Parallel()
+	wd, _ := os.Getwd()
+	var out bytes.Buffer
+	h := hub.New(filepath.Join(wd, "test-files/rbam"), &out)
+	// Services can send mail through the hub's mailer.
+	h.Do(`hub run "`+filepath.Join(wd, "test-files/mail.pf")+`"`, "", "", "", false)
+	out.Reset()
+	h.Do(`notify "rebel@hollywood.org", "James"`, "", "", "mail", false)
+	if got := strings.TrimSpace(out.String()); got != "OK" {
+		t.Fatal("unexpected output " + strconv.Quote(got))
+	}
+	sent := h.Mailer.(*hub.MemoryMailer).Sent()
+	if len(sent) != 1 || sent[0].To[0] != "rebel@hollywood.org" || !strings.Contains(sent[0].Msg, "Hello James.") {
+		t.Fatalf("unexpected mail %v", sent)
+	}
+	h.Do(`hub halt "mail"`, "", "", "", false)
+	// Mail can be delivered locally.
+	dir := t.TempDir()
+	maildir, err := hub.OpenMailer("maildir:mail?from=hub@example.com", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	maildir.Send([]string{"rebel@hollywood.org"}, []byte("Subject: Hello\r\n\r\nHello."))
+	delivered, _ := os.ReadDir(filepath.Join(dir, "mail", "new"))
+	if len(delivered) != 1 || maildir.From() != "hub@example.com" {
+		t.Fatal("maildir didn't get the mail")
+	}
+	mbox, err := hub.OpenMailer("mbox:mbox", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mbox.Send([]string{"rebel@hollywood.org"}, []byte("Subject: Hello\r\n\r\nFrom here on."))
+	mbox.Send([]string{"rebel@hollywood.org"}, []byte("Subject: Goodbye\r\n\r\nGoodbye."))
+	data, _ := os.ReadFile(filepath.Join(dir, "mbox"))
+	if strings.Count(string(data), "\nFrom ") != 1 || !strings.Contains(string(data), "\n>From here on.\n") {
+		t.Fatal("unexpected mbox " + strconv.Quote(string(data)))
+	}
+	if _, err := hub.OpenMailer("carrier-pigeon:", dir); err == nil {
+		t.Fatal("expected an error for an unknown transport")
+	}
+}
+
+func TestLimits(t *testing.T) {
+	// no t.Parallel()
+	wd, _ := os.Getwd()
+	dir := t.TempDir()
+	for _, name := range []string{"hub.env", "hub.hub"} {
+		data, _ := os.ReadFile(filepath.Join(wd, "new-hub", name))
+		os.WriteFile(filepath.Join(dir, name), data, 0600)
+	}
+	os.WriteFile(filepath.Join(dir, "hub.pf"), []byte("import\n\nNULL::\"database/sql\"\n\nconst\n\n"+
+		"HUB_DB = SqlDb(SQLITE)\n\nHUB_MAILER = \"memory:\"\n\n"+
+		"HUB_LIMITS = map(\"ipRate\"::0.001, \"ipBurst\"::6, \"maxBody\"::256, \"dailyQuota\"::1)\n"), 0600)
+	var out bytes.Buffer
+	h := hub.New(dir, &out)
+	h.Do(`hub config admin "mmadmin", "Norma", "Mortenson", "marilyn@hollywood.org", "password123"`, "", "", "", false)
+	defer h.Do(`hub nuke admin`, "mmadmin", "password123", "", false)
+	server := httptest.NewServer(h.HttpHandler())
+	defer server.Close()
+	post := func(body string) *http.Response {
+		resp, err := http.Post(server.URL, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return resp
+	}
+	request := `{"Body": "hub services", "Username": "mmadmin", "Password": "password123"}`
+	tooBig := `{"Body": "` + strings.Repeat("x", 256) + `"}`
+	// The first request claims to be from the user but has the wrong password, and so isn't
+	// charged to them. The second is a batch of two calls, which is over the user's quota although
+	// one request isn't. The third is within the user's quota, the fourth isn't, the fifth is too
+	// big, the sixth is anonymous and so has no quota, but isn't authorized, and the seventh is
+	// over the limit for the address.
+	for i, want := range []int{http.StatusUnauthorized, http.StatusTooManyRequests, http.StatusOK,
+		http.StatusTooManyRequests, http.StatusRequestEntityTooLarge, http.StatusUnauthorized,
+		http.StatusTooManyRequests} {
+		body := request
+		switch i {
+		case 0:
+			body = `{"Body": "hub services", "Username": "mmadmin", "Password": "wrong"}`
+		case 1:
+			body = `{"Batch": ["", ""], "Username": "mmadmin", "Password": "password123"}`
+		case 4:
+			body = tooBig
+		case 5:
+			body = `{"Body": "hub services"}`
+		}
+		resp := post(body)
+		if resp.StatusCode != want {
+			t.Fatal("request " + strconv.Itoa(i) + " got status " + resp.Status)
+		}
+		if want == http.StatusTooManyRequests && resp.Header.Get("Retry-After") == "" {
+			t.Fatal("request " + strconv.Itoa(i) + " has no Retry-After header")
+		}
+	}
+	// Only the request which was admitted and authorized was given a session.
+	if h.SessionCount() != 1 {
+		t.Fatal("the hub has " + strconv.Itoa(h.SessionCount()) + " sessions")
+	}
+	out.Reset()
+	h.Do(`hub stats`, "mmadmin", "password123", "", false)
+	for _, want := range []string{"had 7 HTTP requests, and has refused 4 of them", "IP rate limit: 1",
+		"daily quota: 2", "request size limit: 1", "mmadmin\x1b[0m: 1 of 1"} {
+		if !strings.Contains(out.String(), want) {
+			t.Fatal("unexpected stats " + strconv.Quote(out.String()))
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	// no t.Parallel()
+	wd, _ := os.Getwd()
+	dir := t.TempDir()
+	for _, name := range []string{"hub.env", "hub.hub"} {
+		data, _ := os.ReadFile(filepath.Join(wd, "new-hub", name))
+		os.WriteFile(filepath.Join(dir, name), data, 0600)
+	}
+	os.WriteFile(filepath.Join(dir, "hub.pf"), []byte("import\n\nNULL::\"database/sql\"\n\nconst\n\n"+
+		"HUB_DB = SqlDb(SQLITE)\n\nHUB_MAILER = \"memory:\"\n\nHUB_METRICS = true\n"), 0600)
+	var out bytes.Buffer
+	h := hub.New(dir, &out)
+	h.Do(`hub config admin "mmadmin", "Norma", "Mortenson", "marilyn@hollywood.org", "password123"`, "", "", "", false)
+	defer h.Do(`hub nuke admin`, "mmadmin", "password123", "", false)
+	h.Do(`hub run "`+filepath.Join(wd, "test-files/foo.pf")+`"`, "mmadmin", "password123", "", false)
+	h.Do(`hub register "jdean", "James", "Dean", "rebel@hollywood.org", "password456"`, "", "", "", false)
+	server := httptest.NewServer(h.HttpHandler())
+	defer server.Close()
+	for _, call := range [][2]string{{"foo 21", "foo"}, {"foo 22", "foo"}, {"1 / 0", "foo"},
+		{"hub xyzzy", "foo"}, {"2 + 2", "xyzzy"}} {
+		resp, err := http.Post(server.URL, "application/json", strings.NewReader(
+			`{"Body": "`+call[0]+`", "Service": "`+call[1]+`", "Username": "mmadmin", "Password": "password123"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	get := func(username, password string) (int, string) {
+		req, _ := http.NewRequest(http.MethodGet, server.URL+"/metrics", nil)
+		if username != "" {
+			req.SetBasicAuth(username, password)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+	// Only admins can see the metrics.
+	if status, _ := get("", ""); status != http.StatusUnauthorized {
+		t.Fatal("anonymous request got status " + strconv.Itoa(status))
+	}
+	if status, _ := get("jdean", "password456"); status != http.StatusUnauthorized {
+		t.Fatal("non-admin got status " + strconv.Itoa(status))
+	}
+	status, metrics := get("mmadmin", "password123")
+	if status != http.StatusOK {
+		t.Fatal("admin got status " + strconv.Itoa(status))
+	}
+	for _, want := range []string{
+		"# TYPE pipefish_request_duration_seconds histogram\n",
+		`pipefish_requests_total{service="foo"} 3`,
+		`pipefish_request_duration_seconds_count{service="foo",function="foo"} 2`,
+		`pipefish_request_duration_seconds_bucket{service="foo",function="foo",le="+Inf"} 2`,
+		`pipefish_request_duration_seconds_count{service="foo",function=""} 1`,
+		`pipefish_errors_total{id="vm/div/zero/a"} 1`,
+		`pipefish_vm_instructions_total{service="foo"} `,
+		`pipefish_vm_memory_values{service="foo"} `,
+		"go_goroutines ",
+		// Hub commands and services which don't exist aren't given labels of their own.
+		`pipefish_request_duration_seconds_count{service="hub",function="other"} 1`,
+		`pipefish_request_duration_seconds_count{service="",function=""} 1`,
+	} {
+		if !strings.Contains(metrics, want) {
+			t.Fatal("metrics don't contain " + strconv.Quote(want) + ":\n" + metrics)
+		}
+	}
+	if strings.Contains(metrics, "xyzzy") {
+		t.Fatal("metrics contain labels from the client:\n" + metrics)
+	}
+	// The vms count their operations when the hub keeps metrics.
+	for _, unwanted := range []string{`pipefish_vm_instructions_total{service="foo"} 0` + "\n", `pipefish_vm_memory_values{service="foo"} 0` + "\n"} {
+		if strings.Contains(metrics, unwanted) {
+			t.Fatal("metrics contain " + strconv.Quote(unwanted) + ":\n" + metrics)
+		}
+	}
+}
+
+func TestConfig(t *testing.T) {
+	// no t.Parallel()
+	wd, _ := os.Getwd()
+	dir := t.TempDir()
+	for _, name := range []string{"hub.env", "hub.hub"} {
+		data, _ := os.ReadFile(filepath.Join(wd, "new-hub", name))
+		os.WriteFile(filepath.Join(dir, name), data, 0600)
+	}
+	script, _ := os.ReadFile(filepath.Join(wd, "test-files/env.pf"))
+	os.WriteFile(filepath.Join(dir, "env.pf"), script, 0600)
+	config := func(fields string) {
+		os.WriteFile(filepath.Join(dir, "hub.pf"), []byte("const\n\nHUB_CONFIG = map("+fields+")\n"), 0600)
+	}
+	config(`"services"::map("a"::"nonesuch.pf"), "http"::0, "width"::"wide", "colour"::"blue"`)
+	var out bytes.Buffer
+	h := hub.New(dir, &out)
+	for _, want := range []string{"the config of the hub is invalid", "no field \"colour\"", "should be a port number",
+		"can't be opened", "should be a positive integer"} {
+		if !strings.Contains(out.String(), want) {
+			t.Fatal("unexpected output " + strconv.Quote(out.String()))
+		}
+	}
+	// Nor is the rest of an invalid config used when the hub opens, e.g. to listen to HTTP.
+	taken, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := strconv.Itoa(taken.Addr().(*net.TCPAddr).Port)
+	taken.Close()
+	config(`"http"::` + port + `, "database"::5`)
+	out.Reset()
+	h = hub.New(dir, &out)
+	if !strings.Contains(out.String(), "database\x1b[0m in") || !strings.Contains(out.String(), "won't open its database") {
+		t.Fatal("unexpected output " + strconv.Quote(out.String()))
+	}
+	if _, err := http.Post("http://localhost:"+port, "application/json", strings.NewReader(`{"Body": "hub services"}`)); err == nil {
+		t.Fatal("the hub is listening as an invalid config says")
+	}
+	config(`"services"::map("a"::"env.pf"), "width"::80`)
+	h = hub.New(dir, &out)
+	call := func(line, service string) string {
+		out.Reset()
+		h.Do(line, "", "", service, false)
+		return strings.TrimSpace(out.String())
+	}
+	if got := call(`show "k"`, "a"); got != `"none"` {
+		t.Fatal("unexpected output " + strconv.Quote(got))
+	}
+	// Reloading the config starts the services it gives and halts the ones it no longer does.
+	config(`"services"::map("b"::"env.pf")`)
+	if got := call(`hub reload config`, ""); !strings.HasSuffix(got, "OK") {
+		t.Fatal("unexpected output " + strconv.Quote(got))
+	}
+	if got := call(`show "k"`, "b"); got != `"none"` {
+		t.Fatal("unexpected output " + strconv.Quote(got))
+	}
+	if got := call(`show "k"`, "a"); !strings.Contains(got, "can't find the service") {
+		t.Fatal("unexpected output " + strconv.Quote(got))
+	}
+	// An invalid config isn't used.
+	config(`"services"::map("b"::"env.pf"), "metrics"::"yes"`)
+	if got := call(`hub reload config`, ""); !strings.Contains(got, "should be a boolean") ||
+		!strings.Contains(got, "the config hasn't been reloaded") {
+		t.Fatal("unexpected output " + strconv.Quote(got))
+	}
+	if got := call(`show "k"`, "b"); got != `"none"` {
+		t.Fatal("unexpected output " + strconv.Quote(got))
+	}
+}
+
+func TestServiceGraph(t *testing.T) {
+	// no t.Parallel()
+	wd, _ := os.Getwd()
+	dir := t.TempDir()
+	for _, name := range []string{"hub.env", "hub.hub"} {
+		data, _ := os.ReadFile(filepath.Join(wd, "new-hub", name))
+		os.WriteFile(filepath.Join(dir, name), data, 0600)
+	}
+	// "a" comes first alphabetically, but has to be started after "b", which it depends on.
+	os.WriteFile(filepath.Join(dir, "a.pf"), []byte("external\n\nzort\n\ndef\n\nf(x int) : zort.g(x) + 1\n"), 0600)
+	os.WriteFile(filepath.Join(dir, "b.pf"), []byte("def\n\ng(x int) : 2 * x\n"), 0600)
+	os.WriteFile(filepath.Join(dir, "c.pf"), []byte("external\n\n\"d.pf\"\n"), 0600)
+	os.WriteFile(filepath.Join(dir, "d.pf"), []byte("external\n\nc\n"), 0600)
+	config := func(services string) {
+		os.WriteFile(filepath.Join(dir, "hub.pf"), []byte("const\n\nHUB_CONFIG = map(\"services\"::map("+services+"))\n"), 0600)
+	}
+	config(`"a"::"a.pf", "zort"::"b.pf"`)
+	var out bytes.Buffer
+	h := hub.New(dir, &out)
+	call := func(line, service string) string {
+		out.Reset()
+		h.Do(line, "", "", service, false)
+		return strings.TrimSpace(out.String())
+	}
+	if got := call(`f 3`, "a"); got != "7" {
+		t.Fatal("unexpected output " + strconv.Quote(got))
+	}
+	if got := call(`hub graph`, ""); got != "▪ Service \x1b[36m\"a\"\x1b[39m depends on \x1b[36m\"zort\"\x1b[39m.\n"+
+		"  ▪ Service \x1b[36m\"zort\"\x1b[39m depends on no other service." {
+		t.Fatal("unexpected output " + strconv.Quote(got))
+	}
+	dot := filepath.Join(dir, "hub.dot")
+	call(`hub graph to "`+dot+`"`, "")
+	data, _ := os.ReadFile(dot)
+	if !strings.Contains(string(data), `"a" -> "zort";`) {
+		t.Fatal("unexpected DOT " + strconv.Quote(string(data)))
+	}
+	// Services which depend on one another in a cycle aren't started.
+	config(`"a"::"a.pf", "zort"::"b.pf", "c"::"c.pf", "d"::"d.pf"`)
+	out.Reset()
+	h = hub.New(dir, &out)
+	if got := out.String(); !strings.Contains(got, "\x1b[36m\"c\"\x1b[39m → \x1b[36m\"d\"\x1b[39m → \x1b[36m\"c\"\x1b[39m") {
+		t.Fatal("unexpected output " + strconv.Quote(got))
+	}
+	if got := call(`f 3`, "a"); got != "7" {
+		t.Fatal("unexpected output " + strconv.Quote(got))
+	}
+	if got := call(`hub services`, ""); strings.Contains(got, `"c"`) {
+		t.Fatal("unexpected output " + strconv.Quote(got))
+	}
+}
+
+func TestLockfile(t *testing.T) {
+	// no t.Parallel()
+	wd, _ := os.Getwd()
+	dir := t.TempDir()
+	for _, name := range []string{"hub.env", "hub.hub", "hub.pf"} {
+		data, _ := os.ReadFile(filepath.Join(wd, "new-hub", name))
+		os.WriteFile(filepath.Join(dir, name), data, 0600)
+	}
+	server := filepath.Join(dir, "server.pf")
+	client := filepath.Join(dir, "client.pf")
+	os.WriteFile(server, []byte("def\n\nf(x int) : x + 1\n"), 0600)
+	os.WriteFile(client, []byte("external\n\n\"server.pf\"\n\ndef\n\ng(x int) : server.f(x)\n"), 0600)
+	lockfile := initializer.LockfilePath(client)
+	var out bytes.Buffer
+	h := hub.New(dir, &out)
+	run := func(script string) string {
+		out.Reset()
+		h.Do(`hub run "`+script+`"`, "", "", "", false)
+		return strings.TrimSpace(out.String())
+	}
+	// Without a lockfile, nothing is checked, and the initializer doesn't make one.
+	run(client)
+	if _, err := os.Stat(lockfile); !errors.Is(err, os.ErrNotExist) {
+		t.Fatal("the initializer made a lockfile")
+	}
+	// As `pipefish api lock` does.
+	sv := pf.NewService()
+	sv.SetIgnoreLockfile(true)
+	sv.InitializeFromFilepath(client)
+	initializer.WriteLockfile(lockfile, sv.ExternalApis())
+	// Versions of Pipefish from before APIs had versions skip lines whose first part is empty.
+	if first, _, _ := strings.Cut(sv.ExternalApis()["server"], "\n"); strings.Split(first, " | ")[0] != "" {
+		t.Fatal("unexpected version " + strconv.Quote(first))
+	}
+	locked, _ := os.ReadFile(lockfile)
+	if apis, _ := initializer.ReadLockfile(lockfile); !strings.Contains(apis["server"], "FUNCTION | f | 0 | x int") {
+		t.Fatal("unexpected lockfile " + strconv.Quote(apis["server"]))
+	}
+	// A compatible change is allowed, and doesn't change the lockfile.
+	os.WriteFile(server, []byte("def\n\nf(x int) : x + 1\n\nh(x int) : x\n"), 0600)
+	run(server)
+	if got := run(client); strings.Contains(got, "rror") {
+		t.Fatal("unexpected output " + strconv.Quote(got))
+	}
+	if data, _ := os.ReadFile(lockfile); string(data) != string(locked) {
+		t.Fatal("unexpected lockfile " + strconv.Quote(string(data)))
+	}
+	// A breaking one isn't allowed.
+	os.WriteFile(server, []byte("def\n\nf(x string) : x\n"), 0600)
+	run(server)
+	if got := run(client); !strings.Contains(got, "has changed since it was recorded") ||
+		!strings.Contains(got, "has been removed") {
+		t.Fatal("unexpected output " + strconv.Quote(got))
+	}
+	if data, _ := os.ReadFile(lockfile); string(data) != string(locked) {
+		t.Fatal("unexpected lockfile " + strconv.Quote(string(data)))
+	}
+}
+
+func TestWireFormat(t *testing.T) {
+	// no t.Parallel()
+	wd, _ := os.Getwd()
+	newHub := func(dir string) (*hub.Hub, *bytes.Buffer) {
+		for _, name := range []string{"hub.env", "hub.hub", "hub.pf"} {
+			data, _ := os.ReadFile(filepath.Join(wd, "new-hub", name))
+			os.WriteFile(filepath.Join(dir, name), data, 0600)
+		}
+		var out bytes.Buffer
+		return hub.New(dir, &out), &out
+	}
+	serverDir, clientDir := t.TempDir(), t.TempDir()
+	os.WriteFile(filepath.Join(serverDir, "server.pf"), []byte(`newtype
+
+Color = enum RED, GREEN, BLUE
+
+Person = struct(name string, age int)
+
+Money = clone int
+
+Vec{i int} = clone list :
+    len(that) == i
+
+make Vec{2}
+
+def
+
+vectors(n int) :
+    [Vec{2}[n, RED]], list{int}[n, n]
+
+people(c Color) :
+    [Person("Ann", 30), Person("Bob", 40)], map(c::set(Money(5)), "x"::(1::2.5))
+
+older(p Person) :
+    Person(p[name], p[age] + 1)
+
+inverse(x int) :
+    1 / x
+`), 0600)
+	server, _ := newHub(serverDir)
+	server.Do(`hub run "`+filepath.Join(serverDir, "server.pf")+`"`, "", "", "", false)
+	// The hub serving the service records the requests it gets, and can be made to pretend that
+	// it doesn't speak the binary format.
+	var lock sync.Mutex
+	requests := []map[string]any{}
+	oldHub := false
+	handler := server.HttpHandler()
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request map[string]any
+		json.NewDecoder(r.Body).Decode(&request)
+		lock.Lock()
+		requests = append(requests, maps.Clone(request))
+		if oldHub {
+			delete(request, "Wire")
+			delete(request, "Call")
+		}
+		lock.Unlock()
+		body, _ := json.Marshal(request)
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		handler.ServeHTTP(w, r)
+	}))
+	defer httpServer.Close()
+	os.WriteFile(filepath.Join(clientDir, "client.pf"), []byte("external\n\n\""+httpServer.URL+"/server\"\n"), 0600)
+	client, out := newHub(clientDir)
+	call := func(line string) string {
+		out.Reset()
+		client.Do(line, "", "", "client", false)
+		return strings.TrimSpace(out.String())
+	}
+	client.Do(`hub run "`+filepath.Join(clientDir, "client.pf")+`"`, "", "", "", false)
+	tests := [][2]string{
+		{`server.people server.GREEN`, `([server.Person("Ann", 30), server.Person("Bob", 40)], map("x"::1::2.5, server.GREEN::set(server.Money(5))))`},
+		{`server.older server.Person("Cal", 50)`, `server.Person("Cal", 51)`},
+		{`type((server.people server.RED)[1][server.RED])`, `set`},
+		{`server.vectors 3`, `([server.Vec{2}[3, server.RED]], server.list{int}[3, 3])`},
+	}
+	for _, test := range tests {
+		if got := call(test[0]); got != test[1] {
+			t.Fatal("unexpected output " + strconv.Quote(got) + " from " + test[0])
+		}
+	}
+	if got := call(`server.inverse 0`); !strings.Contains(got, "division by zero") {
+		t.Fatal("unexpected output " + strconv.Quote(got))
+	}
+	// Once the client knows that the hub speaks the binary format, it doesn't send the line.
+	lock.Lock()
+	last := requests[len(requests)-1]
+	lock.Unlock()
+	if last["Wire"] != "pfb1" || last["Body"] != "" {
+		t.Fatal("unexpected request " + fmt.Sprint(last))
+	}
+	// The client makes all its requests in the same session.
+	if server.SessionCount() != 1 {
+		t.Fatal("the client has " + strconv.Itoa(server.SessionCount()) + " sessions")
+	}
+	// Mapping a function of the service over a list makes the calls in one request, as does
+	// `batch`.
+	countRequests := func() int {
+		lock.Lock()
+		defer lock.Unlock()
+		return len(requests)
+	}
+	for _, test := range [][2]string{
+		{`[1, 2, 4] >> server.inverse`, `[1.0, 0.5, 0.25]`},
+		{`batch(server.inverse, [2, 4])`, `[0.5, 0.25]`},
+	} {
+		before := countRequests()
+		if got := call(test[0]); got != test[1] {
+			t.Fatal("unexpected output " + strconv.Quote(got) + " from " + test[0])
+		}
+		if countRequests() != before+1 {
+			t.Fatal("made " + strconv.Itoa(countRequests()-before) + " requests for " + test[0])
+		}
+	}
+	if got := call(`[1, 0, 4] >> server.inverse`); !strings.Contains(got, "division by zero") {
+		t.Fatal("unexpected output " + strconv.Quote(got))
+	}
+	// The hub won't decode values which its own vm couldn't have made.
+	str := func(buf []byte, s string) []byte {
+		return append(binary.AppendUvarint(buf, uint64(len(s))), s...)
+	}
+	typ := func(buf []byte, t values.ValueType) []byte { return binary.AppendUvarint(buf, uint64(t)) }
+	callWith := func(name string, arg []byte) []byte {
+		buf := str(str(binary.AppendUvarint(nil, uint64(vm.PREFIX)), ""), name)
+		buf = binary.AppendUvarint(typ(buf, values.TUPLE), 1)
+		return append(buf, arg...)
+	}
+	emptyList := binary.AppendUvarint(typ(nil, values.LIST), 0)
+	badCalls := map[string][]byte{
+		"field age of struct Person can't be of type string": callWith("older",
+			str(typ(str(typ(binary.AppendUvarint(str(typ(nil, values.FIRST_DEFINED_TYPE), "Person"), 2), values.STRING), "Ann"), values.STRING), "thirty")),
+		"a value of type list can't be an element of a set": callWith("inverse",
+			append(append(binary.AppendUvarint(typ(nil, values.SET), 2), emptyList...), emptyList...)),
+		"a value of type list can't be a key of a map": callWith("inverse",
+			binary.AppendVarint(typ(append(binary.AppendUvarint(typ(nil, values.MAP), 1), emptyList...), values.INT), 1)),
+	}
+	for want, call := range badCalls {
+		body, _ := json.Marshal(map[string]any{"Service": "server", "Wire": "pfb1", "Call": call})
+		resp, err := http.Post(httpServer.URL, "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var response struct{ Body string }
+		json.NewDecoder(resp.Body).Decode(&response)
+		resp.Body.Close()
+		// The hub highlights what's in backquotes, and wraps the message.
+		got := strings.Join(strings.Fields(ansiCodes.ReplaceAllString(response.Body, "")), " ")
+		if !strings.Contains(got, "can't decode the call: "+want) {
+			t.Fatal("unexpected response " + strconv.Quote(response.Body))
+		}
+	}
+	// A client which finds that the hub doesn't speak it uses the literal protocol.
+	lock.Lock()
+	oldHub = true
+	lock.Unlock()
+	client.Do(`hub run "`+filepath.Join(clientDir, "client.pf")+`"`, "", "", "", false)
+	for range 2 {
+		if got := call(`server.inverse 4`); got != `0.25` {
+			t.Fatal("unexpected output " + strconv.Quote(got))
+		}
+	}
+	if got := call(`[2, 4] >> server.inverse`); got != `[0.5, 0.25]` {
+		t.Fatal("unexpected output " + strconv.Quote(got))
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	last = requests[len(requests)-1]
+	if last["Wire"] != nil || last["Body"] != `inverse (4)` {
+		t.Fatal("unexpected request " + fmt.Sprint(last))
+	}
+}
+
+var ansiCodes = regexp.MustCompile("\x1b\\[[0-9;]*m")
+
+func TestGrpc(t *testing.T) {
+	// no t.Parallel()
+	wd, _ := os.Getwd()
+	dir := t.TempDir()
+	for _, name := range []string{"hub.env", "hub.hub", "hub.pf"} {
+		data, _ := os.ReadFile(filepath.Join(wd, "new-hub", name))
+		os.WriteFile(filepath.Join(dir, name), data, 0600)
+	}
+	os.WriteFile(filepath.Join(dir, "server.pf"), []byte(`newtype
+
+Color = enum RED, GREEN, BLUE
+
+Person = struct(name string, age int?, favorite Color)
+
+def
+
+older(p Person) :
+    Person(p[name], p[age] + 1, p[favorite])
+
+inverse(x int) :
+    1 / x
+
+greet(name string) with (greeting string?) :
+    (type(greeting) == null : "Hello" ; else : greeting) + ", " + name + "!"
+`), 0600)
+	var out bytes.Buffer
+	h := hub.New(dir, &out)
+	h.Do(`hub run "`+filepath.Join(dir, "server.pf")+`"`, "", "", "", false)
+	httpServer := httptest.NewUnstartedServer(h.HttpHandler())
+	httpServer.Config.Protocols = &http.Protocols{}
+	httpServer.Config.Protocols.SetHTTP1(true)
+	httpServer.Config.Protocols.SetUnencryptedHTTP2(true)
+	httpServer.Start()
+	defer httpServer.Close()
+	transport := &http.Transport{Protocols: &http.Protocols{}}
+	transport.Protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: transport}
+	// The messages are put together by hand from the fields, each of which is the field number
+	// and a varint, or else the field number and a string or message.
+	varint := func(n uint64, u uint64) []byte {
+		return binary.AppendUvarint(binary.AppendUvarint(nil, n<<3), u)
+	}
+	bytesField := func(n uint64, b []byte) []byte {
+		return append(binary.AppendUvarint(binary.AppendUvarint(nil, n<<3|2), uint64(len(b))), b...)
+	}
+	// Returns the status of the RPC, and the response if it succeeded.
+	rpc := func(path string, message []byte) (string, []byte) {
+		body := append(binary.BigEndian.AppendUint32([]byte{0}, uint32(len(message))), message...)
+		request, _ := http.NewRequest("POST", httpServer.URL+path, bytes.NewReader(body))
+		request.Header.Set("Content-Type", "application/grpc")
+		response, err := client.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer response.Body.Close()
+		data, _ := io.ReadAll(response.Body)
+		if status := response.Header.Get("Grpc-Status"); status != "" {
+			return status + " " + response.Header.Get("Grpc-Message"), nil
+		}
+		if len(data) < 5 || int(binary.BigEndian.Uint32(data[1:5])) != len(data)-5 {
+			t.Fatal("malformed response " + strconv.Quote(string(data)))
+		}
+		return response.Trailer.Get("Grpc-Status"), data[5:]
+	}
+	ann := slices.Concat(bytesField(1, []byte("Ann")), varint(2, 30), varint(3, 1))
+	status, response := rpc("/pipefish.server/Older", bytesField(1, ann))
+	want := bytesField(1, slices.Concat(bytesField(1, []byte("Ann")), varint(2, 31), varint(3, 1)))
+	if status != "0" || !bytes.Equal(response, want) {
+		t.Fatal("unexpected response " + status + " " + strconv.Quote(string(response)))
+	}
+	status, response = rpc("/pipefish.server/Greet", bytesField(1, []byte("Bob")))
+	if status != "0" || !bytes.Equal(response, bytesField(1, []byte("Hello, Bob!"))) {
+		t.Fatal("unexpected response " + status + " " + strconv.Quote(string(response)))
+	}
+	status, response = rpc("/pipefish.server/Greet", slices.Concat(bytesField(1, []byte("Bob")), bytesField(2, []byte("Hi"))))
+	if status != "0" || !bytes.Equal(response, bytesField(1, []byte("Hi, Bob!"))) {
+		t.Fatal("unexpected response " + status + " " + strconv.Quote(string(response)))
+	}
+	failures := []struct {
+		path    string
+		message []byte
+		want    string
+	}{
+		{"/pipefish.server/Inverse", varint(1, 0), "2 division by zero"},
+		{"/pipefish.server/Older", bytesField(1, varint(3, 7)), "3 field p of OlderRequest: field favorite of Person: no element 7 of Color"},
+		{"/pipefish.server/Younger", nil, "12 the service \"server\" has no RPC Younger"},
+		{"/pipefish.nonesuch/Older", nil, "12 the hub has no working service \"nonesuch\""},
+	}
+	for _, test := range failures {
+		if status, _ := rpc(test.path, test.message); !strings.HasPrefix(status, test.want) {
+			t.Fatal("unexpected status " + strconv.Quote(status) + " from " + test.path)
+		}
+	}
+	// A message which claims to be longer than a request may be is refused before it's read.
+	request, _ := http.NewRequest("POST", httpServer.URL+"/pipefish.server/Older", bytes.NewReader([]byte{0, 0xff, 0xff, 0xff, 0xff}))
+	request.Header.Set("Content-Type", "application/grpc")
+	refused, err := client.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	refused.Body.Close()
+	if status := refused.Header.Get("Grpc-Status"); status != "8" {
+		t.Fatal("unexpected status " + strconv.Quote(status) + " for an oversized message")
+	}
+	// The hub serves the same description of the service as `pipefish gen proto`.
+	sv := h.Services["server"]
+	proto := initializer.ProtoFromApi("server", sv.SerializeApi()).String()
+	if !strings.Contains(proto, "rpc Older (OlderRequest) returns (OlderResponse);") ||
+		!strings.Contains(proto, "optional int64 age = 2;") {
+		t.Fatal("unexpected proto:\n" + proto)
+	}
+}
+
+func TestGoClient(t *testing.T) {
+	// no t.Parallel()
+	wd, _ := os.Getwd()
+	script := filepath.Join(wd, "test-files", "clients", "server.pf")
+	sv := pf.NewService()
+	if err := sv.InitializeFromFilepath(script); err != nil {
+		t.Fatal(err)
+	}
+	// The client in `test-files` is what `pipefish gen go` makes of the script.
+	code, err := initializer.GoClientFromApi("server", "server", sv.SerializeApi())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(wd, "test-files", "clients", "server", "client.go")); string(data) != code {
+		t.Fatal("the generated client is out of date:\n" + code)
+	}
+	// The same calls are made by a client in the same process and by one calling a hub.
+	dir := t.TempDir()
+	for _, name := range []string{"hub.env", "hub.hub", "hub.pf"} {
+		data, _ := os.ReadFile(filepath.Join(wd, "new-hub", name))
+		os.WriteFile(filepath.Join(dir, name), data, 0600)
+	}
+	var out bytes.Buffer
+	h := hub.New(dir, &out)
+	h.Do(`hub run "`+script+`"`, "", "", "", false)
+	httpServer := httptest.NewServer(h.HttpHandler())
+	defer httpServer.Close()
+	local, err := server.New(sv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote, err := server.Dial(httpServer.URL, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, client := range []*server.Client{local, remote} {
+		age := 30
+		person, err := client.Older(server.Person{Name: "Ann", Age: &age, Favorite: server.GREEN})
+		if err != nil || person.Name != "Ann" || person.Age == nil || *person.Age != 31 || person.Favorite != server.GREEN {
+			t.Fatalf("unexpected result %v, %v", person, err)
+		}
+		person, err = client.Older(server.Person{Name: "Bob"})
+		if err == nil {
+			t.Fatalf("expected an error, got %v", person)
+		}
+		if got, err := client.Greet("Cal", nil); got != "Hello, Cal!" || err != nil {
+			t.Fatalf("unexpected result %q, %v", got, err)
+		}
+		greeting := "Hi"
+		if got, err := client.Greet("Cal", &greeting); got != "Hi, Cal!" || err != nil {
+			t.Fatalf("unexpected result %q, %v", got, err)
+		}
+		if got, err := client.Double(21); got != 42 || err != nil {
+			t.Fatalf("unexpected result %v, %v", got, err)
+		}
+		if got, err := client.Favorites(server.BLUE); err != nil || got.T != pf.LIST {
+			t.Fatalf("unexpected result %v, %v", got, err)
+		}
+		_, err = client.Inverse(0)
+		var e *server.Error
+		if !errors.As(err, &e) || e.Message != "division by zero" {
+			t.Fatalf("unexpected error %v", err)
+		}
+	}
+}
+
+// Scripts which call the service on a hub through the Python and TypeScript clients.
+const pythonClientTest = `import sys
+import server
+c = server.Client(sys.argv[1])
+print(c.older(server.Person("Ann", 30, server.Color.GREEN)))
+print(c.greet("Cal", None), c.greet("Cal", "Hi"), c.double(21), c.half(3), c.initial("ab"))
+print(c.favorites(server.Color.BLUE), c.echo({1: ["a", 'b"\n'], "c": {2.5}}))
+try:
+    c.inverse(0)
+except server.PipefishError as e:
+    print(e)
+`
+
+const typeScriptClientTest = `import { Client, Color } from "%SERVER%";
+const c = new Client(process.argv[2]);
+console.log(JSON.stringify(await c.older({ name: "Ann", age: 30, favorite: Color.GREEN })));
+console.log(await c.greet("Cal", null), await c.greet("Cal", "Hi"), await c.double(21), await c.half(3), await c.initial("ab"));
+const echoed = (await c.echo(new Map<unknown, unknown>([[1, ["a", 'b"\n']]]))) as Map<unknown, unknown>;
+console.log(JSON.stringify(await c.favorites(Color.BLUE)), JSON.stringify([...echoed]));
+try {
+  await c.inverse(0);
+} catch (e) {
+  console.log((e as Error).message);
+}
+`
+
+func TestScriptClients(t *testing.T) {
+	// no t.Parallel()
+	wd, _ := os.Getwd()
+	clients := filepath.Join(wd, "test-files", "clients")
+	script := filepath.Join(clients, "server.pf")
+	sv := pf.NewService()
+	if err := sv.InitializeFromFilepath(script); err != nil {
+		t.Fatal(err)
+	}
+	// The clients in `test-files` are what `pipefish gen python` and `pipefish gen ts` make of the
+	// script.
+	for file, code := range map[string]string{
+		"server.py": initializer.PythonClientFromApi("server", sv.SerializeApi()),
+		"server.ts": initializer.TypeScriptClientFromApi("server", sv.SerializeApi()),
+	} {
+		if data, _ := os.ReadFile(filepath.Join(clients, file)); string(data) != code {
+			t.Fatal("the generated " + file + " is out of date:\n" + code)
+		}
+	}
+	// The clients are run if there's a Python, or a Node which can run TypeScript.
+	dir := t.TempDir()
+	for _, name := range []string{"hub.env", "hub.hub", "hub.pf"} {
+		data, _ := os.ReadFile(filepath.Join(wd, "new-hub", name))
+		os.WriteFile(filepath.Join(dir, name), data, 0600)
+	}
+	var out bytes.Buffer
+	h := hub.New(dir, &out)
+	h.Do(`hub run "`+script+`"`, "", "", "", false)
+	httpServer := httptest.NewServer(h.HttpHandler())
+	defer httpServer.Close()
+	if _, err := exec.LookPath("python3"); err != nil {
+		t.Log("skipping the Python client: no python3")
+	} else {
+		cmd := exec.Command("python3", "-c", pythonClientTest, httpServer.URL)
+		cmd.Dir = clients
+		cmd.Env = append(os.Environ(), "PYTHONDONTWRITEBYTECODE=1")
+		got, err := cmd.CombinedOutput()
+		want := "Person(name='Ann', age=31, favorite=<Color.GREEN: 'GREEN'>)\n" +
+			"Hello, Cal! Hi, Cal! 42 1.5 a\n" +
+			"[<Color.BLUE: 'BLUE'>, <Color.BLUE: 'BLUE'>] {1: ['a', 'b\"\\n'], 'c': {2.5}}\n" +
+			"division by zero\n"
+		if err != nil || string(got) != want {
+			t.Fatalf("unexpected output of the Python client %v:\n%s", err, got)
+		}
+	}
+	if exec.Command("node", "--experimental-transform-types", "-e", "").Run() != nil {
+		t.Log("skipping the TypeScript client: no node which runs TypeScript")
+	} else {
+		test := filepath.Join(dir, "test.ts")
+		os.WriteFile(test, []byte(strings.Replace(typeScriptClientTest, "%SERVER%", filepath.Join(clients, "server.ts"), 1)), 0600)
+		got, err := exec.Command("node", "--experimental-transform-types", "--no-warnings", test, httpServer.URL).CombinedOutput()
+		want := `{"name":"Ann","age":31,"favorite":"GREEN"}` + "\n" +
+			"Hello, Cal! Hi, Cal! 42 1.5 a\n" +
+			`["BLUE","BLUE"] [[1,["a","b\"\n"]]]` + "\n" +
+			"division by zero\n"
+		if err != nil || string(got) != want {
+			t.Fatalf("unexpected output of the TypeScript client %v:\n%s", err, got)
+		}
+	}
+}
+
+func TestResilientExternals(t *testing.T) {
+	// no t.Parallel()
+	wd, _ := os.Getwd()
+	dir := t.TempDir()
+	for _, name := range []string{"hub.env", "hub.hub", "hub.pf"} {
+		data, _ := os.ReadFile(filepath.Join(wd, "new-hub", name))
+		os.WriteFile(filepath.Join(dir, name), data, 0600)
+	}
+	// The stand-in for a hub serves a service whose functions fail in different ways, and counts
+	// the requests made of each of them.
+	var lock sync.Mutex
+	requests := map[string]int{}
+	standIn := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request struct{ Body, Session string }
+		json.NewDecoder(r.Body).Decode(&request)
+		name, _, _ := strings.Cut(request.Body, " ")
+		lock.Lock()
+		requests[name]++
+		count := requests[name]
+		lock.Unlock()
+		reply := func(body string) {
+			json.NewEncoder(w).Encode(map[string]string{"Body": body, "Session": "s1"})
+		}
+		switch name {
+		case "hub":
+			reply("FUNCTION | flaky | 0 | x int | int *AT 1\n" +
+				"FUNCTION | slow | 0 | x int | int *AT 1\n" +
+				"FUNCTION | down | 0 | x int | int *AT 1\n" +
+				"FUNCTION | secret | 0 | x int | int *AT 1\n" +
+				"FUNCTION | garbled | 0 | x int | int *AT 1\n" +
+				"FUNCTION | stale | 0 | x int | int *AT 1\n" +
+				"FUNCTION | invalid | 0 | x int | int *AT 1\n" +
+				"COMMAND | bump | 0 | x int | ok error *AT 2\n")
+		case "flaky":
+			if count <= 2 {
+				http.Error(w, "try again", http.StatusServiceUnavailable)
+				return
+			}
+			reply("2")
+		case "slow":
+			time.Sleep(300 * time.Millisecond)
+			reply("3")
+		case "down":
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+		case "secret":
+			http.Error(w, "bad password", http.StatusUnauthorized)
+		case "garbled":
+			w.Write([]byte("garbled"))
+		case "stale":
+			if request.Session != "" {
+				http.Error(w, "unknown or expired session", http.StatusBadRequest)
+				return
+			}
+			reply("4")
+		case "invalid":
+			http.Error(w, "bad request", http.StatusBadRequest)
+		case "bump":
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+		}
+	}))
+	defer standIn.Close()
+	client := filepath.Join(dir, "client.pf")
+	os.WriteFile(client, []byte("external\n\n\""+standIn.URL+"/stand\"\n\nvar\n\n"+
+		"$_externals = map(\"stand\"::map(\"timeout\"::0.2, \"backoff\"::0.01, \"breakAfter\"::3, \"breakFor\"::0.3))\n"), 0600)
+	var out bytes.Buffer
+	h := hub.New(dir, &out)
+	h.Do(`hub run "`+client+`"`, "", "", "", false)
+	call := func(line string) string {
+		out.Reset()
+		h.Do(line, "", "", "client", false)
+		return strings.TrimSpace(out.String())
+	}
+	tests := []struct {
+		line, want, function string
+		requests             int
+	}{
+		{`stand.flaky 1`, `2`, "flaky", 3},                  // A function is retried.
+		{`stand.secret 1`, `refused the call`, "secret", 1}, // Being unauthorized isn't worth retrying.
+		{`stand.garbled 1`, `didn't reply as a Pipefish hub`, "garbled", 1},
+		{`stand.stale 1`, `4`, "stale", 2},                                  // A request in a session the hub has forgotten is made again in a new one ...
+		{`stand.invalid 1`, `didn't reply as a Pipefish hub`, "invalid", 1}, // ... but other bad requests aren't.
+		{`stand.bump 1`, `didn't reply as a Pipefish hub`, "bump", 1},       // A command isn't retried.
+		{`stand.slow 1`, `timed out`, "slow", 3},
+		{`stand.down 1`, `can't reach external service`, "down", 3},     // The third failure in a row trips the breaker ...
+		{`stand.flaky 1`, `are suspended after 3 failures`, "flaky", 3}, // ... and so this call isn't made.
+	}
+	for _, test := range tests {
+		if got := call(test.line); !strings.Contains(got, test.want) {
+			t.Fatal("unexpected output " + strconv.Quote(got) + " from " + test.line)
+		}
+		lock.Lock()
+		got := requests[test.function]
+		lock.Unlock()
+		if got != test.requests {
+			t.Fatal("made " + strconv.Itoa(got) + " requests of " + test.function)
+		}
+	}
+	// Once the breaker has been open for long enough, it lets a call through.
+	time.Sleep(300 * time.Millisecond)
+	if got := call(`stand.flaky 1`); got != `2` {
+		t.Fatal("unexpected output " + strconv.Quote(got))
+	}
+	// The configuration is checked when the service is initialized.
+	os.WriteFile(client, []byte("external\n\n\""+standIn.URL+"/stand\"\n\nvar\n\n"+
+		"$_externals = map(\"stand\"::map(\"timeout\"::\"soon\"))\n"), 0600)
+	out.Reset()
+	h.Do(`hub run "`+client+`"`, "", "", "", false)
+	if got := out.String(); !strings.Contains(got, "should be a number of seconds") {
+		t.Fatal("unexpected output " + strconv.Quote(got))
+	}
+}
+
+func TestDefaultDatabase(t *testing.T) {
+	// no t.Parallel()
+	wd, _ := os.Getwd()
+	dir := t.TempDir()
+	for _, name := range []string{"hub.env", "hub.hub"} {
+		data, _ := os.ReadFile(filepath.Join(wd, "new-hub", name))
+		os.WriteFile(filepath.Join(dir, name), data, 0600)
+	}
+	os.WriteFile(filepath.Join(dir, "hub.pf"), []byte("const\n\nHUB_MAILER = \"memory:\"\n"), 0600)
+	var out bytes.Buffer
+	h := hub.New(dir, &out)
+	h.Do(`hub config admin "mmadmin", "Norma", "Mortenson", "marilyn@hollywood.org", "password123"`, "", "", "", false)
+	if got := strings.TrimSpace(out.String()); got != "You are logged on as \x1b[36mmmadmin\x1b[39m." {
+		t.Fatal("unexpected output " + strconv.Quote(got))
+	}
+	if _, err := os.Stat(filepath.Join(dir, "hub.db")); err != nil {
+		t.Fatal(err)
+	}
+	if version, err := hub.SchemaVersion(h.Db); err != nil || version != hub.LatestSchemaVersion() {
+		t.Fatal("schema is at version " + strconv.Itoa(version))
+	}
+	if err := hub.Migrate(h.Db); err != nil {
+		t.Fatal(err)
+	}
+	// The hub should find the database again when it's reopened.
+	out.Reset()
+	h = hub.New(dir, &out)
+	h.Do(`hub sign on "mmadmin", "password123"`, "", "", "", false)
+	if got := strings.TrimSpace(out.String()); got != "You are logged on as \x1b[36mmmadmin\x1b[39m." {
+		t.Fatal("unexpected output " + strconv.Quote(got))
+	}
+}
+
 func TestDump(t *testing.T) { // We want to make sure that if the service is broken, queries get handed off to the empty service.
 	// no t.Parallel()
 	test := []test_helper.TestItem{
 		{`hub run "../hub/test-files/dump.pf"`, `Starting script [36m"dump.pf"[39m as service [36m"dump"[39m.`},
-		{`hub dump "big"`, "# Function dump of `big`\n\n## Code dump for function `big` with sig int\n\n@71 : asgm m263 <- m261  // Assign to memory.\n@72 : gtei m262 <- m263 m265  // Int comparison with >=.\n@73 : asgm m266 <- m262  // Assign to memory.\n@74 : qtru m266 @77  // Test true.\n@75 : asgm m268 <- m267  // Assign to memory.\n@76 : jmp @78  // Jump.\n@77 : asgm m268 <- m3  // Assign to memory.\n@78 : qsat m268 @81  // Test not `UNSAT`.\n@79 : asgm m270 <- m268  // Assign to memory.\n@80 : jmp @82  // Jump.\n@81 : asgm m270 <- m269  // Assign to memory.\n@82 : ret  // Return."},
-		{`hub dump m "big"`, "# Function dump of `big`\n\n## Code dump for function `big` with sig int\n\n@71 : asgm m263 <- m261  // Assign to memory.\n@72 : gtei m262 <- m263 m265  // Int comparison with >=.\n@73 : asgm m266 <- m262  // Assign to memory.\n@74 : qtru m266 @77  // Test true.\n@75 : asgm m268 <- m267  // Assign to memory.\n@76 : jmp @78  // Jump.\n@77 : asgm m268 <- m3  // Assign to memory.\n@78 : qsat m268 @81  // Test not `UNSAT`.\n@79 : asgm m270 <- m268  // Assign to memory.\n@80 : jmp @82  // Jump.\n@81 : asgm m270 <- m269  // Assign to memory.\n@82 : ret  // Return.\n\n### Memory dump for function `big` with sig int`\n\nm261 : UNDEFINED VALUE::UNDEFINED VALUE!\nm262 : error::\x1b[31mError\x1b[39m: something unexpected has gone wrong at line \x1b[33m4:6-8\x1b[39m of \x1b[36m\"../hub/test-files/dump.pf\"\x1b[39m. \nm263 : UNDEFINED VALUE::UNDEFINED VALUE!\nm264 : BLING::>=\nm265 : int::100\nm266 : UNDEFINED VALUE::UNDEFINED VALUE!\nm267 : string::\"big\"\nm268 : UNDEFINED VALUE::UNDEFINED VALUE!\nm269 : string::\"small\"\nm270 : UNDEFINED VALUE::UNDEFINED VALUE!"},
+		{`hub dump "big"`, "# Function dump of `big`\n\n## Code dump for function `big` with sig int\n\n@71 : asgm m267 <- m265  // Assign to memory.\n@72 : gtei m266 <- m267 m269  // Int comparison with >=.\n@73 : asgm m270 <- m266  // Assign to memory.\n@74 : qtru m270 @77  // Test true.\n@75 : asgm m272 <- m271  // Assign to memory.\n@76 : jmp @78  // Jump.\n@77 : asgm m272 <- m3  // Assign to memory.\n@78 : qsat m272 @81  // Test not `UNSAT`.\n@79 : asgm m274 <- m272  // Assign to memory.\n@80 : jmp @82  // Jump.\n@81 : asgm m274 <- m273  // Assign to memory.\n@82 : ret  // Return."},
+		{`hub dump m "big"`, "# Function dump of `big`\n\n## Code dump for function `big` with sig int\n\n@71 : asgm m267 <- m265  // Assign to memory.\n@72 : gtei m266 <- m267 m269  // Int comparison with >=.\n@73 : asgm m270 <- m266  // Assign to memory.\n@74 : qtru m270 @77  // Test true.\n@75 : asgm m272 <- m271  // Assign to memory.\n@76 : jmp @78  // Jump.\n@77 : asgm m272 <- m3  // Assign to memory.\n@78 : qsat m272 @81  // Test not `UNSAT`.\n@79 : asgm m274 <- m272  // Assign to memory.\n@80 : jmp @82  // Jump.\n@81 : asgm m274 <- m273  // Assign to memory.\n@82 : ret  // Return.\n\n### Memory dump for function `big` with sig int`\n\nm265 : UNDEFINED VALUE::UNDEFINED VALUE!\nm266 : error::\x1b[31mError\x1b[39m: something unexpected has gone wrong at line \x1b[33m4:6-8\x1b[39m of \x1b[36m\"../hub/test-files/dump.pf\"\x1b[39m. \nm267 : UNDEFINED VALUE::UNDEFINED VALUE!\nm268 : BLING::>=\nm269 : int::100\nm270 : UNDEFINED VALUE::UNDEFINED VALUE!\nm271 : string::\"big\"\nm272 : UNDEFINED VALUE::UNDEFINED VALUE!\nm273 : string::\"small\"\nm274 : UNDEFINED VALUE::UNDEFINED VALUE!"},
 		{`hub halt "dump"`, `OK`},
 		{`hub quit`, "[32mOK[0m\n" + text.Logo() + "Thank you for using Pipefish. Have a nice day!"},
 	}
@@ -83,6 +1234,105 @@ func TestEnv(t *testing.T) {
 	test_helper.RunHubTest(t, "default", testB)
 }
 
+func TestScopedEnv(t *testing.T) {
+	// no t.Parallel()
+	test := []test_helper.TestItem{
+		{`hub run "../hub/test-files/env.pf" as "a"`, "Starting script \x1b[36m\"env.pf\"\x1b[39m as service \x1b[36m\"a\"\x1b[39m."},
+		{`hub run "../hub/test-files/env.pf" as "b"`, "Starting script \x1b[36m\"env.pf\"\x1b[39m as service \x1b[36m\"b\"\x1b[39m."},
+		{`hub env "k"::"everyone"`, `OK`},
+		{`hub env "a", "k"::"only a"`, `OK`},
+		{`show "k"`, `"everyone"`},
+		{`hub switch "a"`, `OK`},
+		{`show "k"`, `"only a"`},
+		{`hub delete env "k" from "a"`, `OK`},
+		{`show "k"`, `"everyone"`},
+		{`hub nuke env`, `OK`},
+		{`show "k"`, `"none"`},
+		{`hub halt "a"`, `OK`},
+		{`hub halt "b"`, `OK`},
+		{`hub quit`, "\x1b[32mOK\x1b[0m\n" + text.Logo() + "Thank you for using Pipefish. Have a nice day!"},
+	}
+	test_helper.RunHubTest(t, "default", test)
+}
+
+// On an administered hub, only an admin may change the env, and the store is only readable
+// by its owner, even if it was readable by others before.
+func TestEnvAdmin(t *testing.T) {
+	// no t.Parallel()
+	wd, _ := os.Getwd()
+	dir := t.TempDir()
+	for _, name := range []string{"hub.env", "hub.hub"} {
+		data, _ := os.ReadFile(filepath.Join(wd, "new-hub", name))
+		os.WriteFile(filepath.Join(dir, name), data, 0644)
+	}
+	os.WriteFile(filepath.Join(dir, "hub.pf"), []byte("import\n\nNULL::\"database/sql\"\n\nconst\n\n"+
+		"HUB_DB = SqlDb(SQLITE)\n\nHUB_MAILER = \"memory:\"\n"), 0600)
+	var out bytes.Buffer
+	h := hub.New(dir, &out)
+	h.Do(`hub config admin "mmadmin", "Norma", "Mortenson", "marilyn@hollywood.org", "password123"`, "", "", "", false)
+	defer h.Do(`hub nuke admin`, "mmadmin", "password123", "", false)
+	h.Do(`hub run "`+filepath.Join(wd, "test-files/env.pf")+`" as "env"`, "mmadmin", "password123", "", false)
+	for _, line := range []string{`hub env "k"::"v"`, `hub env "env", "k"::"v"`} {
+		out.Reset()
+		h.Do(line, "", "", "", false)
+		if !strings.Contains(out.String(), "admin status") {
+			t.Fatal("a caller who isn't an admin could change the env: " + strconv.Quote(out.String()))
+		}
+	}
+	out.Reset()
+	h.Do(`show "k"`, "mmadmin", "password123", "env", false)
+	if got := strings.TrimSpace(out.String()); got != `"none"` {
+		t.Fatal("unexpected output " + strconv.Quote(got))
+	}
+	out.Reset()
+	h.Do(`hub env "k"::"v"`, "mmadmin", "password123", "", false)
+	h.Do(`show "k"`, "mmadmin", "password123", "env", false)
+	if got := out.String(); !strings.Contains(got, `"v"`) {
+		t.Fatal("unexpected output " + strconv.Quote(got))
+	}
+	if runtime.GOOS == "windows" {
+		return
+	}
+	if info, _ := os.Stat(filepath.Join(dir, "hub.env")); info.Mode().Perm() != 0600 {
+		t.Fatal("unexpected permissions " + info.Mode().String())
+	}
+}
+
+// Stores in the format used before the hub used authenticated encryption should be converted.
+func TestOldEnvStore(t *testing.T) {
+	// no t.Parallel()
+	wd, _ := os.Getwd()
+	dir := t.TempDir()
+	for _, name := range []string{"hub.hub", "hub.pf"} {
+		data, _ := os.ReadFile(filepath.Join(wd, "new-hub", name))
+		os.WriteFile(filepath.Join(dir, name), data, 0600)
+	}
+	plaintext := "PLAINTEXT\n\"k\"::\"old\"\n"
+	plaintext += strings.Repeat(" ", aes.BlockSize-len(plaintext)%aes.BlockSize)
+	salt := make([]byte, 32)
+	rand.Read(salt)
+	block, _ := aes.NewCipher(pbkdf2.Key([]byte("Default key for testing."), salt, 65536, 32, sha256.New))
+	ciphertext := make([]byte, aes.BlockSize+len(plaintext))
+	rand.Read(ciphertext[:aes.BlockSize])
+	cipher.NewCBCEncrypter(block, ciphertext[:aes.BlockSize]).CryptBlocks(ciphertext[aes.BlockSize:], []byte(plaintext))
+	os.WriteFile(filepath.Join(dir, "hub.env"), append(salt, ciphertext...), 0600)
+
+	var out bytes.Buffer
+	hub.New(dir, &out)
+	data, _ := os.ReadFile(filepath.Join(dir, "hub.env"))
+	if !strings.HasPrefix(string(data), hub.ENV_ENCRYPTED+"\n") {
+		t.Fatal("store wasn't converted: " + strconv.Quote(string(data)))
+	}
+	h := hub.New(dir, &out)
+	out.Reset()
+	h.Do(`hub run "`+filepath.Join(wd, "test-files/env.pf")+`"`, "", "", "", false)
+	out.Reset()
+	h.Do(`show "k"`, "", "", "env", false)
+	if got := strings.TrimSpace(out.String()); got != `"old"` {
+		t.Fatal("unexpected output " + strconv.Quote(got))
+	}
+}
+
 func TestErrors(t *testing.T) {
 	// no t.Parallel()
 	test := []test_helper.TestItem{
@@ -94,6 +1344,100 @@ func TestErrors(t *testing.T) {
 	test_helper.RunHubTest(t, "default", test)
 }
 
+func TestHeadless(t *testing.T) {
+	// no t.Parallel()
+	if runtime.GOOS == "windows" {
+		return
+	}
+	wd, _ := os.Getwd()
+	dir := t.TempDir()
+	for _, name := range []string{"hub.env", "hub.hub", "hub.pf"} {
+		data, _ := os.ReadFile(filepath.Join(wd, "new-hub", name))
+		os.WriteFile(filepath.Join(dir, name), data, 0600)
+	}
+	var out bytes.Buffer
+	h := hub.New(dir, &out)
+	h.Do(`hub env key "", "sesame"`, "", "", "", false)
+	h.Do(`hub env "k"::"secret"`, "", "", "", false)
+	// A hub without a terminal can't ask for the env key.
+	out.Reset()
+	hub.NewHeadless(dir, &out, "open barley")
+	if !strings.Contains(out.String(), "env key is invalid") {
+		t.Fatal("unexpected output " + strconv.Quote(out.String()))
+	}
+	h = hub.NewHeadless(dir, &out, "sesame")
+	socket := filepath.Join(dir, hub.CONTROL_SOCKET)
+	if err := h.ServeControl(socket); err != nil {
+		t.Fatal(err)
+	}
+	// Only the owner can use the socket, and there's nothing left over from making it.
+	if info, err := os.Stat(socket); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatal("the control socket has the wrong permissions")
+	}
+	if leftovers, _ := filepath.Glob(filepath.Join(dir, ".hub-sock-*")); len(leftovers) != 0 {
+		t.Fatal("left behind " + strings.Join(leftovers, ", "))
+	}
+	ctl := func(line string) (string, bool) {
+		conn, err := net.Dial("unix", socket)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		json.NewEncoder(conn).Encode(map[string]string{"Type": "line", "Body": line})
+		dec := json.NewDecoder(conn)
+		output, failed := "", false
+		for {
+			var msg struct{ Type, Body string }
+			if err := dec.Decode(&msg); err != nil {
+				t.Fatal(err)
+			}
+			switch msg.Type {
+			case "output":
+				output += msg.Body
+			case "error":
+				failed = true
+			case "ready":
+				return strings.TrimSpace(output), failed
+			}
+		}
+	}
+	if got, failed := ctl(`hub run "` + filepath.Join(wd, "test-files/env.pf") + `"`); failed {
+		t.Fatal("unexpected output " + strconv.Quote(got))
+	}
+	if got, _ := ctl(`show "k"`); got != "secret" {
+		t.Fatal("unexpected output " + strconv.Quote(got))
+	}
+	if got, failed := ctl(`hub halt "nonesuch"`); !failed {
+		t.Fatal("unexpected output " + strconv.Quote(got))
+	}
+	// A client which doesn't answer a prompt is hung up on, and doesn't keep the hub locked.
+	hub.PROMPT_TIMEOUT = 100 * time.Millisecond
+	defer func() { hub.PROMPT_TIMEOUT = 2 * time.Minute }()
+	ctl(`hub run "` + filepath.Join(wd, "test-files/keyboard.pf") + `"`)
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	json.NewEncoder(conn).Encode(map[string]string{"Type": "line", "Body": "greet"})
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for dec := json.NewDecoder(conn); ; {
+		var msg struct{ Type, Body string }
+		if err := dec.Decode(&msg); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal("the hub didn't hang up: " + err.Error())
+		}
+	}
+	conn.Close()
+	if got, _ := ctl(`hub halt "keyboard"`); !strings.Contains(got, "OK") {
+		t.Fatal("unexpected output " + strconv.Quote(got))
+	}
+	ctl(`hub quit`)
+	if _, err := os.Stat(socket); !os.IsNotExist(err) {
+		t.Fatal("the control socket is still there")
+	}
+}
+
 func TestHttp(t *testing.T) {
 	// no t.Parallel()
 	test := []test_helper.TestItem{
@@ -108,6 +1452,178 @@ func TestHttp(t *testing.T) {
 	test_helper.RunHubTest(t, "default", test)
 }
 
+func TestHttpStop(t *testing.T) {
+	// no t.Parallel()
+	wd, _ := os.Getwd()
+	dir := t.TempDir()
+	for _, name := range []string{"hub.env", "hub.hub", "hub.pf"} {
+		data, _ := os.ReadFile(filepath.Join(wd, "new-hub", name))
+		os.WriteFile(filepath.Join(dir, name), data, 0600)
+	}
+	var out bytes.Buffer
+	h := hub.New(dir, &out)
+	// We can't listen to a port which is taken.
+	taken, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := strconv.Itoa(taken.Addr().(*net.TCPAddr).Port)
+	h.Do(`hub http `+port, "", "", "", false)
+	if !strings.Contains(out.String(), "error starting server") {
+		t.Fatal("unexpected output " + strconv.Quote(out.String()))
+	}
+	taken.Close()
+	out.Reset()
+	h.Do(`hub http `+port, "", "", "", false)
+	if got := strings.TrimSpace(out.String()); got != "\x1b[32mOK\x1b[0m" {
+		t.Fatal("unexpected output " + strconv.Quote(got))
+	}
+	resp, err := http.Post("http://localhost:"+port, "application/json", strings.NewReader(`{"Body": "hub services"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	out.Reset()
+	h.Do(`hub http stop 5`, "", "", "", false)
+	if got := strings.TrimSpace(out.String()); got != "\x1b[32mOK\x1b[0m" {
+		t.Fatal("unexpected output " + strconv.Quote(got))
+	}
+	if _, err := http.Post("http://localhost:"+port, "application/json", strings.NewReader(`{"Body": "hub services"}`)); err == nil {
+		t.Fatal("the hub is still listening")
+	}
+	out.Reset()
+	h.Do(`hub http stop`, "", "", "", false)
+	if !strings.Contains(out.String(), "isn't listening") {
+		t.Fatal("unexpected output " + strconv.Quote(out.String()))
+	}
+}
+
+func TestLiveReload(t *testing.T) { // We want the last version of a service which compiled to go on running if the new one doesn't.
+	// no t.Parallel()
+	wd, _ := os.Getwd()
+	dir := t.TempDir()
+	for _, name := range []string{"hub.env", "hub.hub", "hub.pf"} {
+		data, _ := os.ReadFile(filepath.Join(wd, "new-hub", name))
+		os.WriteFile(filepath.Join(dir, name), data, 0600)
+	}
+	script := filepath.Join(dir, "live.pf")
+	write := func(source string, age time.Duration) {
+		os.WriteFile(script, []byte(source), 0600)
+		when := time.Now().Add(-age)
+		os.Chtimes(script, when, when)
+	}
+	write("def\n\nanswer : 1\n", time.Hour)
+	var out bytes.Buffer
+	h := hub.New(dir, &out)
+	h.Do(`hub run "`+script+`"`, "", "", "", false)
+	h.Do(`hub live on`, "", "", "", false)
+	call := func() string {
+		out.Reset()
+		h.Do(`answer`, "", "", "live", false)
+		return strings.TrimSpace(out.String())
+	}
+	if got := call(); got != "1" {
+		t.Fatal("unexpected output " + strconv.Quote(got))
+	}
+	write("def\n\nanswer : fnurgle\n", time.Minute)
+	if got := call(); !strings.Contains(got, "will go on running the last version which compiled") || !strings.HasSuffix(got, "1") {
+		t.Fatal("unexpected output " + strconv.Quote(got))
+	}
+	// It doesn't try again until the file changes.
+	if got := call(); got != "1" {
+		t.Fatal("unexpected output " + strconv.Quote(got))
+	}
+	write("def\n\nanswer : 2\n", 0)
+	if got := call(); got != "2" {
+		t.Fatal("unexpected output " + strconv.Quote(got))
+	}
+}
+
+// Since the hub writes to it in the background in live mode.
+type lockedBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.String()
+}
+
+func (b *lockedBuffer) Reset() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.buf.Reset()
+}
+
+func TestWatcher(t *testing.T) { // A change to a module recompiles the services which import it, and those which depend on them.
+	// no t.Parallel()
+	wd, _ := os.Getwd()
+	dir := t.TempDir()
+	for _, name := range []string{"hub.env", "hub.hub"} {
+		data, _ := os.ReadFile(filepath.Join(wd, "new-hub", name))
+		os.WriteFile(filepath.Join(dir, name), data, 0600)
+	}
+	lib := filepath.Join(dir, "lib.pf")
+	os.WriteFile(lib, []byte("def\n\ng(x int) : x + 1\n"), 0600)
+	os.WriteFile(filepath.Join(dir, "a.pf"), []byte("import\n\n\"lib.pf\"\n\ndef\n\nf(x int) : lib.g(x)\n"), 0600)
+	os.WriteFile(filepath.Join(dir, "b.pf"), []byte("external\n\na\n\ndef\n\nh(x int) : a.f(x)\n"), 0600)
+	os.WriteFile(filepath.Join(dir, "hub.pf"), []byte("const\n\nHUB_CONFIG = map(\"services\"::map(\"a\"::\"a.pf\", \"b\"::\"b.pf\"))\n"), 0600)
+	out := &lockedBuffer{}
+	h := hub.New(dir, out)
+	h.Do(`hub live on`, "", "", "", false)
+	call := func(line, service string) string {
+		out.Reset()
+		h.Do(line, "", "", service, false)
+		return strings.TrimSpace(out.String())
+	}
+	if got := call(`h 1`, "b"); got != "2" {
+		t.Fatal("unexpected output " + strconv.Quote(got))
+	}
+	out.Reset()
+	os.WriteFile(lib, []byte("def\n\ng(x int) : x + 2\n"), 0600)
+	recompiled := "The service \x1b[36m\"b\"\x1b[39m has been recompiled."
+	for deadline := time.Now().Add(5 * time.Second); !strings.Contains(out.String(), recompiled); {
+		if time.Now().After(deadline) {
+			t.Fatal("unexpected output " + strconv.Quote(out.String()))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := call(`h 1`, "b"); got != "3" {
+		t.Fatal("unexpected output " + strconv.Quote(got))
+	}
+	// Live mode can be turned off and on, and the services used, over HTTP while the services
+	// are being recompiled.
+	server := httptest.NewServer(h.HttpHandler())
+	defer server.Close()
+	post := func(line string) {
+		resp, err := http.Post(server.URL, "application/json", strings.NewReader(`{"Body": "`+line+`", "Service": "b"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	for i := range 20 {
+		os.WriteFile(lib, []byte("def\n\ng(x int) : x + "+strconv.Itoa(i)+"\n"), 0600)
+		time.Sleep(reloadJitter[i%len(reloadJitter)])
+		post(`hub live off`)
+		post(`h 1`)
+		post(`hub live on`)
+	}
+	post(`hub live off`)
+}
+
+// Delays which straddle hub.RELOAD_DELAY, so that live mode is turned off before, during, and
+// after the recompilation.
+var reloadJitter = []time.Duration{0, 50 * time.Millisecond, 100 * time.Millisecond, 150 * time.Millisecond}
+
 func TestLog(t *testing.T) {
 	// no t.Parallel()
 	test := []test_helper.TestItem{
@@ -159,7 +1675,7 @@ func TestRbam(t *testing.T) {
 		{`jdean`, `password456`, `$ echo "Hello world!"`, "\x1b[31mHub error\x1b[39m: Only administrators can use the shell remotely."},
 		{`jdean`, `password456`, `hub sign off`, "\x1b[32mOK\x1b[39m\n\n┈┈┈┈┈┈┈┈┈┈┈┈┈┈┈┈┈┈┈┈┈┈┈┈┈┈┈┈┈┈┈┈┈┈┈┈┈┈┈┈┈┈┈┈┈┈┈┈┈┈┈┈┈┈┈┈┈┈┈┈┈┈┈┈┈┈┈┈┈┈┈┈┈┈┈┈┈┈┈┈┈┈┈┈┈┈┈┈┈┈┈┈\n\nThis is an administered hub and you aren't logged on. Please use either \x1b[0m\x1b[48;2;0;0;64m\x1b[97mhub register\x1b[0m to \x1b[0m\nregister as a guest; \x1b[0m\x1b[48;2;0;0;64m\x1b[97mhub forgot password(username, email string)\x1b[0m to replace your password; \x1b[0m\nor \x1b[0m\x1b[48;2;0;0;64m\x1b[97mhub sign on\x1b[0m to sign on if you're trying to use the hub on the terminal it's running on \x1b[0m\nand you're already registered with this hub."},
 		{``, ``, `$ echo "Hello world!"`, "\x1b[31mHub error\x1b[39m: Only administrators can use the shell remotely."},
-		{``, ``, `hub forgot password "jdean", "rebel@hollywood.org"`, "An email with a replacement password has been sent to \x1b[36mrebel@hollywood.org\x1b[39m."},
+		{``, ``, `hub forgot password "jdean", "rebel@hollywood.org"`, "If that is the email address of \x1b[36mjdean\x1b[39m, a reset token has been sent to it."},
 		{``, ``, `hub register "brando", "Marlon", "Brando", "kurtz@hollywood.org", "password000"`, "You are logged on as \x1b[36mbrando\x1b[39m."},
 		{`brando`, `password000`, `hub nuke my account`, "OK"},
 		{``, ``, `hub sign on "mmadmin", "password789"`, "You are logged on as \x1b[36mmmadmin\x1b[39m."},
@@ -173,6 +1689,37 @@ func TestRbam(t *testing.T) {
 	test_helper.RunUserTest(t, "rbam", test)
 }
 
+func TestFunctionAccess(t *testing.T) {
+	// no t.Parallel()
+	test := []test_helper.UserItem{
+		{``, ``, `hub config admin "mmadmin", "Norma", "Mortenson", "marilyn@hollywood.org", "password123"`, "You are logged on as \x1b[36mmmadmin\x1b[39m."},
+		{`mmadmin`, `password123`, `hub run "../hub/test-files/billing.pf"`, "Starting script \x1b[36m\"billing.pf\"\x1b[39m as service \x1b[36m\"billing\"\x1b[39m."},
+		{`mmadmin`, `password123`, `hub let "Users" use "billing"`, `OK`},
+		{`mmadmin`, `password123`, `hub create group "Finance"`, "OK"},
+		{`mmadmin`, `password123`, `hub let "Finance" call "billing.balance"`, "OK"},
+		{`mmadmin`, `password123`, `refund 5`, "5"},
+		{``, ``, `hub register "jdean", "James", "Dean", "rebel@hollywood.org", "password456"`, "You are logged on as \x1b[36mjdean\x1b[39m."},
+		{``, ``, `hub sign on "mmadmin", "password123"`, "You are logged on as \x1b[36mmmadmin\x1b[39m."},
+		{`mmadmin`, `password123`, `hub add "jdean" to "Users"`, "OK"},
+		{`mmadmin`, `password123`, `hub switch "billing"`, "OK"},
+		{`jdean`, `password456`, `refund 5`, "\x1b[31mHub error\x1b[39m: you have no access to the function \x1b[36mrefund\x1b[39m of the service \x1b[36m\"billing\"\x1b[39m."},
+		{`jdean`, `password456`, `balance 5`, "\x1b[31mHub error\x1b[39m: you have no access to the function \x1b[36mbalance\x1b[39m of the service \x1b[36m\"billing\"\x1b[39m."},
+		{`jdean`, `password456`, `$_access = map()`, "\x1b[31mHub error\x1b[39m: only an administrator may use the service variable \x1b[36m$_access\x1b[39m."},
+		{`jdean`, `password456`, `refund 5`, "\x1b[31mHub error\x1b[39m: you have no access to the function \x1b[36mrefund\x1b[39m of the service \x1b[36m\"billing\"\x1b[39m."},
+		{`mmadmin`, `password123`, `hub add "jdean" to "Finance"`, "OK"},
+		{`jdean`, `password456`, `refund 5`, "5"},
+		{`jdean`, `password456`, `balance 5`, "10"},
+		{`mmadmin`, `password123`, `hub unlet "Finance" call "billing.balance"`, "OK"},
+		{`mmadmin`, `password123`, `hub unadd "jdean" to "Finance"`, "OK"},
+		{`jdean`, `password456`, `balance 5`, "10"},
+		{`mmadmin`, `password123`, `hub let "Finance" call "balance"`, "\x1b[31mHub error\x1b[39m: the function should be given in the form \x1b[36mservice.function\x1b[39m."},
+		{`mmadmin`, `password123`, `hub halt "billing"`, "OK"},
+		{`mmadmin`, `password123`, `hub nuke admin`, "OK"},
+		{``, ``, `hub quit`, "\x1b[32mOK\x1b[0m\n" + text.Logo() + "Thank you for using Pipefish. Have a nice day!"},
+	}
+	test_helper.RunUserTest(t, "rbam", test)
+}
+
 func TestServices(t *testing.T) {
 	// no t.Parallel()
 	test := []test_helper.TestItem{
@@ -196,6 +1743,90 @@ func TestServices(t *testing.T) {
 	test_helper.RunHubTest(t, "default", test)
 }
 
+func TestSessions(t *testing.T) {
+	// no t.Parallel()
+	wd, _ := os.Getwd()
+	h := hub.New(filepath.Join(wd, "test-files/default"), io.Discard)
+	h.Do(`hub run "../hub/test-files/foo.pf"`, "", "", "", false)
+	h.Do(`hub run "../hub/test-files/bar.pf"`, "", "", "", false)
+	server := httptest.NewServer(h.HttpHandler())
+	defer server.Close()
+	type request = struct {
+		Body    string
+		Service string
+		Session string
+	}
+	type response = struct {
+		Body    string
+		Session string
+	}
+	post := func(req request) (response, int) {
+		b, _ := json.Marshal(req)
+		resp, err := http.Post(server.URL, "application/json", bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var result response
+		json.NewDecoder(resp.Body).Decode(&result)
+		result.Body = strings.TrimSpace(result.Body)
+		return result, resp.StatusCode
+	}
+	first, _ := post(request{Body: `hub switch "foo"`})
+	second, _ := post(request{Body: `hub switch "bar"`})
+	if first.Session == "" || first.Session == second.Session {
+		t.Fatal("expected two different sessions, got " + strconv.Quote(first.Session) + " and " + strconv.Quote(second.Session))
+	}
+	test := []struct {
+		session, input, want string
+	}{
+		{first.Session, `foo 2`, "4"},
+		{second.Session, `bar 2`, "6"},
+		{first.Session, `foo 3`, "6"},
+		{second.Session, `hub switch "foo"`, "OK"},
+		{second.Session, `foo 4`, "8"},
+	}
+	for _, item := range test {
+		got, _ := post(request{Body: item.input, Session: item.session})
+		if got.Body != item.want {
+			t.Fatal("\nOn input '" + item.input + "'\n    Exp : " + strconv.Quote(item.want) + "\n    Got : " + strconv.Quote(got.Body))
+		}
+	}
+	// Requests made at the same time are evaluated in their own sessions, and get their own output.
+	var wg sync.WaitGroup
+	for i := range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			item := request{Body: "foo " + strconv.Itoa(i), Session: first.Session}
+			want := strconv.Itoa(2 * i)
+			if i%2 == 1 {
+				item = request{Body: "bar " + strconv.Itoa(i), Service: "bar", Session: second.Session}
+				want = strconv.Itoa(3 * i)
+			}
+			b, _ := json.Marshal(item)
+			resp, err := http.Post(server.URL, "application/json", bytes.NewReader(b))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer resp.Body.Close()
+			var got response
+			json.NewDecoder(resp.Body).Decode(&got)
+			if strings.TrimSpace(got.Body) != want {
+				t.Error("\nOn input '" + item.Body + "'\n    Exp : " + strconv.Quote(want) + "\n    Got : " + strconv.Quote(got.Body))
+			}
+		}()
+	}
+	wg.Wait()
+	if _, status := post(request{Body: `foo 2`, Session: "nonsense"}); status != http.StatusBadRequest {
+		t.Fatal("expected unknown session to be refused, got status " + strconv.Itoa(status))
+	}
+	if h.CurrentServiceName() != "bar" {
+		t.Fatal("the remote sessions changed the current service of the terminal to " + strconv.Quote(h.CurrentServiceName()))
+	}
+}
+
 func TestShell(t *testing.T) {
 	// no t.Parallel()
 	test := []test_helper.TestItem{
@@ -232,3 +1863,140 @@ func TestValues(t *testing.T) {
 	}
 	test_helper.RunHubTest(t, "default", test)
 }
+
+func TestWebsocketAdministered(t *testing.T) {
+	// no t.Parallel()
+	wd, _ := os.Getwd()
+	dir := t.TempDir()
+	for _, name := range []string{"hub.env", "hub.hub"} {
+		data, _ := os.ReadFile(filepath.Join(wd, "new-hub", name))
+		os.WriteFile(filepath.Join(dir, name), data, 0600)
+	}
+	os.WriteFile(filepath.Join(dir, "hub.pf"), []byte("import\n\nNULL::\"database/sql\"\n\nconst\n\n"+
+		"HUB_DB = SqlDb(SQLITE)\n\nHUB_MAILER = \"memory:\"\n"), 0600)
+	h := hub.New(dir, io.Discard)
+	h.Do(`hub config admin "mmadmin", "Norma", "Mortenson", "marilyn@hollywood.org", "password123"`, "", "", "", false)
+	defer h.Do(`hub nuke admin`, "mmadmin", "password123", "", false)
+	server := httptest.NewServer(h.HttpHandler())
+	defer server.Close()
+	// A page on another site can't open a websocket to the hub.
+	if conn, err := websocket.Dial("ws"+server.URL[4:]+"/ws?format=ansi", "", "http://evil.example.com"); err == nil {
+		conn.Close()
+		t.Fatal("the hub accepted a websocket from another site")
+	}
+	conn, err := websocket.Dial("ws"+server.URL[4:]+"/ws?format=ansi", "", server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	type message = struct{ Type, Body string }
+	talk := func(msgType, line string) (string, message) {
+		websocket.JSON.Send(conn, message{Type: msgType, Body: line})
+		output := ""
+		for {
+			var msg message
+			if err := websocket.JSON.Receive(conn, &msg); err != nil {
+				t.Fatal(err)
+			}
+			if msg.Type != "output" {
+				return strings.TrimSpace(output), msg
+			}
+			output = output + msg.Body
+		}
+	}
+	talk("", "") // Gets us past the logo.
+	// A connection which hasn't signed on can't be prompted, and so can't use the wizards.
+	if got, next := talk("line", `hub sign on`); next.Type != "ready" || !strings.Contains(got, "sign on (uname, pword string)") {
+		t.Fatal("unexpected output " + strconv.Quote(got) + " followed by " + next.Type)
+	}
+	talk("line", `hub sign on "mmadmin", "password123"`)
+	if _, next := talk("line", `hub change password`); next.Type != "prompt" {
+		t.Fatal("unexpected message " + next.Type)
+	}
+	talk("input", "foo")
+	if got, _ := talk("input", "bar"); !strings.Contains(got, "don't match") {
+		t.Fatal("unexpected output " + strconv.Quote(got))
+	}
+	// A message bigger than a request may be is refused.
+	websocket.Message.Send(conn, `{"Type": "line", "Body": "`+strings.Repeat("x", 2<<20)+`"}`)
+	var msg message
+	if err := websocket.JSON.Receive(conn, &msg); err == nil {
+		t.Fatal("the hub accepted an oversized message")
+	}
+}
+
+func TestWebsocket(t *testing.T) {
+	// no t.Parallel()
+	wd, _ := os.Getwd()
+	h := hub.New(filepath.Join(wd, "test-files/default"), io.Discard)
+	h.Do(`hub run "../hub/test-files/keyboard.pf"`, "", "", "", false)
+	h.Do(`hub run "../hub/test-files/foo.pf"`, "", "", "", false)
+	server := httptest.NewServer(h.HttpHandler())
+	defer server.Close()
+	conn, err := websocket.Dial("ws"+server.URL[4:]+"/ws?format=ansi", "", server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	type message = struct {
+		Type   string
+		Body   string
+		Masked bool
+	}
+	// Sends the line and returns the output up to the next message which isn't output.
+	talk := func(msgType, line string) (string, message) {
+		websocket.JSON.Send(conn, message{Type: msgType, Body: line})
+		output := ""
+		for {
+			var msg message
+			if err := websocket.JSON.Receive(conn, &msg); err != nil {
+				t.Fatal(err)
+			}
+			if msg.Type != "output" {
+				return strings.TrimSpace(output), msg
+			}
+			output = output + msg.Body
+		}
+	}
+	talk("", "") // Gets us past the logo.
+	test := []struct {
+		msgType, input, want string
+		next                 message
+	}{
+		{"line", `hub switch "keyboard"`, "\x1b[32mOK\x1b[0m", message{Type: "ready", Body: "keyboard"}},
+		{"line", `greet`, "", message{Type: "prompt", Body: "Name? "}},
+		{"input", `Alice`, "Hello Alice!", message{Type: "ready", Body: "keyboard"}},
+		{"line", `hub switch "foo"`, "\x1b[32mOK\x1b[0m", message{Type: "ready", Body: "foo"}},
+		{"line", `foo 2`, "4", message{Type: "ready", Body: "foo"}},
+	}
+	for _, item := range test {
+		got, next := talk(item.msgType, item.input)
+		if got != item.want || next != item.next {
+			t.Fatal("\nOn input '" + item.input + "'\n    Exp : " + strconv.Quote(item.want) + ", " + item.next.Type + " " + strconv.Quote(item.next.Body) +
+				"\n    Got : " + strconv.Quote(got) + ", " + next.Type + " " + strconv.Quote(next.Body))
+		}
+	}
+	if h.CurrentServiceName() != "foo" {
+		t.Fatal("the websocket changed the current service of the terminal to " + strconv.Quote(h.CurrentServiceName()))
+	}
+	// A client which doesn't answer a prompt is hung up on, and doesn't keep the hub locked.
+	hub.PROMPT_TIMEOUT = 100 * time.Millisecond
+	defer func() { hub.PROMPT_TIMEOUT = 2 * time.Minute }()
+	talk("line", `hub switch "keyboard"`)
+	if _, next := talk("line", `greet`); next.Type != "prompt" {
+		t.Fatal("unexpected message " + next.Type)
+	}
+	done := make(chan bool)
+	go func() {
+		h.Do(`hub switch "foo"`, "", "", "", false)
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the hub is still locked")
+	}
+	var msg message
+	for websocket.JSON.Receive(conn, &msg) == nil {
+	}
+}
@@ -0,0 +1,381 @@
+package hub
+
+import (
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tim-hardcastle/pipefish/source/values"
+)
+
+// When the hub is listening to HTTP, it limits how often it can be called, so that no-one can
+// tie it up, e.g. by making it check passwords, which is slow on purpose. Requests are limited
+// by the IP address they come from, by the user making them, and by the service they're made
+// to, using a token bucket for each: a bucket holds up to a "burst" of tokens, each request uses
+// one, and they're replaced at a given rate per second. Signed-on users can also be given a
+// quota of requests per day, and requests can be limited in size.
+//
+// A batch of calls sent as one request (see `handleJsonRequest`) uses a token from the bucket of
+// its service and user, and a request from the user's quota, for each call. So long as there's a
+// token left, a batch is let through even if it needs more, and leaves the bucket owing the rest,
+// which means that a batch bigger than the burst isn't refused forever. It only uses one token
+// from the bucket of its address, since it's only one request.
+//
+// Users are only charged for a request once it's been authenticated, since otherwise anyone could
+// use up someone else's limits by claiming to be them. Anonymous requests, and the requests to a
+// hub without a database of users, are limited only by their address and service.
+//
+// A request which is refused for going over a limit gets the response 429, Too Many Requests;
+// one which is too big gets 413, Content Too Large; and an RPC refused for either reason gets the
+// gRPC status RESOURCE_EXHAUSTED. `hub stats` says how many there have been.
+//
+// The limits can be set by giving `limits` in the config of the hub (see `config.go`), or
+// `HUB_LIMITS` in an older hub, as a map from the names of the fields of `Limits` below,
+// starting with a lower-case letter, to numbers, e.g:
+//
+//	"limits"::map("ipRate"::2, "ipBurst"::10, "dailyQuota"::5000)
+//
+// Any limit which isn't given has the value in DEFAULT_LIMITS, and a limit of 0 means there's
+// no limit. The counts are kept in memory, and so start again when the hub does.
+
+type Limits struct {
+	IpRate       float64 // Requests per second from each IP address.
+	IpBurst      float64
+	UserRate     float64 // Requests per second from each user.
+	UserBurst    float64
+	ServiceRate  float64 // Requests per second to each service.
+	ServiceBurst float64
+	MaxBody      int64 // The maximum size of the body of a request, in bytes.
+	DailyQuota   int   // The number of requests a user can make in a day, starting at midnight UTC.
+}
+
+var DEFAULT_LIMITS = Limits{
+	IpRate:       10,
+	IpBurst:      20,
+	UserRate:     10,
+	UserBurst:    20,
+	ServiceRate:  100,
+	ServiceBurst: 200,
+	MaxBody:      1 << 20,
+	DailyQuota:   0,
+}
+
+// Why a request was refused.
+const (
+	REFUSED_IP      = "IP rate limit"
+	REFUSED_USER    = "user rate limit"
+	REFUSED_SERVICE = "service rate limit"
+	REFUSED_QUOTA   = "daily quota"
+	REFUSED_SIZE    = "request size limit"
+)
+
+var refusals = []string{REFUSED_IP, REFUSED_USER, REFUSED_SERVICE, REFUSED_QUOTA, REFUSED_SIZE}
+
+// We stop keeping track of buckets which have filled up again once there are this many.
+const MAX_BUCKETS = 10000
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type quota struct {
+	day   string
+	count int
+}
+
+type limiter struct {
+	limits   Limits
+	lock     sync.Mutex
+	buckets  map[string]*bucket // Keyed by what's being limited and its name, e.g. "ip 127.0.0.1".
+	quotas   map[string]*quota  // Keyed by username. Only holds the quotas for `today`.
+	today    string
+	requests int
+	refused  map[string]int // Keyed by the reason for refusing.
+}
+
+func newLimiter(limits Limits) *limiter {
+	return &limiter{
+		limits:  limits,
+		buckets: map[string]*bucket{},
+		quotas:  map[string]*quota{},
+		refused: map[string]int{},
+	}
+}
+
+// Reads the limits from a map, which may be nil. The name says where the map came from, for
+// the error messages.
+func limitsFromMap(v any, name string) (Limits, error) {
+	limits := DEFAULT_LIMITS
+	if v == nil {
+		return limits, nil
+	}
+	m, ok := v.(values.Map)
+	if !ok {
+		return limits, errors.New(name + " should be a map")
+	}
+	fields := map[string]*float64{
+		"ipRate":       &limits.IpRate,
+		"ipBurst":      &limits.IpBurst,
+		"userRate":     &limits.UserRate,
+		"userBurst":    &limits.UserBurst,
+		"serviceRate":  &limits.ServiceRate,
+		"serviceBurst": &limits.ServiceBurst,
+	}
+	var err error
+	m.Range(func(k, v values.Value) {
+		key, _ := k.V.(string)
+		var n float64
+		switch v.T {
+		case values.INT:
+			n = float64(v.V.(int))
+		case values.FLOAT:
+			n = v.V.(float64)
+		default:
+			err = errors.New("the limit `" + key + "` in " + name + " should be a number")
+			return
+		}
+		if n < 0 {
+			err = errors.New("the limit `" + key + "` in " + name + " can't be negative")
+			return
+		}
+		switch key {
+		case "maxBody":
+			limits.MaxBody = int64(n)
+		case "dailyQuota":
+			limits.DailyQuota = int(n)
+		default:
+			field, ok := fields[key]
+			if !ok {
+				err = errors.New(name + " has no limit `" + key + "`")
+				return
+			}
+			*field = n
+		}
+	})
+	return limits, err
+}
+
+// Changes the limits, keeping count of what's been used so far.
+func (l *limiter) setLimits(limits Limits) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.limits = limits
+}
+
+// Returns the limits, which may be changed at any time by `hub reload config`.
+func (l *limiter) getLimits() Limits {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.limits
+}
+
+// Takes the number of tokens from the bucket if there is at least one, leaving it in debt if
+// there are fewer. The lock should be held.
+func (l *limiter) take(key string, rate, burst float64, n int) bool {
+	if rate == 0 || burst == 0 {
+		return true
+	}
+	now := time.Now()
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= MAX_BUCKETS {
+			l.prune(now)
+		}
+		b = &bucket{tokens: burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens -= float64(n)
+	return true
+}
+
+// Forgets the buckets which have filled up again, since they're as good as new.
+func (l *limiter) prune(now time.Time) {
+	for key, b := range l.buckets {
+		kind, _, _ := strings.Cut(key, " ")
+		rate, burst := l.limits.IpRate, l.limits.IpBurst
+		switch kind {
+		case "user":
+			rate, burst = l.limits.UserRate, l.limits.UserBurst
+		case "service":
+			rate, burst = l.limits.ServiceRate, l.limits.ServiceBurst
+		}
+		if b.tokens+now.Sub(b.last).Seconds()*rate >= burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// Returns the reason for refusing a request from the address, or "" if it's allowed.
+func (l *limiter) admitAddress(addr string) string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.requests++
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	if !l.take("ip "+addr, l.limits.IpRate, l.limits.IpBurst, 1) {
+		l.refused[REFUSED_IP]++
+		return REFUSED_IP
+	}
+	return ""
+}
+
+// Returns the reason for refusing a request making the number of calls to the service, or "" if
+// it's allowed.
+func (l *limiter) admitService(service string, calls int) string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if !l.take("service "+service, l.limits.ServiceRate, l.limits.ServiceBurst, calls) {
+		l.refused[REFUSED_SERVICE]++
+		return REFUSED_SERVICE
+	}
+	return ""
+}
+
+// Returns the reason for refusing a request by the user making the number of calls, or "" if it's
+// allowed. This should only be called once we know who the user is.
+func (l *limiter) admitUser(username string, calls int) string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if !l.take("user "+username, l.limits.UserRate, l.limits.UserBurst, calls) {
+		l.refused[REFUSED_USER]++
+		return REFUSED_USER
+	}
+	if l.limits.DailyQuota > 0 {
+		today := time.Now().UTC().Format("2006-01-02")
+		if today != l.today { // Then yesterday's quotas are no use to anyone.
+			l.quotas = map[string]*quota{}
+			l.today = today
+		}
+		q, ok := l.quotas[username]
+		if !ok {
+			q = &quota{day: today}
+			l.quotas[username] = q
+		}
+		if q.count+calls > l.limits.DailyQuota {
+			l.refused[REFUSED_QUOTA]++
+			return REFUSED_QUOTA
+		}
+		q.count += calls
+	}
+	return ""
+}
+
+func (l *limiter) refuseSize() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.refused[REFUSED_SIZE]++
+}
+
+// Wraps the hub's HTTP handler so that requests are limited by address and size.
+func (h *Hub) limitRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limits := h.limiter.getLimits()
+		if !h.refuse(w, r, h.limiter.admitAddress(r.RemoteAddr)) {
+			return
+		}
+		if limits.MaxBody > 0 {
+			r.Body = http.MaxBytesReader(w, r.Body, limits.MaxBody)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Says whether a request making the number of calls to the service is allowed, and if not,
+// responds accordingly.
+func (h *Hub) admitRequest(w http.ResponseWriter, r *http.Request, service string, calls int) bool {
+	return h.refuse(w, r, h.limiter.admitService(service, calls))
+}
+
+// Says whether a request from the authenticated user making the number of calls is allowed, and
+// if not, responds accordingly.
+func (h *Hub) admitUser(w http.ResponseWriter, r *http.Request, username string, calls int) bool {
+	return h.refuse(w, r, h.limiter.admitUser(username, calls))
+}
+
+// Responds to a request refused for the given reason, and returns false, unless the reason is
+// "", in which case it returns true. An RPC is refused with a gRPC status rather than 429.
+func (h *Hub) refuse(w http.ResponseWriter, r *http.Request, reason string) bool {
+	if reason == "" {
+		return true
+	}
+	limits := h.limiter.getLimits()
+	var retryAfter int
+	switch reason {
+	case REFUSED_IP:
+		retryAfter = int(math.Ceil(1 / limits.IpRate))
+	case REFUSED_USER:
+		retryAfter = int(math.Ceil(1 / limits.UserRate))
+	case REFUSED_SERVICE:
+		retryAfter = int(math.Ceil(1 / limits.ServiceRate))
+	case REFUSED_QUOTA:
+		retryAfter = int(time.Until(nextMidnight()).Seconds()) + 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	if isGrpc(r) {
+		grpcStatus(w, GRPC_RESOURCE_EXHAUSTED, "too many requests: over the "+reason)
+		return false
+	}
+	http.Error(w, "too many requests: over the "+reason, http.StatusTooManyRequests)
+	return false
+}
+
+func nextMidnight() time.Time {
+	return time.Now().UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+}
+
+// Responds to a request whose body we couldn't decode, which may be because it was too big.
+func (h *Hub) badRequest(w http.ResponseWriter, err error) {
+	var tooBig *http.MaxBytesError
+	if errors.As(err, &tooBig) {
+		h.limiter.refuseSize()
+		http.Error(w, "request body is larger than "+strconv.FormatInt(tooBig.Limit, 10)+" bytes", http.StatusRequestEntityTooLarge)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusBadRequest)
+}
+
+func (h *Hub) showStats() {
+	l := h.limiter
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	var buf strings.Builder
+	total := 0
+	for _, n := range l.refused {
+		total += n
+	}
+	buf.WriteString("The hub has had " + strconv.Itoa(l.requests) + " HTTP requests, and has refused " + strconv.Itoa(total) + " of them.\n")
+	for _, reason := range refusals {
+		if l.refused[reason] > 0 {
+			buf.WriteString(BULLET + "Over the " + reason + ": " + strconv.Itoa(l.refused[reason]) + "\n")
+		}
+	}
+	today := time.Now().UTC().Format("2006-01-02")
+	users := []string{}
+	for username, q := range l.quotas {
+		if q.day == today {
+			users = append(users, username)
+		}
+	}
+	if len(users) > 0 {
+		sort.Strings(users)
+		buf.WriteString("\nRequests today by user:\n")
+		for _, username := range users {
+			buf.WriteString(BULLET + Cyan(username) + ": " + strconv.Itoa(l.quotas[username].count) +
+				" of " + strconv.Itoa(l.limits.DailyQuota) + "\n")
+		}
+	}
+	h.WriteString(buf.String())
+}
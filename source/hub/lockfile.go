@@ -0,0 +1,110 @@
+package hub
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/tim-hardcastle/pipefish/source/initializer"
+	"github.com/tim-hardcastle/pipefish/source/pf"
+	"github.com/tim-hardcastle/pipefish/source/text"
+	"github.com/tim-hardcastle/pipefish/source/values"
+)
+
+// `pipefish api diff <old> <new>` says how one API differs from another, and whether the
+// changes would break a client built against the old one; it exits with a status of 1 if they
+// would. Each API may be given either as a Pipefish script, or as a file containing a
+// serialized API, e.g. the output of `hub serialize`.
+//
+// `pipefish api lock <script>` records the APIs of the external services the script declares
+// in its lockfile. See `initializer/api_versions.go`.
+
+func Api() {
+	if len(os.Args) < 3 {
+		println("`api` needs to be followed by `diff` or `lock`.")
+		os.Exit(6)
+	}
+	switch os.Args[2] {
+	case "diff":
+		if len(os.Args) != 5 {
+			println("Wrong number of arguments for `api diff`.")
+			os.Exit(6)
+		}
+		oldAPI := readApi(os.Args[3])
+		newAPI := readApi(os.Args[4])
+		changes := initializer.DiffApis(oldAPI, newAPI)
+		if len(changes) == 0 {
+			fmt.Print("\nThe APIs are the same.\n\n")
+			os.Exit(0)
+		}
+		status := 0
+		fmt.Println()
+		for _, change := range changes {
+			if change.Breaking {
+				fmt.Println(BULLET + Red("Breaking") + ": the " + change.Description + ".")
+				status = 1
+			} else {
+				fmt.Println(BULLET + Green("Compatible") + ": the " + change.Description + ".")
+			}
+		}
+		fmt.Println()
+		os.Exit(status)
+	case "lock":
+		if len(os.Args) != 4 {
+			println("Wrong number of arguments for `api lock`.")
+			os.Exit(6)
+		}
+		filename := os.Args[3]
+		path := initializer.LockfilePath(filename)
+		apis := initializeForCli(filename).ExternalApis()
+		if len(apis) == 0 {
+			fmt.Println("\nThe script " + text.CYAN + "\"" + filename + "\"" + text.RESET + " has no external services.\n")
+			os.Exit(0)
+		}
+		if err := initializer.WriteLockfile(path, apis); err != nil {
+			fmt.Println("\nPipefish can't write the lockfile " + text.CYAN + "\"" + path + "\"" + text.RESET + ": " + err.Error() + ".\n")
+			os.Exit(7)
+		}
+		services := strconv.Itoa(len(apis)) + " external services"
+		if len(apis) == 1 {
+			services = "1 external service"
+		}
+		fmt.Println("\nRecorded the APIs of " + services + " in " + text.CYAN + "\"" + filepath.Base(path) + "\"" + text.RESET + ".\n")
+		os.Exit(0)
+	default:
+		println("`api` needs to be followed by `diff` or `lock`.")
+		os.Exit(6)
+	}
+}
+
+// Reads an API from a file, which may be a Pipefish script or a serialized API.
+func readApi(filename string) string {
+	if filepath.Ext(filename) == ".pf" {
+		return initializeForCli(filename).SerializeApi()
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		fmt.Println("\nPipefish can't read the file " + text.CYAN + "\"" + filename + "\"" + text.RESET + ": " + err.Error() + ".\n")
+		os.Exit(7)
+	}
+	return string(data)
+}
+
+// Initializes a script, or if it has errors, reports them and exits. Since this is done to find
+// the APIs of the script and its external services, and e.g. to remake its lockfile, the APIs
+// aren't checked against the lockfile.
+func initializeForCli(filename string) *pf.Service {
+	newService := pf.NewService()
+	newService.SetIgnoreLockfile(true)
+	newService.InitializeFromFilepathWithStore(filename, values.Map{})
+	if newService.IsBroken() {
+		fmt.Println("\nThere were errors running the script " + text.CYAN + "\"" + filename + "\"" + text.RESET + ".\n")
+		s, _ := newService.GetErrorReport()
+		mdFunc := newService.GetMarkdowner("", 92, values.Map{})
+		fmt.Println(mdFunc(s))
+		fmt.Println()
+		os.Exit(3)
+	}
+	return newService
+}
@@ -0,0 +1,61 @@
+package hub
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/tim-hardcastle/pipefish/source/settings"
+	"github.com/tim-hardcastle/pipefish/source/text"
+)
+
+// Runs the `pipefish` command-line interface.
+func Main() {
+	if len(os.Args) == 1 {
+		showhelp()
+		return
+	}
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "-h", "--help", "help":
+			showhelp()
+			return
+		case "-v", "--version", "version":
+			os.Stdout.WriteString("\nPipefish version " + text.VERSION + ".\n\n")
+			return
+		case "-r", "--run", "run":
+			StartServiceFromCli()
+		case "serve":
+			Serve()
+		case "ctl":
+			Ctl()
+		case "api":
+			Api()
+		case "gen":
+			Gen()
+		case "build":
+			Build()
+		case "-t", "--tui", "tui": // Left blank to avoid the default.
+		case "-w", "--w", "wiki":
+			GetWiki()
+		default:
+			os.Stdout.WriteString("\nPipefish doesn't recognize the command '" + os.Args[1] + "'.\n")
+			println()
+			showhelp()
+			os.Exit(1)
+		}
+	}
+
+	fmt.Print(text.Logo())
+	bytes, _ := os.ReadFile(filepath.Join(settings.PipefishHomeDirectory, ("user/hub.dat")))
+	filename := string(bytes)
+	if filepath.IsLocal(filename) {
+		filepath.Join(settings.PipefishHomeDirectory, filename)
+	}
+	h := New(filename, os.Stdout)
+	h.Repl()
+}
+
+func showhelp() {
+	os.Stdout.WriteString(HELP)
+}
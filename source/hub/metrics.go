@@ -0,0 +1,261 @@
+package hub
+
+import (
+	"fmt"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tim-hardcastle/pipefish/source/lexer"
+	"github.com/tim-hardcastle/pipefish/source/token"
+)
+
+// If `metrics` is true in the config of an administered hub (see `config.go`), or in an older
+// hub `HUB_METRICS = true` is given in its `hub.pf` file, then when the hub is listening to
+// HTTP it serves metrics at `/metrics` in the Prometheus text format. The client must supply
+// the username and password of an admin by basic authentication.
+//
+// The metrics are: the number and duration of the requests made to each service, broken down by
+// the function or command called; the number of errors by Pipefish error ID; the number of
+// operations each service's vm has performed, and the size of its memory; how often each service
+// has been recompiled in live mode; how many requests the hub has refused, and why; and some
+// statistics about the Go runtime.
+//
+// A request is counted as calling the first function or command of the service that appears
+// in it, if any. Since the labels come from what the client sends, a hub command the hub doesn't
+// have is counted as "other", and a service it doesn't have as "", so that no-one can make the
+// hub keep track of as many labels as they like.
+
+// The upper bounds of the buckets of the histogram of request durations, in seconds.
+var LATENCY_BUCKETS = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type requestLabels struct {
+	service, function string
+}
+
+type histogram struct {
+	buckets []uint64 // The number of observations in each bucket, not cumulatively.
+	sum     float64
+	count   uint64
+}
+
+type metrics struct {
+	lock     sync.Mutex
+	requests map[requestLabels]*histogram
+	errors   map[string]uint64 // Keyed by error ID.
+	reloads  map[string]uint64 // Keyed by service.
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		requests: map[requestLabels]*histogram{},
+		errors:   map[string]uint64{},
+		reloads:  map[string]uint64{},
+	}
+}
+
+func (m *metrics) observeRequest(labels requestLabels, start time.Time) {
+	seconds := time.Since(start).Seconds()
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	hist, ok := m.requests[labels]
+	if !ok {
+		hist = &histogram{buckets: make([]uint64, len(LATENCY_BUCKETS))}
+		m.requests[labels] = hist
+	}
+	for i, bound := range LATENCY_BUCKETS {
+		if seconds <= bound {
+			hist.buckets[i]++
+			break
+		}
+	}
+	hist.sum += seconds
+	hist.count++
+}
+
+func (m *metrics) countError(errorId string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.errors[errorId]++
+}
+
+func (m *metrics) countReload(service string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.reloads[service]++
+}
+
+// Works out which service and function a line is for.
+func (h *Hub) labelsOf(line, service string) requestLabels {
+	if words := strings.Fields(line); len(words) > 0 && words[0] == "hub" {
+		if len(words) == 1 {
+			return requestLabels{"hub", ""}
+		}
+		if hub, ok := h.getService("hub"); ok && hub.HasFunction(words[1]) {
+			return requestLabels{"hub", words[1]}
+		}
+		return requestLabels{"hub", "other"}
+	}
+	sv, ok := h.getService(service)
+	if !ok {
+		return requestLabels{"", ""}
+	}
+	if sv.IsBroken() {
+		return requestLabels{service, ""}
+	}
+	rl := lexer.NewRelexer("REPL input", line)
+	for tok := rl.NextToken(); tok.Type != token.EOF; tok = rl.NextToken() {
+		if tok.Type == token.IDENT && sv.HasFunction(tok.Literal) {
+			return requestLabels{service, tok.Literal}
+		}
+	}
+	return requestLabels{service, ""}
+}
+
+func (h *Hub) metricsEnabled() bool {
+	return h.config.Metrics && h.administered()
+}
+
+// Has the vms of the services count the operations they perform just when the hub is keeping
+// metrics, since counting them slows the vms down.
+func (h *Hub) countInstructions() {
+	for _, sv := range h.servicesSnapshot() {
+		sv.SetCountInstructions(h.metricsEnabled())
+	}
+}
+
+func (h *Hub) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if !h.metricsEnabled() {
+		http.NotFound(w, r)
+		return
+	}
+	username, password, ok := r.BasicAuth()
+	if ok && ValidateUser(h.Db, username, password) == nil {
+		ok, _ = IsUserAdmin(h.Db, username)
+	} else {
+		ok = false
+	}
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Basic realm="Pipefish hub"`)
+		http.Error(w, "the metrics of the hub can only be seen by an admin", http.StatusUnauthorized)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write([]byte(h.writeMetrics()))
+}
+
+// Returns the metrics in the Prometheus text exposition format.
+func (h *Hub) writeMetrics() string {
+	var buf strings.Builder
+	header := func(name, kind, help string) {
+		buf.WriteString("# HELP " + name + " " + help + "\n# TYPE " + name + " " + kind + "\n")
+	}
+	sample := func(name string, value any, labels ...string) {
+		buf.WriteString(name)
+		if len(labels) > 0 {
+			buf.WriteString("{")
+			for i := 0; i < len(labels); i += 2 {
+				if i > 0 {
+					buf.WriteString(",")
+				}
+				buf.WriteString(labels[i] + "=" + escapeLabel(labels[i+1]))
+			}
+			buf.WriteString("}")
+		}
+		buf.WriteString(" " + fmt.Sprint(value) + "\n")
+	}
+
+	m := h.metrics
+	m.lock.Lock()
+	labels := make([]requestLabels, 0, len(m.requests))
+	for l := range m.requests {
+		labels = append(labels, l)
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		return labels[i].service < labels[j].service ||
+			labels[i].service == labels[j].service && labels[i].function < labels[j].function
+	})
+	byService := map[string]uint64{}
+	for _, l := range labels {
+		byService[l.service] += m.requests[l].count
+	}
+	header("pipefish_requests_total", "counter", "Requests made to each service by remote clients.")
+	for _, service := range sortedKeys(byService) {
+		sample("pipefish_requests_total", byService[service], "service", service)
+	}
+	header("pipefish_request_duration_seconds", "histogram", "Time taken to handle requests, by service and function.")
+	for _, l := range labels {
+		hist := m.requests[l]
+		cumulative := uint64(0)
+		for i, bound := range LATENCY_BUCKETS {
+			cumulative += hist.buckets[i]
+			sample("pipefish_request_duration_seconds_bucket", cumulative, "service", l.service, "function", l.function, "le", strconv.FormatFloat(bound, 'g', -1, 64))
+		}
+		sample("pipefish_request_duration_seconds_bucket", hist.count, "service", l.service, "function", l.function, "le", "+Inf")
+		sample("pipefish_request_duration_seconds_sum", hist.sum, "service", l.service, "function", l.function)
+		sample("pipefish_request_duration_seconds_count", hist.count, "service", l.service, "function", l.function)
+	}
+	header("pipefish_errors_total", "counter", "Pipefish errors, by error ID.")
+	for _, id := range sortedKeys(m.errors) {
+		sample("pipefish_errors_total", m.errors[id], "id", id)
+	}
+	header("pipefish_service_reloads_total", "counter", "Times each service has been recompiled in live mode.")
+	for _, service := range sortedKeys(m.reloads) {
+		sample("pipefish_service_reloads_total", m.reloads[service], "service", service)
+	}
+	m.lock.Unlock()
+
+	services := h.servicesSnapshot()
+	delete(services, "")
+	header("pipefish_vm_instructions_total", "counter", "Operations performed by the vm of each service.")
+	for _, name := range sortedKeys(services) {
+		sample("pipefish_vm_instructions_total", services[name].InstructionCount(), "service", name)
+	}
+	header("pipefish_vm_memory_values", "gauge", "Values in the memory of the vm of each service.")
+	for _, name := range sortedKeys(services) {
+		sample("pipefish_vm_memory_values", services[name].MemorySize(), "service", name)
+	}
+
+	l := h.limiter
+	l.lock.Lock()
+	header("pipefish_http_requests_total", "counter", "HTTP requests made to the hub.")
+	sample("pipefish_http_requests_total", l.requests)
+	header("pipefish_http_requests_refused_total", "counter", "HTTP requests refused by the hub, by reason.")
+	for _, reason := range refusals {
+		sample("pipefish_http_requests_refused_total", l.refused[reason], "reason", reason)
+	}
+	l.lock.Unlock()
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	header("go_goroutines", "gauge", "Number of goroutines that currently exist.")
+	sample("go_goroutines", runtime.NumGoroutine())
+	header("go_memstats_alloc_bytes", "gauge", "Number of bytes allocated and still in use.")
+	sample("go_memstats_alloc_bytes", mem.Alloc)
+	header("go_memstats_sys_bytes", "gauge", "Number of bytes obtained from the system.")
+	sample("go_memstats_sys_bytes", mem.Sys)
+	header("go_memstats_heap_objects", "gauge", "Number of allocated objects.")
+	sample("go_memstats_heap_objects", mem.HeapObjects)
+	header("go_gc_cycles_total", "counter", "Number of completed GC cycles.")
+	sample("go_gc_cycles_total", mem.NumGC)
+	header("go_info", "gauge", "Information about the Go environment.")
+	sample("go_info", 1, "version", runtime.Version())
+	return buf.String()
+}
+
+func escapeLabel(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s) + `"`
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
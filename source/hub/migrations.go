@@ -0,0 +1,123 @@
+package hub
+
+import (
+	"database/sql"
+)
+
+// The schema of the hub's tables is versioned, so that when Pipefish needs to change it, the
+// database of a hub made by an older version can be brought up to date. The version is kept
+// in the table `PipefishSchema`, and `Migrate` applies whichever of the migrations below it
+// hasn't applied yet, in order, each in a transaction of its own.
+//
+// To change the schema, add a migration to the end of the list. Don't alter one that's been
+// released, since hubs which have already applied it won't apply it again.
+//
+// The first three migrations make the tables that existed before there were migrations, and so
+// they must be harmless to apply to a database which already has those tables.
+var migrations = []string{
+	// 1: Users and groups.
+	`CREATE TABLE IF NOT EXISTS PipefishUsers (
+    username varchar(32),
+    firstName varchar(32),
+    lastName varchar(32),
+    password varchar(60),
+    email varchar(60),
+PRIMARY KEY (username));
+
+CREATE TABLE IF NOT EXISTS PipefishGroups (
+    groupName varchar(32),
+PRIMARY KEY (groupName));
+
+CREATE TABLE IF NOT EXISTS PipefishGroupMemberships (
+    username varchar(32) REFERENCES PipefishUsers ON DELETE CASCADE,
+    groupName varchar(32) REFERENCES PipefishGroups ON DELETE CASCADE,
+    owner BOOLEAN DEFAULT FALSE,
+PRIMARY KEY (username, groupName));
+
+CREATE TABLE IF NOT EXISTS PipefishGroupServices (
+    groupName varchar(32) REFERENCES PipefishGroups ON DELETE CASCADE,
+	serviceName varchar(32),
+PRIMARY KEY (groupName, serviceName));
+
+INSERT INTO PipefishGroups (groupName)
+VALUES('Admin')
+ON CONFLICT DO NOTHING;
+
+INSERT INTO PipefishGroups (groupName)
+VALUES('Users')
+ON CONFLICT DO NOTHING;
+
+INSERT INTO PipefishGroups (groupName)
+VALUES('Guests')
+ON CONFLICT DO NOTHING;`,
+
+	// 2: The audit log. This is append-only: there are functions to add to it and to read it,
+	// but none to change or delete anything.
+	`CREATE TABLE IF NOT EXISTS PipefishAudit (
+    time varchar(32),
+    username varchar(32),
+    address varchar(64),
+    verb varchar(32),
+    args text,
+    outcome text);`,
+
+	// 3: Functions and commands of a service which have been restricted to particular groups
+	// by `hub let (grp) call (fn)`. A function which isn't mentioned can be called by anyone
+	// with access to the service.
+	`CREATE TABLE IF NOT EXISTS PipefishGroupFunctions (
+    groupName varchar(32) REFERENCES PipefishGroups ON DELETE CASCADE,
+    serviceName varchar(32),
+    functionName varchar(32),
+PRIMARY KEY (groupName, serviceName, functionName));`,
+
+	// 4: Tokens for resetting forgotten passwords. We keep a hash of the token rather than the
+	// token itself, so that someone who can read the database can't use them.
+	`CREATE TABLE IF NOT EXISTS PipefishResetTokens (
+    tokenHash varchar(64),
+    username varchar(32) REFERENCES PipefishUsers ON DELETE CASCADE,
+    created varchar(32),
+    used BOOLEAN DEFAULT FALSE,
+PRIMARY KEY (tokenHash));`,
+}
+
+// Brings the schema of the database up to date.
+func Migrate(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS PipefishSchema (version integer)`)
+	if err != nil {
+		return err
+	}
+	version, err := SchemaVersion(db)
+	if err != nil {
+		return err
+	}
+	for i := version; i < len(migrations); i++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err = tx.Exec(migrations[i]); err == nil {
+			_, err = tx.Exec(`INSERT INTO PipefishSchema (version) VALUES ($1)`, i+1)
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err = tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the number of migrations which have been applied to the database.
+func SchemaVersion(db *sql.DB) (int, error) {
+	var version int
+	err := db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM PipefishSchema`).Scan(&version)
+	return version, err
+}
+
+// The number of migrations there are, so that a database which has had them all applied
+// has this as its `SchemaVersion`.
+func LatestSchemaVersion() int {
+	return len(migrations)
+}
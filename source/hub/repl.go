@@ -4,6 +4,7 @@ import (
 	"os"
 	"regexp"
 	"strings"
+	"sync"
 
 	"github.com/lmorg/readline/v4"
 	"github.com/tim-hardcastle/pipefish/source/text"
@@ -16,7 +17,30 @@ func (h *Hub) Repl() {
 	rline.SyntaxHighlighter = func(code []rune) string {
 		return h.Services["hub"].Highlight(code, h.getFonts())
 	}
+	// What the watcher has said since the line being edited was begun. See `watcher.go`.
+	var noteLock sync.Mutex
+	note := ""
+	rline.HintText = func([]rune, int) []rune {
+		noteLock.Lock()
+		defer noteLock.Unlock()
+		return []rune(note)
+	}
+	setNote := func(s string) {
+		noteLock.Lock()
+		note = s
+		noteLock.Unlock()
+	}
+	h.doLock.Lock()
+	h.hint = func(s string) {
+		setNote(s)
+		rline.ForceHintTextUpdate(s)
+	}
+	h.atRepl = true
+	h.doLock.Unlock()
 	for {
+		h.doLock.Lock()
+		h.writeWaiting()
+		h.doLock.Unlock()
 
 		ws := ""
 		input := ""
@@ -81,6 +105,7 @@ func (h *Hub) Repl() {
 		for {
 			rline.SetPrompt(makePrompt(h, ws != ""))
 			line, err := rline.ReadlineWithDefault(ws)
+			setNote("")
 			if err == readline.ErrCtrlC {
 				print("\nQuit Pipefish? [Y/n] ")
 				ch := ReadChar()
@@ -88,6 +113,7 @@ func (h *Hub) Repl() {
 				if ch == 'n' || ch == 'N' {
 					println(text.Green("OK"))
 				} else {
+					h.doLock.Lock()
 					h.Quit()
 					return
 				}
@@ -112,7 +138,9 @@ func (h *Hub) Repl() {
 		input = strings.TrimSpace(input)
 		sv := h.Services[h.CurrentServiceName()]
 		sv.SetOutHandler(sv.MakeTerminalOutHandler())
-		h.Do(input, h.TerminalUsername, h.TerminalPassword, h.CurrentServiceName(), false)
+		h.doLock.Lock()
+		h.doInSession(input, h.terminal, false)
+		h.doLock.Unlock()
 	}
 }
 
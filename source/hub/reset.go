@@ -0,0 +1,144 @@
+package hub
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Someone who has forgotten their password can get it reset in two steps. First they do `hub
+// forgot password (usr, email)`, and if the username and email match an account, the hub emails
+// them a reset token. Then they do `hub reset password (token, pword)` to change their password.
+//
+// A token can only be used once, and is good for RESET_TOKEN_LIFETIME; and a user can't be sent
+// more than MAX_RESET_REQUESTS tokens in that time, so that the hub can't be used to flood their
+// inbox. The hub says the same thing whether or not the username and email match, and whether
+// or not we've sent too many tokens, so as not to tell anyone who has an account.
+//
+// As well as through the hub commands, this can be done by posting JSON to `/forgot-password`
+// and `/reset-password` when the hub is listening to HTTP, which doesn't require the client to
+// be signed on.
+
+var (
+	RESET_TOKEN_LIFETIME = time.Hour
+	MAX_RESET_REQUESTS   = 3
+)
+
+// Sends a reset token to the user if they exist and haven't had too many. The error is only
+// for things going wrong, and not for the email failing to match. Since things can only go
+// wrong if the account exists, the error goes in the audit log, and the caller is told the
+// same thing as usual.
+func (h *Hub) forgotPassword(username, email string) error {
+	if ValidateEmail(h.Db, username, email) != nil {
+		return nil
+	}
+	since := time.Now().Add(-RESET_TOKEN_LIFETIME).UTC().Format(AUDIT_TIME_FORMAT)
+	DeleteResetTokensBefore(h.Db, since)
+	count, err := CountResetTokens(h.Db, username, since)
+	if err != nil {
+		return err
+	}
+	if count >= MAX_RESET_REQUESTS {
+		return nil
+	}
+	b := make([]byte, 16)
+	rand.Read(b)
+	token := hex.EncodeToString(b)
+	err = AddResetToken(h.Db, username, hashToken(token), time.Now().UTC().Format(AUDIT_TIME_FORMAT))
+	if err != nil {
+		return err
+	}
+	return h.sendMail(email, "Password reset for "+username,
+		"Someone, hopefully you, has asked to reset the password of your account "+username+".\n\n"+
+			"To do so, use the hub command:\n\n"+
+			"hub reset password \""+token+"\", \"<your new password>\"\n\n"+
+			"This token can be used once, and expires in "+RESET_TOKEN_LIFETIME.String()+". "+
+			"If you didn't ask to reset your password, you can ignore this email.")
+}
+
+// Changes the password of the user the token was issued to, and returns their username.
+func (h *Hub) resetPassword(token, password string) (string, error) {
+	if password == "" {
+		return "", errors.New("the new password can't be empty")
+	}
+	since := time.Now().Add(-RESET_TOKEN_LIFETIME).UTC().Format(AUDIT_TIME_FORMAT)
+	username, err := ResetPassword(h.Db, hashToken(strings.TrimSpace(token)), since, password)
+	if err != nil {
+		return "", err
+	}
+	// Anyone signed on with the old password should be signed off.
+	h.signOff(func(s *Session) bool { return s.username == username })
+	return username, nil
+}
+
+// The tokens are random and long enough that we don't need to salt them or use a slow hash, and
+// we do need to be able to look them up by their hashes.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+type forgotPasswordRequest = struct {
+	Username string
+	Email    string
+}
+
+type resetPasswordRequest = struct {
+	Token    string
+	Password string
+}
+
+func (h *Hub) handleForgotPassword(w http.ResponseWriter, r *http.Request) {
+	var request forgotPasswordRequest
+	if !h.decodeRbamRequest(w, r, &request) {
+		return
+	}
+	err := h.forgotPassword(request.Username, request.Email)
+	h.auditRequest(r, "forgot-password", []string{request.Username, request.Email}, err)
+	json.NewEncoder(w).Encode(jsonResponse{Body: "If that is the email address of " + request.Username +
+		", a reset token has been sent to it."})
+}
+
+func (h *Hub) handleResetPassword(w http.ResponseWriter, r *http.Request) {
+	var request resetPasswordRequest
+	if !h.decodeRbamRequest(w, r, &request) {
+		return
+	}
+	username, err := h.resetPassword(request.Token, request.Password)
+	h.auditRequest(r, "reset-password", []string{request.Token, request.Password}, err)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(w).Encode(jsonResponse{Body: "The password of " + username + " has been changed."})
+}
+
+func (h *Hub) decodeRbamRequest(w http.ResponseWriter, r *http.Request, request any) bool {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	if !h.administered() {
+		http.Error(w, "this hub doesn't have RBAM intitialized", http.StatusNotFound)
+		return false
+	}
+	if err := json.NewDecoder(r.Body).Decode(request); err != nil {
+		h.badRequest(w, err)
+		return false
+	}
+	return true
+}
+
+// Audits a request which doesn't go through `hub.Do`.
+func (h *Hub) auditRequest(r *http.Request, verb string, args []string, err error) {
+	outcome := "OK"
+	if err != nil {
+		outcome = err.Error()
+	}
+	h.addAuditEntry("", r.RemoteAddr, verb, args, outcome)
+}
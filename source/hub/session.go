@@ -0,0 +1,136 @@
+package hub
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"time"
+
+	"github.com/tim-hardcastle/pipefish/source/pf"
+)
+
+// A session holds the state of the hub which belongs to one person using it rather than to
+// the hub as a whole: their current service, who they're signed on as, and the errors
+// produced by the last thing they did, which are what `hub why`, `hub where`, `hub values`,
+// etc, report on.
+//
+// The person using the terminal has a session of their own, `h.terminal`, which is the one
+// the hub uses by default. Each websocket connection has its own session; and HTTP clients
+// are given a session by the hub, which they can keep using by supplying its `Id` in their
+// requests.
+type Session struct {
+	Id                 string
+	service            string
+	username, password string
+	addr               string // Where the session's requests come from, for the audit log.
+	ers                []*pf.Error
+	lastUsed           time.Time
+}
+
+// Sessions which haven't been used for this long are forgotten.
+var SESSION_TIMEOUT = 24 * time.Hour
+
+// How often the hub looks for sessions to forget, while it has any.
+var SESSION_PRUNE_INTERVAL = 10 * time.Minute
+
+func (h *Hub) newSession() *Session {
+	b := make([]byte, 16)
+	rand.Read(b)
+	s := &Session{Id: hex.EncodeToString(b), ers: []*pf.Error{}, lastUsed: time.Now()}
+	h.sessionLock.Lock()
+	defer h.sessionLock.Unlock()
+	h.sessions[s.Id] = s
+	if h.pruner == nil {
+		h.pruner = time.AfterFunc(SESSION_PRUNE_INTERVAL, h.pruneSessions)
+	}
+	return s
+}
+
+// Forgets the sessions which have timed out, and then waits to do it again if there are any
+// sessions left.
+func (h *Hub) pruneSessions() {
+	h.sessionLock.Lock()
+	defer h.sessionLock.Unlock()
+	for id, old := range h.sessions {
+		if time.Since(old.lastUsed) > SESSION_TIMEOUT {
+			delete(h.sessions, id)
+		}
+	}
+	if len(h.sessions) == 0 {
+		h.pruner = nil
+		return
+	}
+	h.pruner.Reset(SESSION_PRUNE_INTERVAL)
+}
+
+// The number of sessions the hub is keeping.
+func (h *Hub) SessionCount() int {
+	h.sessionLock.Lock()
+	defer h.sessionLock.Unlock()
+	return len(h.sessions)
+}
+
+func (h *Hub) getSession(id string) (*Session, bool) {
+	h.sessionLock.Lock()
+	defer h.sessionLock.Unlock()
+	s, ok := h.sessions[id]
+	if ok && time.Since(s.lastUsed) > SESSION_TIMEOUT {
+		delete(h.sessions, id)
+		return nil, false
+	}
+	return s, ok
+}
+
+// Signs off whoever is signed on in the sessions which satisfy the predicate, e.g. because
+// their account no longer exists.
+func (h *Hub) signOff(pred func(s *Session) bool) {
+	h.sessionLock.Lock()
+	defer h.sessionLock.Unlock()
+	sessions := []*Session{h.terminal}
+	for _, s := range h.sessions {
+		sessions = append(sessions, s)
+	}
+	for _, s := range sessions {
+		if pred(s) {
+			s.username, s.password, s.service = "", "", ""
+		}
+	}
+}
+
+// This evaluates the line on behalf of the session, using the credentials the session is
+// signed on with and its current service, and then restores whatever session the hub was
+// acting for before. It doesn't take the hub's lock, since the line may be a request from a
+// service which is itself being run by the hub on behalf of some other session.
+func (h *Hub) doInSession(line string, s *Session, external bool) {
+	oldSession := h.session
+	h.session = s
+	defer func() { h.session = oldSession }() // Even if evaluating the line panics.
+	s.lastUsed = time.Now()
+	if external {
+		defer h.metrics.observeRequest(h.labelsOf(line, s.service), s.lastUsed)
+	}
+	h.Do(line, s.username, s.password, s.service, external)
+}
+
+// This evaluates the line on behalf of the session like `doInSession`, but with the output of
+// the hub and the services going to the writer, and with the keyboard input the services ask
+// for coming from the handler, rather than the terminal. The caller should hold the hub's lock.
+func (h *Hub) doRedirected(line string, s *Session, external bool, out io.Writer, kb pf.KeyboardHandler) {
+	oldOut := h.Out
+	h.Out = out
+	defer func() { h.Out = oldOut }()
+	hubService, _ := h.getService("hub")
+	sv, _ := h.getService(s.service)
+	for _, sv := range []*pf.Service{hubService, sv} {
+		if sv != nil && !sv.IsBroken() {
+			oldHandler, _ := sv.GetOutHandler()
+			sv.SetOutHandler(sv.MakeWritingOutHandler(out))
+			sv.SetKeyboardHandler(kb)
+			defer func() {
+				sv.SetOutHandler(oldHandler)
+				sv.SetKeyboardHandler(nil)
+			}()
+		}
+	}
+	h.doInSession(line, s, external)
+}
@@ -0,0 +1,250 @@
+package hub
+
+import (
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// In live mode, the hub doesn't only recompile a service when it's used after its code has
+// changed: it also watches the files which the services it's running are compiled from,
+// including the modules they import, and when one of them changes, it recompiles the services
+// compiled from it in the background. It then recompiles the services which depend on those
+// through their `external` declarations (see `graph.go`), since they use stubs made from the
+// APIs of the old versions. The services are recompiled in the order the hub would start them
+// in.
+//
+// Editors may write a file in more than one go, and so the hub waits until the files have
+// stopped changing for RELOAD_DELAY before recompiling anything.
+//
+// The services are compiled without holding the `doLock`, so that the hub goes on serving
+// requests with the old versions in the meantime, and it's only held while each new version
+// is swapped in. The hub says what it's recompiled as soon as it's done. At the REPL, so as not
+// to get in the way of what's being typed, it says so in the hint below the line being edited,
+// and keeps the rest of what it has to say, e.g. the errors, until the next prompt.
+
+var RELOAD_DELAY = 100 * time.Millisecond
+
+type watcher struct {
+	fs      *fsnotify.Watcher
+	lock    sync.Mutex
+	dirs    map[string]bool     // The directories being watched, since editors may replace a file rather than write to it.
+	files   map[string][]string // The names of the services compiled from each file, by its absolute path.
+	changed map[string]bool     // The files which have changed since the services were last recompiled.
+	timer   *time.Timer
+	// Held while the services are being recompiled, so that if the files change again in the
+	// meantime, the next recompilation waits for this one, and so finishes after it.
+	reloading sync.Mutex
+}
+
+// The watcher may be started and stopped by one goroutine while another is recompiling the
+// services, and so `h.watcher` is only used while holding `h.watcherLock`.
+func (h *Hub) getWatcher() *watcher {
+	h.watcherLock.Lock()
+	defer h.watcherLock.Unlock()
+	return h.watcher
+}
+
+func (h *Hub) startWatching() error {
+	h.watcherLock.Lock()
+	if h.watcher != nil {
+		h.watcherLock.Unlock()
+		return nil
+	}
+	fsw, err := fsnotify.NewWatcher()
+	if err != nil {
+		h.watcherLock.Unlock()
+		return err
+	}
+	w := &watcher{fs: fsw, dirs: map[string]bool{}, files: map[string][]string{}, changed: map[string]bool{}}
+	h.watcher = w
+	h.watcherLock.Unlock()
+	h.watchServices()
+	go h.watch(w)
+	return nil
+}
+
+func (h *Hub) stopWatching() {
+	h.watcherLock.Lock()
+	w := h.watcher
+	h.watcher = nil
+	h.watcherLock.Unlock()
+	if w == nil {
+		return
+	}
+	w.lock.Lock()
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+	w.lock.Unlock()
+	w.fs.Close()
+}
+
+// Brings what's being watched up to date with the services the hub is running, and the files
+// they're compiled from.
+func (h *Hub) watchServices() {
+	w := h.getWatcher()
+	if w == nil {
+		return
+	}
+	files := map[string][]string{}
+	dirs := map[string]bool{}
+	for name, sv := range h.servicesSnapshot() {
+		if name == "" || name == "hub" {
+			continue
+		}
+		paths, err := sv.GetSourceFilepaths()
+		if err != nil {
+			continue
+		}
+		for _, path := range paths {
+			path, err = filepath.Abs(path)
+			if err != nil {
+				continue
+			}
+			files[path] = append(files[path], name)
+			dirs[filepath.Dir(path)] = true
+		}
+	}
+	for _, names := range files {
+		slices.Sort(names)
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	for dir := range dirs {
+		if !w.dirs[dir] && w.fs.Add(dir) == nil {
+			w.dirs[dir] = true
+		}
+	}
+	for dir := range w.dirs {
+		if !dirs[dir] {
+			w.fs.Remove(dir)
+			delete(w.dirs, dir)
+		}
+	}
+	w.files = files
+}
+
+func (h *Hub) watch(w *watcher) {
+	for {
+		select {
+		case event, ok := <-w.fs.Events:
+			if !ok {
+				return // The watcher has been closed.
+			}
+			if !event.Has(fsnotify.Write) && !event.Has(fsnotify.Create) {
+				continue
+			}
+			w.lock.Lock()
+			if _, ok := w.files[event.Name]; ok {
+				w.changed[event.Name] = true
+				if w.timer != nil {
+					w.timer.Stop()
+				}
+				w.timer = time.AfterFunc(RELOAD_DELAY, func() { h.reloadChanged(w) })
+			}
+			w.lock.Unlock()
+		case _, ok := <-w.fs.Errors:
+			// We may have missed a change, but then the service will still be recompiled
+			// when it's next used.
+			if !ok {
+				return
+			}
+		}
+	}
+}
+
+// Recompiles the services compiled from the files which have changed, and the services which
+// depend on them. Each service is compiled without the `doLock`, and then installed while
+// holding it, like anything else which changes the services or where the hub's output goes, so
+// that it doesn't happen in the middle of a request. Since the services are compiled one after
+// another, in order, each one is compiled against the new versions of those it depends on.
+func (h *Hub) reloadChanged(w *watcher) {
+	w.reloading.Lock()
+	defer w.reloading.Unlock()
+	if h.getWatcher() != w { // Then live mode has been turned off since.
+		return
+	}
+	affected := map[string]bool{}
+	w.lock.Lock()
+	for file := range w.changed {
+		for _, name := range w.files[file] {
+			affected[name] = true
+		}
+	}
+	w.changed = map[string]bool{}
+	w.lock.Unlock()
+	names, paths := h.runningServices()
+	graph := dependencyGraph(names, paths)
+	order, _ := startupOrder(graph)
+	toBuild := []string{}
+	for _, name := range order { // Since the dependencies come first, one pass finds all the dependents.
+		dependencies, _ := graph.Get(name)
+		for dependency := range affected {
+			if dependencies.Contains(dependency) {
+				affected[name] = true
+				break
+			}
+		}
+		if affected[name] {
+			toBuild = append(toBuild, name)
+		}
+	}
+	for _, name := range toBuild {
+		h.doLock.Lock()
+		b := h.prepareBuild(name, paths[name])
+		h.doLock.Unlock()
+		b.compile()
+		if !h.installReload(w, b) {
+			return
+		}
+	}
+	if len(toBuild) > 0 {
+		h.watchServices()
+	}
+}
+
+// Installs a service which the watcher has recompiled and says so, unless live mode has been
+// turned off since, in which case it returns false.
+func (h *Hub) installReload(w *watcher, b *build) bool {
+	h.doLock.Lock()
+	defer h.doLock.Unlock()
+	if h.getWatcher() != w {
+		return false
+	}
+	out := h.Out
+	var buf strings.Builder
+	if h.atRepl {
+		h.Out = &buf
+	}
+	hint := "The service \"" + b.name + "\" didn't compile: the errors will be shown at the next prompt."
+	ok := h.installBuild(b, true)
+	if ok {
+		h.metrics.countReload(b.name)
+		h.WritePretty("The service <C>\"" + b.name + "\"</> has been recompiled.")
+		hint = "The service \"" + b.name + "\" has been recompiled."
+	}
+	if h.atRepl {
+		h.Out = out
+		if !ok || h.hint == nil { // Otherwise the hint has said all there is to say.
+			h.waiting.WriteString(buf.String())
+		}
+		if h.hint != nil {
+			h.hint(hint)
+		}
+	}
+	return true
+}
+
+// Writes what the hub has said in the background since the last prompt, if anything. The
+// caller should hold the `doLock`.
+func (h *Hub) writeWaiting() {
+	if h.waiting.Len() > 0 {
+		h.WriteString(h.waiting.String() + "\n")
+		h.waiting.Reset()
+	}
+}
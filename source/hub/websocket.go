@@ -0,0 +1,182 @@
+package hub
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/websocket"
+
+	"github.com/tim-hardcastle/pipefish/source/text"
+)
+
+// This lets people use the hub from a browser, by serving an interactive session over a
+// websocket at `/ws` when the hub is listening to HTTP or HTTPS.
+//
+// The client and the hub talk to one another by exchanging JSON objects of type `wsMessage`.
+// The client sends messages of type "line", containing a line of input, as though it had been
+// typed into the REPL; and of type "input", in answer to a prompt from the hub. The hub sends
+// messages of type "output"; of type "prompt" when something does `get ... from Keyboard(...)`;
+// and of type "ready" when it has finished dealing with a line, with the `Body` of the message
+// being the name of the client's current service, so that the client can make a prompt out of
+// it.
+//
+// Output is converted to HTML unless the client connects with `/ws?format=ansi`, in which case
+// it is left with the control codes that a terminal uses.
+//
+// Each connection has its own session, and so its own current service, signed-on user, and
+// errors.
+//
+// Since a browser will open a websocket to any site a page asks it to, and send the cookies
+// for that site, the hub only accepts connections from pages it served itself, or from clients
+// which aren't browsers, and so send no `Origin`. A message can be no bigger than a request can
+// (see `limits.go`). And since the hub holds its lock while it waits for an answer to a prompt,
+// a connection which hasn't signed on to an administered hub can't be prompted: the hub's setup
+// wizards tell it to give its arguments instead, e.g. `hub sign on (uname, pword string)`.
+
+type wsMessage = struct {
+	Type   string
+	Body   string
+	Masked bool // Whether a prompt is for input which should be masked for privacy.
+}
+
+type wsConnection struct {
+	hub     *Hub
+	conn    *websocket.Conn
+	html    bool
+	session *Session
+	out     bytes.Buffer // Accumulates the output of the hub and the services until we send it.
+}
+
+// Refuses a connection from a page on another site.
+func checkOrigin(config *websocket.Config, r *http.Request) error {
+	if r.Header.Get("Origin") == "" {
+		return nil
+	}
+	origin, err := websocket.Origin(config, r)
+	if err != nil {
+		return err
+	}
+	if origin.Host != r.Host {
+		return errors.New("the hub doesn't accept websockets from " + origin.String())
+	}
+	config.Origin = origin
+	return nil
+}
+
+func (h *Hub) handleWebsocket(conn *websocket.Conn) {
+	defer conn.Close()
+	if maxBody := h.limiter.getLimits().MaxBody; maxBody > 0 {
+		conn.MaxPayloadBytes = int(maxBody)
+	}
+	wc := &wsConnection{hub: h, conn: conn, html: conn.Request().URL.Query().Get("format") != "ansi", session: h.newSession()}
+	wc.session.addr = conn.Request().RemoteAddr
+	h.sessionLock.Lock()
+	if h.sockets == nil {
+		h.sockets = map[*wsConnection]bool{}
+	}
+	h.sockets[wc] = true
+	h.sessionLock.Unlock()
+	defer func() {
+		h.sessionLock.Lock()
+		delete(h.sockets, wc)
+		h.sessionLock.Unlock()
+	}()
+	wc.send("output", text.Logo())
+	wc.send("ready", "")
+	for {
+		var msg wsMessage
+		if err := websocket.JSON.Receive(conn, &msg); err != nil {
+			return // The client has gone away.
+		}
+		if msg.Type != "line" {
+			continue // Then it's an answer to a prompt which has already been dealt with.
+		}
+		// The session only has a username once the user has signed on, and so we know who they are.
+		reason := h.limiter.admitService(wc.session.service, 1)
+		if reason == "" && wc.session.username != "" {
+			reason = h.limiter.admitUser(wc.session.username, 1)
+		}
+		if reason != "" {
+			wc.send("output", Red("Hub error")+": too many requests: over the "+reason+".\n")
+		} else {
+			wc.do(msg.Body)
+			wc.flush()
+		}
+		wc.send("ready", wc.session.service)
+	}
+}
+
+// When the hub stops listening, it tells the clients connected by websocket and hangs up on
+// them. (The HTTP server doesn't do this itself, since it hands these connections over to us.)
+func (h *Hub) closeSockets() {
+	h.sessionLock.Lock()
+	defer h.sessionLock.Unlock()
+	for wc := range h.sockets {
+		wc.send("output", "The hub has stopped listening.\n")
+		wc.conn.Close()
+	}
+}
+
+// This evaluates a line in the connection's session, sending the output of the hub and the
+// services to the connection rather than to wherever it usually goes, and asking the client
+// rather than the terminal for keyboard input.
+func (wc *wsConnection) do(line string) {
+	h := wc.hub
+	h.doLock.Lock()
+	defer h.doLock.Unlock()
+	h.socket = wc
+	h.doRedirected(line, wc.session, true, &wc.out, wc)
+	h.socket = nil
+}
+
+// How long the hub waits for a client to answer a prompt.
+var PROMPT_TIMEOUT = 2 * time.Minute
+
+// This satisfies the `KeyboardHandler` interface, so that when a service does `get ... from
+// Keyboard(...)` on behalf of the connection, the prompt goes to the client and the answer
+// comes back.
+//
+// Since the hub holds its lock while it waits, a client which doesn't answer in time is hung
+// up on, so that it can't stop everyone else from using the hub. The line then carries on
+// with empty input for this and any other prompts, and so finishes quickly.
+func (wc *wsConnection) GetFromKeyboard(prompt string, masked bool) string {
+	if !wc.mayPrompt() {
+		return ""
+	}
+	wc.flush()
+	websocket.JSON.Send(wc.conn, wsMessage{Type: "prompt", Body: prompt, Masked: masked})
+	wc.conn.SetReadDeadline(time.Now().Add(PROMPT_TIMEOUT))
+	defer wc.conn.SetReadDeadline(time.Time{})
+	for {
+		var msg wsMessage
+		if err := websocket.JSON.Receive(wc.conn, &msg); err != nil {
+			wc.conn.Close()
+			return ""
+		}
+		if msg.Type == "input" {
+			return msg.Body
+		}
+	}
+}
+
+// Whether the client may be asked for input. The caller should hold the `doLock`.
+func (wc *wsConnection) mayPrompt() bool {
+	return !wc.hub.administered() || wc.session.username != ""
+}
+
+func (wc *wsConnection) flush() {
+	if wc.out.Len() == 0 {
+		return
+	}
+	wc.send("output", wc.out.String())
+	wc.out.Reset()
+}
+
+func (wc *wsConnection) send(msgType, body string) {
+	if msgType == "output" && wc.html {
+		body = text.AnsiToHtml(body)
+	}
+	websocket.JSON.Send(wc.conn, wsMessage{Type: msgType, Body: body})
+}
@@ -0,0 +1,65 @@
+package hub
+
+import (
+	"time"
+
+	"github.com/tim-hardcastle/pipefish/source/pf"
+)
+
+// A request to the hub over HTTP may contain a call to a function of a service in the binary
+// wire format which external services use to talk to one another (see `vm/wire.go`). The hub
+// evaluates it as it would the line which makes the call, except that the arguments are bound
+// to names in the line rather than written in it as literals, and that it returns the result in
+// the binary format rather than outputting it.
+//
+// If the result can't be encoded, or there's no result, because e.g. the user has no access to
+// the function, the hub replies with whatever it's output instead, just as in the literal
+// protocol.
+//
+// A request may instead contain a batch of such calls, as a client makes when it maps an external
+// function over a list, and then the hub evaluates each of them in turn and replies with a list
+// of results, each of which is either the encoded value or what the hub output.
+
+// Evaluates the call on behalf of the session, returning the encoded result, or `nil` if the
+// hub has output something instead.
+func (h *Hub) doWireCall(call []byte, s *Session) []byte {
+	oldSession := h.session
+	h.session = s
+	defer func() { h.session = oldSession }()
+	s.lastUsed = time.Now()
+	h.username, h.password = s.username, s.password
+	h.lastError = ""
+	serviceToUse, ok := h.serviceFor(s.username, s.service)
+	if !ok {
+		return nil
+	}
+	if serviceToUse.IsBroken() {
+		h.WriteError("the service <C>\"" + s.service + "\"</> is broken.")
+		return nil
+	}
+	line, vals, e := serviceToUse.DecodeWireCall(call)
+	if e != nil {
+		h.WriteError("the hub can't decode the call: " + e.Error() + ".")
+		return nil
+	}
+	h.Sources["REPL input"] = []string{line}
+	defer h.auditCall(s.service, line)
+	defer h.metrics.observeRequest(h.labelsOf(line, s.service), s.lastUsed)
+	if !h.mayCall(line, s.username, s.service) {
+		return nil
+	}
+	val, _ := serviceToUse.DoWithValues(line, vals)
+	if errorsExist, _ := serviceToUse.ErrorsExist(); errorsExist {
+		h.GetAndReportErrors(serviceToUse)
+		return nil
+	}
+	data, e := serviceToUse.EncodeWireValue(val)
+	if e != nil {
+		h.outputVal(val, serviceToUse, true)
+		return nil
+	}
+	if val.T == pf.ERROR {
+		h.recordError(val.V.(*pf.Error))
+	}
+	return data
+}
@@ -124,10 +124,11 @@ func (iz *Initializer) SerializedAPIToDeclarations(serializedAPI string, xserve
 			buf.WriteString("\ndef\n\n")
 			buf.WriteString(makeCommandOrFunctionDeclarationFromParts(parts[1:], xserve))
 			lineNo++
-		case "":
+		case "", "VERSION": // See `api_versions.go` for why the version usually has an empty first part.
 			lineNo++
-		default:
-			iz.throw("init/external", &token.Token{}, parts[0])
+		default: // Then it's not an API, and is most likely an error message from the hub.
+			iz.throw("init/external", &token.Token{}, line)
+			return ""
 		}
 		hasHappened[parts[0]] = true
 	}
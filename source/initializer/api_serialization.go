@@ -179,10 +179,11 @@ func (iz *Initializer) SerializeApi() string {
 			}
 		}
 	}
+	result := API_VERSION_PREFIX + ApiVersion(buf.String()) + "\n" + buf.String()
 	if settings.SHOW_API_SERIALIZATION {
-		println("Api serialization:\n\n" + buf.String() + "\n")
+		println("Api serialization:\n\n" + result + "\n")
 	}
-	return buf.String()
+	return result
 }
 
 func isPTI(ty vm.TypeInformation) bool {
@@ -0,0 +1,345 @@
+package initializer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/tim-hardcastle/pipefish/source/token"
+)
+
+// A serialized API starts with a line ` | VERSION | <hash>`, where the hash depends only on what
+// the API declares, and not on the order the serializer happens to declare it in. So if two
+// APIs have the same version, they're the same API. The line starts with ` | ` so that its
+// first part is empty, since versions of Pipefish from before APIs had versions skip such lines,
+// and so can still use the APIs of services on newer hubs.
+//
+// A script may have a lockfile, with the same name as the script but the extension `.lock`,
+// recording the APIs of the external services the script declares, as they were when it was
+// built against them. If it has one, then each time the script is initialized, the API of each
+// external service in the lockfile is checked against it: if it's changed in a way which is
+// compatible with the old one, that's fine, but if the change is breaking, initialization
+// fails. Initializing a script never changes its lockfile: `pipefish api lock <script>` makes
+// a lockfile for the script, or remakes it if the APIs have changed, e.g. to record the APIs of
+// external services which have been added to the script.
+//
+// A lockfile consists of a block for each external service, in the form:
+//
+// EXTERNAL | serviceName
+// < The serialized API of the service. >
+// END EXTERNAL
+//
+// What counts as a breaking change is explained in `DiffApis` below.
+
+const API_VERSION_PREFIX = " | VERSION | "
+
+// Returns the version of the serialized API, ignoring any version it already has.
+func ApiVersion(serializedAPI string) string {
+	lines := apiLines(serializedAPI)
+	slices.Sort(lines)
+	sum := sha256.Sum256([]byte(strings.Join(lines, "\n")))
+	return hex.EncodeToString(sum[:8])
+}
+
+// The declarations of the API, without the version.
+func apiLines(serializedAPI string) []string {
+	lines := []string{}
+	for _, line := range strings.Split(serializedAPI, "\n") {
+		if line != "" && !isVersionLine(line) {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// We also recognize the line without its leading ` | `, in case something has trimmed the space.
+func isVersionLine(line string) bool {
+	return strings.HasPrefix(strings.TrimLeft(line, " |"), "VERSION | ")
+}
+
+type ApiChange struct {
+	Breaking    bool
+	Description string
+}
+
+// Says how the new API differs from the old one, from the point of view of a client built
+// against the old one. Anything which has been removed from the API is a breaking change, as is
+// any change to the parent type of a clone, the fields of a struct, the order of the elements
+// of an enum, or the return types of a function or command. Adding elements to the end of an
+// enum, operations to a clone, types to an abstract type, or types, functions, or commands to the
+// API are compatible changes, as is renaming the parameters of a function or command. Since
+// functions can be overloaded, a function whose parameter types have changed counts as one
+// function removed and another added.
+//
+// The breaking changes come first.
+func DiffApis(oldAPI, newAPI string) []ApiChange {
+	result := []ApiChange{}
+	if ApiVersion(oldAPI) == ApiVersion(newAPI) {
+		return result
+	}
+	oldEntities, newEntities := apiEntities(oldAPI), apiEntities(newAPI)
+	for _, key := range sortedEntityKeys(oldEntities) {
+		o := oldEntities[key]
+		n, ok := newEntities[key]
+		if !ok {
+			result = append(result, ApiChange{true, o.describe() + " has been removed"})
+			continue
+		}
+		result = append(result, o.diff(n)...)
+	}
+	for _, key := range sortedEntityKeys(newEntities) {
+		if _, ok := oldEntities[key]; !ok {
+			result = append(result, ApiChange{false, newEntities[key].describe() + " has been added"})
+		}
+	}
+	slices.SortStableFunc(result, func(a, b ApiChange) int {
+		switch {
+		case a.Breaking && !b.Breaking:
+			return -1
+		case b.Breaking && !a.Breaking:
+			return 1
+		}
+		return 0
+	})
+	return result
+}
+
+// The things an API declares.
+type apiEntity struct {
+	kind  string
+	name  string
+	parts []string // The line of the serialized API, split on " | ".
+}
+
+// Keys the things the API declares by what a client would have to use them by. Lines which
+// aren't well-formed are left out.
+func apiEntities(serializedAPI string) map[string]apiEntity {
+	result := map[string]apiEntity{}
+	for _, line := range apiLines(serializedAPI) {
+		parts := strings.Split(line, " | ")
+		if len(parts) < 2 {
+			continue
+		}
+		e := apiEntity{kind: parts[0], name: parts[1], parts: parts}
+		key := e.kind + " " + e.name
+		switch e.kind {
+		case "FUNCTION", "COMMAND":
+			if len(parts) < 4 {
+				continue
+			}
+			key = key + " " + parts[2] // The position of the function.
+			wellFormed := true
+			for _, param := range parts[3 : len(parts)-1] {
+				name, ty, ok := strings.Cut(param, " ")
+				wellFormed = wellFormed && ok
+				if ty == "bling" {
+					key = key + " | " + name
+				} else {
+					key = key + " | " + ty
+				}
+			}
+			if !wellFormed {
+				continue
+			}
+		case "ABSTRACT", "CLONE":
+			if len(parts) < 3 {
+				continue
+			}
+		case "PARTYPE", "MAKE":
+			key = line
+		}
+		result[key] = e
+	}
+	return result
+}
+
+func sortedEntityKeys(m map[string]apiEntity) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+func (e apiEntity) describe() string {
+	switch e.kind {
+	case "ENUM":
+		return "enum `" + e.name + "`"
+	case "CLONE":
+		return "clone type `" + e.name + "`"
+	case "STRUCT":
+		return "struct `" + e.name + "`"
+	case "ABSTRACT":
+		return "abstract type `" + e.name + "`"
+	case "PARTYPE":
+		return "parameterized type `" + e.name + "`"
+	case "MAKE":
+		return "type instance `" + e.name + "`"
+	case "COMMAND":
+		return "command `" + describeSig(e.parts) + "`"
+	default:
+		return "function `" + describeSig(e.parts) + "`"
+	}
+}
+
+func describeSig(parts []string) string {
+	return strings.Join(strings.Fields(makeCommandOrFunctionDeclarationFromParts(parts[1:], DUMMY)), " ")
+}
+
+// Compares two entities with the same key.
+func (o apiEntity) diff(n apiEntity) []ApiChange {
+	if slices.Equal(o.parts, n.parts) {
+		return nil
+	}
+	switch o.kind {
+	case "ENUM":
+		if len(n.parts) > len(o.parts) && slices.Equal(o.parts, n.parts[:len(o.parts)]) {
+			return []ApiChange{{false, o.describe() + " has new elements " + strings.Join(n.parts[len(o.parts):], ", ")}}
+		}
+		return []ApiChange{{true, o.describe() + " has had its elements changed from " +
+			strings.Join(o.parts[2:], ", ") + " to " + strings.Join(n.parts[2:], ", ")}}
+	case "CLONE":
+		if o.parts[2] != n.parts[2] {
+			return []ApiChange{{true, o.describe() + " has a different parent type"}}
+		}
+		result := []ApiChange{}
+		for _, op := range o.parts[3:] {
+			if !slices.Contains(n.parts[3:], op) {
+				result = append(result, ApiChange{true, o.describe() + " no longer uses `" + op + "`"})
+			}
+		}
+		for _, op := range n.parts[3:] {
+			if !slices.Contains(o.parts[3:], op) {
+				result = append(result, ApiChange{false, o.describe() + " now uses `" + op + "`"})
+			}
+		}
+		return result
+	case "STRUCT":
+		return []ApiChange{{true, o.describe() + " has had its fields changed from (" +
+			describeFields(o.parts[2:]) + ") to (" + describeFields(n.parts[2:]) + ")"}}
+	case "ABSTRACT":
+		oldTypes := strings.Split(o.parts[2], " ")
+		newTypes := strings.Split(n.parts[2], " ")
+		for _, ty := range oldTypes {
+			if !slices.Contains(newTypes, ty) {
+				return []ApiChange{{true, o.describe() + " no longer contains `" + ty + "`"}}
+			}
+		}
+		if len(newTypes) > len(oldTypes) {
+			return []ApiChange{{false, o.describe() + " now contains more types"}}
+		}
+		return nil
+	default: // It's a function or command, since the key of anything else is the whole line.
+		if o.parts[len(o.parts)-1] != n.parts[len(n.parts)-1] {
+			return []ApiChange{{true, o.describe() + " has different return types"}}
+		}
+		return []ApiChange{{false, o.describe() + " has had its parameters renamed to `" + describeSig(n.parts) + "`"}}
+	}
+}
+
+func describeFields(fields []string) string {
+	result := make([]string, len(fields))
+	for i, field := range fields {
+		name, types, _ := strings.Cut(field, " ")
+		result[i] = name + " " + strings.ReplaceAll(types, " ", "/")
+	}
+	return strings.Join(result, ", ")
+}
+
+// Returns the filepath of the lockfile of a script.
+func LockfilePath(scriptFilepath string) string {
+	return strings.TrimSuffix(scriptFilepath, filepath.Ext(scriptFilepath)) + ".lock"
+}
+
+// Reads a lockfile into a map from the names of external services to their serialized APIs.
+func ReadLockfile(path string) (map[string]string, error) {
+	return readLockfile(nil, path)
+}
+
+// Likewise, from the file system the scripts are read from.
+func readLockfile(fsys fs.FS, path string) (map[string]string, error) {
+	data, err := readFile(fsys, path)
+	if err != nil {
+		return nil, err
+	}
+	result := map[string]string{}
+	name := ""
+	var buf strings.Builder
+	for _, line := range strings.Split(string(data), "\n") {
+		switch {
+		case strings.HasPrefix(line, "EXTERNAL | "):
+			name = strings.TrimPrefix(line, "EXTERNAL | ")
+			buf.Reset()
+		case line == "END EXTERNAL":
+			if name == "" {
+				return nil, errors.New("lockfile " + path + " has an `END EXTERNAL` without an `EXTERNAL`")
+			}
+			result[name] = buf.String()
+			name = ""
+		case name != "":
+			buf.WriteString(line + "\n")
+		}
+	}
+	if name != "" {
+		return nil, errors.New("lockfile " + path + " has an `EXTERNAL` without an `END EXTERNAL`")
+	}
+	return result, nil
+}
+
+func WriteLockfile(path string, apis map[string]string) error {
+	var buf strings.Builder
+	names := make([]string, 0, len(apis))
+	for name := range apis {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		buf.WriteString("EXTERNAL | " + name + "\n")
+		buf.WriteString(API_VERSION_PREFIX + ApiVersion(apis[name]) + "\n")
+		lines := apiLines(apis[name])
+		slices.Sort(lines) // So that the lockfile doesn't change unless the API does.
+		for _, line := range lines {
+			buf.WriteString(line + "\n")
+		}
+		buf.WriteString("END EXTERNAL\n")
+	}
+	return os.WriteFile(path, []byte(buf.String()), 0644)
+}
+
+// If the script has a lockfile which records the API of the external service, checks the API
+// against it, throwing an error if it's changed in a way which breaks the script.
+func (iz *Initializer) checkLockedApi(name, serializedAPI string, tok *token.Token) bool {
+	if iz.Common.ignoreLockfile {
+		return true
+	}
+	path := LockfilePath(iz.cp.ScriptFilepath)
+	locked, err := readLockfile(iz.Common.fsys, path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return true
+	}
+	if err != nil {
+		iz.throw("init/external/lockfile", tok, path, err.Error())
+		return false
+	}
+	oldAPI, ok := locked[name]
+	if !ok || ApiVersion(oldAPI) == ApiVersion(serializedAPI) {
+		return true
+	}
+	breaking := []string{}
+	for _, change := range DiffApis(oldAPI, serializedAPI) {
+		if change.Breaking {
+			breaking = append(breaking, change.Description)
+		}
+	}
+	if len(breaking) > 0 {
+		iz.throw("init/external/breaking", tok, name, path, breaking)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,181 @@
+package initializer
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/tim-hardcastle/pipefish/source/values"
+	"github.com/tim-hardcastle/pipefish/source/vm"
+)
+
+// Clients of a service in other languages are made from its serialized API (see
+// `README-api-serialization.md`) by `goclient.go`, `pyclient.go`, and `tsclient.go`, which all
+// see the API in the same way, as described here.
+//
+// The types the clients know about are the scalar types `int`, `float`, `string`, `bool`, and
+// `rune`; and the enums, structs, and clones of scalar types declared by the service. A value of
+// any other type is passed as whatever the client's language has for values it knows nothing
+// about.
+//
+// The functions are the public functions and commands which are prefix or unfix and whose names
+// are identifiers. Each is called by a method with its name, followed by its signature if it's
+// overloaded, as with the RPCs in `proto.go`.
+
+// The API of a service as a client sees it.
+type clientApi struct {
+	types     []string               // The names of the types the client knows about, other than the scalars, in order.
+	enums     map[string][]string    // The elements of the enums.
+	parents   map[string]string      // The parent types of the clones of scalar types.
+	structs   map[string][]clientVar // The fields of the structs.
+	functions []clientFunction
+}
+
+// A field of a struct or a parameter of a function.
+type clientVar struct {
+	name  string
+	types []string // The names of the types it may have, including "null".
+}
+
+type clientFunction struct {
+	name    string // The name of the method, which is the name of the function, followed by its signature if it's overloaded.
+	entity  apiEntity
+	params  []clientVar // The parameters other than the bling.
+	returns []string    // The types it may return other than errors, or nil if it returns a tuple.
+}
+
+var clientScalars = []string{"int", "float", "string", "bool", "rune"}
+
+func newClientApi(serializedAPI string) *clientApi {
+	api := &clientApi{enums: map[string][]string{}, parents: map[string]string{}, structs: map[string][]clientVar{}}
+	entities := apiEntities(serializedAPI)
+	keys := sortedEntityKeys(entities)
+	for _, key := range keys {
+		e := entities[key]
+		switch e.kind {
+		case "ENUM":
+			api.enums[e.name] = e.parts[2:]
+		case "CLONE":
+			if !slices.Contains(clientScalars, e.parts[2]) {
+				continue
+			}
+			api.parents[e.name] = e.parts[2]
+		case "STRUCT":
+			fields := []clientVar{}
+			for _, field := range e.parts[2:] {
+				name, types, _ := strings.Cut(field, " ")
+				fields = append(fields, clientVar{name, strings.Fields(types)})
+			}
+			api.structs[e.name] = fields
+		default:
+			continue
+		}
+		api.types = append(api.types, e.name)
+	}
+	overloads := overloadCounts(entities)
+	named := map[string]bool{}
+	for _, key := range keys {
+		e := entities[key]
+		if e.kind != "FUNCTION" && e.kind != "COMMAND" || !protoIdentifier.MatchString(e.name) {
+			continue
+		}
+		position, _ := strconv.Atoi(e.parts[2])
+		if uint32(position) != vm.PREFIX && uint32(position) != vm.UNFIX {
+			continue
+		}
+		fn := clientFunction{name: e.name, entity: e, returns: (&protoizer{}).returnTypes(e.parts[len(e.parts)-1])}
+		if overloads[fn.name] > 1 {
+			fn.name = fn.name + overloadSuffix(e)
+		}
+		for base, i := fn.name, 2; named[fn.name]; i++ {
+			fn.name = base + strconv.Itoa(i)
+		}
+		named[fn.name] = true
+		for _, param := range e.parts[3 : len(e.parts)-1] {
+			name, ty, _ := strings.Cut(param, " ")
+			if ty == "bling" {
+				continue
+			}
+			types := []string{ty}
+			if base, ok := strings.CutSuffix(ty, "?"); ok {
+				types = []string{base, "null"}
+			}
+			fn.params = append(fn.params, clientVar{name, types})
+		}
+		api.functions = append(api.functions, fn)
+	}
+	return api
+}
+
+// Describes the type of a value which may have the given types: the name of a type the client
+// knows about, followed by "?" if the value may also be `NULL`; or "" if it's any other value.
+func (api *clientApi) describe(types []string) string {
+	nullable := slices.Contains(types, "null")
+	types = slices.DeleteFunc(slices.Clone(types), func(s string) bool { return s == "null" })
+	if len(types) != 1 || !api.knows(types[0]) {
+		return ""
+	}
+	if nullable {
+		return types[0] + "?"
+	}
+	return types[0]
+}
+
+func (api *clientApi) knows(ty string) bool {
+	_, isStruct := api.structs[ty]
+	return slices.Contains(clientScalars, ty) || api.enums[ty] != nil || api.parents[ty] != "" || isStruct
+}
+
+// Whether the function returns only `OK`.
+func (fn *clientFunction) returnsOk() bool {
+	return slices.Equal(fn.returns, []string{"ok"})
+}
+
+// Returns the line which calls the function, given a function which says how to write each
+// argument, as with `vm.ExternalCall.Line`.
+func (fn *clientFunction) line(arg func(i int) string) string {
+	position, _ := strconv.Atoi(fn.entity.parts[2])
+	call := &vm.ExternalCall{Operator: uint32(position), Name: fn.entity.name}
+	for _, param := range fn.entity.parts[3 : len(fn.entity.parts)-1] {
+		name, ty, _ := strings.Cut(param, " ")
+		if ty == "bling" {
+			call.Args = append(call.Args, values.Value{values.BLING, name})
+			continue
+		}
+		call.Args = append(call.Args, values.Value{values.INT, len(call.Args)})
+	}
+	i := -1
+	return call.Line(func(v values.Value) string {
+		i++
+		return arg(i)
+	})
+}
+
+// Returns an expression which concatenates the line which calls the function, given a function
+// which returns an expression for each argument. The pieces of the line between the arguments
+// are written as Go writes strings, which Python and TypeScript also understand.
+func (fn *clientFunction) lineExpression(arg func(i int) string) string {
+	const marker = "\x00"
+	line := fn.line(func(i int) string { return marker + strconv.Itoa(i) + marker })
+	pieces := strings.Split(line, marker)
+	terms := []string{}
+	for i, piece := range pieces {
+		if i%2 == 1 {
+			n, _ := strconv.Atoi(piece)
+			terms = append(terms, arg(n))
+			continue
+		}
+		if piece != "" {
+			terms = append(terms, strconv.Quote(piece))
+		}
+	}
+	return strings.Join(terms, " + ")
+}
+
+// Renames a name which the language can't use, given its reserved words.
+func clientName(name string, reserved []string) string {
+	if slices.Contains(reserved, name) {
+		return name + "_"
+	}
+	return name
+}
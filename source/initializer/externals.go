@@ -1,6 +1,14 @@
 package initializer
 
 import (
+	"math/rand/v2"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tim-hardcastle/pipefish/source/dtypes"
 	"github.com/tim-hardcastle/pipefish/source/err"
 	"github.com/tim-hardcastle/pipefish/source/settings"
 	"github.com/tim-hardcastle/pipefish/source/token"
@@ -10,18 +18,41 @@ import (
 
 // We have two types of external service, defined below: one for services on the same hub, one for services on
 // a different hub.
+//
+// Where possible, both pass values to the service and back in the binary wire format defined in
+// `vm/wire.go`, and otherwise they fall back on the literal protocol, where the call is sent as a
+// line of Pipefish and the result comes back as a Pipefish literal.
+//
+// Calls to a service on a different hub can fail as calls on the same hub can't, and so they
+// have timeouts, retries, and a circuit breaker, configured by the `$_externals` service variable
+// as explained below.
+//
+// When a function of an external service is mapped over a list, e.g. by `L >> crud.show`, or
+// explicitly by `batch(crud.show, L)`, the calls are made by `EvaluateBatch`, which sends them
+// to a different hub in batches of up to `vm.MAX_BATCH` calls, one request per batch, rather than
+// one request per call. This needs the hub to speak the binary wire format: if it doesn't, or
+// one of the calls can't be encoded in it, the calls are made one at a time.
 
 type ExternalCallToHubHandler struct {
-	Evaluator    func(line string) values.Value
+	Evaluator    func(call *vm.ExternalCall) values.Value
 	ProblemFn    func() bool
 	SerializeApi func() string
 }
 
-func (ex ExternalCallToHubHandler) Evaluate(line string) values.Value {
+func (ex ExternalCallToHubHandler) Evaluate(call *vm.ExternalCall) values.Value {
 	if settings.SHOW_XCALLS {
-		println("Line is", line)
+		println("Calling", call.Name)
+	}
+	return ex.Evaluator(call)
+}
+
+// On the same hub, there's no request to save, and so the calls are made one at a time.
+func (ex ExternalCallToHubHandler) EvaluateBatch(calls []*vm.ExternalCall) []values.Value {
+	results := make([]values.Value, len(calls))
+	for i, call := range calls {
+		results[i] = ex.Evaluate(call)
 	}
-	return ex.Evaluator(line)
+	return results
 }
 
 func (es ExternalCallToHubHandler) Problem() *err.Error {
@@ -31,8 +62,8 @@ func (es ExternalCallToHubHandler) Problem() *err.Error {
 	return nil
 }
 
-func (es ExternalCallToHubHandler) GetAPI() string {
-	return es.SerializeApi()
+func (es ExternalCallToHubHandler) GetAPI() (string, *vm.ExternalError) {
+	return es.SerializeApi(), nil
 }
 
 type ExternalHttpCallHandler struct {
@@ -41,23 +72,358 @@ type ExternalHttpCallHandler struct {
 	Username     string
 	Password     string
 	Deserializer func(valAsString string) values.Value
+	Wire         *wireState
+	Config       func() vm.ExternalConfig
+	Breaker      *circuitBreaker
+	Functions    dtypes.Set[string] // The functions of the service, as opposed to its commands, which may be retried.
+	Session      *remoteSession
+}
+
+// The session on the other hub in which we make our requests, so that the hub doesn't have to
+// make a new one for each of them.
+type remoteSession struct {
+	mu sync.Mutex
+	id string
+}
+
+// What we know about whether the hub at the other end speaks the binary wire format, which we
+// find out from its reply to the first call we make in it.
+type wireState struct {
+	codec     *vm.WireCodec
+	speaks    atomic.Int32
+	noBatches atomic.Bool // Whether we've found that the hub speaks the binary format but doesn't know about batches.
 }
 
-func (es ExternalHttpCallHandler) Evaluate(line string) values.Value {
+const (
+	wireUntried int32 = iota
+	wireSpoken
+	wireUnspoken
+)
+
+func (es ExternalHttpCallHandler) Evaluate(call *vm.ExternalCall) values.Value {
+	config := es.Config()
+	if !es.Breaker.allow(config) {
+		return values.Value{values.ERROR, err.CreateErr("ext/circuit", &token.Token{Source: "Pipefish builder"}, es.Service, config.BreakAfter)}
+	}
+	speaks := es.Wire.speaks.Load()
+	var data []byte
+	if speaks != wireUnspoken {
+		data, _ = es.Wire.codec.EncodeCall(call) // If this fails, we use the literal protocol.
+	}
+	line := ""
+	if data == nil || speaks == wireUntried { // Then the hub may need the line to fall back on.
+		line = call.Line(func(v values.Value) string { return es.Wire.codec.Vm.Literal(v, 0) })
+	}
 	if settings.SHOW_XCALLS {
 		println("Line is", line)
 	}
-	exValAsString := vm.Do(es.Host, es.Service, line, es.Username, es.Password)
-	val := es.Deserializer(exValAsString)
-	return val
+	reply, e := es.attempt(&vm.ExternalRequest{Line: line, Call: data}, es.Functions.Contains(call.Name), config)
+	if e != nil {
+		return es.failure(e)
+	}
+	if data != nil && speaks == wireUntried {
+		if reply.Wire {
+			es.Wire.speaks.Store(wireSpoken)
+		} else {
+			es.Wire.speaks.Store(wireUnspoken)
+		}
+	}
+	return es.result(reply.Body, reply.Value)
+}
+
+// Makes the calls in batches if the hub will let us, and otherwise one at a time.
+func (es ExternalHttpCallHandler) EvaluateBatch(calls []*vm.ExternalCall) []values.Value {
+	results := make([]values.Value, len(calls))
+	for start := 0; start < len(calls); {
+		// We make the first call on its own if we don't yet know whether the hub speaks the
+		// binary format, since it may not.
+		if es.Wire.speaks.Load() != wireSpoken || es.Wire.noBatches.Load() {
+			results[start] = es.Evaluate(calls[start])
+			start++
+			continue
+		}
+		end := min(start+vm.MAX_BATCH, len(calls))
+		if !es.evaluateBatch(calls[start:end], results[start:end]) {
+			continue // Then we've found out that we can't, and so we go round again to make them one at a time.
+		}
+		start = end
+	}
+	return results
+}
+
+// Makes the calls in one request, putting the results in `results`, and returns false if it
+// turns out that they can't be made like that.
+func (es ExternalHttpCallHandler) evaluateBatch(calls []*vm.ExternalCall, results []values.Value) bool {
+	batch := make([][]byte, len(calls))
+	retriable := true // Only if all of the calls are to functions.
+	for i, call := range calls {
+		data, e := es.Wire.codec.EncodeCall(call)
+		if e != nil {
+			// Then we make them all one at a time. This isn't worth optimizing, since it only
+			// happens if there's an argument like a lambda which the service can't do anything
+			// useful with anyway.
+			for j := range calls {
+				results[j] = es.Evaluate(calls[j])
+			}
+			return true
+		}
+		batch[i] = data
+		retriable = retriable && es.Functions.Contains(call.Name)
+	}
+	config := es.Config()
+	if !es.Breaker.allow(config) {
+		for i := range results {
+			results[i] = values.Value{values.ERROR, err.CreateErr("ext/circuit", &token.Token{Source: "Pipefish builder"}, es.Service, config.BreakAfter)}
+		}
+		return true
+	}
+	reply, e := es.attempt(&vm.ExternalRequest{Batch: batch}, retriable, config)
+	if e != nil {
+		for i := range results {
+			results[i] = es.failure(e)
+		}
+		return true
+	}
+	if len(reply.Batch) != len(calls) {
+		es.Wire.noBatches.Store(true)
+		return false
+	}
+	for i, result := range reply.Batch {
+		results[i] = es.result(result.Body, result.Value)
+	}
+	return true
+}
+
+// Makes the request, retrying it if it's allowed and the failure might not happen again, and
+// tells the circuit breaker how it went.
+func (es ExternalHttpCallHandler) attempt(rq *vm.ExternalRequest, retriable bool, config vm.ExternalConfig) (*vm.ExternalReply, *vm.ExternalError) {
+	retries := 0
+	if retriable {
+		retries = config.Retries
+	}
+	var (
+		reply *vm.ExternalReply
+		e     *vm.ExternalError
+	)
+	backoff := min(config.Backoff, vm.MAX_BACKOFF)
+	for attempt := 0; ; attempt++ {
+		reply, e = es.do(rq, config)
+		if e == nil || !e.Transient() || attempt >= retries {
+			break
+		}
+		time.Sleep(jitter(backoff))
+		backoff = min(backoff*2, vm.MAX_BACKOFF)
+	}
+	es.Breaker.record(e == nil || !e.Transient(), config)
+	return reply, e
+}
+
+// Returns a random duration between half of the backoff and all of it.
+func jitter(backoff time.Duration) time.Duration {
+	if backoff <= 1 {
+		return backoff
+	}
+	return backoff - rand.N(backoff/2)
+}
+
+func (es ExternalHttpCallHandler) failure(e *vm.ExternalError) values.Value {
+	return values.Value{values.ERROR, err.CreateErr(e.Id, &token.Token{Source: "Pipefish builder"}, es.Service, e.Detail)}
+}
+
+// Turns the result of a call into a value, whether the hub sent the value in the binary format
+// or output it as a literal.
+func (es ExternalHttpCallHandler) result(body string, value []byte) values.Value {
+	if value != nil {
+		val, e := es.Wire.codec.Decode(value)
+		if e != nil {
+			return values.Value{values.ERROR, err.CreateErr("ext/wire", &token.Token{Source: "Pipefish builder"}, es.Service, e.Error())}
+		}
+		return val
+	}
+	return es.Deserializer(body)
+}
+
+// Makes a request of the hub in our session. If the hub has forgotten the session, e.g.
+// because it's been restarted, we make it again in a new one. The request need only say what
+// to send: this fills in where to, and on whose behalf.
+func (es ExternalHttpCallHandler) do(request *vm.ExternalRequest, config vm.ExternalConfig) (*vm.ExternalReply, *vm.ExternalError) {
+	rq := *request
+	rq.Host, rq.Service, rq.Username, rq.Password = es.Host, es.Service, es.Username, es.Password
+	rq.Timeout = config.Timeout
+	es.Session.mu.Lock()
+	rq.Session = es.Session.id
+	es.Session.mu.Unlock()
+	reply, e := vm.DoExternal(&rq)
+	if e != nil && e.ExpiredSession() && rq.Session != "" {
+		rq.Session = ""
+		reply, e = vm.DoExternal(&rq)
+	}
+	if e == nil {
+		es.Session.mu.Lock()
+		es.Session.id = reply.Session
+		es.Session.mu.Unlock()
+	}
+	return reply, e
 }
 
 func (es ExternalHttpCallHandler) Problem() *err.Error {
 	return nil
 }
 
-func (es ExternalHttpCallHandler) GetAPI() string {
-	return vm.Do(es.Host, "", "hub serialize \""+es.Service+"\"", es.Username, es.Password)
+// As well as getting the API, this notes which of the service's operations are functions.
+func (es ExternalHttpCallHandler) GetAPI() (string, *vm.ExternalError) {
+	reply, e := es.do(&vm.ExternalRequest{Line: "hub serialize \"" + es.Service + "\""}, es.Config())
+	if e != nil {
+		return "", e
+	}
+	api := reply.Body
+	for _, line := range strings.Split(api, "\n") {
+		if parts := strings.Split(line, " | "); len(parts) > 1 && parts[0] == "FUNCTION" {
+			es.Functions.Add(parts[1])
+		}
+	}
+	return api, nil
+}
+
+// Counts the calls to an external service which have failed in a row, and trips when there
+// have been too many. See `vm.ExternalConfig` for how it behaves.
+//
+// Only failures which might not happen the next time count, since a reply saying that the
+// caller isn't authorized, for example, shows that the service is up.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	trying    bool // Whether a call is being let through to see if the service has recovered.
+}
+
+// Says whether a call may be made.
+func (cb *circuitBreaker) allow(config vm.ExternalConfig) bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if config.BreakAfter == 0 || cb.failures < config.BreakAfter {
+		return true
+	}
+	if cb.trying || time.Now().Before(cb.openUntil) {
+		return false
+	}
+	cb.trying = true
+	return true
+}
+
+func (cb *circuitBreaker) record(succeeded bool, config vm.ExternalConfig) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.trying = false
+	if succeeded {
+		cb.failures = 0
+		return
+	}
+	cb.failures++
+	if config.BreakAfter > 0 && cb.failures >= config.BreakAfter {
+		cb.openUntil = time.Now().Add(config.BreakFor)
+	}
+}
+
+// The configuration of the external services on other hubs is given by the `$_externals`
+// service variable, which maps the names of the services to maps from the names of options to
+// their values, e.g:
+//
+//	$_externals = map("billing"::map("timeout"::2.5, "retries"::0))
+//
+// The options are `timeout`, `backoff`, and `breakFor`, which are numbers of seconds, and
+// `retries` and `breakAfter`, which are integers. Options which aren't given keep the values in
+// `vm.DEFAULT_EXTERNAL_CONFIG`. See `vm.ExternalConfig` for what they do.
+//
+// This returns the configuration of the named service, and a description of the first thing
+// wrong with it, if anything is, in which case the option concerned keeps its default value.
+func externalConfig(externals values.Value, service string) (vm.ExternalConfig, string) {
+	config := vm.DEFAULT_EXTERNAL_CONFIG
+	if externals.T != values.MAP {
+		return config, ""
+	}
+	options, ok := externals.V.(values.Map).Get(values.Value{values.STRING, service})
+	if !ok {
+		return config, ""
+	}
+	if options.T != values.MAP {
+		return config, "the configuration of " + strconv.Quote(service) + " should be a map"
+	}
+	problem := ""
+	complain := func(s string) {
+		if problem == "" {
+			problem = s
+		}
+	}
+	options.V.(values.Map).Range(func(k, v values.Value) {
+		if k.T != values.STRING {
+			complain("the options of " + strconv.Quote(service) + " should be named by strings")
+			return
+		}
+		name := k.V.(string)
+		switch name {
+		case "timeout", "backoff", "breakFor":
+			var seconds float64
+			switch v.T {
+			case values.INT:
+				seconds = float64(v.V.(int))
+			case values.FLOAT:
+				seconds = v.V.(float64)
+			default:
+				complain("the option " + strconv.Quote(name) + " of " + strconv.Quote(service) + " should be a number of seconds")
+				return
+			}
+			if seconds < 0 || seconds == 0 && name == "timeout" {
+				complain("the option " + strconv.Quote(name) + " of " + strconv.Quote(service) + " is out of range")
+				return
+			}
+			d := time.Duration(seconds * float64(time.Second))
+			switch name {
+			case "timeout":
+				config.Timeout = d
+			case "backoff":
+				config.Backoff = d
+			case "breakFor":
+				config.BreakFor = d
+			}
+		case "retries", "breakAfter":
+			if v.T != values.INT {
+				complain("the option " + strconv.Quote(name) + " of " + strconv.Quote(service) + " should be an integer")
+				return
+			}
+			if v.V.(int) < 0 {
+				complain("the option " + strconv.Quote(name) + " of " + strconv.Quote(service) + " is out of range")
+				return
+			}
+			if name == "retries" {
+				config.Retries = v.V.(int)
+			} else {
+				config.BreakAfter = v.V.(int)
+			}
+		default:
+			complain(strconv.Quote(name) + " isn't an option of external services")
+		}
+	})
+	return config, problem
+}
+
+// Checks the value given to `$_externals`, if it was given one, when the service is
+// initialized.
+func (iz *Initializer) checkExternalConfig(tok *token.Token) {
+	externals := iz.cp.Vm.Mem[iz.cp.GlobalVars.Data["$_externals"].MLoc]
+	externals.V.(values.Map).Range(func(k, v values.Value) {
+		if k.T != values.STRING {
+			iz.throw("init/external/config", tok, "the external services should be named by strings")
+			return
+		}
+		if _, ok := iz.cp.CallHandlerNumbersByName[k.V.(string)]; !ok {
+			iz.throw("init/external/config", tok, strconv.Quote(k.V.(string))+" isn't an external service")
+			return
+		}
+		if _, problem := externalConfig(externals, k.V.(string)); problem != "" {
+			iz.throw("init/external/config", tok, problem)
+		}
+	})
 }
 
 // A function and a couple of types for making an external service call, used to construct
@@ -1,6 +1,9 @@
 package initializer
 
 import (
+	"io/fs"
+	"os"
+	"path"
 	"path/filepath"
 	"strings"
 
@@ -259,6 +262,36 @@ func MakeFilepath(scriptFilepath string) string {
 	return doctoredFilepath
 }
 
+// A service may be initialized from a file system other than the OS, e.g. an `embed.FS`, so that
+// it needs no Pipefish installation. Its files are then laid out as they are in the Pipefish home
+// directory, so that e.g. the `strings` library is `source/initializer/libraries/strings.pf`,
+// together with the scripts of the service. This returns the name in such a file system of the
+// file with the given filepath.
+func fsName(scriptFilepath string) string {
+	name := filepath.ToSlash(MakeFilepath(scriptFilepath))
+	if settings.PipefishHomeDirectory != "" {
+		name = strings.TrimPrefix(name, filepath.ToSlash(settings.PipefishHomeDirectory))
+	}
+	return strings.TrimPrefix(path.Clean(name), "/")
+}
+
+// Reads the file with the given filepath from the file system if there is one, and otherwise from
+// the OS.
+func readFile(fsys fs.FS, scriptFilepath string) ([]byte, error) {
+	if fsys == nil {
+		return os.ReadFile(scriptFilepath)
+	}
+	return fs.ReadFile(fsys, fsName(scriptFilepath))
+}
+
+// Likewise, describes the file.
+func statFile(fsys fs.FS, scriptFilepath string) (fs.FileInfo, error) {
+	if fsys == nil {
+		return os.Stat(scriptFilepath)
+	}
+	return fs.Stat(fsys, fsName(scriptFilepath))
+}
+
 func TweakNameAndPath(name, path, source string) (string, string) {
 	if name == "" {
 		name = ExtractFileName(path)
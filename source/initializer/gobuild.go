@@ -0,0 +1,171 @@
+package initializer
+
+// Normally the Go in a script, whether in `golang` functions or in blocks of pure Go, is compiled
+// at initialization time into a plugin, as described in `gohandler.go`. This needs a Go toolchain
+// at runtime, and a plugin can only be opened if it was built with the same versions of all
+// the packages it shares with the binary opening it.
+//
+// The alternative is to compile all the Go used by a set of scripts ahead of time into a custom
+// `pipefish` binary, which is what `pipefish build --with-go` does by calling `BuildWithGo`. The
+// Go generated from each source is put in a package of its own, and the binary's `main` function
+// registers the functions and converters of each package with `RegisterGo` under the hash of the
+// code, before it starts the hub. Then `compileGo` looks in the registry for the hash of the code
+// it generates, and only makes a plugin if it doesn't find it.
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/format"
+	goparser "go/parser"
+	gotoken "go/token"
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"plugin"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/tim-hardcastle/pipefish/source/compiler"
+	"github.com/tim-hardcastle/pipefish/source/settings"
+	"github.com/tim-hardcastle/pipefish/source/values"
+)
+
+// Where the symbols of the Go for a source are found: either a plugin or a `CompiledGo`.
+type goSymbols interface {
+	Lookup(string) (plugin.Symbol, error)
+}
+
+// The symbols of the Go generated from a source and compiled into the binary, by their names.
+// As with a plugin, the functions are values and the variables are pointers.
+type CompiledGo map[string]any
+
+func (symbols CompiledGo) Lookup(name string) (plugin.Symbol, error) {
+	if symbol, ok := symbols[name]; ok {
+		return symbol, nil
+	}
+	return nil, errors.New("symbol " + name + " not found in compiled Go")
+}
+
+// The Go compiled into the binary, by the hash of its source code.
+var compiledGo = map[string]CompiledGo{}
+
+// Registers Go compiled into the binary. This is called by the `main` function generated by
+// `BuildWithGo`, and shouldn't need to be called otherwise.
+func RegisterGo(hash string, symbols CompiledGo) {
+	compiledGo[hash] = symbols
+}
+
+func goHash(code string) string {
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// Initializes the script as far as generating its Go, and adds the source code of the Go to the
+// map by its hash. The compiler is returned so that the caller can report any errors.
+func GoSourcesFromFilepath(scriptFilepath string, sources map[string]string) (*compiler.Compiler, error) {
+	sourcecode, e := GetSourceCode(scriptFilepath)
+	if e != nil {
+		return nil, e
+	}
+	common := NewCommonInitializerBindle(values.Map{}, map[string]*compiler.Compiler{})
+	common.goSources = sources
+	return startCompiler(common, MakeFilepath(scriptFilepath), sourcecode), nil
+}
+
+// Builds a `pipefish` binary at the given path with the Go compiled into it, given the source
+// code of the Go by its hash as found by `GoSourcesFromFilepath`.
+func BuildWithGo(sources map[string]string, binary string) error {
+	binary, e := filepath.Abs(binary)
+	if e != nil {
+		return e
+	}
+	// The `main` package has to be in the Pipefish module for the generated code to import it.
+	dir, e := os.MkdirTemp(filepath.Join(settings.PipefishHomeDirectory, "source", "initializer"), "gobuild_")
+	if e != nil {
+		return e
+	}
+	defer os.RemoveAll(dir)
+	mainImports := []string{"github.com/tim-hardcastle/pipefish/source/hub", "github.com/tim-hardcastle/pipefish/source/initializer"}
+	var registrations strings.Builder
+	for i, hash := range slices.Sorted(maps.Keys(sources)) {
+		pkg := "gocode" + strconv.Itoa(i)
+		code := strings.Replace(sources[hash], "package main\n", "package "+pkg+"\n", 1)
+		if e := os.Mkdir(filepath.Join(dir, pkg), 0755); e != nil {
+			return e
+		}
+		if e := os.WriteFile(filepath.Join(dir, pkg, "gocode.go"), []byte(code), 0644); e != nil {
+			return e
+		}
+		names, e := exportedSymbols(code)
+		if e != nil {
+			return fmt.Errorf("can't parse generated Go for package %s: %w", pkg, e)
+		}
+		mainImports = append(mainImports, "github.com/tim-hardcastle/pipefish/"+filepath.ToSlash(filepath.Join("source", "initializer", filepath.Base(dir), pkg)))
+		fmt.Fprintf(&registrations, "\tinitializer.RegisterGo(%q, initializer.CompiledGo{\n", hash)
+		for _, name := range names.funcs {
+			fmt.Fprintf(&registrations, "\t\t%q: %s.%s,\n", name, pkg, name)
+		}
+		for _, name := range names.vars {
+			fmt.Fprintf(&registrations, "\t\t%q: &%s.%s,\n", name, pkg, name)
+		}
+		fmt.Fprint(&registrations, "\t})\n")
+	}
+	var main strings.Builder
+	fmt.Fprint(&main, "// Code generated by `pipefish build --with-go`. DO NOT EDIT.\n\npackage main\n\nimport (\n")
+	for _, path := range mainImports {
+		fmt.Fprintf(&main, "\t%q\n", path)
+	}
+	fmt.Fprint(&main, ")\n\nfunc main() {\n", registrations.String(), "\thub.Main()\n}\n")
+	formatted, e := format.Source([]byte(main.String()))
+	if e != nil {
+		return e
+	}
+	if e := os.WriteFile(filepath.Join(dir, "main.go"), formatted, 0644); e != nil {
+		return e
+	}
+	cmd := exec.Command("go", "build", "-o", binary, "./"+filepath.ToSlash(filepath.Join("source", "initializer", filepath.Base(dir))))
+	cmd.Dir = settings.PipefishHomeDirectory
+	if output, e := cmd.CombinedOutput(); e != nil {
+		return fmt.Errorf("%w: %s", e, output)
+	}
+	return nil
+}
+
+type goNames struct {
+	funcs, vars []string
+}
+
+// Finds the exported top-level functions and variables of the Go, which are the symbols
+// `compileGo` may look up.
+func exportedSymbols(code string) (goNames, error) {
+	file, e := goparser.ParseFile(gotoken.NewFileSet(), "", code, 0)
+	if e != nil {
+		return goNames{}, e
+	}
+	names := goNames{}
+	for _, decl := range file.Decls {
+		switch decl := decl.(type) {
+		case *ast.FuncDecl:
+			if decl.Recv == nil && decl.Name.IsExported() {
+				names.funcs = append(names.funcs, decl.Name.Name)
+			}
+		case *ast.GenDecl:
+			if decl.Tok != gotoken.VAR {
+				continue
+			}
+			for _, spec := range decl.Specs {
+				for _, name := range spec.(*ast.ValueSpec).Names {
+					if name.IsExported() {
+						names.vars = append(names.vars, name.Name)
+					}
+				}
+			}
+		}
+	}
+	return names, nil
+}
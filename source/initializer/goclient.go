@@ -0,0 +1,319 @@
+package initializer
+
+import (
+	"go/format"
+	gotoken "go/token"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// A Go package can be made from a service's public API, which lets Go code call the service with
+// its types checked by the Go compiler. Like the `.proto` file in `proto.go`, the package is made
+// from the serialized API (see `README-api-serialization.md`).
+//
+// The package has a `Client`, which is made either by `New`, from an initialized `pf.Service` in
+// the same process; or by `Dial`, from the address of a hub which is running the service, in which
+// case it's a service which declares the service on the hub as `external`, and so calls it as any
+// other external service does.
+//
+// The types are translated as follows:
+//
+// * `int`, `float`, `string`, `bool`, and `rune` become `int`, `float64`, `string`, `bool`, and
+// `rune`.
+// * Enums become named `int` types, with a constant for each element.
+// * Structs become structs, with a capitalized field for each field of the struct.
+// * Clones of the types above become named types with the type of their parent.
+// * A type which may be `NULL` becomes a pointer, which is `nil` for `NULL`.
+// * Anything else is passed as a `pf.Value`.
+//
+// Each public function or command which is prefix or unfix becomes a method of the `Client`, with
+// its name capitalized, and followed by its signature if it's overloaded, as with the RPCs in
+// `proto.go`. It returns the result of the function, if it returns anything but `OK`, and an error,
+// which is an `*Error` if the function returned a Pipefish error.
+
+const goClientPreamble = `
+import (
+	"errors"
+	"strconv"
+	"sync"
+
+	"github.com/tim-hardcastle/pipefish/source/pf"
+)
+
+// The name of the service.
+const SERVICE = %SERVICE%
+
+// A client of the service.
+type Client struct {
+	mu        sync.Mutex // A service runs one line at a time.
+	sv        *pf.Service
+	namespace string // The namespace of the service's functions in ` + "`sv`" + `.
+	types     map[string]pf.Type
+}
+
+// An error returned by the service. An error from a service on a hub has the Id ` + "`vm/user`" + `,
+// as has any error returned by an external service.
+type Error struct {
+	Id      string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Makes a client which calls an initialized service in the same process.
+func New(sv *pf.Service) (*Client, error) {
+	return newClient(sv, "")
+}
+
+// Makes a client which calls the service on the hub at the given host, e.g.
+// "http://localhost:50005", logging on as the given user.
+func Dial(host, username, password string) (*Client, error) {
+	sv := pf.NewService()
+	sv.SetCredentials(func(string) (string, string) { return username, password })
+	if err := sv.InitializeFromCode("external\n\n" + pf.Quote(host+"/"+SERVICE) + "\n"); err != nil {
+		report, _ := sv.GetErrorReport()
+		return nil, errors.New("can't reach service " + strconv.Quote(SERVICE) + " at " + host + ": " + report)
+	}
+	return newClient(sv, SERVICE+".")
+}
+
+func newClient(sv *pf.Service, namespace string) (*Client, error) {
+	c := &Client{sv: sv, namespace: namespace, types: map[string]pf.Type{}}
+	for _, name := range types {
+		t, err := sv.TypeNameToType(namespace + name)
+		if err != nil {
+			return nil, errors.New("the service has no type " + name)
+		}
+		c.types[name] = t
+	}
+	return c, nil
+}
+
+// Calls the service, given a line with the names of the arguments in it.
+func (c *Client) call(line string, args map[string]pf.Value) (pf.Value, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	v, err := c.sv.DoWithValues(c.namespace+line, args)
+	if err != nil {
+		return v, err
+	}
+	if v.T == pf.ERROR {
+		e := v.V.(*pf.Error)
+		return v, &Error{e.ErrorId, e.Message}
+	}
+	return v, nil
+}
+
+func (c *Client) unexpected(v pf.Value, want string) error {
+	return errors.New("expected a value of type " + want + ", got " + c.sv.ToLiteral(v))
+}
+
+func fromNullable[T any](x *T, from func(T) pf.Value) pf.Value {
+	if x == nil {
+		return pf.Value{T: pf.NULL}
+	}
+	return from(*x)
+}
+
+func toNullable[T any](v pf.Value, to func(pf.Value) (T, error)) (*T, error) {
+	if v.T == pf.NULL {
+		return nil, nil
+	}
+	x, err := to(v)
+	if err != nil {
+		return nil, err
+	}
+	return &x, nil
+}
+`
+
+var goClientScalars = map[string]string{"int": "int", "float": "float64", "string": "string", "bool": "bool", "rune": "rune"}
+
+var goClientScalarTypes = map[string]string{"int": "pf.INT", "float": "pf.FLOAT", "string": "pf.STRING", "bool": "pf.BOOL", "rune": "pf.RUNE"}
+
+// Returns the source code of a Go package which is a client of the service, given the name of the
+// package and of the service, and the service's serialized API.
+func GoClientFromApi(pkg, service, serializedAPI string) (string, error) {
+	gz := goClientizer{newClientApi(serializedAPI)}
+	var buf strings.Builder
+	buf.WriteString("// Code generated by `pipefish gen go`. DO NOT EDIT.\n\n")
+	buf.WriteString("// Package " + pkg + " is a client of the Pipefish service `" + service + "`.\n")
+	buf.WriteString("package " + pkg + "\n")
+	buf.WriteString(strings.Replace(goClientPreamble, "%SERVICE%", strconv.Quote(service), 1))
+	buf.WriteString("\n// The types of the service which have Go types.\nvar types = []string{")
+	for i, ty := range gz.types {
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+		buf.WriteString(strconv.Quote(ty))
+	}
+	buf.WriteString("}\n")
+	for _, scalar := range clientScalars {
+		gz.writeScalar(&buf, scalar)
+	}
+	for _, ty := range gz.types {
+		switch {
+		case gz.enums[ty] != nil:
+			gz.writeEnum(&buf, ty)
+		case gz.parents[ty] != "":
+			gz.writeClone(&buf, ty)
+		default:
+			gz.writeStruct(&buf, ty)
+		}
+	}
+	for _, fn := range gz.functions {
+		gz.writeMethod(&buf, fn)
+	}
+	code, err := format.Source([]byte(buf.String()))
+	if err != nil {
+		return buf.String(), err
+	}
+	return string(code), nil
+}
+
+type goClientizer struct {
+	*clientApi
+}
+
+// Returns the Go type of a value which may have the given types, and the names of the functions
+// which convert it to and from a `pf.Value`, or "" if no conversion is needed.
+func (gz *goClientizer) goType(types []string) (string, string, string) {
+	ty, nullable := strings.CutSuffix(gz.describe(types), "?")
+	if ty == "" {
+		return "pf.Value", "", ""
+	}
+	goType := ty
+	if goClientScalars[ty] != "" {
+		goType = goClientScalars[ty]
+	}
+	to, from := "c.to"+capitalize(ty), "c.from"+capitalize(ty)
+	if nullable {
+		return "*" + goType, "toNullable(%s, " + to + ")", "fromNullable(%s, " + from + ")"
+	}
+	return goType, to + "(%s)", from + "(%s)"
+}
+
+// Applies a conversion returned by `goType` to an expression.
+func convert(conversion, expression string) string {
+	if conversion == "" {
+		return expression
+	}
+	return strings.Replace(conversion, "%s", expression, 1)
+}
+
+func (gz *goClientizer) writeScalar(buf *strings.Builder, scalar string) {
+	name, goType, pfType := capitalize(scalar), goClientScalars[scalar], goClientScalarTypes[scalar]
+	buf.WriteString("\nfunc (c *Client) from" + name + "(x " + goType + ") pf.Value {\n")
+	buf.WriteString("\treturn pf.Value{T: " + pfType + ", V: x}\n}\n")
+	buf.WriteString("\nfunc (c *Client) to" + name + "(v pf.Value) (" + goType + ", error) {\n")
+	buf.WriteString("\tif v.T != " + pfType + " {\n\t\tvar zero " + goType + "\n\t\treturn zero, c.unexpected(v, " + strconv.Quote(scalar) + ")\n\t}\n")
+	buf.WriteString("\treturn v.V.(" + goType + "), nil\n}\n")
+}
+
+func (gz *goClientizer) writeEnum(buf *strings.Builder, ty string) {
+	buf.WriteString("\ntype " + ty + " int\n\nconst (\n")
+	for i, element := range gz.enums[ty] {
+		buf.WriteString("\t" + element)
+		if i == 0 {
+			buf.WriteString(" " + ty + " = iota")
+		}
+		buf.WriteString("\n")
+	}
+	buf.WriteString(")\n")
+	buf.WriteString("\nfunc (c *Client) from" + capitalize(ty) + "(x " + ty + ") pf.Value {\n")
+	buf.WriteString("\treturn pf.Value{T: c.types[" + strconv.Quote(ty) + "], V: int(x)}\n}\n")
+	buf.WriteString("\nfunc (c *Client) to" + capitalize(ty) + "(v pf.Value) (" + ty + ", error) {\n")
+	buf.WriteString("\tif v.T != c.types[" + strconv.Quote(ty) + "] {\n\t\treturn 0, c.unexpected(v, " + strconv.Quote(ty) + ")\n\t}\n")
+	buf.WriteString("\treturn " + ty + "(v.V.(int)), nil\n}\n")
+}
+
+func (gz *goClientizer) writeClone(buf *strings.Builder, ty string) {
+	parent := goClientScalars[gz.parents[ty]]
+	buf.WriteString("\ntype " + ty + " " + parent + "\n")
+	buf.WriteString("\nfunc (c *Client) from" + capitalize(ty) + "(x " + ty + ") pf.Value {\n")
+	buf.WriteString("\treturn pf.Value{T: c.types[" + strconv.Quote(ty) + "], V: " + parent + "(x)}\n}\n")
+	buf.WriteString("\nfunc (c *Client) to" + capitalize(ty) + "(v pf.Value) (" + ty + ", error) {\n")
+	buf.WriteString("\tif v.T != c.types[" + strconv.Quote(ty) + "] {\n\t\tvar zero " + ty + "\n\t\treturn zero, c.unexpected(v, " + strconv.Quote(ty) + ")\n\t}\n")
+	buf.WriteString("\treturn " + ty + "(v.V.(" + parent + ")), nil\n}\n")
+}
+
+func (gz *goClientizer) writeStruct(buf *strings.Builder, ty string) {
+	type field struct{ name, goType, to, from string }
+	fields := []field{}
+	for _, f := range gz.structs[ty] {
+		goType, to, from := gz.goType(f.types)
+		fields = append(fields, field{capitalize(f.name), goType, to, from})
+	}
+	buf.WriteString("\ntype " + ty + " struct {\n")
+	for _, f := range fields {
+		buf.WriteString("\t" + f.name + " " + f.goType + "\n")
+	}
+	buf.WriteString("}\n")
+	buf.WriteString("\nfunc (c *Client) from" + capitalize(ty) + "(x " + ty + ") pf.Value {\n")
+	buf.WriteString("\treturn pf.Value{T: c.types[" + strconv.Quote(ty) + "], V: []pf.Value{")
+	for i, f := range fields {
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+		buf.WriteString(convert(f.from, "x."+f.name))
+	}
+	buf.WriteString("}}\n}\n")
+	buf.WriteString("\nfunc (c *Client) to" + capitalize(ty) + "(v pf.Value) (" + ty + ", error) {\n")
+	buf.WriteString("\tvar result " + ty + "\n")
+	buf.WriteString("\tif v.T != c.types[" + strconv.Quote(ty) + "] {\n\t\treturn result, c.unexpected(v, " + strconv.Quote(ty) + ")\n\t}\n")
+	buf.WriteString("\tfields := v.V.([]pf.Value)\n")
+	if slices.ContainsFunc(fields, func(f field) bool { return f.to != "" }) {
+		buf.WriteString("\tvar err error\n")
+	}
+	for i, f := range fields {
+		value := "fields[" + strconv.Itoa(i) + "]"
+		if f.to == "" {
+			buf.WriteString("\tresult." + f.name + " = " + value + "\n")
+			continue
+		}
+		buf.WriteString("\tif result." + f.name + ", err = " + convert(f.to, value) + "; err != nil {\n\t\treturn result, err\n\t}\n")
+	}
+	buf.WriteString("\treturn result, nil\n}\n")
+}
+
+// The names a method gives its parameters are those of the function, unless they're Go keywords
+// or clash with the names the method uses itself.
+var goClientReserved = []string{"c", "v", "err", "zero", "pf"}
+
+func (gz *goClientizer) writeMethod(buf *strings.Builder, fn clientFunction) {
+	params, args := []string{}, []string{}
+	for _, param := range fn.params {
+		goName := param.name
+		if gotoken.IsKeyword(goName) || slices.Contains(goClientReserved, goName) {
+			goName = goName + "_"
+		}
+		goType, _, from := gz.goType(param.types)
+		params = append(params, goName+" "+goType)
+		args = append(args, strconv.Quote("_go_"+param.name)+": "+convert(from, goName))
+	}
+	line := fn.line(func(i int) string { return "_go_" + fn.params[i].name })
+	buf.WriteString("\n// Calls `" + describeSig(fn.entity.parts) + "`.\n")
+	buf.WriteString("func (c *Client) " + capitalize(fn.name) + "(" + strings.Join(params, ", ") + ") ")
+	argMap := "nil"
+	if len(args) > 0 {
+		argMap = "map[string]pf.Value{" + strings.Join(args, ", ") + "}"
+	}
+	if fn.returnsOk() {
+		buf.WriteString("error {\n")
+		buf.WriteString("\t_, err := c.call(" + strconv.Quote(line) + ", " + argMap + ")\n")
+		buf.WriteString("\treturn err\n}\n")
+		return
+	}
+	goType, to, _ := gz.goType(fn.returns)
+	buf.WriteString("(" + goType + ", error) {\n")
+	buf.WriteString("\tv, err := c.call(" + strconv.Quote(line) + ", " + argMap + ")\n")
+	buf.WriteString("\tif err != nil {\n\t\tvar zero " + goType + "\n\t\treturn zero, err\n\t}\n")
+	if to == "" {
+		buf.WriteString("\treturn v, nil\n}\n")
+		return
+	}
+	buf.WriteString("\treturn " + convert(to, "v") + "\n}\n")
+}
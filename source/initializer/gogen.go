@@ -19,6 +19,8 @@ package initializer
 
 import (
 	"fmt"
+	"maps"
+	"slices"
 	"strconv"
 	"strings"
 
@@ -30,7 +32,12 @@ import (
 )
 
 func (iz *Initializer) generateDeclarations(sb *strings.Builder, userDefinedTypes types) {
-	for ty := range userDefinedTypes {
+	// The types are declared in order so that the same script always makes the same Go, which
+	// `gobuild.go` relies on.
+	sortedTypes := slices.SortedFunc(maps.Keys(userDefinedTypes), func(a, b values.ValueType) int {
+		return strings.Compare(iz.cp.Vm.ConcreteTypeInfo[a].GetName(vm.DEFAULT), iz.cp.Vm.ConcreteTypeInfo[b].GetName(vm.DEFAULT))
+	})
+	for _, ty := range sortedTypes {
 		typeInfo := iz.cp.Vm.ConcreteTypeInfo[ty]
 		name := typeInfo.GetName(vm.DEFAULT)
 		switch typeInfo := typeInfo.(type) {
@@ -61,7 +68,7 @@ func (iz *Initializer) generateDeclarations(sb *strings.Builder, userDefinedType
 	// 	    "Dragon": func(t uint32, v any) any {return Dragon{v.([]any)[0], V.([]any)[1], V.([]any)[2]}},
 	// }
 	fmt.Fprint(sb, "var PIPEFISH_FUNCTION_CONVERTER = map[string](func(t uint32, v any) any){\n")
-	for ty := range userDefinedTypes {
+	for _, ty := range sortedTypes {
 		typeInfo := iz.cp.Vm.ConcreteTypeInfo[ty]
 		pfName := iz.cp.Vm.DescribeType(ty, vm.LITERAL, iz.cp.Number)
 		goName := typeInfo.GetName(vm.DEFAULT)
@@ -92,7 +99,7 @@ func (iz *Initializer) generateDeclarations(sb *strings.Builder, userDefinedType
 	// is that then we'd have to import the `reflect` package into everything.
 	fmt.Fprint(sb, "var PIPEFISH_VALUE_CONVERTER = map[string]any{\n")
 
-	for ty := range userDefinedTypes {
+	for _, ty := range sortedTypes {
 		typeInfo := iz.cp.Vm.ConcreteTypeInfo[ty]
 		pfName := iz.cp.Vm.DescribeType(ty, vm.LITERAL, iz.cp.Number)
 		goName := typeInfo.GetName(vm.DEFAULT)
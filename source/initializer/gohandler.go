@@ -102,39 +102,59 @@ func (iz *Initializer) compileGo() {
 
 	for source := range iz.goBucket.sources {
 		sourceToken := &token.Token{Source: source}
-		f, err := os.Stat(MakeFilepath(source))
-		if err != nil {
-			iz.throw("golang/file", sourceToken, source, err.Error())
-			break
+		// The Go may have been compiled into the binary, or we may be finding it so that it can
+		// be: see `gobuild.go`.
+		var symbols goSymbols
+		if iz.Common.goSources != nil || len(compiledGo) > 0 {
+			code := iz.generateGo(source)
+			if code == "" {
+				return
+			}
+			hash := goHash(code)
+			if iz.Common.goSources != nil {
+				iz.Common.goSources[hash] = code
+				continue
+			}
+			if compiled, ok := compiledGo[hash]; ok {
+				symbols = compiled
+			}
 		}
-		var plugins *plugin.Plugin
-		sourceCodeModified := f.ModTime().UnixMilli()
-		objectCodeModified, ok := timeMap[source]
-		if !ok || sourceCodeModified != int64(objectCodeModified) {
-			plugins = iz.makeNewSoFile(source, sourceCodeModified)
-		} else {
-			soFile := settings.PipefishHomeDirectory + "source/initializer/gobucket/" + text.Flatten(source) + "_" + strconv.Itoa(int(sourceCodeModified)) + ".so"
-			plugins, err = plugin.Open(soFile)
+		if symbols == nil {
+			f, err := statFile(iz.Common.fsys, MakeFilepath(source))
 			if err != nil {
-				iz.throw("golang/open.b", sourceToken, err.Error())
+				iz.throw("golang/file", sourceToken, source, err.Error())
+				break
+			}
+			var plugins *plugin.Plugin
+			sourceCodeModified := f.ModTime().UnixMilli()
+			objectCodeModified, ok := timeMap[source]
+			if !ok || sourceCodeModified != int64(objectCodeModified) {
+				plugins = iz.makeNewSoFile(source, sourceCodeModified)
+			} else {
+				soFile := settings.PipefishHomeDirectory + "source/initializer/gobucket/" + text.Flatten(source) + "_" + strconv.Itoa(int(sourceCodeModified)) + ".so"
+				plugins, err = plugin.Open(soFile)
+				if err != nil {
+					iz.throw("golang/open.b", sourceToken, err.Error())
+					return
+				}
+			}
+			if plugins == nil { // Then the Go has failed to compile.
+				iz.throw("golang/compile", sourceToken)
 				return
 			}
-		}
-		if plugins == nil { // Then the Go has failed to compile.
-			iz.throw("golang/compile", sourceToken)
-			return
+			symbols = plugins
 		}
 
 		// We extract the conversion data from the object code, reformat it, and store the results
 		// in the vm.
 		newGoConverter := make([](func(t uint32, v any) any), len(iz.cp.Vm.ConcreteTypeInfo))
 		copy(newGoConverter, iz.cp.Vm.GoConverter)
-		functionConverterSymbol, _ := plugins.Lookup("PIPEFISH_FUNCTION_CONVERTER")
+		functionConverterSymbol, _ := symbols.Lookup("PIPEFISH_FUNCTION_CONVERTER")
 		functionConverter := *functionConverterSymbol.(*map[string](func(t uint32, v any) any))
-		if equalsFunctionSymbol, err := plugins.Lookup("Equals"); err == nil {
+		if equalsFunctionSymbol, err := symbols.Lookup("Equals"); err == nil {
 			iz.cp.Vm.GoEquals = equalsFunctionSymbol.(func(x any, y any) bool)
 		}
-		if literalFunctionSymbol, err := plugins.Lookup("Literal"); err == nil {
+		if literalFunctionSymbol, err := symbols.Lookup("Literal"); err == nil {
 			iz.cp.Vm.GoLiteral = literalFunctionSymbol.(func(x any) string)
 		}
 		for k, v := range BUILTIN_FUNCTION_CONVERTER {
@@ -145,7 +165,7 @@ func (iz *Initializer) compileGo() {
 			newGoConverter[typeNumber] = constructor
 		}
 		iz.cp.Vm.GoConverter = newGoConverter
-		valueConverterSymbol, _ := plugins.Lookup("PIPEFISH_VALUE_CONVERTER")
+		valueConverterSymbol, _ := symbols.Lookup("PIPEFISH_VALUE_CONVERTER")
 		valueConverter := *valueConverterSymbol.(*map[string]any)
 		for k, v := range BUILTIN_VALUE_CONVERTER {
 			valueConverter[k] = v
@@ -158,7 +178,7 @@ func (iz *Initializer) compileGo() {
 		// in the common parser bindle. I.e. we are returning our result by mutating the
 		// functions.
 		for _, function := range iz.goBucket.functions[source] {
-			goFunction, _ := plugins.Lookup(capitalize(function.op.Literal))
+			goFunction, _ := symbols.Lookup(capitalize(function.op.Literal))
 			function.body.(*parser.GolangExpression).GoFunction = reflect.ValueOf(goFunction)
 		}
 	}
@@ -187,6 +207,52 @@ type types = dtypes.Set[values.ValueType]
 // Most of the code generation is in the `gogen.go` file in this same `initializer` package.
 func (iz *Initializer) makeNewSoFile(source string, newTime int64) *plugin.Plugin {
 	sourceToken := &token.Token{Source: source}
+	code := iz.generateGo(source)
+	if code == "" {
+		return nil
+	}
+	counter++ // The number of the gocode_<counter>.go source file we're going to write.
+	soFile := filepath.Join(settings.PipefishHomeDirectory, filepath.FromSlash("source/initializer/gobucket/"+text.Flatten(source)+"_"+strconv.Itoa(int(newTime))+".so"))
+	timeMap := iz.getGoTimes()
+	if oldTime, ok := timeMap[source]; ok {
+		os.Remove(filepath.Join(settings.PipefishHomeDirectory, filepath.FromSlash("source/initializer/gobucket/"+text.Flatten(source)+"_"+strconv.Itoa(int(oldTime))+".so")))
+	}
+	goFile := filepath.Join(settings.PipefishHomeDirectory, "gocode_"+strconv.Itoa(counter)+".go")
+	iz.cmG("Creating goFile with filepath '"+goFile+"'\n\n", source)
+	file, err := os.Create(goFile)
+	if err != nil {
+		iz.throw("golang/create", sourceToken, err.Error())
+		return nil
+	}
+	file.WriteString(code)
+	iz.cmG("*************GENERATED GO IS*************\n\n"+code+"*****************************************\n\n", source)
+	file.Close()
+	if settings.SHOW_GOLANG && !(settings.MandatoryImportSet()).Contains(source) {
+		println("Creating soFile with filepath '" + soFile + "'\n\n")
+	}
+	cmd := exec.Command("go", "build", "-buildmode=plugin", "-o", soFile, goFile) // Version to use running from terminal.
+	// cmd := exec.Command("go", "build", "-gcflags=all=-N -l", "-buildmode=plugin", "-o", soFile, goFile) // Version to use with debugger.
+	output, err := cmd.Output()
+	if err != nil {
+		iz.throw("golang/build", sourceToken, err.Error()+": "+string(output))
+		return nil
+	}
+	plugins, err := plugin.Open(soFile)
+	if err != nil {
+		iz.throw("golang/open.a", sourceToken, err.Error())
+		return nil
+	}
+	// We do this here and not earlier with defer because a .go file that doesn't compile should
+	// be visible for debugging.
+	os.Remove(goFile)
+	timeMap[source] = newTime
+	iz.recordGoTimes(timeMap)
+	return plugins
+}
+
+// This returns the source code of the `main` package made from the Go in a source, or "" if there
+// are errors.
+func (iz *Initializer) generateGo(source string) string {
 	iz.cmG("Making golang from source '"+source+"'\n\n", source)
 	var StringBuilder strings.Builder
 	sb := &StringBuilder
@@ -237,7 +303,7 @@ func (iz *Initializer) makeNewSoFile(source string, newTime int64) *plugin.Plugi
 	}
 	iz.transitivelyCloseTypes(userDefinedTypes)
 	if iz.errorsExist() {
-		return nil
+		return ""
 	}
 	// We emit the type declarations and converters.
 	iz.generateDeclarations(sb, userDefinedTypes)
@@ -249,43 +315,10 @@ func (iz *Initializer) makeNewSoFile(source string, newTime int64) *plugin.Plugi
 	for _, pureGo := range iz.goBucket.pureGo[source] {
 		fmt.Fprint(sb, pureGo)
 	}
-	counter++ // The number of the gocode_<counter>.go source file we're going to write.
-	soFile := filepath.Join(settings.PipefishHomeDirectory, filepath.FromSlash("source/initializer/gobucket/"+text.Flatten(source)+"_"+strconv.Itoa(int(newTime))+".so"))
-	timeMap := iz.getGoTimes()
-	if oldTime, ok := timeMap[source]; ok {
-		os.Remove(filepath.Join(settings.PipefishHomeDirectory, filepath.FromSlash("source/initializer/gobucket/"+text.Flatten(source)+"_"+strconv.Itoa(int(oldTime))+".so")))
-	}
-	goFile := filepath.Join(settings.PipefishHomeDirectory, "gocode_"+strconv.Itoa(counter)+".go")
-	iz.cmG("Creating goFile with filepath '"+goFile+"'\n\n", source)
-	file, err := os.Create(goFile)
-	if err != nil {
-		iz.throw("golang/create", sourceToken, err.Error())
-		return nil
-	}
-	file.WriteString(sb.String())
-	iz.cmG("*************GENERATED GO IS*************\n\n"+sb.String()+"*****************************************\n\n", source)
-	file.Close()
-	if settings.SHOW_GOLANG && !(settings.MandatoryImportSet()).Contains(source) {
-		println("Creating soFile with filepath '" + soFile + "'\n\n")
-	}
-	cmd := exec.Command("go", "build", "-buildmode=plugin", "-o", soFile, goFile) // Version to use running from terminal.
-	// cmd := exec.Command("go", "build", "-gcflags=all=-N -l", "-buildmode=plugin", "-o", soFile, goFile) // Version to use with debugger.
-	output, err := cmd.Output()
-	if err != nil {
-		iz.throw("golang/build", sourceToken, err.Error()+": "+string(output))
-		return nil
-	}
-	plugins, err := plugin.Open(soFile)
-	if err != nil {
-		iz.throw("golang/open.a", sourceToken, err.Error())
-		return nil
+	if iz.errorsExist() {
+		return ""
 	}
-	// We do this here and not earlier with defer because a .go file that doesn't compile should
-	// be visible for debugging.
-	os.Remove(goFile)
-	timeMap[source] = newTime
-	iz.recordGoTimes(timeMap)
-	return plugins
+	return sb.String()
 }
 
 // This makes sure that if  we're generating declarations for a struct type,
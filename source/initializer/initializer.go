@@ -2,9 +2,11 @@ package initializer
 
 import (
 	"embed"
+	"io/fs"
 	"maps"
 	"os"
 	"path/filepath"
+	"reflect"
 	"sort"
 
 	orderedmap "github.com/wk8/go-ordered-map/v2"
@@ -82,16 +84,55 @@ type commonInitializerBindle struct {
 	// This is a map of the compilers of all the (potential) external services on the same hub.
 	// They're stored as compilers because the initializer can't see the `Service` class.
 	serviceCompilers map[string]*compiler.Compiler
-	hubStore         values.Map // The hub store --- see wiki.
+	hubStore         values.Map  // The hub store --- see wiki.
+	credentials      Credentials // How to log on to the hubs of external services, or nil to ask at the terminal.
+	// When we're only finding the Go in the scripts so as to compile it into a binary, this
+	// collects the source code of the Go by its hash, and is otherwise nil. See `gobuild.go`.
+	goSources map[string]string
+	natives   map[string]any // The Go functions supplying the native functions, by name. See `natives.go`.
+	fsys      fs.FS          // The file system the scripts are read from, or nil for the OS. See `getters.go`.
+	// The Pipefish types which the Go types of the native functions stand for. See `natives.go`.
+	nativeTypes map[reflect.Type]values.ValueType
+	// Whether the APIs of the external services are checked against the lockfile of the script
+	// which declares them. See `api_versions.go`.
+	ignoreLockfile bool
+}
+
+// Supplies the username and password with which to log on to the hub at the given host, for
+// calls to an external service on it.
+type Credentials func(host string) (username, password string)
+
+// What a compiler is started with other than its source code. Any of it may be left out.
+type Options struct {
+	Store       values.Map                    // The hub store --- see wiki.
+	Services    map[string]*compiler.Compiler // The services on the same hub, which the script may declare as external.
+	Credentials Credentials                   // How to log on to the hubs of external services, or nil to ask at the terminal.
+	Natives     map[string]any                // The Go functions supplying the native functions, by name. See `natives.go`.
+	FS          fs.FS                         // The file system the scripts are read from, or nil for the OS. See `getters.go`.
+	// Whether to skip checking the APIs of the external services against the script's lockfile,
+	// e.g. so as to remake it. See `api_versions.go`.
+	IgnoreLockfile bool
 }
 
 // Initializes the `CommonInitializerBindle`.
 func NewCommonInitializerBindle(store values.Map, services map[string]*compiler.Compiler) *commonInitializerBindle {
+	return newCommonInitializerBindle(Options{Store: store, Services: services})
+}
+
+func newCommonInitializerBindle(opts Options) *commonInitializerBindle {
+	if opts.Services == nil {
+		opts.Services = map[string]*compiler.Compiler{}
+	}
 	b := commonInitializerBindle{
 		functions:        make(map[funcSource]*parsedFunction),
 		declarationMap:   make(map[decKey]any),
-		serviceCompilers: services,
-		hubStore:         store,
+		serviceCompilers: opts.Services,
+		hubStore:         opts.Store,
+		credentials:      opts.Credentials,
+		natives:          opts.Natives,
+		nativeTypes:      map[reflect.Type]values.ValueType{},
+		fsys:             opts.FS,
+		ignoreLockfile:   opts.IgnoreLockfile,
 	}
 	return &b
 }
@@ -115,11 +156,11 @@ type typeOperatorInfo struct {
 }
 
 // Initializes a compiler given the filepath and sourcecode.
-func newCompiler(Common *parser.CommonParserBindle, ccb *compiler.CommonCompilerBindle, scriptFilepath, sourcecode string, mc *vm.Vm, namespacePath string) *compiler.Compiler {
+func newCompiler(Common *parser.CommonParserBindle, ccb *compiler.CommonCompilerBindle, fsys fs.FS, scriptFilepath, sourcecode string, mc *vm.Vm, namespacePath string) *compiler.Compiler {
 	p := parser.New(Common, scriptFilepath, sourcecode, namespacePath)
 	cp := compiler.NewCompiler(p, ccb)
 	cp.ScriptFilepath = scriptFilepath
-	file, _ := os.Stat(scriptFilepath)
+	file, _ := statFile(fsys, scriptFilepath)
 	if file == nil { // E.g. the empty service.
 		cp.Sources = map[string]int64{}
 	} else {
@@ -138,21 +179,41 @@ func newCompiler(Common *parser.CommonParserBindle, ccb *compiler.CommonCompiler
 
 // Initializes a compiler given the filepath.
 func StartCompilerFromFilepath(filepath string, svs map[string]*compiler.Compiler, store values.Map) (*compiler.Compiler, error) {
-	sourcecode, e := GetSourceCode(filepath)
+	return StartCompilerFromFilepathWithOptions(filepath, Options{Store: store, Services: svs})
+}
+
+// Initializes a compiler given the filepath, which is read from `opts.FS` if it isn't nil.
+func StartCompilerFromFilepathWithOptions(filepath string, opts Options) (*compiler.Compiler, error) {
+	sourcecode, e := getSourceCode(opts.FS, filepath)
 	if e != nil {
 		return nil, e
 	}
-	return StartCompiler(filepath, sourcecode, svs, store), nil
+	return StartCompilerWithOptions(filepath, sourcecode, opts), nil
 }
 
+// Initializes a compiler given the filepath and sourcecode.
 func StartCompiler(scriptFilepath, sourcecode string, hubServices map[string]*compiler.Compiler, store values.Map) *compiler.Compiler {
-	// We begin by creating an initializer and injecting a new CommonInitializerBindle into it.
-	iz := NewInitializer(NewCommonInitializerBindle(store, hubServices))
+	return StartCompilerWithOptions(scriptFilepath, sourcecode, Options{Store: store, Services: hubServices})
+}
+
+// Initializes a compiler given the filepath and sourcecode, and whatever else it needs.
+func StartCompilerWithOptions(scriptFilepath, sourcecode string, opts Options) *compiler.Compiler {
+	return startCompiler(newCommonInitializerBindle(opts), scriptFilepath, sourcecode)
+}
+
+func startCompiler(common *commonInitializerBindle, scriptFilepath, sourcecode string) *compiler.Compiler {
+	// We begin by creating an initializer and injecting the CommonInitializerBindle into it.
+	iz := NewInitializer(common)
 	// We carry out several phases of initialization each of which is performed recursively on
 	// all of the modules in the dependency tree before moving on to the next. (The need to do this is
 	// in fact what defines the phases.)
 	iz.cmI("Parsing everything.")
 	result := iz.ParseEverythingFromSourcecode(vm.BlankVm(), parser.NewCommonParserBindle(), compiler.NewCommonCompilerBindle(), scriptFilepath, sourcecode, "")
+	if common.fsys != nil {
+		if err := vm.LoadOperations(common.fsys); err != nil {
+			iz.throw("init/operations", &token.Token{Source: "source/vm/operations.md"}, err.Error())
+		}
+	}
 	if iz.errorsExist() {
 		iz.cp.P.Common.IsBroken = true
 		return result
@@ -238,6 +299,9 @@ func StartCompiler(scriptFilepath, sourcecode string, hubServices map[string]*co
 		iz.cp.P.Common.IsBroken = true
 		return result
 	}
+	if iz.Common.goSources != nil { // Then we only wanted the Go, and have no Go functions to evaluate the constants with.
+		return result
+	}
 	iz.cmI("Compiling everything else.")
 	iz.compileEverythingElse()
 	if iz.errorsExist() {
@@ -263,7 +327,7 @@ func StartCompiler(scriptFilepath, sourcecode string, hubServices map[string]*co
 // extracts the source code from the given file, and then calls the `parseEverything“
 // method, below.
 func (iz *Initializer) ParseEverythingFromSourcecode(mc *vm.Vm, cpb *parser.CommonParserBindle, ccb *compiler.CommonCompilerBindle, scriptFilepath, sourcecode, namespacePath string) *compiler.Compiler {
-	iz.cp = newCompiler(cpb, ccb, scriptFilepath, sourcecode, mc, namespacePath)
+	iz.cp = newCompiler(cpb, ccb, iz.Common.fsys, scriptFilepath, sourcecode, mc, namespacePath)
 	iz.P = iz.cp.P
 	iz.parseEverything(scriptFilepath, sourcecode)
 	iz.cp.ScriptFilepath = scriptFilepath
@@ -1044,7 +1108,8 @@ func (iz *Initializer) compileGoModules() {
 		dependencyIz.compileGoModules()
 	}
 
-	iz.compileGo() // This is in 'gohandler.go' in this package.
+	iz.compileGo()      // This is in 'gohandler.go' in this package.
+	iz.compileNatives() // And this is in 'natives.go'.
 }
 
 var IMPERATIVES = dtypes.SetOf(commandDeclaration, testDeclaration)
@@ -1218,6 +1283,8 @@ func (iz *Initializer) compileEverythingElse() [][]labeledParsedCodeChunk { // T
 		"$_cliArguments":    {values.LIST, cliArgs, altType(values.LIST)},
 		"$_moduleDirectory": {values.STRING, filepath.Dir(iz.cp.ScriptFilepath), altType(values.STRING)},
 		"$_env":             {values.MAP, iz.Common.hubStore, altType(values.MAP)},
+		"$_access":          {values.MAP, values.Map{}, altType(values.MAP)},
+		"$_externals":       {values.MAP, values.Map{}, altType(values.MAP)},
 	}
 	// Service variables which tell the compiler how to compile things must be
 	// set before we compile the functions, and so can't be calculated but must
@@ -1321,6 +1388,12 @@ func (iz *Initializer) compileEverythingElse() [][]labeledParsedCodeChunk { // T
 	if iz.errorsExist() {
 		return result
 	}
+	if decs, ok := namesToDeclarations.Get("$_externals"); ok {
+		iz.checkExternalConfig(decs[0].chunk.getToken())
+		if iz.errorsExist() {
+			return result
+		}
+	}
 	// We make a note of where "stringify" is.
 	callInfoForStringify := iz.cp.FunctionForest["stringify"].Tree.Branch[0].Node.Branch[0].Node.CallInfo
 	stringifyFn := callInfoForStringify.Compiler.Fns[callInfoForStringify.Number]
@@ -1608,10 +1681,11 @@ func (iz *Initializer) compileFunction(decType declarationType, decNo int, outer
 			}
 		}
 		cpFn.Builtin = name
-	case token.GOLANG:
+	case token.GOLANG, token.NATIVE:
 		cpFn.GoNumber = uint32(len(iz.cp.Vm.GoFns))
 		cpFn.HasGo = true
-		iz.cp.Vm.GoFns = append(iz.cp.Vm.GoFns, vm.GoFn{Code: izFn.body.(*parser.GolangExpression).GoFunction})
+		iz.cp.Vm.GoFns = append(iz.cp.Vm.GoFns, vm.GoFn{Code: izFn.body.(*parser.GolangExpression).GoFunction,
+			Native: izFn.body.GetToken().Type == token.NATIVE})
 	case token.XCALL:
 	default:
 		logVar, _ := iz.cp.GlobalVars.GetVar("$_logTo")
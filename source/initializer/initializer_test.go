@@ -14,8 +14,10 @@ import (
 	"path/filepath"
 	"runtime"
 	"strconv"
+	"strings"
 	"testing"
 
+	"github.com/tim-hardcastle/pipefish/source/initializer"
 	"github.com/tim-hardcastle/pipefish/source/settings"
 	"github.com/tim-hardcastle/pipefish/source/test_helper"
 	"github.com/tim-hardcastle/pipefish/source/text"
@@ -144,6 +146,35 @@ func TestGocode(t *testing.T) {
 	test_helper.Teardown("gocode_test.pf")
 }
 
+func TestCompiledGo(t *testing.T) {
+	// no t.Parallel()
+	wd, _ := os.Getwd()
+	sources := map[string]string{}
+	cp, e := initializer.GoSourcesFromFilepath(filepath.Join(wd, "../compiler/test-files/compiled_go_test.pf"), sources)
+	if e != nil || cp.P.Common.IsBroken {
+		t.Fatalf("Can't get the Go from compiled_go_test.pf.")
+	}
+	if len(sources) != 1 {
+		t.Fatalf("Expected the Go of one source, got %v.", len(sources))
+	}
+	// We register the Go as the `main` function made by `pipefish build --with-go` would.
+	for hash := range sources {
+		initializer.RegisterGo(hash, initializer.CompiledGo{
+			"PIPEFISH_FUNCTION_CONVERTER": &map[string](func(t uint32, v any) any){},
+			"PIPEFISH_VALUE_CONVERTER":    &map[string]any{},
+			"Double":                      func(i int) any { return i * 2 },
+		})
+	}
+	tests := []test_helper.TestItem{
+		{`double 21`, `42`},
+	}
+	test_helper.RunTest(t, "compiled_go_test.pf", tests, test_helper.TestValues)
+	plugins, _ := filepath.Glob(filepath.Join(settings.PipefishHomeDirectory, "source/initializer/gobucket/*compiled_go_test*"))
+	if len(plugins) != 0 {
+		t.Errorf("Expected the compiled Go to be used, but a plugin was built.")
+	}
+}
+
 func TestGolangItes(t *testing.T) {
 	// no t.Parallel()
 	tests := []test_helper.TestItem{
@@ -479,3 +510,222 @@ func TestExternalOrImportChunking(t *testing.T) {
 	}
 	test_helper.RunInitializerTest(t, tests, test_helper.TestExternalOrImportChunking)
 }
+
+func TestDiffApis(t *testing.T) {
+	old := " | VERSION | 0\n" +
+		"ENUM | Color | RED | GREEN\n" +
+		"STRUCT | Person | name string | age int\n" +
+		"CLONE | UID | int | +\n" +
+		"FUNCTION | f | 0 | x int | int *AT 1\n"
+	tests := []struct {
+		new, want string
+	}{
+		{"ENUM | Color | RED | GREEN\nSTRUCT | Person | name string | age int\nFUNCTION | f | 0 | x int | int *AT 1\nCLONE | UID | int | +\n", ""},
+		{"ENUM | Color | RED | GREEN | BLUE\nSTRUCT | Person | name string | age int\nCLONE | UID | int | + | -\nFUNCTION | f | 0 | y int | int *AT 1\n",
+			"compatible: clone type `UID` now uses `-`; compatible: enum `Color` has new elements BLUE; " +
+				"compatible: function `f (x int)` has had its parameters renamed to `f (y int)`"},
+		{"ENUM | Color | GREEN | RED\nSTRUCT | Person | name string\nCLONE | UID | int | +\nFUNCTION | f | 0 | x string | int *AT 1\n",
+			"breaking: enum `Color` has had its elements changed from RED, GREEN to GREEN, RED; " +
+				"breaking: function `f (x int)` has been removed; " +
+				"breaking: struct `Person` has had its fields changed from (name string, age int) to (name string); " +
+				"compatible: function `f (x string)` has been added"},
+	}
+	for _, test := range tests {
+		got := []string{}
+		for _, change := range initializer.DiffApis(old, test.new) {
+			if change.Breaking {
+				got = append(got, "breaking: "+change.Description)
+			} else {
+				got = append(got, "compatible: "+change.Description)
+			}
+		}
+		if strings.Join(got, "; ") != test.want {
+			t.Fatal("unexpected diff " + strconv.Quote(strings.Join(got, "; ")))
+		}
+	}
+}
+
+func TestProtoFromApi(t *testing.T) {
+	api := "VERSION | 0\n" +
+		"ENUM | TrafficLight | RED | AMBER | GREEN\n" +
+		"STRUCT | Person | name string | age int null | light TrafficLight\n" +
+		"STRUCT | Box | contents list\n" +
+		"CLONE | UID | int | +\n" +
+		"FUNCTION | find | 0 | id UID | Person error *AT 2\n" +
+		"FUNCTION | find | 0 | name string | Person error *AT 2\n" +
+		"FUNCTION | add | 0 | x int | to bling | y float? | float *AT 1\n" +
+		"FUNCTION | unbox | 0 | b Box | list *AT 1\n" +
+		"FUNCTION | both | 0 | x int | int string *AT 2\n" +
+		"FUNCTION | plus | 1 | x int | plus bling | y int | int *AT 1\n" +
+		"COMMAND | reset | 3 | ok error *AT 2\n"
+	want := `// The API of the Pipefish service ` + "`people`" + `.
+
+syntax = "proto3";
+
+package pipefish;
+
+enum TrafficLight {
+  TRAFFIC_LIGHT_RED = 0;
+  TRAFFIC_LIGHT_AMBER = 1;
+  TRAFFIC_LIGHT_GREEN = 2;
+}
+
+message Box {
+  string contents = 1; // A Pipefish literal.
+}
+
+message Person {
+  string name = 1;
+  optional int64 age = 2;
+  TrafficLight light = 3;
+}
+
+message ResetRequest {}
+
+message ResetResponse {}
+
+message AddRequest {
+  int64 x = 1;
+  optional double y = 2;
+}
+
+message AddResponse {
+  double value = 1;
+}
+
+message BothRequest {
+  int64 x = 1;
+}
+
+message BothResponse {
+  string value = 1; // A Pipefish literal.
+}
+
+message FindUIDRequest {
+  int64 id = 1;
+}
+
+message FindUIDResponse {
+  Person value = 1;
+}
+
+message FindStringRequest {
+  string name = 1;
+}
+
+message FindStringResponse {
+  Person value = 1;
+}
+
+service people {
+  rpc Reset (ResetRequest) returns (ResetResponse);
+  rpc Add (AddRequest) returns (AddResponse);
+  rpc Both (BothRequest) returns (BothResponse);
+  rpc FindUID (FindUIDRequest) returns (FindUIDResponse);
+  rpc FindString (FindStringRequest) returns (FindStringResponse);
+}
+`
+	got := initializer.ProtoFromApi("people", api).String()
+	if got != want {
+		t.Fatal("unexpected proto:\n" + got)
+	}
+}
+
+// The API the tests of the clients are made from.
+const clientTestApi = "VERSION | 0\n" +
+	"ENUM | TrafficLight | RED | AMBER | GREEN\n" +
+	"STRUCT | Person | name string | age int null | light TrafficLight\n" +
+	"STRUCT | Box | contents list\n" +
+	"CLONE | UID | int | +\n" +
+	"CLONE | Vec | list\n" +
+	"FUNCTION | find | 0 | id UID | Person error *AT 2\n" +
+	"FUNCTION | find | 0 | name string | Person error *AT 2\n" +
+	"FUNCTION | add | 0 | x int | to bling | y float? | float *AT 1\n" +
+	"FUNCTION | unbox | 0 | b Box | list *AT 1\n" +
+	"FUNCTION | plus | 1 | x int | plus bling | y int | int *AT 1\n" +
+	"COMMAND | reset | 3 | ok error *AT 2\n"
+
+func TestGoClientFromApi(t *testing.T) {
+	got, err := initializer.GoClientFromApi("people", "people", clientTestApi)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wants := []string{
+		"package people\n",
+		"const SERVICE = \"people\"\n",
+		"var types = []string{\"UID\", \"TrafficLight\", \"Box\", \"Person\"}\n",
+		"type UID int\n",
+		"\tRED TrafficLight = iota\n",
+		"type Person struct {\n\tName  string\n\tAge   *int\n\tLight TrafficLight\n}\n",
+		"type Box struct {\n\tContents pf.Value\n}\n",
+		"func (c *Client) Reset() error {\n\t_, err := c.call(\"reset\", nil)\n",
+		"func (c *Client) Add(x int, y *float64) (float64, error) {\n" +
+			"\tv, err := c.call(\"add (_go_x) to (_go_y)\", map[string]pf.Value{\"_go_x\": c.fromInt(x), \"_go_y\": fromNullable(y, c.fromFloat)})\n",
+		"func (c *Client) FindUID(id UID) (Person, error) {\n",
+		"func (c *Client) FindString(name string) (Person, error) {\n",
+		"func (c *Client) Unbox(b Box) (pf.Value, error) {\n",
+	}
+	for _, want := range wants {
+		if !strings.Contains(got, want) {
+			t.Fatal("expected " + strconv.Quote(want) + " in the client:\n" + got)
+		}
+	}
+	// Clones of types other than the scalars, and infix functions, aren't translated.
+	if strings.Contains(got, "Vec") || strings.Contains(got, "Plus") {
+		t.Fatal("unexpected client:\n" + got)
+	}
+}
+
+func TestPythonClientFromApi(t *testing.T) {
+	got := initializer.PythonClientFromApi("people", clientTestApi)
+	wants := []string{
+		"SERVICE = \"people\"\n",
+		"UID = typing.NewType(\"UID\", int)\n",
+		"class TrafficLight(enum.Enum):\n    RED = \"RED\"\n",
+		"@dataclasses.dataclass(frozen=True)\nclass Person:\n    name: str\n    age: int | None\n    light: TrafficLight\n",
+		"class Box:\n    contents: typing.Any\n",
+		"_STRUCTS = {\"Box\": (Box, [\"\"]), \"Person\": (Person, [\"string\", \"int?\", \"TrafficLight\"])}\n",
+		"_CLONES = {\"UID\": \"int\"}\n",
+		"    def reset(self) -> None:\n        \"\"\"Calls `reset`.\"\"\"\n        self._call(\"reset\")\n",
+		"    def add(self, x: int, y: float | None) -> float:\n",
+		"        return _expect(self._call(\"add (\" + _encode(x, \"int\") + \") to (\" + _encode(y, \"float?\") + \")\"), \"float\")\n",
+		"    def findUID(self, id: UID) -> Person:\n",
+		"    def findString(self, name: str) -> Person:\n",
+		"    def unbox(self, b: Box) -> typing.Any:\n",
+	}
+	for _, want := range wants {
+		if !strings.Contains(got, want) {
+			t.Fatal("expected " + strconv.Quote(want) + " in the client:\n" + got)
+		}
+	}
+	if strings.Contains(got, "Vec") || strings.Contains(got, "def plus") {
+		t.Fatal("unexpected client:\n" + got)
+	}
+}
+
+func TestTypeScriptClientFromApi(t *testing.T) {
+	got := initializer.TypeScriptClientFromApi("people", clientTestApi)
+	wants := []string{
+		"export const SERVICE = \"people\";\n",
+		"export type UID = number;\n",
+		"export enum TrafficLight {\n  RED = \"RED\",\n",
+		"export interface Person {\n  name: string;\n  age: number | null;\n  light: TrafficLight;\n}\n",
+		"export interface Box {\n  contents: unknown;\n}\n",
+		"  [\"Person\", [[\"name\", \"string\"], [\"age\", \"int?\"], [\"light\", \"TrafficLight\"]]],\n",
+		"  [\"UID\", \"int\"],\n",
+		"  async reset(): Promise<void> {\n    await this.call(\"reset\");\n  }\n",
+		"  async add(x: number, y: number | null): Promise<number> {\n" +
+			"    return expect(await this.call(\"add (\" + encode(x, \"int\") + \") to (\" + encode(y, \"float?\") + \")\"), \"float\") as number;\n",
+		"  async findUID(id: UID): Promise<Person> {\n",
+		"  async findString(name: string): Promise<Person> {\n",
+		"  async unbox(b: Box): Promise<unknown> {\n",
+	}
+	for _, want := range wants {
+		if !strings.Contains(got, want) {
+			t.Fatal("expected " + strconv.Quote(want) + " in the client:\n" + got)
+		}
+	}
+	if strings.Contains(got, "Vec") || strings.Contains(got, "async plus") {
+		t.Fatal("unexpected client:\n" + got)
+	}
+}
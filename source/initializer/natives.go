@@ -0,0 +1,280 @@
+package initializer
+
+// A Go program embedding a service can supply functions to it by calling `RegisterFunction` on the
+// service before initializing it. Each is declared in the script by a stub with the body
+// `native`, e.g. `fetchUser(id int) -> User : native`, which is then called just as though it
+// were a `golang` function, except that the Go function is the one registered rather than one
+// compiled from the script.
+//
+// Since we don't generate the Go types, we check that the Go function's types match the
+// signature of the stub, and add converters to the VM for any types which need them, as
+// `compileGo` does with the converters it finds in the `.so` file.
+
+import (
+	"reflect"
+
+	"github.com/tim-hardcastle/pipefish/source/err"
+	"github.com/tim-hardcastle/pipefish/source/parser"
+	"github.com/tim-hardcastle/pipefish/source/token"
+	"github.com/tim-hardcastle/pipefish/source/values"
+	"github.com/tim-hardcastle/pipefish/source/vm"
+)
+
+// The Go types which the VM passes to Go functions for the built-in types.
+var NATIVE_BUILTIN_TYPES = map[values.ValueType]reflect.Type{
+	values.BOOL:   reflect.TypeFor[bool](),
+	values.FLOAT:  reflect.TypeFor[float64](),
+	values.INT:    reflect.TypeFor[int](),
+	values.RUNE:   reflect.TypeFor[rune](),
+	values.STRING: reflect.TypeFor[string](),
+	values.LIST:   reflect.TypeFor[[]any](),
+	values.MAP:    reflect.TypeFor[map[any]any](),
+	values.PAIR:   reflect.TypeFor[[2]any](),
+	values.SET:    reflect.TypeFor[map[any]struct{}](),
+}
+
+var errorType = reflect.TypeFor[error]()
+
+func (iz *Initializer) compileNatives() {
+	for j := functionDeclaration; j <= commandDeclaration; j++ {
+		for _, pc := range iz.parsedCode[j] {
+			fn := pc.(*parsedFunction)
+			if fn.body.GetToken().Type != token.NATIVE {
+				continue
+			}
+			goFunction, ok := iz.Common.natives[fn.op.Literal]
+			if !ok {
+				iz.throw("golang/native/missing", &fn.op, fn.op.Literal)
+				continue
+			}
+			iz.addBuiltinGoConverters()
+			wrapper, ok := iz.wrapNative(fn, reflect.ValueOf(goFunction))
+			if !ok {
+				continue
+			}
+			fn.body.(*parser.GolangExpression).GoFunction = wrapper
+		}
+	}
+}
+
+// If the body of the function is the keyword `native`, returns its token. It isn't the keyword if
+// it's anything more than the bare word, or if the word is declared by the script as a constant,
+// variable, function or command, or by the function as a parameter or in its `given` block, since
+// then it's just an identifier.
+func (iz *Initializer) nativeKeyword(tc *tokenizedFunctionDeclaration) (token.Token, bool) {
+	toks := significantTokens(tc.body)
+	if len(toks) != 1 || toks[0].Type != token.IDENT || toks[0].Literal != "native" {
+		return token.Token{}, false
+	}
+	for _, pair := range tc.sig {
+		if pair.Name.Literal == "native" {
+			return token.Token{}, false
+		}
+	}
+	if tc.given != nil {
+		for _, tok := range significantTokens(tc.given) {
+			if tok.Type == token.IDENT && tok.Literal == "native" {
+				return token.Token{}, false
+			}
+		}
+	}
+	for dT := constantDeclaration; dT <= variableDeclaration; dT++ {
+		for _, dec := range iz.tokenizedCode[dT] {
+			for _, pair := range dec.(*tokenizedConstOrVarDeclaration).sig {
+				if pair.Name.Literal == "native" {
+					return token.Token{}, false
+				}
+			}
+		}
+	}
+	for dT := functionDeclaration; dT <= commandDeclaration; dT++ {
+		for _, dec := range iz.tokenizedCode[dT] {
+			if dec.(*tokenizedFunctionDeclaration).op.Literal == "native" {
+				return token.Token{}, false
+			}
+		}
+	}
+	return toks[0], true
+}
+
+// Returns the tokens of a chunk of code other than newlines and the end of the chunk.
+func significantTokens(tcc *parser.TokenizedCodeChunk) []token.Token {
+	result := []token.Token{}
+	tcc.ToStart()
+	for i := 0; i < tcc.Length(); i++ {
+		tok := tcc.NextToken()
+		if tok.Type != token.NEWLINE && tok.Type != token.EOF {
+			result = append(result, tok)
+		}
+	}
+	tcc.ToStart()
+	return result
+}
+
+// Checks the Go function against the signature of the stub, and returns a function which calls
+// it and returns a single value, as the VM expects of a Go function, turning a non-nil error
+// into a Pipefish error.
+func (iz *Initializer) wrapNative(fn *parsedFunction, goFunction reflect.Value) (reflect.Value, bool) {
+	goType := goFunction.Type()
+	params := parser.AstSig{}
+	for _, param := range fn.sig {
+		if _, ok := param.VarType.(*parser.TypeBling); !ok {
+			params = append(params, param)
+		}
+	}
+	if goType.IsVariadic() || goType.NumIn() != len(params) {
+		iz.throw("golang/native/param", &fn.op, fn.op.Literal, goType.String())
+		return reflect.Value{}, false
+	}
+	for i, param := range params {
+		if ok, reported := iz.matchNativeType(&fn.op, iz.cp.GetAbstractTypeFromAstType(param.VarType), goType.In(i)); !ok {
+			if !reported {
+				iz.throw("golang/native/param", &fn.op, fn.op.Literal, goType.String())
+			}
+			return reflect.Value{}, false
+		}
+	}
+	results := goType.NumOut()
+	returnsError := results > 0 && goType.Out(results-1) == errorType
+	if returnsError {
+		results--
+	}
+	rets := fn.callInfo.ReturnTypes
+	switch {
+	case results > 1:
+		iz.throw("golang/native/return", &fn.op, fn.op.Literal, goType.String())
+		return reflect.Value{}, false
+	case results == 1 && len(rets) > 1:
+		iz.throw("golang/native/return", &fn.op, fn.op.Literal, goType.String())
+		return reflect.Value{}, false
+	case results == 1 && len(rets) == 1:
+		if ok, reported := iz.matchNativeType(&fn.op, iz.cp.GetAbstractTypeFromAstType(rets[0].VarType), goType.Out(0)); !ok {
+			if !reported {
+				iz.throw("golang/native/return", &fn.op, fn.op.Literal, goType.String())
+			}
+			return reflect.Value{}, false
+		}
+	case results == 0 && len(rets) > 0 && !(len(rets) == 1 && parser.Is(rets[0].VarType, "ok")):
+		iz.throw("golang/native/return", &fn.op, fn.op.Literal, goType.String())
+		return reflect.Value{}, false
+	}
+	wrapperType := reflect.FuncOf(iz.nativeIns(goType), []reflect.Type{reflect.TypeFor[any]()}, false)
+	name := fn.op.Literal
+	return reflect.MakeFunc(wrapperType, func(args []reflect.Value) []reflect.Value {
+		out := goFunction.Call(args)
+		if returnsError && !out[len(out)-1].IsNil() {
+			e := out[len(out)-1].Interface().(error)
+			// The VM will supply the token of the call.
+			return []reflect.Value{reflect.ValueOf(err.CreateErr("vm/native", nil, name, e.Error()))}
+		}
+		if results == 0 {
+			return []reflect.Value{reflect.ValueOf(struct{}{})} // Which the VM turns into `OK`.
+		}
+		return []reflect.Value{out[0]}
+	}), true
+}
+
+func (iz *Initializer) nativeIns(goType reflect.Type) []reflect.Type {
+	ins := make([]reflect.Type, 0, goType.NumIn())
+	for i := 0; i < goType.NumIn(); i++ {
+		ins = append(ins, goType.In(i))
+	}
+	return ins
+}
+
+// Says whether values of the abstract Pipefish type can be converted to and from the Go type.
+// For the user-defined types this adds the converters to the VM, as `compileGo` does with the
+// converters generated for `golang` functions.
+//
+// Since the VM converts a value from Go by looking up its Go type, each Go type can stand for
+// only one Pipefish type in a given service. If it already stands for another, we report the
+// conflict, and the second return value says that we've done so.
+func (iz *Initializer) matchNativeType(tok *token.Token, abType values.AbstractType, goType reflect.Type) (bool, bool) {
+	if goType.Kind() == reflect.Interface && goType.NumMethod() == 0 {
+		return true, false
+	}
+	if abType.Len() != 1 {
+		return false, false
+	}
+	pfType := abType.Types[0]
+	if builtin, ok := NATIVE_BUILTIN_TYPES[pfType]; ok {
+		return goType == builtin, false
+	}
+	if known, ok := iz.Common.nativeTypes[goType]; ok {
+		if known != pfType {
+			iz.throw("golang/native/conflict", tok, goType.String(), iz.cp.Vm.DescribeType(known, vm.LITERAL, 0),
+				iz.cp.Vm.DescribeType(pfType, vm.LITERAL, 0))
+			return false, true
+		}
+		return true, false
+	}
+	switch typeInfo := iz.cp.Vm.ConcreteTypeInfo[pfType].(type) {
+	case vm.EnumType:
+		if !goType.ConvertibleTo(reflect.TypeFor[int]()) || goType.Kind() == reflect.Float32 || goType.Kind() == reflect.Float64 {
+			return false, false
+		}
+		iz.addNativeConverter(pfType, goType, func(t uint32, v any) any { return reflect.ValueOf(v).Convert(goType).Interface() })
+	case vm.CloneType:
+		parent, ok := NATIVE_BUILTIN_TYPES[typeInfo.Parent]
+		if !ok || goType.Kind() != parent.Kind() || !(typeInfo.Parent == values.INT || typeInfo.Parent == values.FLOAT ||
+			typeInfo.Parent == values.RUNE || typeInfo.Parent == values.STRING) {
+			return false, false
+		}
+		iz.addNativeConverter(pfType, goType, func(t uint32, v any) any { return reflect.ValueOf(v).Convert(goType).Interface() })
+	case vm.StructType:
+		if goType.Kind() != reflect.Struct || goType.NumField() != len(typeInfo.AbstractStructFields) {
+			return false, false
+		}
+		// We add the converter before looking at the fields, in case the struct is recursive.
+		iz.addNativeConverter(pfType, goType, func(t uint32, v any) any {
+			goStruct := reflect.New(goType).Elem()
+			for i, field := range v.([]any) {
+				if field != nil {
+					goStruct.Field(i).Set(reflect.ValueOf(field))
+				}
+			}
+			return goStruct.Interface()
+		})
+		for i, fieldType := range typeInfo.AbstractStructFields {
+			if !goType.Field(i).IsExported() {
+				iz.removeNativeConverter(pfType, goType)
+				return false, false
+			}
+			if ok, reported := iz.matchNativeType(tok, fieldType, goType.Field(i).Type); !ok {
+				iz.removeNativeConverter(pfType, goType)
+				return false, reported
+			}
+		}
+	default:
+		return false, false
+	}
+	return true, false
+}
+
+func (iz *Initializer) addNativeConverter(pfType values.ValueType, goType reflect.Type, converter func(t uint32, v any) any) {
+	iz.Common.nativeTypes[goType] = pfType
+	iz.cp.Vm.GoToPipefishTypes[goType] = pfType
+	iz.cp.Vm.GoConverter[pfType] = converter
+}
+
+func (iz *Initializer) removeNativeConverter(pfType values.ValueType, goType reflect.Type) {
+	delete(iz.Common.nativeTypes, goType)
+	delete(iz.cp.Vm.GoToPipefishTypes, goType)
+	iz.cp.Vm.GoConverter[pfType] = nil
+}
+
+// Makes sure the VM can convert the built-in types, which `compileGo` would have done if there
+// were any `golang` functions.
+func (iz *Initializer) addBuiltinGoConverters() {
+	if len(iz.cp.Vm.GoConverter) < len(iz.cp.Vm.ConcreteTypeInfo) {
+		newGoConverter := make([](func(t uint32, v any) any), len(iz.cp.Vm.ConcreteTypeInfo))
+		copy(newGoConverter, iz.cp.Vm.GoConverter)
+		iz.cp.Vm.GoConverter = newGoConverter
+	}
+	for typeName, constructor := range BUILTIN_FUNCTION_CONVERTER {
+		iz.cp.Vm.GoConverter[iz.cp.ConcreteTypeWithNamespaceNow(typeName)] = constructor
+	}
+	for typeName, goValue := range BUILTIN_VALUE_CONVERTER {
+		iz.cp.Vm.GoToPipefishTypes[reflect.TypeOf(goValue).Elem()] = iz.cp.ConcreteTypeWithNamespaceNow(typeName)
+	}
+}
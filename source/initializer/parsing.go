@@ -1,7 +1,7 @@
 package initializer
 
 import (
-	"os"
+	"io/fs"
 	"path/filepath"
 	"regexp"
 	"strings"
@@ -35,7 +35,7 @@ import (
 
 // Just exists to wrap around the next function.
 func (iz *Initializer) ParseEverythingFromFilePath(mc *vm.Vm, cpb *parser.CommonParserBindle, ccb *compiler.CommonCompilerBindle, scriptFilepath, namespacePath string) (*compiler.Compiler, error) {
-	sourcecode, e := GetSourceCode(scriptFilepath)
+	sourcecode, e := getSourceCode(iz.Common.fsys, scriptFilepath)
 	if e != nil {
 		return nil, e
 	}
@@ -43,13 +43,22 @@ func (iz *Initializer) ParseEverythingFromFilePath(mc *vm.Vm, cpb *parser.Common
 }
 
 func GetSourceCode(scriptFilepath string) (string, error) {
+	return getSourceCode(nil, scriptFilepath)
+}
+
+// Gets the source code of a script from a file system laid out as described in `getters.go`.
+func GetSourceCodeFromFS(fsys fs.FS, scriptFilepath string) (string, error) {
+	return getSourceCode(fsys, scriptFilepath)
+}
+
+func getSourceCode(fsys fs.FS, scriptFilepath string) (string, error) {
 	var sourcebytes []byte
 	var err error
 	if scriptFilepath != "" { // In which case we're making a blank VM.
 		if len(scriptFilepath) >= 11 && scriptFilepath[:11] == "test-files/" {
 			sourcebytes, err = compiler.TestFolder.ReadFile(scriptFilepath)
 		} else {
-			sourcebytes, err = os.ReadFile(MakeFilepath(scriptFilepath))
+			sourcebytes, err = readFile(fsys, MakeFilepath(scriptFilepath))
 		}
 		if err != nil {
 			return "", err
@@ -254,7 +263,7 @@ func (iz *Initializer) addToNamespace(thingsToImport []tokenizedCode) {
 		path := pathTok.Literal
 		source := pathTok.Source
 		_, path = TweakNameAndPath("", path, source)
-		file, _ := os.Stat(MakeFilepath(path))
+		file, _ := statFile(iz.Common.fsys, MakeFilepath(path))
 		if file != nil { // Exempts things like the builins.
 			iz.cp.Sources[path] = file.ModTime().UnixMilli()
 		}
@@ -264,9 +273,15 @@ func (iz *Initializer) addToNamespace(thingsToImport []tokenizedCode) {
 		iz.cmI("Adding '" + path + "' to namespace")
 		var libDat []byte
 		if strings.HasPrefix(filepath.ToSlash(path), "rsc-pf/") {
-			libDat, _ = folder.ReadFile(filepath.ToSlash(path))
+			var e error = fs.ErrNotExist
+			if iz.Common.fsys != nil {
+				libDat, e = readFile(iz.Common.fsys, path)
+			}
+			if e != nil { // Then we use the copy embedded in the binary.
+				libDat, _ = folder.ReadFile(filepath.ToSlash(path))
+			}
 		} else {
-			libDat, _ = os.ReadFile(path)
+			libDat, _ = readFile(iz.Common.fsys, path)
 		}
 		stdImp := strings.TrimRight(string(libDat), "\n") + "\n"
 		iz.cmI("Making new relexer with filepath '" + path + "'")
@@ -361,7 +376,9 @@ func (iz *Initializer) initializeExternals(startAt int) {
 			serviceName := path[pos+1:]
 			username := ""
 			password := ""
-			if !testing.Testing() {
+			if iz.Common.credentials != nil {
+				username, password = iz.Common.credentials(hostpath)
+			} else if !testing.Testing() {
 				rline := readline.NewInstance()
 				println("\n\nPlease enter your username and password for hub at " + text.CYAN + "'" + pathWithoutPort + "'" + text.RESET + ".")
 				rline.SetPrompt("Username: ")
@@ -384,7 +401,8 @@ func (iz *Initializer) initializeExternals(startAt int) {
 			continue // Either we've thrown an error or we don't need to do anything.
 		}
 		// Otherwise we need to start up the service, add it to the hub, and then declare it as external.
-		newServiceCp, e := StartCompilerFromFilepath(path, iz.Common.serviceCompilers, iz.Common.hubStore)
+		newServiceCp, e := StartCompilerFromFilepathWithOptions(path, Options{Store: iz.Common.hubStore,
+			Services: iz.Common.serviceCompilers, Credentials: iz.Common.credentials, FS: iz.Common.fsys})
 		if e != nil { // Then we couldn't open the file.
 			iz.throw("init/external/file", &dec.path, path, e.Error())
 			return
@@ -397,8 +415,26 @@ func (iz *Initializer) initializeExternals(startAt int) {
 // Functions auxiliary to the above.
 func (iz *Initializer) addExternalOnSameHub(path, name string) {
 	hubService := iz.Common.serviceCompilers[name]
-	ev := func(line string) values.Value {
-		exVal := hubService.Do(line)
+	wire := &vm.WireCodec{Vm: iz.cp.Vm}
+	ev := func(call *vm.ExternalCall) values.Value {
+		var exVal values.Value
+		data, e := wire.EncodeCall(call)
+		if e == nil {
+			var line string
+			var vals map[string]values.Value
+			line, vals, e = hubService.DecodeWireCall(data)
+			if e == nil {
+				exVal = hubService.DoWithValues(line, vals)
+			}
+		}
+		if e != nil {
+			exVal = hubService.Do(call.Line(func(v values.Value) string { return iz.cp.Vm.Literal(v, 0) }))
+		}
+		if data, e := hubService.WireCodec().Encode(exVal); e == nil {
+			if val, e := wire.Decode(data); e == nil {
+				return val
+			}
+		}
 		serialize := hubService.Vm.Literal(exVal, 0)
 		return iz.cp.Do(serialize)
 	}
@@ -409,22 +445,48 @@ func (iz *Initializer) addExternalOnSameHub(path, name string) {
 		return hubService.API
 	}
 	serviceToAdd := ExternalCallToHubHandler{ev, pr, se}
-	iz.addAnyExternalService(serviceToAdd, path, name)
+	iz.addAnyExternalService(serviceToAdd, wire, path, name)
 }
 
 func (iz *Initializer) addHttpService(path, name, username, password string) {
 	ds := func(valAsString string) values.Value {
 		return iz.cp.Do(valAsString)
 	}
-	serviceToAdd := ExternalHttpCallHandler{path, name, username, password, ds}
-	iz.addAnyExternalService(serviceToAdd, path, name)
+	wire := &vm.WireCodec{Vm: iz.cp.Vm}
+	// The configuration is looked up at each call, since the service variable may not have been
+	// initialized yet, and may be changed later.
+	config := func() vm.ExternalConfig {
+		v, ok := iz.cp.GlobalVars.Data["$_externals"]
+		if !ok {
+			return vm.DEFAULT_EXTERNAL_CONFIG
+		}
+		result, _ := externalConfig(iz.cp.Vm.Mem[v.MLoc], name)
+		return result
+	}
+	serviceToAdd := ExternalHttpCallHandler{path, name, username, password, ds, &wireState{codec: wire}, config, &circuitBreaker{}, dtypes.Set[string]{}, &remoteSession{}}
+	iz.addAnyExternalService(serviceToAdd, wire, path, name)
 }
 
-func (iz *Initializer) addAnyExternalService(handlerForService vm.ExternalCallHandler, path, name string) {
+// The wire codec of the service is given the number of the compiler of the module made from the
+// API, so that it names types as the external service does.
+func (iz *Initializer) addAnyExternalService(handlerForService vm.ExternalCallHandler, wire *vm.WireCodec, path, name string) {
 	externalServiceOrdinal := uint32(len(iz.cp.Vm.ExternalCallHandlers))
+	dec := iz.tokenizedCode[externalDeclaration][externalServiceOrdinal].(*tokenizedExternalOrImportDeclaration)
+	tok := &dec.path
+	if tok.Source == "" { // Then the external service was declared just by its name.
+		tok = &dec.name
+	}
+	serializedAPI, e := handlerForService.GetAPI()
+	if e != nil {
+		iz.throw(e.Id, tok, name, e.Detail)
+		return
+	}
+	if !iz.checkLockedApi(name, serializedAPI, tok) {
+		return
+	}
+	iz.cp.ExternalApis[name] = serializedAPI
 	iz.cp.CallHandlerNumbersByName[name] = externalServiceOrdinal
 	iz.cp.Vm.ExternalCallHandlers = append(iz.cp.Vm.ExternalCallHandlers, handlerForService)
-	serializedAPI := handlerForService.GetAPI()
 	sourcecode := iz.SerializedAPIToDeclarations(serializedAPI, externalServiceOrdinal) // This supplies us with a stub that know how to call the external servie.
 	if settings.SHOW_EXTERNAL_STUBS {
 		println("Making stub for external service '", name, "'.\n\n")
@@ -436,8 +498,9 @@ func (iz *Initializer) addAnyExternalService(handlerForService vm.ExternalCallHa
 	newCp := newIz.ParseEverythingFromSourcecode(iz.cp.Vm, iz.P.Common, iz.cp.Common, path, sourcecode, name+"."+iz.P.NamespacePath)
 	newCp.P.Namespace = name
 	iz.P.NamespaceBranch[name] = &parser.ParserData{newCp.P, path}
-	newCp.P.Private = iz.tokenizedCode[externalDeclaration][externalServiceOrdinal].(*tokenizedExternalOrImportDeclaration).private
+	newCp.P.Private = dec.private
 	iz.cp.Modules[name] = newCp
+	wire.CpNumber = newCp.Number
 }
 
 // This method takes the tokens from the relexer and splits it up into
@@ -1383,8 +1446,16 @@ func (iz *Initializer) parse(decType declarationType, decNumber int) parsedCode
 			body:      iz.P.ParseTokenizedChunk(),
 		}
 	case *tokenizedFunctionDeclaration:
-		iz.P.TokenizedCode = tc.body
-		parsedBody := iz.P.ParseTokenizedChunk()
+		// A function with the body `native` is supplied by Go through `RegisterFunction`, and is
+		// then called like a `golang` function: see `natives.go`.
+		var parsedBody parser.Node
+		if tok, ok := iz.nativeKeyword(tc); ok {
+			tok.Type = token.NATIVE
+			parsedBody = &parser.GolangExpression{Token: tok}
+		} else {
+			iz.P.TokenizedCode = tc.body
+			parsedBody = iz.P.ParseTokenizedChunk()
+		}
 		var parsedGiven parser.Node
 		if tc.given != nil {
 			iz.P.TokenizedCode = tc.given
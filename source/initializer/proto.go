@@ -0,0 +1,372 @@
+package initializer
+
+import (
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/tim-hardcastle/pipefish/source/vm"
+)
+
+// A service's public API can be described as protocol buffers, so that clients in other
+// languages can call it by gRPC. The `.proto` file is made from the serialized API (see
+// `README-api-serialization.md`), and the hub uses the same description to translate the
+// messages it gets into calls and the results back into messages. See `hub/grpc.go`.
+//
+// The types are translated as follows:
+//
+// * `int`, `float`, `string`, `bool`, and `rune` become `int64`, `double`, `string`, `bool`,
+// and `int32`.
+// * Enums become enums, whose values are the elements of the enum prefixed by its name, in
+// order, so that the number of a value is the index of the element.
+// * Structs become messages, with a field for each field of the struct.
+// * Clones of the types above become the type of their parent.
+// * A type which may be `NULL` becomes an optional field.
+//
+// Each public function or command which is prefix or unfix becomes an RPC, so long as all its
+// parameters have types which can be translated. The request has a field for each parameter,
+// and the bling is supplied by the hub. The response has a field `value` with the type the
+// function returns, if it's one that can be translated, or otherwise with the result as a
+// Pipefish literal in a string; and no fields at all if the function only returns `OK`. An error
+// is returned as the status of the RPC, and not in the response. The RPCs of overloaded
+// functions are told apart by their signatures, so that e.g. `find(id UID)` and
+// `find(name string)` become `FindUID` and `FindString`: see `overloadSuffix`.
+
+// The protocol buffers package of the services.
+const PROTO_PACKAGE = "pipefish"
+
+type ProtoApi struct {
+	Service  string
+	Enums    []ProtoEnum
+	Messages []ProtoMessage
+	Rpcs     []ProtoRpc
+}
+
+type ProtoEnum struct {
+	Name     string
+	Elements []string
+}
+
+type ProtoMessage struct {
+	Name   string
+	Fields []ProtoField
+}
+
+type ProtoField struct {
+	Name     string
+	Type     string // The Pipefish type: a builtin type, or the name of an enum, struct, or clone; or "" if the field is a literal.
+	Proto    string // The protocol buffers type.
+	Optional bool   // Whether the value may be `NULL`, which is sent as the field being absent.
+}
+
+type ProtoRpc struct {
+	Name     string
+	Function string
+	Position uint32   // `vm.PREFIX` or `vm.UNFIX`.
+	Sig      []string // The bling of the function, with "" for each parameter in turn.
+	Request  ProtoMessage
+	Response ProtoMessage
+}
+
+var protoScalars = map[string]string{"int": "int64", "float": "double", "string": "string", "bool": "bool", "rune": "int32"}
+
+var protoIdentifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Describes the API as protocol buffers. The name of the service should be a valid identifier.
+func ProtoFromApi(service, serializedAPI string) *ProtoApi {
+	api := &ProtoApi{Service: service}
+	entities := apiEntities(serializedAPI)
+	keys := sortedEntityKeys(entities)
+	parents := map[string]string{}   // The parent types of the clones.
+	structs := map[string][]string{} // The fields of the structs.
+	for _, key := range keys {
+		e := entities[key]
+		switch e.kind {
+		case "ENUM":
+			api.Enums = append(api.Enums, ProtoEnum{e.name, e.parts[2:]})
+		case "CLONE":
+			parents[e.name] = e.parts[2]
+		case "STRUCT":
+			structs[e.name] = e.parts[2:]
+		}
+	}
+	pz := protoizer{api: api, parents: parents, structs: structs}
+	for _, key := range keys {
+		if e := entities[key]; e.kind == "STRUCT" {
+			message := ProtoMessage{Name: e.name}
+			for _, field := range structs[e.name] {
+				name, types, _ := strings.Cut(field, " ")
+				message.Fields = append(message.Fields, pz.field(name, strings.Fields(types)))
+			}
+			api.Messages = append(api.Messages, message)
+		}
+	}
+	overloads := overloadCounts(entities)
+	named := map[string]bool{}
+	for _, key := range keys {
+		e := entities[key]
+		if e.kind != "FUNCTION" && e.kind != "COMMAND" || !protoIdentifier.MatchString(e.name) {
+			continue
+		}
+		position, _ := strconv.Atoi(e.parts[2])
+		if uint32(position) != vm.PREFIX && uint32(position) != vm.UNFIX {
+			continue
+		}
+		rpc := ProtoRpc{Function: e.name, Position: uint32(position)}
+		decodable := true
+		for _, param := range e.parts[3 : len(e.parts)-1] {
+			name, ty, _ := strings.Cut(param, " ")
+			if ty == "bling" {
+				rpc.Sig = append(rpc.Sig, name)
+				continue
+			}
+			rpc.Sig = append(rpc.Sig, "")
+			types := []string{ty}
+			if base, ok := strings.CutSuffix(ty, "?"); ok {
+				types = []string{base, "null"}
+			}
+			field := pz.field(name, types)
+			decodable = decodable && pz.decodable(field)
+			rpc.Request.Fields = append(rpc.Request.Fields, field)
+		}
+		if !decodable {
+			continue
+		}
+		rpc.Name = strings.ToUpper(e.name[:1]) + e.name[1:]
+		if overloads[e.name] > 1 {
+			rpc.Name = rpc.Name + overloadSuffix(e)
+		}
+		// Two signatures can only come out the same if their types differ in punctuation, so
+		// this will hardly ever happen.
+		for base, i := rpc.Name, 2; named[rpc.Name]; i++ {
+			rpc.Name = base + strconv.Itoa(i)
+		}
+		named[rpc.Name] = true
+		rpc.Request.Name = rpc.Name + "Request"
+		rpc.Response.Name = rpc.Name + "Response"
+		if returns := pz.returnTypes(e.parts[len(e.parts)-1]); !slices.Equal(returns, []string{"ok"}) {
+			rpc.Response.Fields = []ProtoField{pz.field("value", returns)}
+		}
+		api.Rpcs = append(api.Rpcs, rpc)
+	}
+	return api
+}
+
+// Counts the functions and commands with each name which would become RPCs if their types could
+// be translated, so that the name of an RPC doesn't depend on whether its overloads can be.
+func overloadCounts(entities map[string]apiEntity) map[string]int {
+	counts := map[string]int{}
+	for _, e := range entities {
+		if e.kind != "FUNCTION" && e.kind != "COMMAND" || !protoIdentifier.MatchString(e.name) {
+			continue
+		}
+		position, _ := strconv.Atoi(e.parts[2])
+		if uint32(position) == vm.PREFIX || uint32(position) == vm.UNFIX {
+			counts[e.name]++
+		}
+	}
+	return counts
+}
+
+var identifierWord = regexp.MustCompile(`[A-Za-z0-9]+|\?`)
+
+// Describes the signature of an overloaded function, to go after its name: the words of its
+// parameter types and its bling, capitalized, with "OrNull" for a type which may be `NULL`. So
+// `move(x int) to (y int)` gets the suffix `IntToInt`.
+func overloadSuffix(e apiEntity) string {
+	var buf strings.Builder
+	for _, param := range e.parts[3 : len(e.parts)-1] {
+		name, ty, _ := strings.Cut(param, " ")
+		if ty == "bling" {
+			ty = name
+		}
+		for _, word := range identifierWord.FindAllString(ty, -1) {
+			if word == "?" {
+				word = "OrNull"
+			}
+			buf.WriteString(strings.ToUpper(word[:1]) + word[1:])
+		}
+	}
+	return buf.String()
+}
+
+type protoizer struct {
+	api     *ProtoApi
+	parents map[string]string
+	structs map[string][]string
+}
+
+// Makes a field from the names of the types it may have.
+func (pz *protoizer) field(name string, types []string) ProtoField {
+	field := ProtoField{Name: name, Optional: slices.Contains(types, "null")}
+	types = slices.DeleteFunc(slices.Clone(types), func(s string) bool { return s == "null" })
+	if len(types) != 1 {
+		field.Proto = "string"
+		return field
+	}
+	ty := types[0]
+	proto := pz.proto(ty)
+	if proto == "" {
+		field.Proto = "string"
+		return field
+	}
+	field.Type, field.Proto = ty, proto
+	return field
+}
+
+// The protocol buffers type of a Pipefish type, or "" if it hasn't got one.
+func (pz *protoizer) proto(ty string) string {
+	if proto, ok := protoScalars[ty]; ok {
+		return proto
+	}
+	if parent, ok := pz.parents[ty]; ok {
+		return protoScalars[parent]
+	}
+	if _, ok := pz.structs[ty]; ok {
+		return ty
+	}
+	if slices.ContainsFunc(pz.api.Enums, func(e ProtoEnum) bool { return e.Name == ty }) {
+		return ty
+	}
+	return ""
+}
+
+// Whether a value of the field can be made from a message, which it can't if the field, or any
+// field of a struct it contains, is a literal.
+func (pz *protoizer) decodable(field ProtoField) bool {
+	return pz.decodableType(field.Type, map[string]bool{})
+}
+
+func (pz *protoizer) decodableType(ty string, seen map[string]bool) bool {
+	if ty == "" {
+		return false
+	}
+	fields, ok := pz.structs[ty]
+	if !ok || seen[ty] {
+		return true
+	}
+	seen[ty] = true
+	for _, f := range fields {
+		name, types, _ := strings.Cut(f, " ")
+		if !pz.decodableType(pz.field(name, strings.Fields(types)).Type, seen) {
+			return false
+		}
+	}
+	return true
+}
+
+// The names of the types a function may return, other than errors, from the serialization of
+// its typescheme; or nothing if it may return a tuple.
+func (pz *protoizer) returnTypes(typescheme string) []string {
+	result := []string{}
+	words := strings.Fields(typescheme)
+	for i := 0; i < len(words); i++ {
+		switch words[i] {
+		case "*TT", "*FT":
+			return nil
+		case "*AT":
+			i++
+		case "error":
+		default:
+			if !slices.Contains(result, words[i]) {
+				result = append(result, words[i])
+			}
+		}
+	}
+	return result
+}
+
+// Finds an RPC by name.
+func (api *ProtoApi) Rpc(name string) (*ProtoRpc, bool) {
+	for i := range api.Rpcs {
+		if api.Rpcs[i].Name == name {
+			return &api.Rpcs[i], true
+		}
+	}
+	return nil, false
+}
+
+// Finds a struct's message by name.
+func (api *ProtoApi) Message(name string) (*ProtoMessage, bool) {
+	for i := range api.Messages {
+		if api.Messages[i].Name == name {
+			return &api.Messages[i], true
+		}
+	}
+	return nil, false
+}
+
+// Finds an enum by name.
+func (api *ProtoApi) Enum(name string) (*ProtoEnum, bool) {
+	for i := range api.Enums {
+		if api.Enums[i].Name == name {
+			return &api.Enums[i], true
+		}
+	}
+	return nil, false
+}
+
+// Returns the `.proto` file describing the API.
+func (api *ProtoApi) String() string {
+	var buf strings.Builder
+	buf.WriteString("// The API of the Pipefish service `" + api.Service + "`.\n\n")
+	buf.WriteString("syntax = \"proto3\";\n\npackage " + PROTO_PACKAGE + ";\n")
+	for _, enum := range api.Enums {
+		buf.WriteString("\nenum " + enum.Name + " {\n")
+		prefix := enumPrefix(enum.Name)
+		for i, el := range enum.Elements {
+			buf.WriteString("  " + prefix + el + " = " + strconv.Itoa(i) + ";\n")
+		}
+		buf.WriteString("}\n")
+	}
+	for _, message := range api.Messages {
+		writeProtoMessage(&buf, message)
+	}
+	for _, rpc := range api.Rpcs {
+		writeProtoMessage(&buf, rpc.Request)
+		writeProtoMessage(&buf, rpc.Response)
+	}
+	buf.WriteString("\nservice " + api.Service + " {\n")
+	for _, rpc := range api.Rpcs {
+		buf.WriteString("  rpc " + rpc.Name + " (" + rpc.Request.Name + ") returns (" + rpc.Response.Name + ");\n")
+	}
+	buf.WriteString("}\n")
+	return buf.String()
+}
+
+func writeProtoMessage(buf *strings.Builder, message ProtoMessage) {
+	buf.WriteString("\nmessage " + message.Name + " {")
+	if len(message.Fields) == 0 {
+		buf.WriteString("}\n")
+		return
+	}
+	buf.WriteString("\n")
+	for i, field := range message.Fields {
+		buf.WriteString("  ")
+		if field.Optional {
+			buf.WriteString("optional ")
+		}
+		buf.WriteString(field.Proto + " " + field.Name + " = " + strconv.Itoa(i+1) + ";")
+		if field.Type == "" {
+			buf.WriteString(" // A Pipefish literal.")
+		}
+		buf.WriteString("\n")
+	}
+	buf.WriteString("}\n")
+}
+
+// Enum values are in the scope of the package and not of the enum, so e.g. the elements of
+// `TrafficLight` become `TRAFFIC_LIGHT_RED` etc.
+func enumPrefix(name string) string {
+	var buf strings.Builder
+	for i, r := range name {
+		if i > 0 && unicode.IsUpper(r) {
+			buf.WriteRune('_')
+		}
+		buf.WriteRune(unicode.ToUpper(r))
+	}
+	buf.WriteRune('_')
+	return buf.String()
+}
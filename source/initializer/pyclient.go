@@ -0,0 +1,405 @@
+package initializer
+
+import (
+	"strconv"
+	"strings"
+)
+
+// A Python module can be made from a service's public API, which is a client of the service on a
+// hub, calling it over HTTP as `api/__init__.py` does, but with the types of the service translated
+// into Python types, and its functions into methods. It uses only the standard library.
+//
+// The types are translated as follows:
+//
+// * `int`, `float`, `string`, `bool`, and `rune` become `int`, `float`, `str`, `bool`, and `str`.
+// * Enums become subclasses of `enum.Enum`.
+// * Structs become frozen dataclasses.
+// * Clones of the types above become `typing.NewType`s of the type of their parent.
+// * A type which may be `NULL` may also be `None`.
+// * Anything else is passed as whatever Python value it most resembles: a list, tuple, dict, set,
+// or `Pair`.
+//
+// Each public function or command which is prefix or unfix becomes a method of the `Client`, whose
+// name is followed by its signature if it's overloaded, as in `clients.go`. It returns the result
+// of the function, and raises a `PipefishError` if the function returned an error. The hub's
+// replies are Pipefish literals, which the module parses into Python values.
+
+const pyClientPreamble = `
+from __future__ import annotations
+
+import ast
+import dataclasses
+import decimal
+import enum
+import json
+import math
+import re
+import typing
+import urllib.error
+import urllib.request
+
+# The name of the service.
+SERVICE = %SERVICE%
+
+
+class PipefishError(Exception):
+    """An error returned by the service, or a reply from it which the client can't understand."""
+
+
+class Pair(typing.NamedTuple):
+    """A Pipefish pair ` + "`key::value`" + `."""
+
+    key: typing.Any
+    value: typing.Any
+`
+
+const pyClientClient = `
+
+class Client:
+    """A client of the service on the hub at the given host, e.g. "http://localhost:50005", which
+    logs on as the given user. It keeps the session the hub gives it from one call to the next."""
+
+    def __init__(self, host: str, username: str = "", password: str = ""):
+        self.host = host.rstrip("/")
+        self.username = username
+        self.password = password
+        self.session = ""
+
+    def _call(self, line: str) -> typing.Any:
+        request = urllib.request.Request(
+            self.host + "/",
+            data=json.dumps({"Body": line, "Service": SERVICE, "Username": self.username,
+                             "Password": self.password, "Session": self.session}).encode(),
+            headers={"Content-Type": "application/json"},
+        )
+        try:
+            with urllib.request.urlopen(request) as response:
+                reply = json.load(response)
+        except urllib.error.HTTPError as e:
+            raise PipefishError(e.read().decode().strip()) from None
+        self.session = reply["Session"]
+        try:
+            return _decode(reply["Body"])
+        except (ValueError, TypeError):
+            raise PipefishError(_message(reply["Body"])) from None
+`
+
+const pyClientPostamble = `
+
+# A type is described to the functions below as the name of a type the client knows about,
+# followed by "?" if the value may be NULL; or "" if the value may be anything.
+
+
+def _is(x: typing.Any, ty: str) -> bool:
+    if ty.endswith("?"):
+        return x is None or _is(x, ty[:-1])
+    ty = _CLONES.get(ty, ty)
+    if ty == "int":
+        return isinstance(x, int) and not isinstance(x, bool)
+    if ty == "float":
+        return isinstance(x, (int, float)) and not isinstance(x, bool)
+    if ty == "string":
+        return isinstance(x, str)
+    if ty == "rune":
+        return isinstance(x, str) and len(x) == 1
+    if ty == "bool":
+        return isinstance(x, bool)
+    if ty in _ENUMS:
+        return isinstance(x, _ENUMS[ty])
+    if ty in _STRUCTS:
+        return isinstance(x, _STRUCTS[ty][0])
+    return True
+
+
+def _expect(x: typing.Any, ty: str) -> typing.Any:
+    if not _is(x, ty):
+        raise PipefishError("expected a value of type " + ty + ", got " + repr(x))
+    return x
+
+
+_ESCAPES = {"\\": "\\\\", "\n": "\\n", "\r": "\\r", "\t": "\\t", "\x1b": "\\e"}
+
+
+def _escape(s: str, quote: str) -> str:
+    return "".join("\\" + c if c == quote else _ESCAPES.get(c, c) for c in s)
+
+
+def _float(x: float) -> str:
+    # Pipefish has no exponents in its float literals.
+    if math.isinf(x) or math.isnan(x):
+        raise ValueError("Pipefish has no literal for " + repr(x))
+    s = format(decimal.Decimal(repr(float(x))), "f")
+    return s if "." in s else s + ".0"
+
+
+def _encode(x: typing.Any, ty: str = "") -> str:
+    """Writes a value as a Pipefish literal."""
+    if ty and not _is(x, ty):
+        raise TypeError("expected a value of type " + ty + ", got " + repr(x))
+    ty = ty[:-1] if ty.endswith("?") else ty
+    if x is None:
+        return "NULL"
+    if ty in _CLONES:
+        return ty + "(" + _encode(x, _CLONES[ty]) + ")"
+    if ty == "rune":
+        return "'" + _escape(x, "'") + "'"
+    if ty == "float" or isinstance(x, float):
+        return _float(x)
+    if isinstance(x, bool):
+        return "true" if x else "false"
+    if isinstance(x, int):
+        return str(x)
+    if isinstance(x, str):
+        return '"' + _escape(x, '"') + '"'
+    if isinstance(x, enum.Enum):
+        return x.name
+    name = type(x).__name__
+    if name in _STRUCTS and _STRUCTS[name][0] is type(x):
+        fields = zip(dataclasses.fields(x), _STRUCTS[name][1])
+        return name + "(" + ", ".join(_encode(getattr(x, f.name), t) for f, t in fields) + ")"
+    if isinstance(x, Pair):
+        return _encode(x.key) + "::" + _encode(x.value)
+    if isinstance(x, tuple):
+        return ("tuple(" if len(x) == 1 else "(") + ", ".join(map(_encode, x)) + ")"
+    if isinstance(x, list):
+        return "[" + ", ".join(map(_encode, x)) + "]"
+    if isinstance(x, dict):
+        return "map(" + ", ".join(_encode(k) + "::" + _encode(v) for k, v in x.items()) + ")"
+    if isinstance(x, (set, frozenset)):
+        return "set(" + ", ".join(map(_encode, x)) + ")"
+    raise TypeError("can't write " + repr(x) + " as a Pipefish value")
+
+
+_TOKEN = re.compile(r"""\s*(?:
+    (?P<number>[-+]?\d+(?:\.\d+)?(?:[eE][-+]?\d+)?|[-+]Inf|NaN\b)
+  | (?P<string>"(?:[^"\\]|\\.)*")
+  | (?P<rune>'.')
+  | (?P<name>[A-Za-z_][A-Za-z0-9_]*(?:\.[A-Za-z_][A-Za-z0-9_]*)*)
+  | (?P<punctuation>::|[][(),])
+)""", re.VERBOSE | re.DOTALL)
+
+
+class _Decoder:
+    """Parses the literals the hub writes. Types other than those of the service are read as
+    whatever Python value they most resemble."""
+
+    def __init__(self, text: str):
+        self.tokens = []
+        text = text.rstrip()
+        pos = 0
+        while pos < len(text):
+            match = _TOKEN.match(text, pos)
+            if match is None:
+                raise ValueError("can't read " + text[pos:])
+            self.tokens.append((match.lastgroup, match.group(match.lastgroup)))
+            pos = match.end()
+        self.i = 0
+
+    def next(self) -> tuple[str, str]:
+        if self.i == len(self.tokens):
+            raise ValueError("unexpected end of reply")
+        self.i += 1
+        return self.tokens[self.i - 1]
+
+    def peek(self) -> str:
+        return self.tokens[self.i][1] if self.i < len(self.tokens) else ""
+
+    def value(self) -> typing.Any:
+        x = self.primary()
+        if self.peek() == "::":
+            self.next()
+            return Pair(x, self.value())
+        return x
+
+    def values(self, close: str) -> list:
+        result = []
+        if self.peek() == close:
+            self.next()
+            return result
+        while True:
+            result.append(self.value())
+            _, t = self.next()
+            if t == close:
+                return result
+            if t != ",":
+                raise ValueError("unexpected " + t)
+
+    def primary(self) -> typing.Any:
+        kind, t = self.next()
+        if kind == "number":
+            return int(t) if re.fullmatch(r"[-+]?\d+", t) else float(t)
+        if kind == "string":
+            return ast.literal_eval(t)
+        if kind == "rune":
+            return t[1]
+        if t == "[":
+            return self.values("]")
+        if t == "(":
+            return tuple(self.values(")"))
+        if kind != "name":
+            raise ValueError("unexpected " + t)
+        name = t.rsplit(".", 1)[-1]
+        if self.peek() == "(":
+            self.next()
+            args = self.values(")")
+            if name in _STRUCTS:
+                return _STRUCTS[name][0](*args)
+            if name in _CLONES and len(args) == 1:
+                return args[0]
+            if name == "tuple":
+                return tuple(args)
+            if name == "set":
+                return set(args)
+            if name == "map" or args and all(isinstance(arg, Pair) for arg in args):
+                return dict(args)
+            return args
+        if self.peek() == "[":
+            self.next()
+            return self.values("]")
+        constants = {"true": True, "false": False, "NULL": None, "OK": None}
+        if name in constants:
+            return constants[name]
+        if name in _ELEMENTS:
+            return _ELEMENTS[name]
+        raise ValueError("unexpected " + t)
+
+
+def _decode(body: str) -> typing.Any:
+    decoder = _Decoder(body)
+    if not decoder.tokens:
+        return None
+    x = decoder.value()
+    if decoder.i != len(decoder.tokens):
+        raise ValueError("unexpected " + decoder.peek())
+    return x
+
+
+_ANSI = re.compile(r"\x1b\[[0-9;]*m")
+
+
+def _message(body: str) -> str:
+    """Finds the message of an error from the hub."""
+    text = _ANSI.sub("", body).replace("\n", "").strip()
+    match = re.fullmatch(r"\[\d+\] Error: (.*?)(?: at line .*)?\.?", text, re.DOTALL)
+    return match.group(1) if match else text
+`
+
+var pyClientScalars = map[string]string{"int": "int", "float": "float", "string": "str", "bool": "bool", "rune": "str"}
+
+// The names a method gives its parameters are those of the function, unless they're Python
+// keywords or clash with the names the method uses itself; and likewise for the names of methods
+// and fields.
+var pyClientReserved = []string{"False", "None", "True", "and", "as", "assert", "async", "await",
+	"break", "class", "continue", "def", "del", "elif", "else", "except", "finally", "for", "from",
+	"global", "if", "import", "in", "is", "lambda", "nonlocal", "not", "or", "pass", "raise",
+	"return", "try", "while", "with", "yield", "self", "host", "username", "password", "session"}
+
+// Returns the source code of a Python module which is a client of the service, given the name of
+// the service and its serialized API.
+func PythonClientFromApi(service, serializedAPI string) string {
+	api := newClientApi(serializedAPI)
+	var buf strings.Builder
+	buf.WriteString("# Code generated by `pipefish gen python`. DO NOT EDIT.\n\n")
+	buf.WriteString("\"\"\"A client of the Pipefish service `" + service + "`.\"\"\"\n")
+	buf.WriteString(strings.Replace(pyClientPreamble, "%SERVICE%", strconv.Quote(service), 1))
+	for _, ty := range api.types {
+		switch {
+		case api.enums[ty] != nil:
+			buf.WriteString("\n\nclass " + ty + "(enum.Enum):\n")
+			for _, element := range api.enums[ty] {
+				buf.WriteString("    " + element + " = " + strconv.Quote(element) + "\n")
+			}
+		case api.parents[ty] != "":
+			buf.WriteString("\n\n" + ty + " = typing.NewType(" + strconv.Quote(ty) + ", " + pyClientScalars[api.parents[ty]] + ")\n")
+		default:
+			buf.WriteString("\n\n@dataclasses.dataclass(frozen=True)\nclass " + ty + ":\n")
+			if len(api.structs[ty]) == 0 {
+				buf.WriteString("    pass\n")
+			}
+			for _, field := range api.structs[ty] {
+				buf.WriteString("    " + clientName(field.name, pyClientReserved) + ": " + pyType(api.describe(field.types)) + "\n")
+			}
+		}
+	}
+	buf.WriteString("\n\n# The types of the service which the client knows about.\n")
+	buf.WriteString("_ENUMS = {" + pyRegistry(api, func(ty string) string {
+		if api.enums[ty] == nil {
+			return ""
+		}
+		return ty
+	}) + "}\n")
+	buf.WriteString("_STRUCTS = {" + pyRegistry(api, func(ty string) string {
+		if _, ok := api.structs[ty]; !ok {
+			return ""
+		}
+		descriptions := []string{}
+		for _, field := range api.structs[ty] {
+			descriptions = append(descriptions, strconv.Quote(api.describe(field.types)))
+		}
+		return "(" + ty + ", [" + strings.Join(descriptions, ", ") + "])"
+	}) + "}\n")
+	buf.WriteString("_CLONES = {" + pyRegistry(api, func(ty string) string {
+		if api.parents[ty] == "" {
+			return ""
+		}
+		return strconv.Quote(api.parents[ty])
+	}) + "}\n")
+	buf.WriteString("_ELEMENTS = {element.name: element for enum_ in _ENUMS.values() for element in enum_}\n")
+	buf.WriteString(pyClientClient)
+	for _, fn := range api.functions {
+		params, descriptions := []string{"self"}, []string{}
+		for _, param := range fn.params {
+			description := api.describe(param.types)
+			params = append(params, clientName(param.name, pyClientReserved)+": "+pyType(description))
+			descriptions = append(descriptions, description)
+		}
+		call := "self._call(" + fn.lineExpression(func(i int) string {
+			return "_encode(" + clientName(fn.params[i].name, pyClientReserved) + ", " + strconv.Quote(descriptions[i]) + ")"
+		}) + ")"
+		buf.WriteString("\n    def " + clientName(fn.name, pyClientReserved) + "(" + strings.Join(params, ", ") + ") -> ")
+		switch {
+		case fn.returnsOk():
+			buf.WriteString("None:\n")
+			buf.WriteString("        \"\"\"Calls `" + describeSig(fn.entity.parts) + "`.\"\"\"\n")
+			buf.WriteString("        " + call + "\n")
+		default:
+			description := api.describe(fn.returns)
+			buf.WriteString(pyType(description) + ":\n")
+			buf.WriteString("        \"\"\"Calls `" + describeSig(fn.entity.parts) + "`.\"\"\"\n")
+			if description == "" {
+				buf.WriteString("        return " + call + "\n")
+				continue
+			}
+			buf.WriteString("        return _expect(" + call + ", " + strconv.Quote(description) + ")\n")
+		}
+	}
+	buf.WriteString(pyClientPostamble)
+	return buf.String()
+}
+
+// Returns the Python type of a value, given the description of its type by `clientApi.describe`.
+func pyType(description string) string {
+	ty, nullable := strings.CutSuffix(description, "?")
+	if ty == "" {
+		return "typing.Any"
+	}
+	if pyClientScalars[ty] != "" {
+		ty = pyClientScalars[ty]
+	}
+	if nullable {
+		return ty + " | None"
+	}
+	return ty
+}
+
+// Returns the entries of a dictionary from the names of the types to the values given by the
+// function, for those types for which it doesn't return "".
+func pyRegistry(api *clientApi, value func(ty string) string) string {
+	entries := []string{}
+	for _, ty := range api.types {
+		if v := value(ty); v != "" {
+			entries = append(entries, strconv.Quote(ty)+": "+v)
+		}
+	}
+	return strings.Join(entries, ", ")
+}
@@ -0,0 +1,503 @@
+package initializer
+
+import (
+	"strconv"
+	"strings"
+)
+
+// A TypeScript module can be made from a service's public API, which is a client of the service on
+// a hub, calling it over HTTP with `fetch`, with the types of the service translated into
+// TypeScript types, and its functions into methods.
+//
+// The types are translated as follows:
+//
+// * `int` and `float` become `number`; `string` and `rune` become `string`; and `bool` becomes
+// `boolean`.
+// * Enums become string enums, whose values are the names of their elements.
+// * Structs become interfaces.
+// * Clones of the types above become aliases of the type of their parent.
+// * A type which may be `NULL` may also be `null`.
+// * Anything else is `unknown`, and is passed as whatever TypeScript value it most resembles: an
+// array, `Map`, `Set`, `Tuple`, or `Pair`. Since such values have no types the client can see, a
+// `number` is passed as an `int` if it's an integer, and a string as a `string`, even if they were
+// meant as a `float` or an element of an enum; and an object as the struct it was decoded from.
+//
+// Each public function or command which is prefix or unfix becomes an async method of the `Client`,
+// whose name is followed by its signature if it's overloaded, as in `clients.go`. It resolves to
+// the result of the function, and rejects with a `PipefishError` if the function returned an error.
+// The hub's replies are Pipefish literals, which the module parses into TypeScript values.
+
+const tsClientPreamble = `
+/** The name of the service. */
+export const SERVICE = %SERVICE%;
+
+/** An error returned by the service, or a reply from it which the client can't understand. */
+export class PipefishError extends Error {}
+
+/** A Pipefish pair ` + "`key::value`" + `. */
+export class Pair {
+  constructor(readonly key: unknown, readonly value: unknown) {}
+}
+
+/** A Pipefish tuple. */
+export class Tuple {
+  constructor(readonly values: unknown[]) {}
+}
+`
+
+const tsClientClient = `
+/**
+ * A client of the service on the hub at the given host, e.g. "http://localhost:50005", which logs
+ * on as the given user. It keeps the session the hub gives it from one call to the next.
+ */
+export class Client {
+  private session = "";
+
+  constructor(readonly host: string, readonly username = "", readonly password = "") {}
+
+  private async call(line: string): Promise<unknown> {
+    const response = await fetch(this.host.replace(/\/+$/, "") + "/", {
+      method: "POST",
+      headers: { "Content-Type": "application/json" },
+      body: JSON.stringify({
+        Body: line,
+        Service: SERVICE,
+        Username: this.username,
+        Password: this.password,
+        Session: this.session,
+      }),
+    });
+    const text = await response.text();
+    if (!response.ok) {
+      throw new PipefishError(text.trim());
+    }
+    const reply = JSON.parse(text);
+    this.session = reply.Session;
+    try {
+      return decode(reply.Body);
+    } catch {
+      throw new PipefishError(message(reply.Body));
+    }
+  }
+`
+
+const tsClientPostamble = `}
+
+// A type is described to the functions below as the name of a type the client knows about,
+// followed by "?" if the value may be NULL; or "" if the value may be anything.
+
+function is(x: unknown, ty: string): boolean {
+  if (ty.endsWith("?")) {
+    return x === null || is(x, ty.slice(0, -1));
+  }
+  ty = CLONES.get(ty) ?? ty;
+  switch (ty) {
+    case "int":
+      return typeof x === "number" && Number.isInteger(x);
+    case "float":
+      return typeof x === "number";
+    case "string":
+      return typeof x === "string";
+    case "rune":
+      return typeof x === "string" && [...x].length === 1;
+    case "bool":
+      return typeof x === "boolean";
+  }
+  const elements = ENUMS.get(ty);
+  if (elements !== undefined) {
+    return Object.values(elements).includes(x as string);
+  }
+  const fields = STRUCTS.get(ty);
+  if (fields !== undefined) {
+    return typeof x === "object" && x !== null && fields.every(([field]) => field in (x as object));
+  }
+  return true;
+}
+
+function expect(x: unknown, ty: string): unknown {
+  if (!is(x, ty)) {
+    throw new PipefishError("expected a value of type " + ty + ", got " + String(x));
+  }
+  return x;
+}
+
+const ESCAPES: Record<string, string> = { "\\": "\\\\", "\n": "\\n", "\r": "\\r", "\t": "\\t", "\x1b": "\\e" };
+
+function escape(s: string, quote: string): string {
+  return [...s].map((c) => (c === quote ? "\\" + c : ESCAPES[c] ?? c)).join("");
+}
+
+// Pipefish has no exponents in its float literals.
+function float(x: number): string {
+  if (!Number.isFinite(x)) {
+    throw new TypeError("Pipefish has no literal for " + x);
+  }
+  let s = String(x);
+  const match = /^(-?)(\d)(?:\.(\d+))?e([-+]\d+)$/.exec(s);
+  if (match !== null) {
+    const digits = match[2] + (match[3] ?? "");
+    const exponent = Number(match[4]);
+    s = exponent < 0
+      ? match[1] + "0." + "0".repeat(-exponent - 1) + digits
+      : match[1] + digits + "0".repeat(exponent - digits.length + 1);
+  }
+  return s.includes(".") ? s : s + ".0";
+}
+
+// Structs decoded from the hub's replies, so that they can be sent back to it.
+const structTypes = new WeakMap<object, string>();
+
+/** Writes a value as a Pipefish literal. */
+function encode(x: unknown, ty = ""): string {
+  if (ty !== "" && !is(x, ty)) {
+    throw new TypeError("expected a value of type " + ty + ", got " + String(x));
+  }
+  ty = ty.replace(/\?$/, "");
+  if (x === null || x === undefined) {
+    return "NULL";
+  }
+  const parent = CLONES.get(ty);
+  if (parent !== undefined) {
+    return ty + "(" + encode(x, parent) + ")";
+  }
+  if (ty === "" && typeof x === "object") {
+    ty = structTypes.get(x) ?? "";
+  }
+  const fields = STRUCTS.get(ty);
+  if (fields !== undefined) {
+    const struct = x as Record<string, unknown>;
+    return ty + "(" + fields.map(([field, fieldType]) => encode(struct[field], fieldType)).join(", ") + ")";
+  }
+  if (ENUMS.has(ty)) {
+    return x as string;
+  }
+  if (ty === "rune") {
+    return "'" + escape(x as string, "'") + "'";
+  }
+  if (ty === "float") {
+    return float(x as number);
+  }
+  switch (typeof x) {
+    case "boolean":
+      return x ? "true" : "false";
+    case "number":
+      return Number.isInteger(x) ? BigInt(x).toString() : float(x);
+    case "bigint":
+      return x.toString();
+    case "string":
+      return '"' + escape(x, '"') + '"';
+  }
+  if (x instanceof Pair) {
+    return encode(x.key) + "::" + encode(x.value);
+  }
+  if (x instanceof Tuple) {
+    return (x.values.length === 1 ? "tuple(" : "(") + x.values.map((v) => encode(v)).join(", ") + ")";
+  }
+  if (Array.isArray(x)) {
+    return "[" + x.map((v) => encode(v)).join(", ") + "]";
+  }
+  if (x instanceof Map) {
+    return "map(" + [...x].map(([k, v]) => encode(k) + "::" + encode(v)).join(", ") + ")";
+  }
+  if (x instanceof Set) {
+    return "set(" + [...x].map((v) => encode(v)).join(", ") + ")";
+  }
+  throw new TypeError("can't write " + String(x) + " as a Pipefish value");
+}
+
+const TOKEN = new RegExp(
+  "\\s*(?:" +
+  [
+    /([-+]?\d+(?:\.\d+)?(?:[eE][-+]?\d+)?|[-+]Inf|NaN\b)/.source,
+    /("(?:[^"\\]|\\.)*")/.source,
+    /('[^]')/.source,
+    /([A-Za-z_][A-Za-z0-9_]*(?:\.[A-Za-z_][A-Za-z0-9_]*)*)/.source,
+    /(::|[\][(),])/.source,
+  ].join("|") + ")",
+  "uy",
+);
+
+const TOKEN_KINDS = ["number", "string", "rune", "name", "punctuation"];
+
+function unquote(s: string): string {
+  const escapes: Record<string, string> = { a: "\x07", b: "\b", f: "\f", n: "\n", r: "\r", t: "\t", v: "\v" };
+  return s.slice(1, -1).replace(
+    /\\(?:x([0-9a-fA-F]{2})|u([0-9a-fA-F]{4})|U([0-9a-fA-F]{8})|([0-7]{3})|(.))/gsu,
+    (_, x, u, U, o, c) => {
+      const hex = x ?? u ?? U;
+      if (hex !== undefined) {
+        return String.fromCodePoint(parseInt(hex, 16));
+      }
+      if (o !== undefined) {
+        return String.fromCodePoint(parseInt(o, 8));
+      }
+      return escapes[c] ?? c;
+    },
+  );
+}
+
+/**
+ * Parses the literals the hub writes. Types other than those of the service are read as whatever
+ * TypeScript value they most resemble.
+ */
+class Decoder {
+  readonly tokens: [string, string][] = [];
+  i = 0;
+
+  constructor(text: string) {
+    text = text.trimEnd();
+    const token = new RegExp(TOKEN);
+    while (token.lastIndex < text.length) {
+      const start = token.lastIndex;
+      const match = token.exec(text);
+      if (match === null) {
+        throw new SyntaxError("can't read " + text.slice(start));
+      }
+      const group = match.findIndex((g, i) => i > 0 && g !== undefined);
+      this.tokens.push([TOKEN_KINDS[group - 1], match[group]]);
+    }
+  }
+
+  next(): [string, string] {
+    if (this.i === this.tokens.length) {
+      throw new SyntaxError("unexpected end of reply");
+    }
+    return this.tokens[this.i++];
+  }
+
+  peek(): string {
+    return this.i < this.tokens.length ? this.tokens[this.i][1] : "";
+  }
+
+  value(): unknown {
+    const x = this.primary();
+    if (this.peek() === "::") {
+      this.next();
+      return new Pair(x, this.value());
+    }
+    return x;
+  }
+
+  values(close: string): unknown[] {
+    const result: unknown[] = [];
+    if (this.peek() === close) {
+      this.next();
+      return result;
+    }
+    for (;;) {
+      result.push(this.value());
+      const [, t] = this.next();
+      if (t === close) {
+        return result;
+      }
+      if (t !== ",") {
+        throw new SyntaxError("unexpected " + t);
+      }
+    }
+  }
+
+  primary(): unknown {
+    const [kind, t] = this.next();
+    switch (kind) {
+      case "number":
+        return Number(t.replace(/^\+/, "").replace("Inf", "Infinity"));
+      case "string":
+        return unquote(t);
+      case "rune":
+        return t.slice(1, -1);
+    }
+    if (t === "[") {
+      return this.values("]");
+    }
+    if (t === "(") {
+      return new Tuple(this.values(")"));
+    }
+    if (kind !== "name") {
+      throw new SyntaxError("unexpected " + t);
+    }
+    const name = t.slice(t.lastIndexOf(".") + 1);
+    if (this.peek() === "(") {
+      this.next();
+      const args = this.values(")");
+      const fields = STRUCTS.get(name);
+      if (fields !== undefined && fields.length === args.length) {
+        const struct: Record<string, unknown> = {};
+        fields.forEach(([field], i) => (struct[field] = args[i]));
+        structTypes.set(struct, name);
+        return struct;
+      }
+      if (CLONES.has(name) && args.length === 1) {
+        return args[0];
+      }
+      if (name === "tuple") {
+        return new Tuple(args);
+      }
+      if (name === "set") {
+        return new Set(args);
+      }
+      if (name === "map" || (args.length > 0 && args.every((arg) => arg instanceof Pair))) {
+        if (!args.every((arg) => arg instanceof Pair)) {
+          throw new SyntaxError("expected pairs in " + name);
+        }
+        return new Map(args.map((arg): [unknown, unknown] => [(arg as Pair).key, (arg as Pair).value]));
+      }
+      return args;
+    }
+    if (this.peek() === "[") {
+      this.next();
+      return this.values("]");
+    }
+    switch (name) {
+      case "true":
+        return true;
+      case "false":
+        return false;
+      case "NULL":
+      case "OK":
+        return null;
+    }
+    if (ELEMENTS.has(name)) {
+      return ELEMENTS.get(name);
+    }
+    throw new SyntaxError("unexpected " + t);
+  }
+}
+
+function decode(body: string): unknown {
+  const decoder = new Decoder(body);
+  if (decoder.tokens.length === 0) {
+    return null;
+  }
+  const x = decoder.value();
+  if (decoder.i !== decoder.tokens.length) {
+    throw new SyntaxError("unexpected " + decoder.peek());
+  }
+  return x;
+}
+
+/** Finds the message of an error from the hub. */
+function message(body: string): string {
+  const text = body.replace(/\x1b\[[0-9;]*m/g, "").replace(/\n/g, "").trim();
+  const match = /^\[\d+\] Error: (.*?)(?: at line .*)?\.?$/s.exec(text);
+  return match !== null ? match[1] : text;
+}
+`
+
+var tsClientScalars = map[string]string{"int": "number", "float": "number", "string": "string", "bool": "boolean", "rune": "string"}
+
+// The names a method gives its parameters are those of the function, unless they're reserved
+// words; and the names of methods mustn't clash with the names the `Client` uses itself.
+var tsClientReserved = []string{"await", "break", "case", "catch", "class", "const", "continue",
+	"debugger", "default", "delete", "do", "else", "enum", "export", "extends", "false", "finally",
+	"for", "function", "if", "implements", "import", "in", "instanceof", "interface", "let", "new",
+	"null", "package", "private", "protected", "public", "return", "static", "super", "switch",
+	"this", "throw", "true", "try", "typeof", "var", "void", "while", "with", "yield"}
+
+var tsClientMembers = []string{"call", "session", "host", "username", "password", "constructor"}
+
+// Returns the source code of a TypeScript module which is a client of the service, given the name
+// of the service and its serialized API.
+func TypeScriptClientFromApi(service, serializedAPI string) string {
+	api := newClientApi(serializedAPI)
+	var buf strings.Builder
+	buf.WriteString("// Code generated by `pipefish gen ts`. DO NOT EDIT.\n\n")
+	buf.WriteString("// A client of the Pipefish service `" + service + "`.\n")
+	buf.WriteString(strings.Replace(tsClientPreamble, "%SERVICE%", strconv.Quote(service), 1))
+	for _, ty := range api.types {
+		switch {
+		case api.enums[ty] != nil:
+			buf.WriteString("\nexport enum " + ty + " {\n")
+			for _, element := range api.enums[ty] {
+				buf.WriteString("  " + element + " = " + strconv.Quote(element) + ",\n")
+			}
+			buf.WriteString("}\n")
+		case api.parents[ty] != "":
+			buf.WriteString("\nexport type " + ty + " = " + tsClientScalars[api.parents[ty]] + ";\n")
+		default:
+			buf.WriteString("\nexport interface " + ty + " {\n")
+			for _, field := range api.structs[ty] {
+				buf.WriteString("  " + field.name + ": " + tsType(api.describe(field.types)) + ";\n")
+			}
+			buf.WriteString("}\n")
+		}
+	}
+	buf.WriteString("\n// The types of the service which the client knows about.\n")
+	buf.WriteString("const ENUMS = new Map<string, Record<string, string>>([")
+	tsRegistry(&buf, api, func(ty string) string {
+		if api.enums[ty] == nil {
+			return ""
+		}
+		return ty
+	})
+	buf.WriteString("const STRUCTS = new Map<string, [string, string][]>([")
+	tsRegistry(&buf, api, func(ty string) string {
+		if _, ok := api.structs[ty]; !ok {
+			return ""
+		}
+		fields := []string{}
+		for _, field := range api.structs[ty] {
+			fields = append(fields, "["+strconv.Quote(field.name)+", "+strconv.Quote(api.describe(field.types))+"]")
+		}
+		return "[" + strings.Join(fields, ", ") + "]"
+	})
+	buf.WriteString("const CLONES = new Map<string, string>([")
+	tsRegistry(&buf, api, func(ty string) string {
+		if api.parents[ty] == "" {
+			return ""
+		}
+		return strconv.Quote(api.parents[ty])
+	})
+	buf.WriteString("const ELEMENTS = new Map([...ENUMS.values()].flatMap((elements) => Object.entries(elements)));\n")
+	buf.WriteString(tsClientClient)
+	for _, fn := range api.functions {
+		params, descriptions := []string{}, []string{}
+		for _, param := range fn.params {
+			description := api.describe(param.types)
+			params = append(params, clientName(param.name, tsClientReserved)+": "+tsType(description))
+			descriptions = append(descriptions, description)
+		}
+		call := "await this.call(" + fn.lineExpression(func(i int) string {
+			return "encode(" + clientName(fn.params[i].name, tsClientReserved) + ", " + strconv.Quote(descriptions[i]) + ")"
+		}) + ")"
+		buf.WriteString("\n  /** Calls `" + describeSig(fn.entity.parts) + "`. */\n")
+		buf.WriteString("  async " + clientName(fn.name, tsClientMembers) + "(" + strings.Join(params, ", ") + "): ")
+		switch description := api.describe(fn.returns); {
+		case fn.returnsOk():
+			buf.WriteString("Promise<void> {\n    " + call + ";\n  }\n")
+		case description == "":
+			buf.WriteString("Promise<unknown> {\n    return " + call + ";\n  }\n")
+		default:
+			buf.WriteString("Promise<" + tsType(description) + "> {\n")
+			buf.WriteString("    return expect(" + call + ", " + strconv.Quote(description) + ") as " + tsType(description) + ";\n  }\n")
+		}
+	}
+	buf.WriteString(tsClientPostamble)
+	return buf.String()
+}
+
+// Returns the TypeScript type of a value, given the description of its type by
+// `clientApi.describe`.
+func tsType(description string) string {
+	ty, nullable := strings.CutSuffix(description, "?")
+	if ty == "" {
+		return "unknown"
+	}
+	if tsClientScalars[ty] != "" {
+		ty = tsClientScalars[ty]
+	}
+	if nullable {
+		return ty + " | null"
+	}
+	return ty
+}
+
+// Writes the entries of a map from the names of the types to the values given by the function,
+// for those types for which it doesn't return "", and the end of the statement.
+func tsRegistry(buf *strings.Builder, api *clientApi, value func(ty string) string) {
+	for _, ty := range api.types {
+		if v := value(ty); v != "" {
+			buf.WriteString("\n  [" + strconv.Quote(ty) + ", " + v + "],")
+		}
+	}
+	buf.WriteString("\n]);\n")
+}
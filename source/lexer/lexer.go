@@ -580,6 +580,33 @@ func (runes *RuneSupplier) ReadFormattedString() (string, bool) {
 	return result, true
 }
 
+// Returns a formatted string literal which the lexer will read as the given string, i.e. it
+// escapes what `ReadFormattedString` unescapes.
+func Quote(s string) string {
+	var buf strings.Builder
+	buf.WriteRune('"')
+	for _, ch := range s {
+		switch ch {
+		case '\n':
+			buf.WriteString(`\n`)
+		case '\r':
+			buf.WriteString(`\r`)
+		case '\t':
+			buf.WriteString(`\t`)
+		case '"':
+			buf.WriteString(`\"`)
+		case '\\':
+			buf.WriteString(`\\`)
+		case '\033':
+			buf.WriteString(`\e`)
+		default:
+			buf.WriteRune(ch)
+		}
+	}
+	buf.WriteRune('"')
+	return buf.String()
+}
+
 func (runes *RuneSupplier) ReadPlaintextString(ch rune) (string, bool) {
 	result := ""
 	for {
@@ -27,6 +27,11 @@ func TestLiterals(t *testing.T) {
 	testLexingString(t, input, items)
 }
 
+func TestQuote(t *testing.T) {
+	s := "q\n\r\t\033\\\"é"
+	testLexingString(t, lexer.Quote(s), []testItem{{token.STRING, s, 1}})
+}
+
 func TestPlaintext(t *testing.T) {
 	input := "`Hello world!`"
 
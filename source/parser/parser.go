@@ -807,7 +807,14 @@ func (p *Parser) parsePrefixExpression() Node {
 	} else {
 		right = p.ParseExpression(FPREFIX)
 	}
-	expression.Args = p.RecursivelyListify(right)
+	// The bling of a function in another namespace is known to the parser of that namespace.
+	resolvingParser := p
+	if expression.Token.Namespace != "" {
+		if rp := p.getParserFromNamespace(expression.Token); rp != nil {
+			resolvingParser = rp
+		}
+	}
+	expression.Args = resolvingParser.RecursivelyListify(right)
 	return expression
 }
 
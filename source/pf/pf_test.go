@@ -1,14 +1,18 @@
 package pf_test
 
 import (
+	"errors"
 	"os"
 	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
+	"testing/fstest"
 
 	"github.com/tim-hardcastle/pipefish/source/pf"
 	"github.com/tim-hardcastle/pipefish/source/test_helper"
 	"github.com/tim-hardcastle/pipefish/source/text"
+	"github.com/tim-hardcastle/pipefish/source/vm"
 )
 
 func TestApi(t *testing.T) {
@@ -36,8 +40,8 @@ func TestDump(t *testing.T) { // We want to make sure that if the service is bro
 	// no t.Parallel()
 	test := []test_helper.TestItem{
 		{`hub run "../hub/test-files/dump.pf"`, `Starting script [36m"dump.pf"[39m as service [36m"dump"[39m.`},
-		{`hub dump "big"`, "# Function dump of `big`\n\n## Code dump for function `big` with sig int\n\n@71 : asgm m263 <- m261  // Assign to memory.\n@72 : gtei m262 <- m263 m265  // Int comparison with >=.\n@73 : asgm m266 <- m262  // Assign to memory.\n@74 : qtru m266 @77  // Test true.\n@75 : asgm m268 <- m267  // Assign to memory.\n@76 : jmp @78  // Jump.\n@77 : asgm m268 <- m3  // Assign to memory.\n@78 : qsat m268 @81  // Test not `UNSAT`.\n@79 : asgm m270 <- m268  // Assign to memory.\n@80 : jmp @82  // Jump.\n@81 : asgm m270 <- m269  // Assign to memory.\n@82 : ret  // Return."},
-		{`hub dump m "big"`, "# Function dump of `big`\n\n## Code dump for function `big` with sig int\n\n@71 : asgm m263 <- m261  // Assign to memory.\n@72 : gtei m262 <- m263 m265  // Int comparison with >=.\n@73 : asgm m266 <- m262  // Assign to memory.\n@74 : qtru m266 @77  // Test true.\n@75 : asgm m268 <- m267  // Assign to memory.\n@76 : jmp @78  // Jump.\n@77 : asgm m268 <- m3  // Assign to memory.\n@78 : qsat m268 @81  // Test not `UNSAT`.\n@79 : asgm m270 <- m268  // Assign to memory.\n@80 : jmp @82  // Jump.\n@81 : asgm m270 <- m269  // Assign to memory.\n@82 : ret  // Return.\n\n### Memory dump for function `big` with sig int`\n\nm261 : UNDEFINED VALUE::UNDEFINED VALUE!\nm262 : error::\x1b[31mError\x1b[39m: something unexpected has gone wrong at line \x1b[33m4:6-8\x1b[39m of \x1b[36m\"../hub/test-files/dump.pf\"\x1b[39m. \nm263 : UNDEFINED VALUE::UNDEFINED VALUE!\nm264 : BLING::>=\nm265 : int::100\nm266 : UNDEFINED VALUE::UNDEFINED VALUE!\nm267 : string::\"big\"\nm268 : UNDEFINED VALUE::UNDEFINED VALUE!\nm269 : string::\"small\"\nm270 : UNDEFINED VALUE::UNDEFINED VALUE!"},
+		{`hub dump "big"`, "# Function dump of `big`\n\n## Code dump for function `big` with sig int\n\n@71 : asgm m267 <- m265  // Assign to memory.\n@72 : gtei m266 <- m267 m269  // Int comparison with >=.\n@73 : asgm m270 <- m266  // Assign to memory.\n@74 : qtru m270 @77  // Test true.\n@75 : asgm m272 <- m271  // Assign to memory.\n@76 : jmp @78  // Jump.\n@77 : asgm m272 <- m3  // Assign to memory.\n@78 : qsat m272 @81  // Test not `UNSAT`.\n@79 : asgm m274 <- m272  // Assign to memory.\n@80 : jmp @82  // Jump.\n@81 : asgm m274 <- m273  // Assign to memory.\n@82 : ret  // Return."},
+		{`hub dump m "big"`, "# Function dump of `big`\n\n## Code dump for function `big` with sig int\n\n@71 : asgm m267 <- m265  // Assign to memory.\n@72 : gtei m266 <- m267 m269  // Int comparison with >=.\n@73 : asgm m270 <- m266  // Assign to memory.\n@74 : qtru m270 @77  // Test true.\n@75 : asgm m272 <- m271  // Assign to memory.\n@76 : jmp @78  // Jump.\n@77 : asgm m272 <- m3  // Assign to memory.\n@78 : qsat m272 @81  // Test not `UNSAT`.\n@79 : asgm m274 <- m272  // Assign to memory.\n@80 : jmp @82  // Jump.\n@81 : asgm m274 <- m273  // Assign to memory.\n@82 : ret  // Return.\n\n### Memory dump for function `big` with sig int`\n\nm265 : UNDEFINED VALUE::UNDEFINED VALUE!\nm266 : error::\x1b[31mError\x1b[39m: something unexpected has gone wrong at line \x1b[33m4:6-8\x1b[39m of \x1b[36m\"../hub/test-files/dump.pf\"\x1b[39m. \nm267 : UNDEFINED VALUE::UNDEFINED VALUE!\nm268 : BLING::>=\nm269 : int::100\nm270 : UNDEFINED VALUE::UNDEFINED VALUE!\nm271 : string::\"big\"\nm272 : UNDEFINED VALUE::UNDEFINED VALUE!\nm273 : string::\"small\"\nm274 : UNDEFINED VALUE::UNDEFINED VALUE!"},
 		{`hub halt "dump"`, `OK`},
 		{`hub quit`, "[32mOK[0m\n" + text.Logo() + "Thank you for using Pipefish. Have a nice day!"},
 	}
@@ -66,6 +70,27 @@ func TestEnv(t *testing.T) {
 	test_helper.RunHubTest(t, "default", test)
 }
 
+func TestFileSystem(t *testing.T) {
+	// no t.Parallel()
+	// The `strings` library is our own, to show that it's read from the file system.
+	fsys := fstest.MapFS{
+		"app/main.pf": {Data: []byte("import\n\n\"lib.pf\"\n\"strings\"\n\ndef\n\nf(s string) : strings.shout(lib.double(s))\n")},
+		"app/lib.pf":  {Data: []byte("def\n\ndouble(s string) : s + s\n")},
+		"source/initializer/libraries/strings.pf": {Data: []byte("def\n\nshout(s string) : s + \"!\"\n")},
+	}
+	srv := pf.NewService()
+	srv.SetFileSystem(fsys)
+	err := srv.InitializeFromFilepath("app/main.pf")
+	if err != nil {
+		report, _ := srv.GetErrorReport()
+		t.Fatal("Can't initialize service: " + report)
+	}
+	got, _ := srv.Do(`f "la"`)
+	if srv.ToLiteral(got) != `"lala!"` {
+		t.Errorf("Evaluating f \"la\": wanted \"lala!\", got %v.", srv.ToLiteral(got))
+	}
+}
+
 func TestLog(t *testing.T) {
 	// no t.Parallel()
 	test := []test_helper.TestItem{
@@ -143,6 +168,90 @@ func TestMisc(t *testing.T) {
 	}
 }
 
+func TestNative(t *testing.T) {
+	// no t.Parallel()
+	type Color int
+	type User struct {
+		Name  string
+		Age   int
+		Color Color
+	}
+	srv := pf.NewService()
+	srv.RegisterFunction("fetchUser", func(id int) (User, error) {
+		if id != 42 {
+			return User{}, errors.New("no such user")
+		}
+		return User{"Joe", 22, 1}, nil
+	})
+	srv.RegisterFunction("older", func(u User, years int) User { return User{u.Name, u.Age + years, u.Color} })
+	srv.RegisterFunction("shout", func(s string) string { return strings.ToUpper(s) + "!" })
+	err := srv.InitializeFromCode(`newtype
+
+Color = enum RED, GREEN, BLUE
+
+User = struct(name string, age int, color Color)
+
+def
+
+fetchUser(id int) -> User : native
+
+older(u User) by (years int) -> User : native
+
+shout(s string) -> string : native
+`)
+	if err != nil {
+		report, _ := srv.GetErrorReport()
+		t.Fatal("Can't initialize service: " + report)
+	}
+	tests := []test_helper.TestItem{
+		{`fetchUser 42`, `User("Joe", 22, GREEN)`},
+		{`older (User "Ann", 30, BLUE) by 5`, `User("Ann", 35, BLUE)`},
+		{`shout "hello"`, `"HELLO!"`},
+	}
+	for _, test := range tests {
+		got, _ := srv.Do(test.Input)
+		if srv.ToLiteral(got) != test.Want {
+			t.Errorf("Evaluating %v: wanted %v, got %v.", test.Input, test.Want, srv.ToLiteral(got))
+		}
+	}
+	got, _ := srv.DoWithValues(`fetchUser id`, map[string]pf.Value{"id": {pf.INT, 41}})
+	if got.T != pf.ERROR || got.V.(*pf.Error).Message != "native function `fetchUser` returned error `no such user`" {
+		t.Errorf("Expected error from fetchUser 41, got %v.", srv.ToLiteral(got))
+	}
+	srv = pf.NewService()
+	if srv.InitializeFromCode("def\n\nfetchUser(id int) -> int : native\n") == nil {
+		t.Errorf("Expected an error initializing a native function which wasn't registered.")
+	}
+	// If the script declares `native`, it's an identifier and not the keyword.
+	srv = pf.NewService()
+	if srv.InitializeFromCode("const\n\nnative = 5\n\ndef\n\nfive(x int) : native\n") != nil {
+		report, _ := srv.GetErrorReport()
+		t.Fatal("Can't initialize service: " + report)
+	}
+	if got, _ := srv.Do("five 1"); srv.ToLiteral(got) != "5" {
+		t.Errorf("Evaluating five 1: wanted 5, got %v.", srv.ToLiteral(got))
+	}
+	// One Go type can't stand for two Pipefish types.
+	srv = pf.NewService()
+	srv.RegisterFunction("light", func(c Color) Color { return c })
+	srv.RegisterFunction("paint", func(c Color) Color { return c })
+	srv.InitializeFromCode(`newtype
+
+Color = enum RED, GREEN, BLUE
+
+Light = enum STOP, GO
+
+def
+
+light(c Light) -> Light : native
+
+paint(c Color) -> Color : native
+`)
+	if report, _ := srv.GetErrorReport(); !strings.Contains(report, "can't stand for both") {
+		t.Errorf("Expected a conflict between the Go types of native functions, got %v.", report)
+	}
+}
+
 func TestServices(t *testing.T) {
 	// no t.Parallel()
 	test := []test_helper.TestItem{
@@ -314,3 +423,34 @@ func TestValues(t *testing.T) {
 	}
 	test_helper.RunHubTest(t, "default", test)
 }
+
+func TestWire(t *testing.T) {
+	// no t.Parallel()
+	sv := pf.NewService()
+	if err := sv.InitializeFromCode("def\n\ninverse(x any) :\n    1 / x\n"); err != nil {
+		t.Fatal(err)
+	}
+	decode := func(call *vm.ExternalCall) error {
+		data, err := sv.EncodeWireCall(call)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, err = sv.DecodeWireCall(data)
+		return err
+	}
+	if err := decode(&vm.ExternalCall{Operator: vm.PREFIX, Name: "inverse", Args: []pf.Value{{pf.INT, 2}}}); err != nil {
+		t.Fatal(err)
+	}
+	// The name is compiled as part of a line, and so can't be more than a name.
+	if err := decode(&vm.ExternalCall{Operator: vm.PREFIX, Name: "inverse(0) + inverse", Args: []pf.Value{{pf.INT, 2}}}); err == nil {
+		t.Fatal("decoded a call with a line for a name")
+	}
+	// Values can't be nested deeply enough to exhaust the decoder's stack.
+	v := pf.Value{pf.INT, 2}
+	for range vm.MAX_WIRE_DEPTH {
+		v = pf.Value{pf.TUPLE, []pf.Value{v}}
+	}
+	if err := decode(&vm.ExternalCall{Operator: vm.PREFIX, Name: "inverse", Args: []pf.Value{v}}); err == nil {
+		t.Fatal("decoded a value nested too deep")
+	}
+}
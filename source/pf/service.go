@@ -9,15 +9,20 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"maps"
 	"os"
 	"reflect"
+	"slices"
 	"strings"
+	"sync/atomic"
 
 	"golang.org/x/crypto/pbkdf2"
 
 	"github.com/tim-hardcastle/pipefish/source/compiler"
 	"github.com/tim-hardcastle/pipefish/source/err"
 	"github.com/tim-hardcastle/pipefish/source/initializer"
+	"github.com/tim-hardcastle/pipefish/source/lexer"
 	"github.com/tim-hardcastle/pipefish/source/settings"
 	"github.com/tim-hardcastle/pipefish/source/text"
 	"github.com/tim-hardcastle/pipefish/source/values"
@@ -30,6 +35,10 @@ type Service struct {
 	cp             *compiler.Compiler
 	localExternals map[string]*Service
 	db             *sql.DB
+	credentials    initializer.Credentials
+	natives        map[string]any // The Go functions registered with `RegisterFunction`.
+	fsys           fs.FS          // The file system set by `SetFileSystem`, or nil for the OS.
+	ignoreLockfile bool           // Set by `SetIgnoreLockfile`.
 }
 
 // Returns a new service.
@@ -47,7 +56,7 @@ func (sv *Service) InitializeFromCode(code string) error {
 
 // Initializes the service with the source code supplied in the file indicated by the filepath.
 func (sv *Service) InitializeFromFilepath(scriptFilepath string) error {
-	sourcecode, e := initializer.GetSourceCode(scriptFilepath)
+	sourcecode, e := initializer.GetSourceCodeFromFS(sv.fsys, scriptFilepath)
 	if e != nil {
 		return e
 	}
@@ -63,10 +72,13 @@ func (sv *Service) InitializeFromCodeWithStore(code string, store Map) error {
 
 // Initializes the service with the source code supplied in the file indicated by the filepath.
 func (sv *Service) InitializeFromFilepathWithStore(scriptFilepath string, store Map) error {
-	sourcecode, e := initializer.GetSourceCode(scriptFilepath)
+	sourcecode, e := initializer.GetSourceCodeFromFS(sv.fsys, scriptFilepath)
 	if e != nil {
 		return e
 	}
+	if sv.fsys != nil {
+		return sv.initialize(scriptFilepath, sourcecode, store)
+	}
 	return sv.initialize(initializer.MakeFilepath(scriptFilepath), sourcecode, store)
 }
 
@@ -80,10 +92,11 @@ func (sv *Service) initialize(scriptFilepath, sourcecode string, store Map) erro
 	for k, v := range sv.localExternals {
 		compilerMap[k] = v.cp
 	}
-	cp := initializer.StartCompiler(scriptFilepath, sourcecode, compilerMap, store)
+	cp := initializer.StartCompilerWithOptions(scriptFilepath, sourcecode, initializer.Options{Store: store,
+		Services: compilerMap, Credentials: sv.credentials, Natives: sv.natives, FS: sv.fsys, IgnoreLockfile: sv.ignoreLockfile})
 	sv.cp = cp
 	for k, v := range compilerMap {
-		sv.localExternals[k] = &Service{v, sv.localExternals, sv.db}
+		sv.localExternals[k] = &Service{v, sv.localExternals, sv.db, sv.credentials, nil, sv.fsys, false}
 	}
 	if sv.IsBroken() {
 		return errors.New("compilation error")
@@ -109,6 +122,15 @@ type InHandler = vm.InHandler
 // which if necessary allows the user to write a string to the same place.
 type OutHandler = vm.OutHandler
 
+// An interface with one method, `GetFromKeyboard(prompt string, masked bool)`, which
+// supplies a string when the Pipefish code does `get x from Keyboard(prompt)`, if the
+// keyboard isn't the one attached to the terminal.
+type KeyboardHandler = vm.KeyboardHandler
+
+// An interface with one method, `Send(to []string, msg []byte) error`, which sends the mail
+// posted by the `net/smtp` library when the Pipefish code doesn't say which server to use.
+type MailHandler = vm.MailHandler
+
 // An InHandler which just gets an input from an io.Reader supplied at its construction.
 type SimpleInHandler = vm.SimpleInHandler
 
@@ -200,6 +222,67 @@ func (sv *Service) SetLocalExternalServices(svs map[string]*Service) {
 	sv.localExternals = svs
 }
 
+// Supplies the username and password with which the service logs on to the hubs of the
+// external services it uses, given the host of each hub, e.g. "http://localhost:50005". This
+// must be done before the service is initialized. Otherwise they're asked for at the terminal.
+func (sv *Service) SetCredentials(credentials func(host string) (username, password string)) {
+	sv.credentials = credentials
+}
+
+// Sets the file system from which the service reads its scripts, e.g. an `embed.FS`, so that a
+// binary embedding it can run without a Pipefish installation. This must be done before the
+// service is initialized, and applies to the root script given to `InitializeFromFilepath`, the
+// modules and external services it imports, and the standard libraries.
+//
+// The file system should be laid out like the Pipefish home directory: the standard libraries go
+// in `source/initializer/libraries`, and may be copied from there. It may also contain
+// `source/vm/operations.md`, which is used to describe the VM's code when debugging. Other
+// scripts are found by their paths relative to the root of the file system.
+func (sv *Service) SetFileSystem(fsys fs.FS) {
+	sv.fsys = fsys
+}
+
+// Says whether the service, when it's initialized, should skip checking the APIs of the
+// external services its script declares against the script's lockfile, e.g. so as to remake
+// the lockfile from them. See `ExternalApis`.
+func (sv *Service) SetIgnoreLockfile(ignore bool) {
+	sv.ignoreLockfile = ignore
+}
+
+// Returns the serialized APIs of the external services declared by the service's script, by
+// name, e.g. so that they can be written to its lockfile with `initializer.WriteLockfile`.
+func (sv *Service) ExternalApis() map[string]string {
+	if sv.cp == nil {
+		return map[string]string{}
+	}
+	return maps.Clone(sv.cp.ExternalApis)
+}
+
+// Registers a Go function to supply the function of the same name declared in the script with
+// the body `native`, e.g. `fetchUser(id int) -> User : native`. This must be done before the
+// service is initialized.
+//
+// The Go function should have a parameter for each parameter of the Pipefish function other than
+// bling, of the corresponding Go type: `int`, `float64`, `string`, `bool`, `rune`, `[]any`,
+// `map[any]any`, `map[any]struct{}`, or `[2]any` for the built-in types; a struct with the same
+// number of exported fields for a struct type; an integer type for an enum; a type with the same
+// underlying type for a clone of `int`, `float`, `string`, or `rune`; or `any` for anything. It
+// may return nothing or one such value, optionally followed by an `error`, which if it isn't nil
+// is returned to Pipefish as an error.
+func (sv *Service) RegisterFunction(name string, function any) error {
+	if sv.cp != nil {
+		return errors.New("service is already initialized")
+	}
+	if reflect.TypeOf(function) == nil || reflect.TypeOf(function).Kind() != reflect.Func {
+		return errors.New("can't register a value which isn't a function")
+	}
+	if sv.natives == nil {
+		sv.natives = map[string]any{}
+	}
+	sv.natives[name] = function
+	return nil
+}
+
 // Sets an InHandler, i.e. the thing that decides what happens when you do
 // `get x from Input()`.
 func (sv *Service) SetInHandler(in InHandler) error {
@@ -226,11 +309,51 @@ func (sv *Service) SetOutHandler(out vm.OutHandler) error {
 	return nil
 }
 
+// Returns the service's OutHandler, so that it can be restored after being temporarily replaced.
+func (sv *Service) GetOutHandler() (OutHandler, error) {
+	if sv.cp == nil {
+		return nil, errors.New("service is uninitialized")
+	}
+	return sv.cp.Vm.OutHandle, nil
+}
+
+// Sets a KeyboardHandler, i.e. the thing that decides what happens when you do
+// `get x from Keyboard(prompt)`. If it's `nil`, the terminal is used.
+func (sv *Service) SetKeyboardHandler(kb KeyboardHandler) error {
+	if sv.cp == nil {
+		return errors.New("service is uninitialized")
+	}
+	if sv.IsBroken() {
+		return errors.New("service is broken")
+	}
+	sv.cp.Vm.KeyboardHandle = kb
+	return nil
+}
+
+// Sets a MailHandler, i.e. the thing that sends the mail when the service posts mail with the
+// `net/smtp` library without saying which server to send it through.
+func (sv *Service) SetMailHandler(m MailHandler) error {
+	if sv.cp == nil {
+		return errors.New("service is uninitialized")
+	}
+	if sv.IsBroken() {
+		return errors.New("service is broken")
+	}
+	sv.cp.Vm.MailHandle = m
+	return nil
+}
+
 // Once the service is initialized, will interpret the string supplied as though
 // it had been entered into the REPL of the service. The error field will be non-nil
 // in the case of a compile-time error. In the case of a runtime error, it will be
 // nil, and the error will be returned as the `Value`.
 func (sv *Service) Do(line string) (Value, error) {
+	return sv.DoWithValues(line, nil)
+}
+
+// Like `Do`, but with the given values bound to names in the line, as though they were global
+// variables.
+func (sv *Service) DoWithValues(line string, vals map[string]Value) (Value, error) {
 	if sv.cp == nil {
 		return Value{}, errors.New("service is uninitialized")
 	}
@@ -240,6 +363,7 @@ func (sv *Service) Do(line string) (Value, error) {
 	sv.cp.P.ResetAfterError()
 	sv.cp.Vm.LiveTracking = make([]vm.TrackingData, 0)
 	state := sv.cp.GetState()
+	env := sv.cp.EnvironmentWithValues(vals)
 	cT := sv.cp.CodeTop()
 	node := sv.cp.P.ParseLine("REPL input", line)
 	if settings.SHOW_PARSER {
@@ -252,7 +376,7 @@ func (sv *Service) Do(line string) (Value, error) {
 	if sv.cp.P.ErrorsExist() {
 		return Value{}, errors.New("error parsing input")
 	}
-	ctxt := compiler.Context{Env: sv.cp.GlobalVars, Access: compiler.REPL, LowMem: compiler.DUMMY, TrackingFlavor: compiler.LF_NONE}
+	ctxt := compiler.Context{Env: env, Access: compiler.REPL, LowMem: compiler.DUMMY, TrackingFlavor: compiler.LF_NONE}
 	sv.cp.CompileNode(node, ctxt)
 	if sv.cp.P.ErrorsExist() {
 		return Value{}, errors.New("error compiling input")
@@ -266,6 +390,79 @@ func (sv *Service) Do(line string) (Value, error) {
 	return result, nil
 }
 
+// Decodes an external call made in the binary wire format, returning a line which makes the
+// call, with the values of the arguments bound to names in it, to be passed to `DoWithValues`.
+func (sv *Service) DecodeWireCall(call []byte) (string, map[string]Value, error) {
+	if sv.cp == nil {
+		return "", nil, errors.New("service is uninitialized")
+	}
+	return sv.cp.DecodeWireCall(call)
+}
+
+// Encodes a value in the binary wire format.
+func (sv *Service) EncodeWireValue(v Value) ([]byte, error) {
+	if sv.cp == nil {
+		return nil, errors.New("service is uninitialized")
+	}
+	return sv.cp.WireCodec().Encode(v)
+}
+
+// Encodes a call to a function of the service in the binary wire format.
+func (sv *Service) EncodeWireCall(xc *vm.ExternalCall) ([]byte, error) {
+	if sv.cp == nil {
+		return nil, errors.New("service is uninitialized")
+	}
+	return sv.cp.WireCodec().EncodeCall(xc)
+}
+
+// Decodes a value in the binary wire format.
+func (sv *Service) DecodeWireValue(data []byte) (Value, error) {
+	if sv.cp == nil {
+		return Value{}, errors.New("service is uninitialized")
+	}
+	return sv.cp.WireCodec().Decode(data)
+}
+
+// Sets whether the service's vm counts the operations it performs, which it doesn't by default
+// since counting them slows it down.
+func (sv *Service) SetCountInstructions(count bool) error {
+	if sv.cp == nil {
+		return errors.New("service is uninitialized")
+	}
+	flag := uint32(0)
+	if count {
+		flag = 1
+	}
+	atomic.StoreUint32(&sv.cp.Vm.CountInstructions, flag)
+	return nil
+}
+
+// Returns the number of operations the service's vm has performed while it was counting them:
+// see `SetCountInstructions`.
+func (sv *Service) InstructionCount() uint64 {
+	if sv.cp == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&sv.cp.Vm.InstructionCount)
+}
+
+// Returns the number of values in the service's vm's memory as of when it last finished running.
+func (sv *Service) MemorySize() int {
+	if sv.cp == nil {
+		return 0
+	}
+	return int(atomic.LoadUint64(&sv.cp.Vm.MemorySize))
+}
+
+// Returns whether the name is the name of a function or command of the service, or the first
+// word of one.
+func (sv *Service) HasFunction(name string) bool {
+	if sv.cp == nil {
+		return false
+	}
+	return sv.cp.P.Functions.Contains(name) || sv.cp.P.Forefixes.Contains(name)
+}
+
 // Gets the value of a global variable given its name. Unlike using `Do` for the
 // same purpose, this can get the value of private variables.
 func (sv *Service) GetVariable(vname string) (values.Value, error) {
@@ -350,6 +547,28 @@ func needsUpdate(cp *compiler.Compiler) (bool, error) {
 	return false, nil
 }
 
+// Gets the filepaths of the source code of the service, including the code of the modules
+// it imports, but not of the external services it uses.
+func (sv *Service) GetSourceFilepaths() ([]string, error) {
+	if sv.cp == nil {
+		return nil, errors.New("service is uninitialized")
+	}
+	result := []string{}
+	sourceFilepaths(sv.cp, &result)
+	return result, nil
+}
+
+func sourceFilepaths(cp *compiler.Compiler, result *[]string) {
+	for fname := range cp.Sources {
+		if !slices.Contains(*result, fname) {
+			*result = append(*result, fname)
+		}
+	}
+	for _, importedCp := range cp.Modules {
+		sourceFilepaths(importedCp, result)
+	}
+}
+
 // Returns `true` if the last thing the service did produced errors, whether runtime
 // or compile time.
 func (sv *Service) ErrorsExist() (bool, error) {
@@ -434,6 +653,12 @@ func (sv *Service) ToLiteral(v Value) string {
 	return sv.cp.Vm.Literal(v, 0)
 }
 
+// Returns a Pipefish string literal for the string, e.g. for putting it into the code
+// passed to `InitializeFromCode`.
+func Quote(s string) string {
+	return lexer.Quote(s)
+}
+
 // Converts a `Value` to a string using Pipefish's `string` function.
 func (sv *Service) ToString(v Value) string {
 	return sv.cp.Vm.DefaultDescription(v)
@@ -462,7 +687,8 @@ func (sv *Service) UnderlyingType(v Value) Type {
 	return v.T
 }
 
-// Returns the `Type` associated with a given type name.
+// Returns the `Type` associated with a given type name. The name may be qualified by the
+// namespace of an import or external service, e.g. `server.Person`.
 func (sv *Service) TypeNameToType(s string) (Type, error) {
 	if sv.cp == nil {
 		return values.UNDEFINED_TYPE, errors.New("service is uninitialized")
@@ -470,7 +696,16 @@ func (sv *Service) TypeNameToType(s string) (Type, error) {
 	if sv.IsBroken() {
 		return values.UNDEFINED_TYPE, errors.New("service is broken")
 	}
-	t, ok := sv.cp.GetConcreteType(s)
+	cp := sv.cp
+	for {
+		namespace, name, ok := strings.Cut(s, ".")
+		module, isModule := cp.Modules[namespace]
+		if !ok || !isModule {
+			break
+		}
+		cp, s = module, name
+	}
+	t, ok := cp.GetConcreteType(s)
 	if !ok {
 		return values.UNDEFINED_TYPE, errors.New("no concrete type of that name exists")
 	}
@@ -733,6 +968,9 @@ var DEFAULT_TYPE_FOR = map[Type]reflect.Type{
 
 // Serializes a Map of Values into newline-separated key-value pairs, encrypting if the
 // password is non-empty, and heading the result with "PLAINTEXT\n" if the password is empty.
+//
+// Deprecated: the hub now writes its env store in the format described in `hub/env.go`, and
+// only reads this one so as to convert it.
 func (sv *Service) WriteSecret(store values.Map, password string) string {
 	var plaintext strings.Builder
 	plaintext.WriteString("PLAINTEXT\n")
@@ -0,0 +1,125 @@
+package text
+
+import (
+	"fmt"
+	"html"
+	"strconv"
+	"strings"
+)
+
+// The sixteen standard colors, in the order of their control codes.
+var ansiColors = []string{"#000000", "#cd3131", "#0dbc79", "#e5e510", "#2472c8", "#bc3fbc", "#11a8cd", "#e5e5e5",
+	"#666666", "#f14c4c", "#23d18b", "#f5f543", "#3b8eea", "#d670d6", "#29b8db", "#ffffff"}
+
+type htmlFont struct {
+	fg, bg                   string
+	bold, italic, underlined bool
+}
+
+func (f htmlFont) style() string {
+	styles := []string{}
+	if f.fg != "" {
+		styles = append(styles, "color:"+f.fg)
+	}
+	if f.bg != "" {
+		styles = append(styles, "background-color:"+f.bg)
+	}
+	if f.bold {
+		styles = append(styles, "font-weight:bold")
+	}
+	if f.italic {
+		styles = append(styles, "font-style:italic")
+	}
+	if f.underlined {
+		styles = append(styles, "text-decoration:underline")
+	}
+	return strings.Join(styles, ";")
+}
+
+// This converts the output of the markdowner and the highlighter, which is colored with Linux
+// control codes, into HTML, so that it can be displayed in a browser, e.g. by someone using
+// the hub through a websocket. The result should be put in a `<pre>` element or something else
+// that respects whitespace.
+func AnsiToHtml(s string) string {
+	var sb strings.Builder
+	font := htmlFont{}
+	openStyle := "" // The style of the `<span>` we're in, if any.
+	write := func(text string) {
+		if text == "" {
+			return
+		}
+		if style := font.style(); style != openStyle {
+			if openStyle != "" {
+				sb.WriteString("</span>")
+			}
+			if style != "" {
+				sb.WriteString(`<span style="` + style + `">`)
+			}
+			openStyle = style
+		}
+		sb.WriteString(html.EscapeString(text))
+	}
+	for len(s) > 0 {
+		start := strings.Index(s, "\033[")
+		if start == -1 {
+			write(s)
+			break
+		}
+		write(s[:start])
+		end := strings.IndexByte(s[start:], 'm')
+		if end == -1 { // Then it's not a control code we know about, and we drop the rest.
+			break
+		}
+		font = font.apply(strings.Split(s[start+2:start+end], ";"))
+		s = s[start+end+1:]
+	}
+	if openStyle != "" {
+		sb.WriteString("</span>")
+	}
+	return sb.String()
+}
+func (f htmlFont) apply(codes []string) htmlFont {
+	for i := 0; i < len(codes); i++ {
+		code, _ := strconv.Atoi(codes[i])
+		switch {
+		case code == 0:
+			f = htmlFont{}
+		case code == 1:
+			f.bold = true
+		case code == 3:
+			f.italic = true
+		case code == 4:
+			f.underlined = true
+		case code == 22:
+			f.bold = false
+		case code == 23:
+			f.italic = false
+		case code == 24:
+			f.underlined = false
+		case 30 <= code && code <= 37:
+			f.fg = ansiColors[code-30]
+		case code == 39:
+			f.fg = ""
+		case 40 <= code && code <= 47:
+			f.bg = ansiColors[code-40]
+		case code == 49:
+			f.bg = ""
+		case 90 <= code && code <= 97:
+			f.fg = ansiColors[code-82]
+		case 100 <= code && code <= 107:
+			f.bg = ansiColors[code-92]
+		case (code == 38 || code == 48) && i+4 < len(codes) && codes[i+1] == "2":
+			r, _ := strconv.Atoi(codes[i+2])
+			g, _ := strconv.Atoi(codes[i+3])
+			b, _ := strconv.Atoi(codes[i+4])
+			color := fmt.Sprintf("#%02x%02x%02x", r, g, b)
+			if code == 38 {
+				f.fg = color
+			} else {
+				f.bg = color
+			}
+			i = i + 4
+		}
+	}
+	return f
+}
@@ -49,6 +49,21 @@ func TestMarkdown(t *testing.T) {
 	}
 }
 
+func TestAnsiToHtml(t *testing.T) {
+	tests := []test_helper.TestItem{
+		{`plain <text>`, `plain &lt;text&gt;`},
+		{text.Red("red") + " text", `<span style="color:#cd3131">red</span> text`},
+		{"\033[1m\033[3mbold italic\033[22m\033[23m.", `<span style="font-weight:bold;font-style:italic">bold italic</span>.`},
+		{"\033[0m\033[48;2;0;0;64m\033[97mcode\033[0m", `<span style="color:#ffffff;background-color:#000040">code</span>`},
+	}
+	for _, test := range tests {
+		got := text.AnsiToHtml(test.Input)
+		if !(test.Want == got) {
+			t.Fatalf("Test failed with input %q \nExp :\n%s\nGot :\n%s", test.Input, test.Want, got)
+		}
+	}
+}
+
 func TestTextUtils(t *testing.T) {
 	if !(text.Flatten("foo/bar.troz") == "foo_bar_troz") {
 		t.Fatalf("Flatten failed")
@@ -85,6 +85,7 @@ const (
 	LOG             = "LOG"             // What we turn \\ into.
 	MAGIC_COLON     = "MAGIC COLON"     // What the relexer turns a colon into when it comes after the signature of an inner function.
 	MAGIC_SEMICOLON = "MAGIC_SEMICOLON" // What the semicolons in C-like for loops get turned into by the relexer.
+	NATIVE          = "NATIVE"          // What the initializer turns the body `native` of a function supplied by Go into.
 	PRELOG          = "PRELOG"          // What we turn \\ into when it's the first thing after the function signature.
 	XCALL           = "XCALL"           // Used in generated code to supply hooks to the external calls.
 )
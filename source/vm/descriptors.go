@@ -33,7 +33,7 @@ func (vm *Vm) DescribeCode(loc uint32) string {
 func (vm *Vm) DescribeOperandValues(addr uint32) string {
 	op := vm.Code[addr]
 	operands := op.Args
-	operandFlavors := opInfo[op.Opcode].operandFlavors
+	operandFlavors := operations()[op.Opcode].operandFlavors
 	result := ""
 	sep := ""
 	for i, operandType := range operandFlavors {
@@ -2,55 +2,274 @@ package vm
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"io"
+	"net"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/tim-hardcastle/pipefish/source/settings"
+	"github.com/tim-hardcastle/pipefish/source/values"
 )
 
+// A call to a function of an external service, as made by the `Extn` opcode.
+type ExternalCall struct {
+	Operator  uint32 // Whether the function is prefix, infix, suffix, or unfix.
+	Namespace string // The remainder of the namespace of the function.
+	Name      string
+	Args      []values.Value // Including the bling.
+}
+
+// Writes the call as a line of Pipefish, given a function to write each argument other than
+// the bling.
+func (xc *ExternalCall) Line(arg func(v values.Value) string) string {
+	lastWasBling := false
+	var buf strings.Builder
+	if xc.Operator == PREFIX || xc.Operator == UNFIX {
+		buf.WriteString(xc.Namespace)
+		buf.WriteString(xc.Name)
+		lastWasBling = true
+	}
+	if xc.Operator == PREFIX {
+		if len(xc.Args) == 0 {
+			buf.WriteString("(")
+		}
+		lastWasBling = len(xc.Args) > 0
+	}
+	if xc.Operator == INFIX || xc.Operator == SUFFIX {
+		buf.WriteString("(")
+	}
+	for i, v := range xc.Args {
+		if v.T == values.BLING {
+			if xc.Operator == INFIX && v.V.(string) == xc.Name { // Then we need to attach the namespace to the operator.
+				buf.WriteString(xc.Namespace)
+			}
+			if !lastWasBling {
+				buf.WriteString(")")
+			}
+			buf.WriteString(" ")
+			buf.WriteString(v.V.(string))
+			lastWasBling = true
+			continue
+		}
+		// So it's non-bling
+		if lastWasBling {
+			buf.WriteString(" (")
+		} else {
+			if i > 0 {
+				buf.WriteString(", ")
+			}
+		}
+		lastWasBling = false
+		buf.WriteString(arg(v))
+	}
+	if !lastWasBling {
+		buf.WriteString(")")
+	}
+	if xc.Operator == SUFFIX {
+		buf.WriteString(xc.Namespace)
+		buf.WriteString(xc.Name)
+	}
+	return buf.String()
+}
+
+// If `Wire` is set to `WIRE_VERSION`, then `Call` contains the call in the binary wire format.
+// A hub which speaks it sets `Wire` in its reply, and puts the result in `Value`, or, if the
+// result can't be encoded, puts it in `Body` as a literal. A hub which doesn't speak it ignores
+// them and evaluates the line in `Body`. See `wire.go`.
+//
+// A hub which speaks the binary format can also be sent a batch of calls in `Batch` rather than
+// one in `Call`. It makes them in turn, and puts their results in `Batch` in its reply, in the
+// same order. A hub which doesn't know about batches replies without them, and the calls are
+// then made one at a time.
+//
+// The hub makes a session for the first request, and we make the rest of our requests in the
+// same session, rather than have it make a new one each time.
 type jsonRequest = struct {
 	Body     string
 	Service  string
 	Username string
 	Password string
+	Session  string   `json:",omitempty"`
+	Wire     string   `json:",omitempty"`
+	Call     []byte   `json:",omitempty"`
+	Batch    [][]byte `json:",omitempty"`
 }
 
 type jsonResponse = struct {
 	Body    string
+	Session string
+	Wire    string
+	Value   []byte
+	Batch   []ExternalResult
+}
+
+// The result of one of a batch of calls: the value in the binary format, or, if it couldn't be
+// encoded, what the hub output instead.
+type ExternalResult struct {
+	Body  string
+	Value []byte `json:",omitempty"`
+}
+
+// The most calls that can be sent in one batch. Since a batch counts as one request against
+// the hub's rate limits, a hub won't take a bigger one, and a longer list of calls is sent in
+// several batches.
+const MAX_BATCH = 100
+
+// A request to a service on another hub.
+type ExternalRequest struct {
+	Host     string
+	Service  string
+	Username string
+	Password string
+	Session  string // The ID of the session on the hub to make the request in, if we have one.
+	Line     string
+	Call     []byte   // The call in the binary wire format, or nil to use the literal protocol.
+	Batch    [][]byte // A batch of calls in the binary format, sent instead of `Call`.
+	Timeout  time.Duration
+}
+
+// The reply to an `ExternalRequest`.
+type ExternalReply struct {
+	Body    string
+	Value   []byte           // The value, if the hub replied with one in the binary format.
+	Wire    bool             // Whether the hub speaks the binary format.
+	Session string           // The ID of the session the hub made the request in.
+	Batch   []ExternalResult // The results of a batch of calls, if the hub knows about batches.
+}
+
+// How calls to an external service on another hub are made. Each attempt at a call times out
+// after `Timeout`. If it fails in a way which might not happen the next time, then a call to a
+// function, but not to a command, is retried up to `Retries` times, waiting `Backoff` before the
+// first retry and twice as long before each one after that, up to `MAX_BACKOFF`. So that the
+// callers of a service which has failed don't all retry at the same moment, each wait is
+// shortened by a random amount of up to half of it. Functions can be retried safely because they
+// have no side effects.
+//
+// If `BreakAfter` calls in a row fail, the circuit breaker opens, and calls to the service fail
+// at once, without being made, for the next `BreakFor`. After that, one call is let through to
+// see if the service has recovered: if it has, the breaker closes, and if not, it opens again.
+// If `BreakAfter` is 0, the breaker never opens.
+type ExternalConfig struct {
+	Timeout    time.Duration
+	Retries    int
+	Backoff    time.Duration
+	BreakAfter int
+	BreakFor   time.Duration
 }
 
-func Do(host, service, line, username, password string) string {
-	jRq := jsonRequest{Body: line, Service: service, Username: username, Password: password}
+// The longest we wait before retrying a call, however many times it's been retried.
+const MAX_BACKOFF = 10 * time.Second
+
+var DEFAULT_EXTERNAL_CONFIG = ExternalConfig{
+	Timeout:    30 * time.Second,
+	Retries:    2,
+	Backoff:    100 * time.Millisecond,
+	BreakAfter: 5,
+	BreakFor:   30 * time.Second,
+}
+
+// A failure to get a reply from an external service. The `Id` is that of the Pipefish error
+// which the failure becomes: `ext/timeout`, `ext/unreachable`, `ext/unauthorized`, or
+// `ext/protocol`.
+type ExternalError struct {
+	Id     string
+	Detail string
+	Status int // The HTTP status of the reply, if there was a reply.
+}
+
+func (e *ExternalError) Error() string {
+	return e.Detail
+}
+
+// What a hub replies, with a status of `http.StatusBadRequest`, to a request made in a session
+// it doesn't have, e.g. because it's been restarted since the session was made.
+const EXPIRED_SESSION = "unknown or expired session"
+
+// Whether the hub has forgotten the session the request was made in, in which case the request
+// can be made again in a new one.
+func (e *ExternalError) ExpiredSession() bool {
+	return e.Status == http.StatusBadRequest && e.Detail == EXPIRED_SESSION
+}
+
+// Whether the call might succeed if it was made again.
+func (e *ExternalError) Transient() bool {
+	switch e.Id {
+	case "ext/timeout", "ext/unreachable":
+		return true
+	case "ext/protocol":
+		return e.Status == http.StatusTooManyRequests || e.Status >= 500
+	}
+	return false
+}
+
+// All external calls over HTTP share the one client, so that connections to a hub are kept
+// alive and reused from one call to the next. Timeouts are set on each request instead of on
+// the client, since they vary from service to service.
+var externalClient = &http.Client{Transport: externalTransport()}
+
+func externalTransport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = 16
+	return transport
+}
+
+// Sends the request to the hub, returning the reply, or an error if the hub didn't reply
+// properly.
+func DoExternal(rq *ExternalRequest) (*ExternalReply, *ExternalError) {
+	jRq := jsonRequest{Body: rq.Line, Service: rq.Service, Username: rq.Username, Password: rq.Password, Session: rq.Session}
+	if rq.Call != nil {
+		jRq.Wire, jRq.Call = WIRE_VERSION, rq.Call
+	}
+	if rq.Batch != nil {
+		jRq.Wire, jRq.Batch = WIRE_VERSION, rq.Batch
+	}
 	body, _ := json.Marshal(jRq)
-	request, err := http.NewRequest("POST", host, bytes.NewBuffer(body))
+	ctx, cancel := context.WithTimeout(context.Background(), rq.Timeout)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, "POST", rq.Host, bytes.NewBuffer(body))
 	if err != nil {
-		return "error \"Can't parse request\"" 
+		return nil, &ExternalError{Id: "ext/protocol", Detail: err.Error()}
 	}
 	request.Header.Set("Content-Type", "application/json; charset=UTF-8")
-
-	client := &http.Client{}
-	response, err := client.Do(request)
+	response, err := externalClient.Do(request)
 	if err != nil {
-		return "error: `" + err.Error() + "`"
+		return nil, transportError(err, rq.Timeout)
 	}
-
 	defer response.Body.Close()
 	rBody, err := io.ReadAll(response.Body)
 	if err != nil {
-		return "error: " + err.Error()
+		return nil, transportError(err, rq.Timeout)
 	}
 	if settings.SHOW_XCALLS {
-		rawJ := ""
-		for _, c := range rBody {
-			rawJ = rawJ + (string(c))
+		println("Raw json is", string(rBody))
+	}
+	if response.StatusCode != http.StatusOK {
+		id := "ext/protocol"
+		if response.StatusCode == http.StatusUnauthorized || response.StatusCode == http.StatusForbidden {
+			id = "ext/unauthorized"
+		}
+		detail := strings.TrimSpace(string(rBody))
+		if detail == "" {
+			detail = http.StatusText(response.StatusCode)
 		}
-		println("Raw json is", rawJ)
+		return nil, &ExternalError{Id: id, Detail: detail, Status: response.StatusCode}
 	}
 	var jRsp jsonResponse
 	err = json.Unmarshal(rBody, &jRsp)
 	if err != nil {
-		return "error: " + err.Error()
+		return nil, &ExternalError{Id: "ext/protocol", Detail: "the reply isn't valid JSON: " + err.Error(), Status: response.StatusCode}
+	}
+	return &ExternalReply{Body: jRsp.Body, Value: jRsp.Value, Wire: jRsp.Wire == WIRE_VERSION, Session: jRsp.Session, Batch: jRsp.Batch}, nil
+}
+
+func transportError(err error, timeout time.Duration) *ExternalError {
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout() {
+		return &ExternalError{Id: "ext/timeout", Detail: "no reply within " + timeout.String()}
 	}
-	return jRsp.Body
+	return &ExternalError{Id: "ext/unreachable", Detail: err.Error()}
 }
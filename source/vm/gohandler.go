@@ -220,6 +220,9 @@ func (vm *Vm) goToPipefish(goValue reflect.Value) values.Value {
 		return values.Value{values.NULL, nil}
 	}
 	someGoDatum := goValue.Interface()
+	if pfError, ok := someGoDatum.(*err.Error); ok { // As returned by a native function, see `initializer/natives.go`.
+		return values.Value{values.ERROR, pfError}
+	}
 	uint32Type, ok := vm.GoToPipefishTypes[reflect.TypeOf(someGoDatum)]
 	if ok {
 		pipefishType := values.ValueType(uint32Type)
@@ -9,6 +9,7 @@ import (
 	"github.com/tim-hardcastle/pipefish/source/values"
 
 	"github.com/lmorg/readline/v4"
+	"src.elv.sh/pkg/persistent/vector"
 )
 
 type InHandler interface {
@@ -20,6 +21,38 @@ type OutHandler interface {
 	Write(s string)
 }
 
+// Supplies the responses to `get ... from Keyboard(...)` and `get ... from masked Keyboard(...)`
+// when the keyboard in question isn't the one attached to the terminal, e.g. when a remote
+// user is talking to the hub through a websocket.
+type KeyboardHandler interface {
+	GetFromKeyboard(prompt string, masked bool) string
+}
+
+// Sends the mail posted by the `net/smtp` library, e.g. through the transport the hub is
+// configured to use.
+type MailHandler interface {
+	Send(to []string, msg []byte) error
+}
+
+func (vm *Vm) sendMail(recipients vector.Vector, msg string, tok uint32) values.Value {
+	if vm.MailHandle == nil {
+		return vm.makeError("vm/mail/none", tok)
+	}
+	to := []string{}
+	for i := 0; i < recipients.Len(); i++ {
+		el, _ := recipients.Index(i)
+		recipient, ok := el.(values.Value).V.(string)
+		if !ok {
+			return vm.makeError("vm/mail/recipient", tok)
+		}
+		to = append(to, recipient)
+	}
+	if err := vm.MailHandle.Send(to, []byte(msg)); err != nil {
+		return vm.makeError("vm/mail/send", tok, err.Error())
+	}
+	return values.Value{values.SUCCESSFUL_VALUE, nil}
+}
+
 type StandardInHandler struct {
 	prompt string
 	cancel chan os.Signal
@@ -347,4 +347,8 @@ const (
 	WtoM
 	// Yeet type parameters (dst mem)
 	Yeet
+	// Send mail (dst mem mem tok)
+	Mail
+	// Batched external service call (dst num num mem mem mem)
+	Extb
 )
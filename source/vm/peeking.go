@@ -1,11 +1,16 @@
 package vm
 
 import (
+	"errors"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"unicode"
 
 	"github.com/tim-hardcastle/pipefish/source/settings"
@@ -23,7 +28,17 @@ type operatorInfo struct {
 	notes          []string // We keep these as seperate lines so we can add them as comments to vm.go.
 }
 
-var opInfo = map[Opcode]operatorInfo{}
+// The operations, once they've been read. Since they may be read from the file system of one
+// service while another service is describing its code, they're published atomically.
+var opInfo atomic.Pointer[map[Opcode]operatorInfo]
+
+// Returns the operations, or nil if they haven't been read.
+func operations() map[Opcode]operatorInfo {
+	if ops := opInfo.Load(); ops != nil {
+		return *ops
+	}
+	return nil
+}
 
 func init() {
 	// Set up the operations map.
@@ -31,38 +46,18 @@ func init() {
 	if err != nil { // Then we don't have access to the source.
 		return
 	}
-	lines := strings.Split(string(content), "\n")
-	i := 0
-	for ; lines[i] != "## Operators"; i++ {
-	} // Skips the preamble to `operations.md`.
-	i++
-	for i < len(lines) {
-		// We start off at a newline, which we skip.
-		i++
-		headline := lines[i]
-		fields := strings.Fields(headline)
-		opcode := fields[0]
-		operands := fields[2:]
-		i++
-		description := lines[i]
-		i++
-		notes := []string{}
-		for ; i < len(lines) && lines[i] != ""; i++ {
-			notes = append(notes, lines[i])
-		}
-		opInfo[OPCODES[opcode]] = operatorInfo{
-			opcode:         opcode,
-			operandFlavors: operands,
-			description:    description,
-			notes:          notes,
-		}
+	ops, err := readOperations(string(content))
+	if err != nil {
+		println("Pipefish: " + err.Error() + ".")
+		return
 	}
+	opInfo.Store(&ops)
 	// Add comments to operations.go.
 	operationsFile := filepath.Join(settings.PipefishHomeDirectory, "source/vm/operations.go")
 	content, _ = os.ReadFile(operationsFile)
-	lines = strings.Split(string(content), "\n")
+	lines := strings.Split(string(content), "\n")
 	result := ""
-	i = 0
+	i := 0
 	for ; lines[i] != "const ("; i++ {
 		result = result + lines[i] + "\n"
 	}
@@ -82,7 +77,7 @@ func init() {
 		runes[0] = unicode.ToLower(runes[0])
 		opcode = string(runes)
 		opNumber := OPCODES[opcode]
-		result = result + "\t// " + opInfo[opNumber].description + " (" + strings.Join(opInfo[opNumber].operandFlavors, " ") + ")\n"
+		result = result + "\t// " + ops[opNumber].description + " (" + strings.Join(ops[opNumber].operandFlavors, " ") + ")\n"
 		result = result + lines[i] + "\n"
 	}
 	result = result + ")\n"
@@ -111,8 +106,8 @@ func init() {
 			if !ok {
 				panic("Opcode `" + opcode + "` not found.")
 			}
-			result = result + line + " // " + opInfo[opNumber].description + " (" + strings.Join(opInfo[opNumber].operandFlavors, " ") + ")\n"
-			for _, noteLine := range opInfo[opNumber].notes {
+			result = result + line + " // " + ops[opNumber].description + " (" + strings.Join(ops[opNumber].operandFlavors, " ") + ")\n"
+			for _, noteLine := range ops[opNumber].notes {
 				result = result + "\t\t\t\t// " + noteLine + "\n"
 			}
 			eatComments = true
@@ -124,6 +119,83 @@ func init() {
 
 }
 
+var (
+	loadOperations    sync.Once
+	loadOperationsErr error
+)
+
+// If the operations haven't been read in from the Pipefish home directory, because there isn't one,
+// this reads them from the file system supplied to initialize a service, if it contains
+// `source/vm/operations.md`. This is only tried once, with the first file system supplied, and
+// returns an error if the file is there but can't be read.
+func LoadOperations(fsys fs.FS) error {
+	loadOperations.Do(func() {
+		if opInfo.Load() != nil {
+			return
+		}
+		content, err := fs.ReadFile(fsys, "source/vm/operations.md")
+		if errors.Is(err, fs.ErrNotExist) {
+			return
+		}
+		if err != nil {
+			loadOperationsErr = err
+			return
+		}
+		ops, err := readOperations(string(content))
+		if err != nil {
+			loadOperationsErr = err
+			return
+		}
+		opInfo.Store(&ops)
+	})
+	return loadOperationsErr
+}
+
+func readOperations(content string) (map[Opcode]operatorInfo, error) {
+	ops := map[Opcode]operatorInfo{}
+	lines := strings.Split(content, "\n")
+	i := slices.Index(lines, "## Operators") // Skips the preamble to `operations.md`.
+	if i == -1 {
+		return nil, errors.New("`operations.md` has no `## Operators` heading")
+	}
+	i++
+	for i < len(lines) {
+		// We start off at a newline, which we skip.
+		i++
+		if i == len(lines) { // Then the file ends with a newline.
+			break
+		}
+		headline := lines[i]
+		fields := strings.Fields(headline)
+		if len(fields) < 2 || fields[1] != ":" {
+			return nil, errors.New("line " + strconv.Itoa(i+1) + " of `operations.md` should be an operator, a colon, and the flavors of its operands")
+		}
+		opcode := fields[0]
+		opNumber, ok := OPCODES[opcode]
+		if !ok {
+			return nil, errors.New("line " + strconv.Itoa(i+1) + " of `operations.md` has the unknown operator `" + opcode + "`")
+		}
+		operands := fields[2:]
+		i++
+		if i == len(lines) {
+			return nil, errors.New("the operator `" + opcode + "` in `operations.md` has no description")
+		}
+		description := lines[i]
+		i++
+		notes := []string{}
+		for ; i < len(lines) && lines[i] != ""; i++ {
+			notes = append(notes, lines[i])
+		}
+		ops[opNumber] = operatorInfo{
+			opcode:         opcode,
+			operandFlavors: operands,
+			description:    description,
+			notes:          notes,
+		}
+	}
+	return ops, nil
+}
+
 // This will just be a whitespace-separated string like "foo bar !qux", where ! indicates a flag
 // to be turned off.
 func (vm *Vm) SetPeeks(s string) {
@@ -202,12 +274,12 @@ func (vm *Vm) Dump(s string) {
 func (op *Operation) ppOperand(i int) string {
 	// If we're calling this, the OPERANDS table shows that the operation ought to have an [i] operand.
 	//
-	opFlavor := opInfo[op.Opcode].operandFlavors[i]
+	opFlavor := operations()[op.Opcode].operandFlavors[i]
 	if i >= len(op.Args) {
 		if opFlavor == "tup" {
 			return " ()"
 		}
-		println("Not enough operands supplied to " + opInfo[op.Opcode].opcode + "; was expecting " + strconv.Itoa(len(opInfo[op.Opcode].operandFlavors)) + " but got " + strconv.Itoa(len(op.Args)) + ".")
+		println("Not enough operands supplied to " + operations()[op.Opcode].opcode + "; was expecting " + strconv.Itoa(len(operations()[op.Opcode].operandFlavors)) + " but got " + strconv.Itoa(len(op.Args)) + ".")
 		argStr := "Args were:"
 		for j := range op.Args {
 			argStr = argStr + " " + op.ppOperand(j)
@@ -241,7 +313,7 @@ func (op *Operation) ppOperand(i int) string {
 	case "tok":
 		return " TK" + opVal
 	case "tup":
-		args := op.Args[i : len(op.Args)+1-len(opInfo[op.Opcode].operandFlavors)+i]
+		args := op.Args[i : len(op.Args)+1-len(operations()[op.Opcode].operandFlavors)+i]
 		result := " ("
 		for j, v := range args[:] {
 			result = result + "m" + strconv.Itoa(int(v))
@@ -257,12 +329,12 @@ func (op *Operation) ppOperand(i int) string {
 }
 
 func describe(op *Operation) string {
-	operands := opInfo[op.Opcode].operandFlavors
-	result := opInfo[op.Opcode].opcode
+	operands := operations()[op.Opcode].operandFlavors
+	result := operations()[op.Opcode].opcode
 	for i := range operands {
 		result = result + op.ppOperand(i)
 	}
-	return result + "  // " + opInfo[op.Opcode].description + "."
+	return result + "  // " + operations()[op.Opcode].description + "."
 }
 
 var OPCODES = map[string]Opcode{
@@ -311,6 +383,7 @@ var OPCODES = map[string]Opcode{
 	"equt": Equt,
 	"eqxx": Eqxx,
 	"eval": Eval,
+	"extb": Extb,
 	"extn": Extn,
 	"flpp": Flpp,
 	"flps": Flps,
@@ -361,6 +434,7 @@ var OPCODES = map[string]Opcode{
 	"lnSn": LnSn,
 	"logn": Logn,
 	"logy": Logy,
+	"mail": Mail,
 	"mkEn": MkEn,
 	"mker": Mker,
 	"mkfn": Mkfn,
@@ -10,6 +10,7 @@ import (
 	"reflect"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"syscall"
 	"src.elv.sh/pkg/persistent/vector"
 	"github.com/tim-hardcastle/pipefish/source/err"
@@ -48,6 +49,11 @@ type Vm struct {
 	Tracking                   []TrackingData // Data needed by the 'trak' opcode to produce the live tracking data.
 	InHandle                   InHandler
 	OutHandle                  OutHandler
+	KeyboardHandle             KeyboardHandler // If nil, the `Keyboard` type of the `terminal` library reads from the terminal.
+	MailHandle                 MailHandler     // If nil, the `net/smtp` library can only send mail through a server it's given.
+	InstructionCount           uint64          // How many operations the vm has performed, for the hub's metrics. Use `sync/atomic` to read it.
+	CountInstructions          uint32          // Non-zero to keep the `InstructionCount`, which is only done if asked since it slows the vm. Use `sync/atomic` to set it.
+	MemorySize                 uint64          // How many values the memory held when the vm last finished running, for the hub's metrics. Use `sync/atomic` to read it.
 	AbstractTypes              []AbstractTypeInfo
 	ExternalCallHandlers       []ExternalCallHandler // The services declared external, whether on the same hub or a different one.
 	UsefulTypes                UsefulTypes
@@ -89,7 +95,8 @@ type TestInfo struct {
 // Contains a Go function in the form of a reflect.Value, and, currently, nothing else.
 // TODO --- this has been the case for a long time, you could probably refactor now.
 type GoFn struct {
-	Code reflect.Value
+	Code   reflect.Value
+	Native bool // Whether it was registered by the Go program embedding the service, rather than compiled from a `golang` function.
 }
 type AbstractTypeInfo struct {
 	Name string
@@ -115,9 +122,10 @@ type Lambda struct {
 }
 // Interface wrapping around external calls whether to the same hub or via HTTP.
 type ExternalCallHandler interface {
-	Evaluate(line string) values.Value
+	Evaluate(call *ExternalCall) values.Value
+	EvaluateBatch(calls []*ExternalCall) []values.Value // Which may make the calls in one request.
 	Problem() *err.Error
-	GetAPI() string
+	GetAPI() (string, *ExternalError)
 }
 // All the information we need to make a lambda at a particular point in the code.
 type LambdaFactory struct {
@@ -216,6 +224,16 @@ func (vm *Vm) run(addr uint32, ctx context.Context, cancel chan os.Signal) {
 	// We exit the loop and this function when we perform a `ret` openeration and `stackHeight``
 	// equals the length of the callstack.
 	stackHeight := len(vm.callstack)
+	// We count the operations locally, if at all, and add them up at the end so as to keep the
+	// loop fast. For the same reason, we publish the size of the memory only when we're done.
+	counting := atomic.LoadUint32(&vm.CountInstructions) != 0
+	count := uint64(0)
+	defer func() {
+		if counting {
+			atomic.AddUint64(&vm.InstructionCount, count)
+		}
+		atomic.StoreUint64(&vm.MemorySize, uint64(len(vm.Mem)))
+	}()
 loop:
 	for {
 		select {
@@ -236,6 +254,9 @@ loop:
 				vm.Dump(vm.DescribeOperandValues(addr))
 			}
 			args := vm.Code[addr].Args
+			if counting {
+				count++
+			}
 		Switch:
 			switch vm.Code[addr].Opcode {
 			case Addf: // Add floats (dst mem mem)
@@ -745,6 +766,31 @@ loop:
 			case Eval: // Eval (dst mem num)
 				// This evaluates the string v#1 using evaluator number n#2.
 				vm.Mem[args[0]] = vm.Evaluators[args[2]](vm.Mem[args[1]].V.(string))
+			case Extb: // Batched external service call (dst num num mem mem mem)
+				// Operands are as for `extn`, except that the function is called on each element
+				// of the list v#5, and the result is the list of what it returns, or the first
+				// error if any of them is an error. The calls may be made in a batch. See
+				// `externals.go`.
+				elements := vm.Mem[args[5]].V.(vector.Vector)
+				calls := make([]*ExternalCall, elements.Len())
+				for i := range calls {
+					el, _ := elements.Index(i)
+					calls[i] = &ExternalCall{
+						Operator:  args[2],
+						Namespace: vm.Mem[args[3]].V.(string),
+						Name:      vm.Mem[args[4]].V.(string),
+						Args:      []values.Value{el.(values.Value)},
+					}
+				}
+				result := vector.Empty
+				for _, v := range vm.ExternalCallHandlers[args[1]].EvaluateBatch(calls) {
+					if v.T == values.ERROR {
+						vm.Mem[args[0]] = v
+						break Switch
+					}
+					result = result.Conj(v)
+				}
+				vm.Mem[args[0]] = values.Value{values.LIST, result}
 			case Extn: // External service call (dst num num mem mem tup)
 				// Operands are: 
 				//     n#1 : the number of the external service to call
@@ -752,60 +798,16 @@ loop:
 				//     v#2 : the remainder of the namespace of the function as a string
 				//     v#3 : the name of the function as a string
 				//     #4 : a tuple of the locations of the arguments we wish to pass.
-				externalOrdinal := args[1]
-				operatorType := args[2]
-				remainingNamespace := vm.Mem[args[3]].V.(string)
-				name := vm.Mem[args[4]].V.(string)
-				argLocs := args[5:]
-				lastWasBling := false
-				var buf strings.Builder
-				if operatorType == PREFIX || operatorType == UNFIX {
-					buf.WriteString(remainingNamespace)
-					buf.WriteString(name)
-					lastWasBling = true
-				}
-				if operatorType == PREFIX {
-					if len(argLocs) == 0 {
-						buf.WriteString("(")
-					}
-					lastWasBling = len(argLocs) > 0
-				}
-				if operatorType == INFIX || operatorType == SUFFIX {
-					buf.WriteString("(")
-				}
-				for i, loc := range argLocs {
-					serializedValue := vm.Literal(vm.Mem[loc], 0)
-					if operatorType == INFIX && vm.Mem[loc].T == values.BLING && serializedValue == name { // Then we need to attach the namespace to the operator.
-						buf.WriteString(remainingNamespace)
-					}
-					if vm.Mem[loc].T == values.BLING {
-						if !lastWasBling {
-							buf.WriteString(")")
-						}
-						buf.WriteString(" ")
-						buf.WriteString(serializedValue)
-						lastWasBling = true
-						continue
-					}
-					// So it's non-bling
-					if lastWasBling {
-						buf.WriteString(" (")
-					} else {
-						if i > 0 {
-							buf.WriteString(", ")
-						}
-					}
-					lastWasBling = false
-					buf.WriteString(serializedValue)
-				}
-				if !lastWasBling {
-					buf.WriteString(")")
+				call := &ExternalCall{
+					Operator:  args[2],
+					Namespace: vm.Mem[args[3]].V.(string),
+					Name:      vm.Mem[args[4]].V.(string),
+					Args:      make([]values.Value, len(args[5:])),
 				}
-				if operatorType == SUFFIX {
-					buf.WriteString(remainingNamespace)
-					buf.WriteString(name)
+				for i, loc := range args[5:] {
+					call.Args[i] = vm.Mem[loc]
 				}
-				vm.Mem[args[0]] = vm.ExternalCallHandlers[externalOrdinal].Evaluate(buf.String())
+				vm.Mem[args[0]] = vm.ExternalCallHandlers[args[1]].Evaluate(call)
 			case Flpp: // Pop peek flags ()
 				vm.PopPeeks()
 			case Flps: // Push peek flags (mem)
@@ -830,6 +832,9 @@ loop:
 				goTpl := make([]reflect.Value, 0, len(args))
 				for _, v := range args[3:] { // TODO --- how can this be right? Surely they should be stored in a TUPLE.
 					el := vm.Mem[v]
+					if el.T == values.BLING && F.Native { // A native function has no parameters for the bling.
+						continue
+					}
 					goVal, ok := vm.pipefishToGo(el)
 					if !ok {
 						newError := err.CreateErr("vm/pipefish/type", vm.Mem[args[1]].V.(*err.Error).Token, vm.DescribeType(el.T, LITERAL, 0))
@@ -858,6 +863,9 @@ loop:
 					vm.Mem[args[0]] = values.Value{values.ERROR, newError}
 					break Switch
 				}
+				if val.T == values.ERROR && val.V.(*err.Error).Token == nil {
+					val.V.(*err.Error).Token = vm.Mem[args[1]].V.(*err.Error).Token
+				}
 				vm.Mem[args[0]] = val
 			case Gsql: // Get from SQL (dst mem mem mem mem num tok)
 				// This returns an error or `OK` in m#0, the SQL data being put in the reference variable v#1.
@@ -954,14 +962,21 @@ loop:
 			case Inpt: // Input from keyboard (dst mem mem)
 				// v#1 is of type `terminal.Keyboard` with one field consisting of the prompt. #v2 is a 
 				// boolean saying whether the input should be masked for privacy.
-				temp := vm.InHandle
-				if vm.Mem[args[2]].V.(bool) {
-					vm.InHandle = &MaskedInHandler{vm.Mem[args[1]].V.([]values.Value)[0].V.(string), cancel}
+				prompt := vm.Mem[args[1]].V.([]values.Value)[0].V.(string)
+				masked := vm.Mem[args[2]].V.(bool)
+				var response string
+				if vm.KeyboardHandle != nil {
+					response = vm.KeyboardHandle.GetFromKeyboard(prompt, masked)
 				} else {
-					vm.InHandle = &StandardInHandler{vm.Mem[args[1]].V.([]values.Value)[0].V.(string), cancel}
+					temp := vm.InHandle
+					if masked {
+						vm.InHandle = &MaskedInHandler{prompt, cancel}
+					} else {
+						vm.InHandle = &StandardInHandler{prompt, cancel}
+					}
+					response = vm.InHandle.Get()
+					vm.InHandle = temp
 				}
-				response := vm.InHandle.Get()
-				vm.InHandle = temp
 				vm.Mem[vm.Mem[args[0]].V.(uint32)] = values.Value{values.STRING, response}
 			case Inte: // Integer from enum (dst mem)
 				vm.Mem[args[0]] = values.Value{values.INT, vm.Mem[args[1]].V.(int)}
@@ -1281,6 +1296,10 @@ loop:
 				vm.logging = false
 			case Logy: // Turn logging on ()
 				vm.logging = true
+			case Mail: // Send mail (dst mem mem tok)
+				// Sends the message v#2 to the list of recipients v#1 through the vm's `MailHandle`, returning 
+				// either `OK` or an error created using the token n#3.
+				vm.Mem[args[0]] = vm.sendMail(vm.Mem[args[1]].V.(vector.Vector), vm.Mem[args[2]].V.(string), args[3])
 			case MkEn: // Enum element from int (dst typ mem tok)
 				// Makes an enum of type number n#1 from an integer v#2, using token n#3 to return an error if
 				// v#2 is out of bounds.
@@ -2152,7 +2171,7 @@ loop:
 					vm.Mem[args[0]+uint32(i)] = v
 				}
 			default:
-				panic("Unhandled opcode '" + opInfo[vm.Code[addr].Opcode].opcode + "'")
+				panic("Unhandled opcode '" + operations()[vm.Code[addr].Opcode].opcode + "'")
 			}
 			addr++
 		}
@@ -203,8 +203,8 @@ func TestDump(t *testing.T) { // We want to make sure that if the service is bro
 	// no t.Parallel()
 	test := []test_helper.TestItem{
 		{`hub run "../hub/test-files/dump.pf"`, `Starting script [36m"dump.pf"[39m as service [36m"dump"[39m.`},
-		{`hub dump "big"`, "# Function dump of `big`\n\n## Code dump for function `big` with sig int\n\n@71 : asgm m263 <- m261  // Assign to memory.\n@72 : gtei m262 <- m263 m265  // Int comparison with >=.\n@73 : asgm m266 <- m262  // Assign to memory.\n@74 : qtru m266 @77  // Test true.\n@75 : asgm m268 <- m267  // Assign to memory.\n@76 : jmp @78  // Jump.\n@77 : asgm m268 <- m3  // Assign to memory.\n@78 : qsat m268 @81  // Test not `UNSAT`.\n@79 : asgm m270 <- m268  // Assign to memory.\n@80 : jmp @82  // Jump.\n@81 : asgm m270 <- m269  // Assign to memory.\n@82 : ret  // Return."},
-		{`hub dump m "big"`, "# Function dump of `big`\n\n## Code dump for function `big` with sig int\n\n@71 : asgm m263 <- m261  // Assign to memory.\n@72 : gtei m262 <- m263 m265  // Int comparison with >=.\n@73 : asgm m266 <- m262  // Assign to memory.\n@74 : qtru m266 @77  // Test true.\n@75 : asgm m268 <- m267  // Assign to memory.\n@76 : jmp @78  // Jump.\n@77 : asgm m268 <- m3  // Assign to memory.\n@78 : qsat m268 @81  // Test not `UNSAT`.\n@79 : asgm m270 <- m268  // Assign to memory.\n@80 : jmp @82  // Jump.\n@81 : asgm m270 <- m269  // Assign to memory.\n@82 : ret  // Return.\n\n### Memory dump for function `big` with sig int`\n\nm261 : UNDEFINED VALUE::UNDEFINED VALUE!\nm262 : error::\x1b[31mError\x1b[39m: something unexpected has gone wrong at line \x1b[33m4:6-8\x1b[39m of \x1b[36m\"../hub/test-files/dump.pf\"\x1b[39m. \nm263 : UNDEFINED VALUE::UNDEFINED VALUE!\nm264 : BLING::>=\nm265 : int::100\nm266 : UNDEFINED VALUE::UNDEFINED VALUE!\nm267 : string::\"big\"\nm268 : UNDEFINED VALUE::UNDEFINED VALUE!\nm269 : string::\"small\"\nm270 : UNDEFINED VALUE::UNDEFINED VALUE!"},
+		{`hub dump "big"`, "# Function dump of `big`\n\n## Code dump for function `big` with sig int\n\n@71 : asgm m267 <- m265  // Assign to memory.\n@72 : gtei m266 <- m267 m269  // Int comparison with >=.\n@73 : asgm m270 <- m266  // Assign to memory.\n@74 : qtru m270 @77  // Test true.\n@75 : asgm m272 <- m271  // Assign to memory.\n@76 : jmp @78  // Jump.\n@77 : asgm m272 <- m3  // Assign to memory.\n@78 : qsat m272 @81  // Test not `UNSAT`.\n@79 : asgm m274 <- m272  // Assign to memory.\n@80 : jmp @82  // Jump.\n@81 : asgm m274 <- m273  // Assign to memory.\n@82 : ret  // Return."},
+		{`hub dump m "big"`, "# Function dump of `big`\n\n## Code dump for function `big` with sig int\n\n@71 : asgm m267 <- m265  // Assign to memory.\n@72 : gtei m266 <- m267 m269  // Int comparison with >=.\n@73 : asgm m270 <- m266  // Assign to memory.\n@74 : qtru m270 @77  // Test true.\n@75 : asgm m272 <- m271  // Assign to memory.\n@76 : jmp @78  // Jump.\n@77 : asgm m272 <- m3  // Assign to memory.\n@78 : qsat m272 @81  // Test not `UNSAT`.\n@79 : asgm m274 <- m272  // Assign to memory.\n@80 : jmp @82  // Jump.\n@81 : asgm m274 <- m273  // Assign to memory.\n@82 : ret  // Return.\n\n### Memory dump for function `big` with sig int`\n\nm265 : UNDEFINED VALUE::UNDEFINED VALUE!\nm266 : error::\x1b[31mError\x1b[39m: something unexpected has gone wrong at line \x1b[33m4:6-8\x1b[39m of \x1b[36m\"../hub/test-files/dump.pf\"\x1b[39m. \nm267 : UNDEFINED VALUE::UNDEFINED VALUE!\nm268 : BLING::>=\nm269 : int::100\nm270 : UNDEFINED VALUE::UNDEFINED VALUE!\nm271 : string::\"big\"\nm272 : UNDEFINED VALUE::UNDEFINED VALUE!\nm273 : string::\"small\"\nm274 : UNDEFINED VALUE::UNDEFINED VALUE!"},
 		{`hub halt "dump"`, `OK`},
 		{`hub quit`, "[32mOK[0m\n" + text.Logo() + "Thank you for using Pipefish. Have a nice day!"},
 	}
@@ -0,0 +1,596 @@
+package vm
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"strconv"
+	"sync"
+
+	"github.com/tim-hardcastle/pipefish/source/err"
+	"github.com/tim-hardcastle/pipefish/source/token"
+	"github.com/tim-hardcastle/pipefish/source/values"
+	"src.elv.sh/pkg/persistent/vector"
+)
+
+// The binary wire format for external service calls.
+//
+// In the literal protocol, a call to an external service is sent as a line of Pipefish which
+// the service compiles and runs, and the result comes back as a Pipefish literal which the
+// client compiles in turn. In the binary wire format, the arguments and the result are sent as
+// values, and so aren't compiled. The service does still compile a line which calls the
+// function, made from the namespace, name, and bling that it's sent (see `ExternalCall.Line`),
+// with the arguments bound to names in it; and so it only accepts a call whose namespace, name,
+// and bling are each one word (see `compiler.DecodeWireCall`), so that nothing else can be
+// slipped into the line.
+//
+// Since the client has a facsimile of the public types of the service, made from its API (see
+// `initializer/README-api-serialization.md`), a user-defined type can be sent by name, and
+// each side finds the type of that name from the point of view of the service. For the
+// service, that's its own namespace, and for the client, it's the namespace of the module which
+// the client made from the API. The builtin types are sent by number.
+//
+// A value is sent as its type followed by its payload. A type is sent as a uvarint: if it's
+// less than `values.FIRST_DEFINED_TYPE` it's the number of a builtin type, and otherwise it's
+// `values.FIRST_DEFINED_TYPE + n` where `n` numbers the user-defined types in the order they
+// first occur in the message. The first time a type occurs, its number is followed by its name.
+//
+// The payloads are:
+//
+// * bools : one byte, 0 or 1.
+// * ints and runes : a varint.
+// * floats : eight bytes, little-endian.
+// * strings and bling : a uvarint length and then the bytes.
+// * labels : the name of the label, as a string.
+// * types : a uvarint count and then the types.
+// * lists, sets, and tuples : a uvarint count and then the values.
+// * maps : a uvarint count and then the keys and values alternately.
+// * pairs : the key and the value.
+// * errors : the error ID, the message, and the source, line, and character positions of the
+// token, followed by the values attached to the error as a list.
+// * enums : the uvarint index of the element.
+// * structs : a uvarint count and then the fields.
+// * clones : the payload of the parent type.
+// * `NULL` and `OK` : nothing.
+//
+// A call is sent as the operator type of the function as a uvarint, the remaining namespace
+// and name of the function as strings, and then the arguments as a tuple, including the bling.
+//
+// Anything else, e.g. a lambda, can't be sent in the binary format, and so the call falls back
+// on the literal protocol. Values may be nested no more than `MAX_WIRE_DEPTH` deep.
+
+// The version of the binary format, which hubs use to agree that they can both speak it.
+const WIRE_VERSION = "pfb1"
+
+// How deep values may be nested in a message, so that a malicious one can't exhaust the stack
+// of the decoder.
+const MAX_WIRE_DEPTH = 512
+
+// Translates values to and from the binary format, naming types from the point of view of the
+// compiler with the given number.
+type WireCodec struct {
+	Vm       *Vm
+	CpNumber uint32
+	types    map[string]values.ValueType // Made the first time we decode something.
+	labels   map[string]int
+	once     sync.Once
+}
+
+// Encodes a value.
+func (wc *WireCodec) Encode(v values.Value) ([]byte, error) {
+	enc := wireEncoder{wc: wc, types: map[values.ValueType]uint64{}}
+	if e := enc.value(v); e != nil {
+		return nil, e
+	}
+	return enc.buf, nil
+}
+
+// Decodes a value.
+func (wc *WireCodec) Decode(data []byte) (values.Value, error) {
+	dec := wireDecoder{wc: wc.prepare(), data: data}
+	v, e := dec.value()
+	if e == nil && len(dec.data) > 0 {
+		e = errors.New("trailing data after value")
+	}
+	return v, e
+}
+
+// Encodes a call to an external service.
+func (wc *WireCodec) EncodeCall(xc *ExternalCall) ([]byte, error) {
+	enc := wireEncoder{wc: wc, types: map[values.ValueType]uint64{}}
+	enc.buf = binary.AppendUvarint(enc.buf, uint64(xc.Operator))
+	enc.string(xc.Namespace)
+	enc.string(xc.Name)
+	if e := enc.value(values.Value{values.TUPLE, xc.Args}); e != nil {
+		return nil, e
+	}
+	return enc.buf, nil
+}
+
+// Decodes a call to an external service.
+func (wc *WireCodec) DecodeCall(data []byte) (*ExternalCall, error) {
+	dec := wireDecoder{wc: wc.prepare(), data: data}
+	operator, e := dec.uvarint()
+	if e != nil {
+		return nil, e
+	}
+	if operator > uint64(UNFIX) {
+		return nil, errors.New("unknown operator type " + strconv.FormatUint(operator, 10))
+	}
+	xc := &ExternalCall{Operator: uint32(operator)}
+	if xc.Namespace, e = dec.string(); e != nil {
+		return nil, e
+	}
+	if xc.Name, e = dec.string(); e != nil {
+		return nil, e
+	}
+	args, e := dec.value()
+	if e != nil {
+		return nil, e
+	}
+	if args.T != values.TUPLE {
+		return nil, errors.New("arguments of call aren't a tuple")
+	}
+	if len(dec.data) > 0 {
+		return nil, errors.New("trailing data after call")
+	}
+	xc.Args = args.V.([]values.Value)
+	return xc, nil
+}
+
+// Makes the maps from names to types and labels, if they haven't been made already. Since a
+// codec is kept for as long as its service, it may be used by more than one call at once.
+func (wc *WireCodec) prepare() *WireCodec {
+	wc.once.Do(func() {
+		wc.types = map[string]values.ValueType{}
+		for t, namespace := range wc.Vm.NamespaceInfo[wc.CpNumber] {
+			if t >= values.FIRST_DEFINED_TYPE {
+				wc.types[namespace+wc.Vm.ConcreteTypeInfo[t].GetName(DEFAULT)] = t
+			}
+		}
+		wc.labels = map[string]int{}
+		for i, label := range wc.Vm.Labels {
+			wc.labels[label] = i
+		}
+	})
+	return wc
+}
+
+type wireEncoder struct {
+	wc    *WireCodec
+	buf   []byte
+	types map[values.ValueType]uint64 // The user-defined types which have occurred so far, by their number in the message.
+}
+
+func (enc *wireEncoder) string(s string) {
+	enc.buf = binary.AppendUvarint(enc.buf, uint64(len(s)))
+	enc.buf = append(enc.buf, s...)
+}
+
+func (enc *wireEncoder) typ(t values.ValueType) error {
+	if t < values.FIRST_DEFINED_TYPE {
+		enc.buf = binary.AppendUvarint(enc.buf, uint64(t))
+		return nil
+	}
+	if n, ok := enc.types[t]; ok {
+		enc.buf = binary.AppendUvarint(enc.buf, uint64(values.FIRST_DEFINED_TYPE)+n)
+		return nil
+	}
+	namespace, ok := enc.wc.Vm.NamespaceInfo[enc.wc.CpNumber][t]
+	if !ok || int(t) >= len(enc.wc.Vm.ConcreteTypeInfo) {
+		return errors.New("type " + strconv.Itoa(int(t)) + " has no name in the namespace")
+	}
+	n := uint64(len(enc.types))
+	enc.types[t] = n
+	enc.buf = binary.AppendUvarint(enc.buf, uint64(values.FIRST_DEFINED_TYPE)+n)
+	enc.string(namespace + enc.wc.Vm.ConcreteTypeInfo[t].GetName(DEFAULT))
+	return nil
+}
+
+func (enc *wireEncoder) value(v values.Value) error {
+	if e := enc.typ(v.T); e != nil {
+		return e
+	}
+	return enc.payload(v.T, v.V)
+}
+
+func (enc *wireEncoder) values(vals []values.Value) error {
+	enc.buf = binary.AppendUvarint(enc.buf, uint64(len(vals)))
+	for _, v := range vals {
+		if e := enc.value(v); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+func (enc *wireEncoder) payload(t values.ValueType, v any) error {
+	switch info := enc.wc.Vm.ConcreteTypeInfo[t].(type) {
+	case EnumType:
+		enc.buf = binary.AppendUvarint(enc.buf, uint64(v.(int)))
+		return nil
+	case StructType:
+		if info.Snippet {
+			return errors.New("can't send snippets")
+		}
+		return enc.values(v.([]values.Value))
+	case CloneType:
+		return enc.payload(info.Parent, v)
+	}
+	switch t {
+	case values.SUCCESSFUL_VALUE, values.NULL:
+	case values.BOOL:
+		if v.(bool) {
+			enc.buf = append(enc.buf, 1)
+		} else {
+			enc.buf = append(enc.buf, 0)
+		}
+	case values.INT:
+		enc.buf = binary.AppendVarint(enc.buf, int64(v.(int)))
+	case values.RUNE:
+		enc.buf = binary.AppendVarint(enc.buf, int64(v.(rune)))
+	case values.FLOAT:
+		enc.buf = binary.LittleEndian.AppendUint64(enc.buf, math.Float64bits(v.(float64)))
+	case values.STRING, values.BLING:
+		enc.string(v.(string))
+	case values.LABEL:
+		enc.string(enc.wc.Vm.Labels[v.(int)])
+	case values.TYPE:
+		types := v.(values.AbstractType).Types
+		enc.buf = binary.AppendUvarint(enc.buf, uint64(len(types)))
+		for _, t := range types {
+			if e := enc.typ(t); e != nil {
+				return e
+			}
+		}
+	case values.TUPLE:
+		return enc.values(v.([]values.Value))
+	case values.PAIR:
+		pair := v.([]values.Value)
+		if e := enc.value(pair[0]); e != nil {
+			return e
+		}
+		return enc.value(pair[1])
+	case values.LIST:
+		vec := v.(vector.Vector)
+		enc.buf = binary.AppendUvarint(enc.buf, uint64(vec.Len()))
+		for i := 0; i < vec.Len(); i++ {
+			el, _ := vec.Index(i)
+			if e := enc.value(el.(values.Value)); e != nil {
+				return e
+			}
+		}
+	case values.SET:
+		return enc.values(v.(values.Set).AsSlice())
+	case values.MAP:
+		pairs := v.(values.Map).AsSlice()
+		enc.buf = binary.AppendUvarint(enc.buf, uint64(len(pairs)))
+		for _, pair := range pairs {
+			if e := enc.value(pair.Key); e != nil {
+				return e
+			}
+			if e := enc.value(pair.Val); e != nil {
+				return e
+			}
+		}
+	case values.ERROR:
+		ob := v.(*err.Error)
+		message := ob.Message
+		if message == "" && ob.ErrorId != "" {
+			message = err.CreateErr(ob.ErrorId, ob.Token, ob.Args...).Message
+		}
+		tok := ob.Token
+		if tok == nil {
+			tok = &token.Token{}
+		}
+		enc.string(ob.ErrorId)
+		enc.string(message)
+		enc.string(tok.Source)
+		enc.buf = binary.AppendVarint(enc.buf, int64(tok.Line))
+		enc.buf = binary.AppendVarint(enc.buf, int64(tok.ChStart))
+		enc.buf = binary.AppendVarint(enc.buf, int64(tok.ChEnd))
+		return enc.values(ob.Values)
+	default:
+		return errors.New("can't send values of type " + enc.wc.Vm.DescribeType(t, LITERAL, enc.wc.CpNumber))
+	}
+	return nil
+}
+
+type wireDecoder struct {
+	wc    *WireCodec
+	data  []byte
+	types []values.ValueType // The user-defined types which have occurred so far, in order.
+	depth int                // How deep in nested values we are.
+}
+
+var errWireTruncated = errors.New("message is truncated")
+
+func (dec *wireDecoder) uvarint() (uint64, error) {
+	n, size := binary.Uvarint(dec.data)
+	if size <= 0 {
+		return 0, errWireTruncated
+	}
+	dec.data = dec.data[size:]
+	return n, nil
+}
+
+func (dec *wireDecoder) varint() (int64, error) {
+	n, size := binary.Varint(dec.data)
+	if size <= 0 {
+		return 0, errWireTruncated
+	}
+	dec.data = dec.data[size:]
+	return n, nil
+}
+
+// Reads the length of something with that many elements, none of which can take up less than a
+// byte, so that a corrupt length can't make us allocate more than we've been sent.
+func (dec *wireDecoder) count() (int, error) {
+	n, e := dec.uvarint()
+	if e != nil {
+		return 0, e
+	}
+	if n > uint64(len(dec.data)) {
+		return 0, errWireTruncated
+	}
+	return int(n), nil
+}
+
+func (dec *wireDecoder) string() (string, error) {
+	n, e := dec.uvarint()
+	if e != nil {
+		return "", e
+	}
+	if n > uint64(len(dec.data)) {
+		return "", errWireTruncated
+	}
+	s := string(dec.data[:n])
+	dec.data = dec.data[n:]
+	return s, nil
+}
+
+func (dec *wireDecoder) typ() (values.ValueType, error) {
+	n, e := dec.uvarint()
+	if e != nil {
+		return values.UNDEFINED_TYPE, e
+	}
+	if n < uint64(values.FIRST_DEFINED_TYPE) {
+		return values.ValueType(n), nil
+	}
+	n = n - uint64(values.FIRST_DEFINED_TYPE)
+	if n < uint64(len(dec.types)) {
+		return dec.types[n], nil
+	}
+	if n > uint64(len(dec.types)) {
+		return values.UNDEFINED_TYPE, errors.New("type is used before it's named")
+	}
+	name, e := dec.string()
+	if e != nil {
+		return values.UNDEFINED_TYPE, e
+	}
+	t, ok := dec.wc.types[name]
+	if !ok {
+		return values.UNDEFINED_TYPE, errors.New("there is no type `" + name + "`")
+	}
+	dec.types = append(dec.types, t)
+	return t, nil
+}
+
+func (dec *wireDecoder) value() (values.Value, error) {
+	if dec.depth >= MAX_WIRE_DEPTH {
+		return values.Value{}, errors.New("values are nested more than " + strconv.Itoa(MAX_WIRE_DEPTH) + " deep")
+	}
+	dec.depth++
+	defer func() { dec.depth-- }()
+	t, e := dec.typ()
+	if e != nil {
+		return values.Value{}, e
+	}
+	return dec.payload(t)
+}
+
+func (dec *wireDecoder) values() ([]values.Value, error) {
+	n, e := dec.count()
+	if e != nil {
+		return nil, e
+	}
+	vals := make([]values.Value, n)
+	for i := range vals {
+		if vals[i], e = dec.value(); e != nil {
+			return nil, e
+		}
+	}
+	return vals, nil
+}
+
+func (dec *wireDecoder) payload(t values.ValueType) (values.Value, error) {
+	switch info := dec.wc.Vm.ConcreteTypeInfo[t].(type) {
+	case EnumType:
+		i, e := dec.uvarint()
+		if e != nil {
+			return values.Value{}, e
+		}
+		if i >= uint64(len(info.ElementNames)) {
+			return values.Value{}, errors.New("enum `" + info.Name + "` has no element " + strconv.FormatUint(i, 10))
+		}
+		return values.Value{t, int(i)}, nil
+	case StructType:
+		if info.Snippet {
+			return values.Value{}, errors.New("can't receive snippets")
+		}
+		fields, e := dec.values()
+		if e != nil {
+			return values.Value{}, e
+		}
+		if len(fields) != len(info.LabelNumbers) {
+			return values.Value{}, errors.New("struct `" + info.Name + "` has the wrong number of fields")
+		}
+		for i, field := range fields {
+			if !info.AbstractStructFields[i].Contains(field.T) {
+				return values.Value{}, errors.New("field `" + dec.wc.Vm.Labels[info.LabelNumbers[i]] + "` of struct `" +
+					info.Name + "` can't be of type `" + dec.wc.Vm.DescribeType(field.T, LITERAL, dec.wc.CpNumber) + "`")
+			}
+		}
+		return values.Value{t, fields}, nil
+	case CloneType:
+		v, e := dec.payload(info.Parent)
+		v.T = t
+		return v, e
+	}
+	switch t {
+	case values.SUCCESSFUL_VALUE, values.NULL:
+		return values.Value{t, nil}, nil
+	case values.BOOL:
+		if len(dec.data) == 0 {
+			return values.Value{}, errWireTruncated
+		}
+		b := dec.data[0]
+		dec.data = dec.data[1:]
+		return values.Value{t, b == 1}, nil
+	case values.INT:
+		i, e := dec.varint()
+		return values.Value{t, int(i)}, e
+	case values.RUNE:
+		i, e := dec.varint()
+		return values.Value{t, rune(i)}, e
+	case values.FLOAT:
+		if len(dec.data) < 8 {
+			return values.Value{}, errWireTruncated
+		}
+		f := math.Float64frombits(binary.LittleEndian.Uint64(dec.data))
+		dec.data = dec.data[8:]
+		return values.Value{t, f}, nil
+	case values.STRING, values.BLING:
+		s, e := dec.string()
+		return values.Value{t, s}, e
+	case values.LABEL:
+		s, e := dec.string()
+		if e != nil {
+			return values.Value{}, e
+		}
+		label, ok := dec.wc.labels[s]
+		if !ok {
+			return values.Value{}, errors.New("there is no label `" + s + "`")
+		}
+		return values.Value{t, label}, nil
+	case values.TYPE:
+		n, e := dec.count()
+		if e != nil {
+			return values.Value{}, e
+		}
+		types := make([]values.ValueType, n)
+		for i := range types {
+			if types[i], e = dec.typ(); e != nil {
+				return values.Value{}, e
+			}
+		}
+		return values.Value{t, values.AbT(types...)}, nil // Which sorts them as the types are numbered here.
+	case values.TUPLE:
+		vals, e := dec.values()
+		return values.Value{t, vals}, e
+	case values.PAIR:
+		key, e := dec.value()
+		if e != nil {
+			return values.Value{}, e
+		}
+		val, e := dec.value()
+		return values.Value{t, []values.Value{key, val}}, e
+	case values.LIST:
+		vals, e := dec.values()
+		vec := vector.Empty
+		for _, v := range vals {
+			vec = vec.Conj(v)
+		}
+		return values.Value{t, vec}, e
+	case values.SET:
+		vals, e := dec.values()
+		if e != nil {
+			return values.Value{}, e
+		}
+		set := values.Set{}
+		for _, v := range vals {
+			if !dec.hashable(v) {
+				return values.Value{}, errors.New("a value of type `" + dec.wc.Vm.DescribeType(v.T, LITERAL, dec.wc.CpNumber) + "` can't be an element of a set")
+			}
+			set = set.Add(v)
+		}
+		return values.Value{t, set}, nil
+	case values.MAP:
+		n, e := dec.count()
+		if e != nil {
+			return values.Value{}, e
+		}
+		m := values.Map{}
+		for range n {
+			key, e := dec.value()
+			if e != nil {
+				return values.Value{}, e
+			}
+			val, e := dec.value()
+			if e != nil {
+				return values.Value{}, e
+			}
+			if !dec.hashable(key) {
+				return values.Value{}, errors.New("a value of type `" + dec.wc.Vm.DescribeType(key.T, LITERAL, dec.wc.CpNumber) + "` can't be a key of a map")
+			}
+			m = m.Set(key, val)
+		}
+		return values.Value{t, m}, nil
+	case values.ERROR:
+		return dec.error()
+	}
+	return values.Value{}, errors.New("can't receive values of type " + strconv.Itoa(int(t)))
+}
+
+// Says whether a value can be put in a set or used as the key of a map, i.e. whether
+// `values.Value.Compare` can compare it with others. We check this since the values we decode
+// weren't made by our own vm, which wouldn't have made such a set or map in the first place.
+func (dec *wireDecoder) hashable(v values.Value) bool {
+	switch info := dec.wc.Vm.ConcreteTypeInfo[v.T].(type) {
+	case EnumType:
+		return true
+	case StructType:
+		for _, field := range v.V.([]values.Value) {
+			if !dec.hashable(field) {
+				return false
+			}
+		}
+		return true
+	case CloneType:
+		return dec.hashable(values.Value{info.Parent, v.V})
+	}
+	switch v.T {
+	case values.NULL, values.INT, values.BOOL, values.STRING, values.RUNE, values.FLOAT, values.TYPE, values.LABEL:
+		return true
+	case values.PAIR:
+		pair := v.V.([]values.Value)
+		return dec.hashable(pair[0]) && dec.hashable(pair[1])
+	}
+	return false
+}
+
+// The error is received as an error raised by the user, since the arguments from which the
+// message of any other error would be made can't be sent.
+func (dec *wireDecoder) error() (values.Value, error) {
+	strs := make([]string, 3)
+	var e error
+	for i := range strs {
+		if strs[i], e = dec.string(); e != nil {
+			return values.Value{}, e
+		}
+	}
+	pos := make([]int, 3)
+	for i := range pos {
+		n, e := dec.varint()
+		if e != nil {
+			return values.Value{}, e
+		}
+		pos[i] = int(n)
+	}
+	vals, e := dec.values()
+	if e != nil {
+		return values.Value{}, e
+	}
+	tok := &token.Token{Source: strs[2], Line: pos[0], ChStart: pos[1], ChEnd: pos[2]}
+	return values.Value{values.ERROR, &err.Error{ErrorId: "vm/user", Message: strs[1], Token: tok, Values: vals}}, nil
+}